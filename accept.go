@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// backoff between retries on accept errors, doubled on each consecutive
+	// failure, as in net/http
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+	// pause when out of file descriptors, to let connections close instead
+	// of spinning on the pending connection which can't be accepted
+	acceptFdPause = time.Second
+)
+
+// acceptLimit is the token bucket of -accept-rate shared by all listeners,
+// next is when the bucket runs empty at the current pace
+var acceptLimit struct {
+	sync.Mutex
+	interval time.Duration // between tokens, 0 for unlimited
+	burst    int
+	next     time.Time
+}
+
+// parseAcceptRate parses N/s, N/m or N per another duration unit
+func parseAcceptRate(spec string) (time.Duration, error) {
+	i := strings.IndexByte(spec, '/')
+	if i < 0 {
+		return 0, fmt.Errorf("`%s` is not a rate N/s", spec)
+	}
+	n, err := strconv.ParseUint(spec[:i], 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid number of connections in `%s`", spec)
+	}
+	per, err := time.ParseDuration("1" + spec[i+1:])
+	if err != nil {
+		return 0, fmt.Errorf("invalid unit in `%s`", spec)
+	}
+	return per / time.Duration(n), nil
+}
+
+// acceptDelay takes a token, returning how long to wait for it when the
+// bucket is empty; waiting leaves new connections in the listen backlog
+func acceptDelay() time.Duration {
+	acceptLimit.Lock()
+	defer acceptLimit.Unlock()
+	now := time.Now()
+	if full := now.Add(-time.Duration(acceptLimit.burst) * acceptLimit.interval); acceptLimit.next.Before(full) {
+		acceptLimit.next = full
+	}
+	acceptLimit.next = acceptLimit.next.Add(acceptLimit.interval)
+	return acceptLimit.next.Sub(now)
+}
+
+// handOff passes an accepted connection to the manager; when -accept-queue
+// is full it's closed right away with -queue-overflow reject, otherwise with
+// -watchdog the listener waits no longer than the watchdog takes to restart
+// a stuck manager, then closes it, so the accept loop never wedges
+func handOff(manager chan net.Conn, conn net.Conn) {
+	select {
+	case manager <- conn:
+		return
+	default:
+	}
+	if queueOverflow == "reject" {
+		if debug.Load() {
+			log.Printf("Connection queue is full, closing connection from `%s`\n", conn.RemoteAddr())
+		}
+		accounting.Lock()
+		accounting.Overflow++
+		accounting.Unlock()
+		conn.Close()
+		return
+	}
+	if watchdogTimeout <= 0 {
+		manager <- conn
+		return
+	}
+	timer := time.NewTimer(2 * watchdogTimeout)
+	defer timer.Stop()
+	select {
+	case manager <- conn:
+	case <-timer.C:
+		log.Printf("Watchdog: connection manager didn't take connection from `%s` in %v, closing\n", conn.RemoteAddr(), 2*watchdogTimeout)
+		accounting.Lock()
+		accounting.Stalled++
+		accounting.Unlock()
+		conn.Close()
+	}
+}
+
+// acceptLoop accepts connections from a listener until it is closed, backing
+// off on errors
+func acceptLoop(listener net.Listener, manager chan net.Conn) {
+	var backoff time.Duration
+	for {
+		if acceptLimit.interval > 0 {
+			if delay := acceptDelay(); delay > 0 {
+				accounting.Lock()
+				accounting.AcceptDelayed++
+				accounting.Unlock()
+				time.Sleep(delay)
+			}
+		}
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err == nil {
+			backoff = 0
+			handOff(manager, countFd(conn))
+			continue
+		}
+		accounting.Lock()
+		accounting.AcceptFailures++
+		accounting.Unlock()
+
+		if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+			log.Printf("Out of file descriptors, pausing accept on `%s` for %v: %v\n", listener.Addr(), acceptFdPause, err)
+			time.Sleep(acceptFdPause)
+			continue
+		}
+		if backoff == 0 {
+			backoff = acceptBackoffMin
+		} else if backoff *= 2; backoff > acceptBackoffMax {
+			backoff = acceptBackoffMax
+		}
+		log.Printf("Failed to accept connection, retrying in %v: %v\n", backoff, err)
+		time.Sleep(backoff)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessRule admits clients during a daily time window, optionally only from
+// the listed networks; with ports it only applies to listeners on them
+type accessRule struct {
+	timeWindow
+	ports map[int]bool
+	cidrs []*net.IPNet
+}
+
+var accessRules []*accessRule
+
+// parseAccessRule parses `[:port[,port]] [days] HH:MM-HH:MM [cidr[,cidr]]`
+// with days as in -schedule
+func parseAccessRule(spec string) (*accessRule, error) {
+	fields := strings.Fields(spec)
+	r := &accessRule{}
+	if len(fields) > 0 && strings.HasPrefix(fields[0], ":") {
+		r.ports = make(map[int]bool)
+		for _, p := range parseTargetList(fields[0]) {
+			port, err := strconv.Atoi(strings.TrimPrefix(p, ":"))
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("invalid listener port `%s`", p)
+			}
+			r.ports[port] = true
+		}
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.Contains(fields[0], ":") {
+		fields = append([]string{"*"}, fields...)
+	}
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("expected `[:port[,port]] [days] HH:MM-HH:MM [cidr[,cidr]]`, got `%s`", spec)
+	}
+	if err := r.parse(fields[0], fields[1]); err != nil {
+		return nil, err
+	}
+	if len(fields) == 3 {
+		for _, c := range parseTargetList(fields[2]) {
+			_, cidr, err := net.ParseCIDR(c)
+			if err != nil {
+				return nil, err
+			}
+			r.cidrs = append(r.cidrs, cidr)
+		}
+	}
+	return r, nil
+}
+
+// accessAllowed reports whether any access rule for the listener at local
+// admits the client now; all clients are admitted when no rule applies to
+// the listener, rules with ports never apply to one without a port
+func accessAllowed(client, local net.Addr) bool {
+	if len(accessRules) == 0 {
+		return true
+	}
+	now := time.Now()
+	ip, _ := addrIpPort(client)
+	_, port := addrIpPort(local)
+	scoped := false
+	for _, r := range accessRules {
+		if r.ports != nil && !r.ports[port] {
+			continue
+		}
+		scoped = true
+		if !r.matches(now) {
+			continue
+		}
+		if len(r.cidrs) == 0 {
+			return true
+		}
+		for _, cidr := range r.cidrs {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return !scoped
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type usageCounters struct {
+	Conns    uint64 `json:"conns"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+type usageReport struct {
+	Since            time.Time                 `json:"since"`
+	Total            usageCounters             `json:"total"`
+	Targets          map[string]*usageCounters `json:"targets"`
+	Clients          map[string]*usageCounters `json:"clients"`
+	Rules            map[string]*usageCounters `json:"rules"`
+	AcceptFailures   uint64                    `json:"accept_failures"`
+	Shed             uint64                    `json:"shed"`
+	AcceptDelayed    uint64                    `json:"accept_delayed"`
+	RateLimited      uint64                    `json:"rate_limited"`
+	Overflow         uint64                    `json:"overflow"`
+	Buffered         uint64                    `json:"buffered"`
+	BufferedPeak     uint64                    `json:"buffered_peak"`
+	BufferPauses     uint64                    `json:"buffer_pauses"`
+	Slow             uint64                    `json:"slow"`
+	WatchdogRestarts uint64                    `json:"watchdog_restarts"`
+	Stalled          uint64                    `json:"stalled"`
+	TargetsHeld      uint64                    `json:"targets_held"`
+	ZoneSpills       uint64                    `json:"zone_spills"`
+	// closed connections and sessions by duration in seconds and by bytes
+	// in both directions, connects to targets by latency in seconds
+	Duration *histogram            `json:"duration"`
+	Size     *histogram            `json:"size"`
+	Dial     map[string]*histogram `json:"dial"`
+	// -rule-limit limits and saturation, not restored from -stats-file
+	RuleLimits map[string]ruleLimitStats `json:"rule_limits,omitempty"`
+	// -shadow connections and comparisons, not restored from -stats-file
+	Shadow *shadowStats `json:"shadow,omitempty"`
+}
+
+const (
+	// clients without connections for longer are dropped from the counters
+	clientStatsTtl = 24 * time.Hour
+	// clients counted separately at most, connections of further clients
+	// are counted as otherClients
+	maxStatsClients = 10000
+	otherClients    = "other"
+)
+
+// accounting keeps cumulative per-target and per-client counters; bytes of
+// connections are added when they close, live connections are added to the
+// report from the connection table
+var accounting = struct {
+	sync.Mutex
+	usageReport
+	seen map[string]time.Time // last connection of clients by IP
+}{seen: make(map[string]time.Time), usageReport: usageReport{Since: time.Now(), Targets: make(map[string]*usageCounters), Clients: make(map[string]*usageCounters), Rules: make(map[string]*usageCounters),
+	Duration: newHistogram(durationBounds), Size: newHistogram(sizeBounds), Dial: make(map[string]*histogram)}}
+
+func clientIp(client string) string {
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		return host
+	}
+	return client
+}
+
+func (u *usageCounters) add(conns, in, out uint64) {
+	u.Conns += conns
+	u.BytesIn += in
+	u.BytesOut += out
+}
+
+// account adds connection counts and bytes to the total, rule, target and
+// client counters; accounting must be locked
+func account(report *usageReport, rule, target, client string, conns, in, out uint64) {
+	report.Total.add(conns, in, out)
+	if rule != "" {
+		if report.Rules[rule] == nil {
+			report.Rules[rule] = &usageCounters{}
+		}
+		report.Rules[rule].add(conns, in, out)
+	}
+	if target != "" {
+		if report.Targets[target] == nil {
+			report.Targets[target] = &usageCounters{}
+		}
+		report.Targets[target].add(conns, in, out)
+	}
+	if client != "" {
+		ip := clientIp(client)
+		if report.Clients[ip] == nil && len(report.Clients) >= maxStatsClients {
+			ip = otherClients
+		}
+		if report.Clients[ip] == nil {
+			report.Clients[ip] = &usageCounters{}
+		}
+		report.Clients[ip].add(conns, in, out)
+	}
+}
+
+func accountOpen(c *trackedConn) {
+	accounting.Lock()
+	account(&accounting.usageReport, c.rule, c.target, c.client, 1, 0, 0)
+	seenClient(c.client)
+	accounting.Unlock()
+	topOpen(c)
+}
+
+func accountClose(c *trackedConn) {
+	in, out := atomic.LoadUint64(&c.bytesIn), atomic.LoadUint64(&c.bytesOut)
+	accounting.Lock()
+	account(&accounting.usageReport, c.rule, c.target, c.client, 0, in, out)
+	accounting.Duration.observe(time.Since(c.started).Seconds())
+	accounting.Size.observe(float64(in + out))
+	seenClient(c.client)
+	accounting.Unlock()
+	topClose(c)
+}
+
+// seenClient records a connection of a client counted separately;
+// accounting must be locked
+func seenClient(client string) {
+	if ip := clientIp(client); accounting.Clients[ip] != nil {
+		accounting.seen[ip] = time.Now()
+	}
+}
+
+// expireClientStats drops the counters of clients without connections for
+// clientStatsTtl, so they don't grow without bound
+func expireClientStats(ctx context.Context) {
+	ticker := systemClock.NewTicker(clientStatsTtl / 24)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.Chan():
+		}
+		live := make(map[string]bool)
+		for _, c := range listConns() {
+			live[clientIp(c.Client)] = true
+		}
+		accounting.Lock()
+		for ip, at := range accounting.seen {
+			if now.Sub(at) > clientStatsTtl && !live[ip] {
+				delete(accounting.seen, ip)
+				delete(accounting.Clients, ip)
+			}
+		}
+		accounting.Unlock()
+	}
+}
+
+// usageStats returns a copy of the counters including bytes transferred by
+// live connections so far
+func usageStats() usageReport {
+	live := listConns()
+	accounting.Lock()
+	defer accounting.Unlock()
+	report := usageReport{
+		Since:            accounting.Since,
+		Total:            accounting.Total,
+		Targets:          make(map[string]*usageCounters, len(accounting.Targets)),
+		Clients:          make(map[string]*usageCounters, len(accounting.Clients)),
+		Rules:            make(map[string]*usageCounters, len(accounting.Rules)),
+		AcceptFailures:   accounting.AcceptFailures,
+		Shed:             accounting.Shed,
+		AcceptDelayed:    accounting.AcceptDelayed,
+		RateLimited:      accounting.RateLimited,
+		Overflow:         accounting.Overflow,
+		Slow:             accounting.Slow,
+		WatchdogRestarts: accounting.WatchdogRestarts,
+		Stalled:          accounting.Stalled,
+		TargetsHeld:      accounting.TargetsHeld,
+		ZoneSpills:       accounting.ZoneSpills,
+		Duration:         accounting.Duration.copy(),
+		Size:             accounting.Size.copy(),
+		Dial:             make(map[string]*histogram, len(accounting.Dial)),
+	}
+	for target, h := range accounting.Dial {
+		report.Dial[target] = h.copy()
+	}
+	report.Buffered, report.BufferedPeak, report.BufferPauses = bufferStats()
+	report.RuleLimits = ruleLimitReport()
+	report.Shadow = shadowReport()
+	for target, u := range accounting.Targets {
+		c := *u
+		report.Targets[target] = &c
+	}
+	for client, u := range accounting.Clients {
+		c := *u
+		report.Clients[client] = &c
+	}
+	for rule, u := range accounting.Rules {
+		c := *u
+		report.Rules[rule] = &c
+	}
+	for _, c := range live {
+		account(&report, c.Rule, c.Target, c.Client, 0, c.BytesIn, c.BytesOut)
+	}
+	return report
+}
+
+// savedStats is the format of the -stats-file
+type savedStats struct {
+	usageReport
+	Quota []quotaBucket `json:"quota_buckets,omitempty"`
+}
+
+func loadStats(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved savedStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	report := saved.usageReport
+	if report.Targets == nil {
+		report.Targets = make(map[string]*usageCounters)
+	}
+	if report.Clients == nil {
+		report.Clients = make(map[string]*usageCounters)
+	}
+	if report.Rules == nil {
+		report.Rules = make(map[string]*usageCounters)
+	}
+	if !report.Duration.valid(durationBounds) {
+		report.Duration = newHistogram(durationBounds)
+	}
+	if !report.Size.valid(sizeBounds) {
+		report.Size = newHistogram(sizeBounds)
+	}
+	for target, h := range report.Dial {
+		if !h.valid(dialBounds) {
+			delete(report.Dial, target)
+		}
+	}
+	if report.Dial == nil {
+		report.Dial = make(map[string]*histogram)
+	}
+	accounting.Lock()
+	accounting.usageReport = report
+	// restored clients expire as if they connected now
+	for ip := range report.Clients {
+		if ip != otherClients {
+			accounting.seen[ip] = time.Now()
+		}
+	}
+	accounting.Unlock()
+	setQuotaBuckets(saved.Quota)
+	return nil
+}
+
+func saveStats(path string) error {
+	saved := savedStats{usageReport: usageStats()}
+	quotas.RLock()
+	saved.Quota = quotas.buckets
+	data, err := json.Marshal(saved)
+	quotas.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// checkpointStats periodically saves the counters so they survive restarts
+func checkpointStats(ctx context.Context, path string, interval time.Duration) {
+	ticker := systemClock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+		if err := saveStats(path); err != nil {
+			log.Printf("Failed to save stats to `%s`: %v\n", path, err)
+		} else if debug.Load() {
+			log.Printf("Saved stats to `%s`\n", path)
+		}
+	}
+}
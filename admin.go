@@ -0,0 +1,586 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultAdmin = "127.0.0.1:7070"
+
+// serveAdmin binds the admin API listener and serves it in background
+func serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/conns", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, listConns())
+	})
+	mux.HandleFunc("/conns/kill", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		var id uint64
+		if v := r.FormValue("id"); v != "" {
+			var err error
+			if id, err = strconv.ParseUint(v, 10, 64); err != nil || id == 0 {
+				http.Error(w, "invalid id", http.StatusBadRequest)
+				return
+			}
+		}
+		target := r.FormValue("target")
+		if id == 0 && target == "" {
+			http.Error(w, "id or target required", http.StatusBadRequest)
+			return
+		}
+		killed := killConns(id, target)
+		if verbose.Load() {
+			log.Printf("Admin API closed %d connection(s), id: %d, target: `%s`\n", killed, id, target)
+		}
+		writeJson(w, map[string]int{"killed": killed})
+	})
+
+	mux.HandleFunc("/events", serveEvents)
+	mux.HandleFunc("/metrics", serveMetrics)
+	mux.HandleFunc("/health", serveHealth)
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, usageStats())
+	})
+	mux.HandleFunc("/top", func(w http.ResponseWriter, r *http.Request) {
+		n := 10
+		if v := r.FormValue("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 1 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		by := r.FormValue("by")
+		if by != "" && by != "bytes" && by != "conns" {
+			http.Error(w, "invalid by, expected bytes or conns", http.StatusBadRequest)
+			return
+		}
+		writeJson(w, topList(n, by == "conns"))
+	})
+	mux.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, listTargets())
+	})
+	mux.HandleFunc("/targets/drain", targetHandler(func(target string, r *http.Request) error {
+		setDraining(target, true)
+		return nil
+	}))
+	mux.HandleFunc("/targets/enable", targetHandler(func(target string, r *http.Request) error {
+		setDraining(target, false)
+		return nil
+	}))
+	mux.HandleFunc("/targets/weight", targetHandler(func(target string, r *http.Request) error {
+		w, err := strconv.ParseUint(r.FormValue("weight"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid weight")
+		}
+		setWeight(target, uint(w))
+		return nil
+	}))
+
+	mux.HandleFunc("/targets/blacklist", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, listBlacklist())
+	})
+	mux.HandleFunc("/targets/blacklist/add", blacklistHandler(true))
+	mux.HandleFunc("/targets/blacklist/remove", blacklistHandler(false))
+
+	mux.HandleFunc("/log/level", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if err := setLogLevel(r.FormValue("level")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJson(w, map[string]string{"level": logLevel()})
+	})
+
+	mux.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, listMaintenance())
+	})
+	mux.HandleFunc("/maintenance/on", maintenanceHandler(true))
+	mux.HandleFunc("/maintenance/off", maintenanceHandler(false))
+
+	mux.HandleFunc("/split", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			percent, err := strconv.ParseUint(r.FormValue("percent"), 10, 32)
+			if err != nil || percent > 100 {
+				http.Error(w, "invalid percent", http.StatusBadRequest)
+				return
+			}
+			setSplit(uint(percent))
+		}
+		writeJson(w, getSplit())
+	})
+
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, listBans())
+	})
+	mux.HandleFunc("/bans/lift", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		client := r.FormValue("client")
+		if !liftBan(client) {
+			http.Error(w, "client is not banned", http.StatusNotFound)
+			return
+		}
+		log.Printf("Admin API lifted ban on client `%s`\n", client)
+		writeJson(w, listBans())
+	})
+
+	listener, err := listenAdmin(addr)
+	if err != nil {
+		fatalf(errBind, "Failed to setup admin API listener on `%s`: %v\n", addr, err)
+	}
+	scheme := "http"
+	if _, unix := adminSocketPath(addr); adminTlsCert != "" || vaultPki != "" && !unix {
+		config, err := adminTlsConfig()
+		if err != nil {
+			fatalf(errConfig, "Failed to load admin API certificates: %v\n", err)
+		}
+		listener = tls.NewListener(listener, config)
+		scheme = "https"
+	}
+	if verbose.Load() {
+		if _, unix := adminSocketPath(addr); unix {
+			log.Printf("Admin API listening on `%s`\n", addr)
+		} else {
+			log.Printf("Admin API listening on `%s://%s`\n", scheme, listener.Addr())
+		}
+	}
+	go func() {
+		if err := http.Serve(listener, auditAdmin(authAdmin(mux))); err != nil {
+			fatalf(errBind, "Admin API failed: %v\n", err)
+		}
+	}()
+}
+
+// targetHandler wraps an admin action on the target given by `target` form
+// value, responding with the updated target list
+func targetHandler(action func(target string, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		target := r.FormValue("target")
+		if target == "" {
+			http.Error(w, "target required", http.StatusBadRequest)
+			return
+		}
+		if err := action(target, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if verbose.Load() {
+			log.Printf("Admin API %s `%s`\n", r.URL.Path, target)
+		}
+		writeJson(w, listTargets())
+	}
+}
+
+// blacklistHandler adds or removes the IP address or CIDR given by `address`
+// form value, responding with the updated blacklist
+func blacklistHandler(add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		address := r.FormValue("address")
+		if address == "" {
+			http.Error(w, "address required", http.StatusBadRequest)
+			return
+		}
+		if err := blacklistTarget(address, add); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Admin API %s `%s`\n", r.URL.Path, address)
+		writeJson(w, listBlacklist())
+	}
+}
+
+// maintenanceHandler switches the listener given by `listener` form value,
+// all listeners when omitted, into or out of maintenance mode, responding
+// with the listeners in maintenance
+func maintenanceHandler(on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		listener := r.FormValue("listener")
+		if err := setMaintenance(listener, on); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if listener == "" {
+			listener = "*"
+		}
+		log.Printf("Admin API %s `%s`\n", r.URL.Path, listener)
+		writeJson(w, listMaintenance())
+	}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil && debug.Load() {
+		log.Printf("Failed to write admin API response: %v\n", err)
+	}
+}
+
+// adminEndpoint locates the admin API for subcommands and holds the
+// credentials to authenticate with
+type adminEndpoint struct {
+	addr      string
+	tokenFile string
+	ca        string
+	cert      string
+	key       string
+}
+
+// adminFlags adds flags of the admin API address and credentials
+func adminFlags(cmd *flag.FlagSet) *adminEndpoint {
+	a := &adminEndpoint{}
+	cmd.StringVar(&a.addr, "admin", defaultAdmin, "Admin API address host:port, https://host:port or unix:/path")
+	cmd.StringVar(&a.tokenFile, "token-file", "", "Send the bearer token in file")
+	cmd.StringVar(&a.ca, "tls-ca", "", "Verify the https:// admin API certificate with CA certificates in PEM file, instead of system roots")
+	cmd.StringVar(&a.cert, "tls-cert", "", "Client certificate PEM file for the https:// admin API")
+	cmd.StringVar(&a.key, "tls-key", "", "Client certificate key PEM file")
+	return a
+}
+
+// adminRequest performs a request against the admin API and decodes the JSON
+// response into v
+func adminRequest(admin *adminEndpoint, method, path string, form url.Values, v interface{}) error {
+	client, base, err := adminClient(admin)
+	if err != nil {
+		return err
+	}
+	var req *http.Request
+	if method == http.MethodPost {
+		req, err = http.NewRequest(method, base+path, strings.NewReader(form.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(method, base+path, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if admin.tokenFile != "" {
+		token, err := readToken(admin.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// an unhealthy proxy still reports its health
+	if resp.StatusCode != http.StatusOK && (path != "/health" || resp.StatusCode != http.StatusServiceUnavailable) {
+		return fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// runConns implements `goproxy conns` which prints the connection table or
+// closes connections through the admin API
+func runConns(args []string) {
+	cmd := flag.NewFlagSet("goproxy conns", flag.ExitOnError)
+	admin := adminFlags(cmd)
+	kill := cmd.Uint64("kill", 0, "Close connection with ID")
+	killTarget := cmd.String("kill-target", "", "Close all connections to target host:port")
+	cmd.Parse(args)
+
+	if *kill != 0 || *killTarget != "" {
+		form := url.Values{}
+		if *kill != 0 {
+			form.Set("id", strconv.FormatUint(*kill, 10))
+		}
+		if *killTarget != "" {
+			form.Set("target", *killTarget)
+		}
+		var resp map[string]int
+		if err := adminRequest(admin, http.MethodPost, "/conns/kill", form, &resp); err != nil {
+			log.Fatalf("Failed to close connections: %v\n", err)
+		}
+		fmt.Printf("Closed %d connection(s)\n", resp["killed"])
+		return
+	}
+
+	var conns []connInfo
+	if err := adminRequest(admin, http.MethodGet, "/conns", nil, &conns); err != nil {
+		log.Fatalf("Failed to list connections: %v\n", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPROTO\tRULE\tCLIENT\tTARGET\tAGE\tIDLE\tIN\tOUT")
+	for _, c := range conns {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%v\t%v\t%d\t%d\n", c.Id, c.Proto, c.Rule, c.Client, c.Target,
+			seconds(c.Age), seconds(c.Idle), c.BytesIn, c.BytesOut)
+	}
+	w.Flush()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second)).Round(time.Second)
+}
+
+// runStats implements `goproxy stats` which prints cumulative usage counters
+// through the admin API
+func runStats(args []string) {
+	cmd := flag.NewFlagSet("goproxy stats", flag.ExitOnError)
+	admin := adminFlags(cmd)
+	clients := cmd.Bool("clients", false, "Report per-client counters instead of per-target")
+	rules := cmd.Bool("rules", false, "Report per-rule counters instead of per-target")
+	cmd.Parse(args)
+
+	var report usageReport
+	if err := adminRequest(admin, http.MethodGet, "/stats", nil, &report); err != nil {
+		log.Fatalf("Failed to get stats: %v\n", err)
+	}
+	rows, title := report.Targets, "TARGET"
+	if *clients {
+		rows, title = report.Clients, "CLIENT"
+	} else if *rules {
+		rows, title = report.Rules, "RULE"
+	}
+	// only targets have connect latency
+	perTarget := !*clients && !*rules
+	keys := make([]string, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Printf("Since %s\n", report.Since.Format(time.RFC3339))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if !perTarget {
+		fmt.Fprintf(w, "%s\tCONNS\tIN\tOUT\n", title)
+	} else {
+		fmt.Fprintf(w, "%s\tCONNS\tIN\tOUT\tDIAL P50\tDIAL P99\n", title)
+	}
+	for _, key := range keys {
+		u := rows[key]
+		if !perTarget {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", key, u.Conns, u.BytesIn, u.BytesOut)
+		} else if h := report.Dial[key]; h != nil && h.Count > 0 {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%v\t%v\n", key, u.Conns, u.BytesIn, u.BytesOut, bucketDuration(h.quantile(0.5)), bucketDuration(h.quantile(0.99)))
+		} else {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t-\t-\n", key, u.Conns, u.BytesIn, u.BytesOut)
+		}
+	}
+	fmt.Fprintf(w, "TOTAL\t%d\t%d\t%d\n", report.Total.Conns, report.Total.BytesIn, report.Total.BytesOut)
+	w.Flush()
+	if h := report.Duration; h != nil && h.Count > 0 {
+		fmt.Printf("Duration p50 %v, p90 %v, p99 %v\n", bucketDuration(h.quantile(0.5)), bucketDuration(h.quantile(0.9)), bucketDuration(h.quantile(0.99)))
+	}
+	if h := report.Size; h != nil && h.Count > 0 {
+		fmt.Printf("Bytes per connection p50 %.0f, p90 %.0f, p99 %.0f\n", h.quantile(0.5), h.quantile(0.9), h.quantile(0.99))
+	}
+	if report.AcceptFailures > 0 {
+		fmt.Printf("Accept failures %d\n", report.AcceptFailures)
+	}
+	if report.AcceptDelayed > 0 {
+		fmt.Printf("Accepts delayed by rate limit %d\n", report.AcceptDelayed)
+	}
+	if report.RateLimited > 0 {
+		fmt.Printf("Connections over client rate limit %d\n", report.RateLimited)
+	}
+	if report.Overflow > 0 {
+		fmt.Printf("Connections closed on full accept queue %d\n", report.Overflow)
+	}
+	if report.Shed > 0 {
+		fmt.Printf("Connections shed near file descriptor limit %d\n", report.Shed)
+	}
+	if report.Slow > 0 {
+		fmt.Printf("Slow connections closed %d\n", report.Slow)
+	}
+	if report.WatchdogRestarts > 0 || report.Stalled > 0 {
+		fmt.Printf("Watchdog restarts %d, connections closed while stalled %d\n", report.WatchdogRestarts, report.Stalled)
+	}
+	if report.TargetsHeld > 0 {
+		fmt.Printf("DNS refreshes ignored below -min-targets %d\n", report.TargetsHeld)
+	}
+	if report.ZoneSpills > 0 {
+		fmt.Printf("Targets picked outside of the zone %d\n", report.ZoneSpills)
+	}
+	if report.BufferedPeak > 0 {
+		fmt.Printf("Buffered %d bytes, peak %d, reads delayed %d\n", report.Buffered, report.BufferedPeak, report.BufferPauses)
+	}
+	if sh := report.Shadow; sh != nil {
+		fmt.Printf("Shadowed connections %d, failed %d", sh.Connections, sh.Failed)
+		if compared := sh.Matched + sh.SizeDiffers + sh.ContentDiffers; compared > 0 {
+			fmt.Printf(", compared %d: matched %d, size differs %d, content differs %d (%.1f%% diverged)", compared,
+				sh.Matched, sh.SizeDiffers, sh.ContentDiffers, float64(sh.SizeDiffers+sh.ContentDiffers)*100/float64(compared))
+		}
+		if sh.Incomplete > 0 {
+			fmt.Printf(", incomplete %d", sh.Incomplete)
+		}
+		fmt.Println()
+	}
+	if *rules && len(report.RuleLimits) > 0 {
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "RULE\tLIVE\tLIMIT\tREJECTED\tBANDWIDTH\tTHROTTLED\tBUFFERED\tLIMIT\tPAUSES")
+		limit := func(v uint64) string {
+			if v == 0 {
+				return "-"
+			}
+			return formatBytes(float64(v))
+		}
+		names := make([]string, 0, len(report.RuleLimits))
+		for rule := range report.RuleLimits {
+			names = append(names, rule)
+		}
+		sort.Strings(names)
+		for _, rule := range names {
+			l := report.RuleLimits[rule]
+			conns := "-"
+			if l.Conns > 0 {
+				conns = strconv.FormatInt(l.Conns, 10)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\t%v\t%d\t%s\t%d\n", rule, l.Live, conns, l.Rejected, limit(l.Bandwidth),
+				bucketDuration(l.ThrottledSeconds).Round(time.Millisecond), l.Buffered, limit(l.MaxBuffered), l.BufferPauses)
+		}
+		w.Flush()
+	}
+}
+
+// runTop implements `goproxy top` which prints the heaviest clients and
+// targets over the -top-window through the admin API
+func runTop(args []string) {
+	cmd := flag.NewFlagSet("goproxy top", flag.ExitOnError)
+	admin := adminFlags(cmd)
+	n := cmd.Int("n", 10, "Number of clients and targets to print")
+	by := cmd.String("by", "bytes", "Rank by bytes or conns")
+	cmd.Parse(args)
+
+	var report topReport
+	form := url.Values{"n": {strconv.Itoa(*n)}, "by": {*by}}
+	if err := adminRequest(admin, http.MethodGet, "/top?"+form.Encode(), nil, &report); err != nil {
+		log.Fatalf("Failed to get top talkers: %v\n", err)
+	}
+	printTop(os.Stdout, report)
+}
+
+// printTop prints the top clients and targets as tables
+func printTop(out io.Writer, report topReport) {
+	fmt.Fprintf(out, "Last %v\n", seconds(report.Window))
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, list := range []struct {
+		title   string
+		entries []topEntry
+	}{{"CLIENT", report.Clients}, {"TARGET", report.Targets}} {
+		fmt.Fprintf(w, "%s\tCONNS\tIN\tOUT\n", list.title)
+		for _, e := range list.entries {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", e.Address, e.Conns, e.BytesIn, e.BytesOut)
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
+
+// runStatus implements `goproxy status` which summarizes health, targets,
+// connections and rates through the admin API
+func runStatus(args []string) {
+	cmd := flag.NewFlagSet("goproxy status", flag.ExitOnError)
+	admin := adminFlags(cmd)
+	interval := cmd.Duration("interval", time.Second, "Interval to measure rates over")
+	cmd.Parse(args)
+	if *interval <= 0 {
+		log.Fatalf("Interval must be positive\n")
+	}
+
+	var before, after usageReport
+	if err := adminRequest(admin, http.MethodGet, "/stats", nil, &before); err != nil {
+		log.Fatalf("Failed to get stats: %v\n", err)
+	}
+	start := time.Now()
+	var h healthInfo
+	if err := adminRequest(admin, http.MethodGet, "/health", nil, &h); err != nil {
+		log.Fatalf("Failed to check health: %v\n", err)
+	}
+	var targets []targetInfo
+	if err := adminRequest(admin, http.MethodGet, "/targets", nil, &targets); err != nil {
+		log.Fatalf("Failed to list targets: %v\n", err)
+	}
+	var conns []connInfo
+	if err := adminRequest(admin, http.MethodGet, "/conns", nil, &conns); err != nil {
+		log.Fatalf("Failed to list connections: %v\n", err)
+	}
+	var maintenance []string
+	if err := adminRequest(admin, http.MethodGet, "/maintenance", nil, &maintenance); err != nil {
+		log.Fatalf("Failed to list listeners in maintenance: %v\n", err)
+	}
+	time.Sleep(*interval - time.Since(start))
+	if err := adminRequest(admin, http.MethodGet, "/stats", nil, &after); err != nil {
+		log.Fatalf("Failed to get stats: %v\n", err)
+	}
+	elapsed := time.Since(start).Seconds()
+
+	state := "Unhealthy"
+	if h.Healthy {
+		state = "Healthy"
+	}
+	fmt.Printf("%s, %d of %d targets reachable, %d required\n", state, h.Reachable, h.Targets, h.Min)
+	protos := make(map[string]int)
+	for _, c := range conns {
+		protos[c.Proto]++
+	}
+	names := make([]string, 0, len(protos))
+	for proto, n := range protos {
+		names = append(names, fmt.Sprintf("%s %d", proto, n))
+	}
+	sort.Strings(names)
+	fmt.Printf("Connections %d live", len(conns))
+	if len(names) > 0 {
+		fmt.Printf(" (%s)", strings.Join(names, ", "))
+	}
+	fmt.Printf(", %.1f/s new, %d since %s\n", float64(after.Total.Conns-before.Total.Conns)/elapsed,
+		after.Total.Conns, after.Since.Format(time.RFC3339))
+	fmt.Printf("Traffic in %sB/s, out %sB/s\n", formatBytes(float64(after.Total.BytesIn-before.Total.BytesIn)/elapsed),
+		formatBytes(float64(after.Total.BytesOut-before.Total.BytesOut)/elapsed))
+	if len(maintenance) > 0 {
+		fmt.Printf("Maintenance on %s\n", strings.Join(maintenance, ", "))
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tGROUP\tWEIGHT\tSTATE\tCONNS\tERRORS")
+	for _, t := range targets {
+		state := "active"
+		switch {
+		case t.Blacklisted:
+			state = "blacklisted"
+		case t.Draining:
+			state = "draining"
+		case t.Unreachable:
+			state = "unreachable"
+		case t.Alerting:
+			state = "alerting"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%.1f%%\n", t.Target, t.Group, t.Weight, state, t.Conns, t.ErrorRate*100)
+	}
+	w.Flush()
+}
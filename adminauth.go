@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminAuth holds the -admin-token-file token and -admin-allow networks
+// checked on every admin API request
+var adminAuth struct {
+	token string
+	allow []*net.IPNet
+}
+
+// readToken reads a bearer token from the first line of the file
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token, _, _ := strings.Cut(string(data), "\n")
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", errors.New("token is empty")
+	}
+	return token, nil
+}
+
+// setupAdminAuth reads the admin API token and parses the allowed networks
+func setupAdminAuth() error {
+	if adminTokenFile != "" {
+		token, err := readToken(adminTokenFile)
+		if err != nil {
+			return fmt.Errorf("-admin-token-file: %v", err)
+		}
+		adminAuth.token = token
+	}
+	for _, c := range parseTargetList(adminAllow) {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("-admin-allow: %v", err)
+		}
+		adminAuth.allow = append(adminAuth.allow, cidr)
+	}
+	return nil
+}
+
+// adminTlsConfig returns the admin API server TLS configuration with the
+// -admin-tls-cert or -vault-pki certificate, requiring client certificates
+// signed by -admin-tls-client-ca when given and not revoked
+func adminTlsConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if vaultPki != "" {
+		config.GetCertificate = vaultCertificate
+	} else {
+		cert, err := tls.LoadX509KeyPair(adminTlsCert, adminTlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if adminTlsClientCa != "" {
+		pool, err := loadCertPool(adminTlsClientCa)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if adminTlsCrl != "" {
+			if err := loadAdminCrl(adminTlsCrl); err != nil {
+				return nil, fmt.Errorf("-admin-tls-crl: %v", err)
+			}
+		}
+		if adminTlsCrl != "" || adminTlsOcsp {
+			config.VerifyConnection = verifyAdminClient
+		}
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in `%s`", path)
+	}
+	return pool, nil
+}
+
+// authAdmin refuses admin API clients outside -admin-allow and requests
+// without the -admin-token-file bearer token; GET /health is left open to
+// load balancer checks, which can't send a token
+func authAdmin(next http.Handler) http.Handler {
+	if adminAuth.token == "" && len(adminAuth.allow) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(adminAuth.allow) > 0 && !adminClientAllowed(r.RemoteAddr) {
+			if verbose.Load() {
+				log.Printf("Admin API refused client `%s` not in -admin-allow\n", r.RemoteAddr)
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if adminAuth.token != "" && r.URL.Path != "/health" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminAuth.token)) != 1 {
+				if verbose.Load() {
+					log.Printf("Admin API refused client `%s` without a valid token\n", r.RemoteAddr)
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminClientAllowed reports whether the client address is in -admin-allow;
+// a client without an address is refused, -admin-allow is not taken with a
+// Unix socket
+func adminClientAllowed(client string) bool {
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range adminAuth.allow {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// adminCrl holds the -admin-tls-crl revocation lists, reloaded when the file
+// changes
+var adminCrl struct {
+	sync.RWMutex
+	lists   []*x509.RevocationList
+	modTime time.Time
+}
+
+// ocspCache keeps OCSP responses for admin API client certificates until
+// their next update
+var ocspCache = struct {
+	sync.Mutex
+	responses map[string]*ocsp.Response
+}{responses: make(map[string]*ocsp.Response)}
+
+// ocspDefaultTtl is how long a response without a next update is kept
+const ocspDefaultTtl = time.Hour
+
+// loadAdminCrl reads PEM or DER revocation lists and checks they are signed
+// by a -admin-tls-client-ca certificate
+func loadAdminCrl(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cas, err := loadCerts(adminTlsClientCa)
+	if err != nil {
+		return err
+	}
+	var ders [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+	var lists []*x509.RevocationList
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return err
+		}
+		signed := false
+		for _, ca := range cas {
+			if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return fmt.Errorf("CRL of `%s` is not signed by a CA of -admin-tls-client-ca", crl.Issuer)
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			log.Printf("CRL of `%s` in `%s` is past its next update at %v, still using it\n", crl.Issuer, path, crl.NextUpdate)
+		}
+		lists = append(lists, crl)
+	}
+	adminCrl.Lock()
+	adminCrl.lists, adminCrl.modTime = lists, info.ModTime()
+	adminCrl.Unlock()
+	return nil
+}
+
+func loadCerts(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// reloadAdminCrl checks the CRL file every minute and reloads it when it
+// is replaced, e.g. by a cron job fetching it from the CA
+func reloadAdminCrl(ctx context.Context, path string) {
+	ticker := systemClock.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Failed to check CRL `%s`: %v\n", path, err)
+			continue
+		}
+		adminCrl.RLock()
+		changed := !info.ModTime().Equal(adminCrl.modTime)
+		adminCrl.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := loadAdminCrl(path); err != nil {
+			log.Printf("Failed to reload CRL `%s`: %v\n", path, err)
+			continue
+		}
+		if verbose.Load() {
+			log.Printf("Reloaded CRL `%s`\n", path)
+		}
+		publishEvent("reload", func() interface{} { return map[string]string{"config": "crl", "path": path} })
+		audit("file watch", "reload CRL `"+path+"`", nil, nil)
+	}
+}
+
+// verifyAdminClient refuses admin API client certificates revoked by
+// -admin-tls-crl or, with -admin-tls-ocsp, by their OCSP responder
+func verifyAdminClient(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	chain := cs.VerifiedChains[0]
+	leaf := chain[0]
+	if crlRevoked(leaf) {
+		return fmt.Errorf("client certificate `%s` serial %x is revoked", leaf.Subject, leaf.SerialNumber)
+	}
+	if adminTlsOcsp && len(chain) > 1 && len(leaf.OCSPServer) > 0 {
+		status, err := ocspStatus(leaf, chain[1])
+		if err != nil {
+			return fmt.Errorf("client certificate `%s` serial %x: OCSP: %v", leaf.Subject, leaf.SerialNumber, err)
+		}
+		if status != ocsp.Good {
+			return fmt.Errorf("client certificate `%s` serial %x is %s by OCSP", leaf.Subject, leaf.SerialNumber,
+				map[int]string{ocsp.Revoked: "revoked", ocsp.Unknown: "unknown"}[status])
+		}
+	}
+	return nil
+}
+
+func crlRevoked(cert *x509.Certificate) bool {
+	adminCrl.RLock()
+	defer adminCrl.RUnlock()
+	for _, crl := range adminCrl.lists {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) {
+			continue
+		}
+		for _, revoked := range crl.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ocspStatus asks the first OCSP responder of the certificate for its
+// status, or answers from the cache
+func ocspStatus(cert, issuer *x509.Certificate) (int, error) {
+	key := string(cert.RawIssuer) + "/" + cert.SerialNumber.String()
+	ocspCache.Lock()
+	cached := ocspCache.responses[key]
+	ocspCache.Unlock()
+	if cached != nil && time.Now().Before(cached.NextUpdate) {
+		return cached.Status, nil
+	}
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return 0, err
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, errors.New(strings.ToLower(resp.Status))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return 0, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return 0, err
+	}
+	if parsed.NextUpdate.IsZero() {
+		parsed.NextUpdate = time.Now().Add(ocspDefaultTtl)
+	}
+	ocspCache.Lock()
+	for k, r := range ocspCache.responses {
+		if time.Now().After(r.NextUpdate) {
+			delete(ocspCache.responses, k)
+		}
+	}
+	ocspCache.responses[key] = parsed
+	ocspCache.Unlock()
+	return parsed.Status, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminSocketPath returns the Unix socket path of an admin address given as
+// unix:/path
+func adminSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, "unix:"), true
+}
+
+// parseSocketMode parses -admin-socket-mode as octal file permissions
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("expected octal permissions such as 0660, got `%s`", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// listenAdmin binds the admin API on host:port, or on a Unix socket with
+// -admin-socket-mode and -admin-socket-owner applied; a stale socket left
+// by a previous run is replaced, a live one is not
+func listenAdmin(addr string) (net.Listener, error) {
+	path, ok := adminSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("`%s` exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, errors.New("another process is listening on the socket")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	mode, _ := parseSocketMode(adminSocketMode)
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if adminSocketOwner != "" {
+		userName, groupName, _ := strings.Cut(adminSocketOwner, ":")
+		uid, gid, err := lookupIds(userName, groupName)
+		if err == nil {
+			err = os.Chown(path, uid, gid)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set owner `%s`: %v", adminSocketOwner, err)
+		}
+	}
+	return listener, nil
+}
+
+// removeAdminSocket removes the admin API socket on shutdown
+func removeAdminSocket() {
+	if path, ok := adminSocketPath(admin); ok {
+		os.Remove(path)
+	}
+}
+
+// adminClient returns an HTTP client for the admin API at host:port,
+// https://host:port or unix:/path, and the base URL to request
+func adminClient(a *adminEndpoint) (*http.Client, string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if path, ok := adminSocketPath(a.addr); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+		return client, "http://goproxy", nil
+	}
+	if !strings.HasPrefix(a.addr, "https://") {
+		return client, "http://" + a.addr, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if a.ca != "" {
+		pool, err := loadCertPool(a.ca)
+		if err != nil {
+			return nil, "", err
+		}
+		config.RootCAs = pool
+	}
+	if a.cert != "" {
+		cert, err := tls.LoadX509KeyPair(a.cert, a.key)
+		if err != nil {
+			return nil, "", err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	client.Transport = &http.Transport{TLSClientConfig: config}
+	return client, strings.TrimSuffix(a.addr, "/"), nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AffinityExtractor derives an application-level key from a client datagram.
+// Datagrams sharing a key are forwarded to the same target, so related flows
+// (a SIP dialog, an RTP stream) stay on one backend.
+type AffinityExtractor interface {
+	Key(packet []byte) (string, bool)
+}
+
+var affinityExtractors = map[string]AffinityExtractor{
+	"sip":    sipAffinity{},
+	"rtp":    rtpAffinity{},
+	"client": clientAffinity{},
+}
+
+// clientAffinity keys all datagrams by client address, for protocols without
+// an application-level key
+type clientAffinity struct{}
+
+func (clientAffinity) Key(packet []byte) (string, bool) {
+	return "", false
+}
+
+// sipAffinity keys SIP messages by their Call-ID header
+type sipAffinity struct{}
+
+func (sipAffinity) Key(packet []byte) (string, bool) {
+	headers := packet
+	if end := bytes.Index(packet, []byte("\r\n\r\n")); end >= 0 {
+		headers = packet[:end]
+	}
+	for _, line := range strings.Split(string(headers), "\r\n")[1:] {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		name := strings.TrimSpace(line[:colon])
+		// `i` is the compact form of Call-ID
+		if strings.EqualFold(name, "Call-ID") || name == "i" || name == "I" {
+			if callId := strings.TrimSpace(line[colon+1:]); callId != "" {
+				return "sip:" + callId, true
+			}
+		}
+	}
+	return "", false
+}
+
+// rtpAffinity keys RTP and RTCP packets by their sender SSRC
+type rtpAffinity struct{}
+
+func (rtpAffinity) Key(packet []byte) (string, bool) {
+	if len(packet) < 8 || packet[0]>>6 != 2 {
+		return "", false
+	}
+	var ssrc uint32
+	// RTCP packet types 200-204 carry the sender SSRC right after the header
+	if pt := packet[1]; pt >= 200 && pt <= 204 {
+		ssrc = binary.BigEndian.Uint32(packet[4:8])
+	} else if len(packet) >= 12 {
+		ssrc = binary.BigEndian.Uint32(packet[8:12])
+	} else {
+		return "", false
+	}
+	return "rtp:" + strconv.FormatUint(uint64(ssrc), 16), true
+}
+
+type udpSession struct {
+	id       uint64
+	out      net.Conn
+	loop     *loopSocket // reading replies with -event-loop
+	tracked  *trackedConn
+	listener *net.UDPConn
+	client   *net.UDPAddr
+	lastSeen time.Time
+}
+
+// manageUdpAffinity forwards datagrams bidirectionally, keeping one upstream
+// session per affinity key; datagrams without a recognizable key are keyed by
+// client address; replies are sent from the listener the client last used
+func manageUdpAffinity(ctx context.Context, listeners []*net.UDPConn, resolver chan []Target, extractor AffinityExtractor) {
+	var mu sync.Mutex
+	var connectTo []Target
+	sessions := make(map[string]*udpSession)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case targets := <-resolver:
+				setTargets(targets)
+				mu.Lock()
+				connectTo = targets
+				mu.Unlock()
+			}
+		}
+	}()
+
+	go func() {
+		ticker := systemClock.NewTicker(udpSessionTimeout / 2)
+		defer ticker.Stop()
+		for {
+			var now time.Time
+			select {
+			case <-ctx.Done():
+				return
+			case now = <-ticker.Chan():
+			}
+			mu.Lock()
+			for key, s := range sessions {
+				if now.Sub(s.lastSeen) > udpSessionTimeout {
+					if debug.Load() {
+						log.Printf("[%d] UDP session `%s` to `%s` idle, closing\n", s.id, key, s.out.RemoteAddr())
+					}
+					s.tracked.setCloseReason("idle")
+					untrackConn(s.id)
+					s.loop.stop()
+					s.out.Close()
+					delete(sessions, key)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener *net.UDPConn) {
+			defer wg.Done()
+			readAffinity(ctx, listener, extractor, &mu, &connectTo, sessions)
+		}(listener)
+	}
+	wg.Wait()
+}
+
+// readAffinity reads datagrams from a listener until it is closed, creating
+// sessions as needed; mu guards connectTo and sessions
+func readAffinity(ctx context.Context, listener *net.UDPConn, extractor AffinityExtractor, mu *sync.Mutex, connectTo *[]Target, sessions map[string]*udpSession) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("Failed to read UDP datagram: %v\n", err)
+			if strings.Contains(err.Error(), "closed network connection") {
+				return
+			}
+			continue
+		}
+		key, ok := extractor.Key(buf[:n])
+		if !ok {
+			key = client.String()
+		}
+		if portRange != "" {
+			// each port of the range is a separate session to the mapped port
+			_, port := addrIpPort(listener.LocalAddr())
+			key = strconv.Itoa(port) + "/" + key
+		}
+
+		mu.Lock()
+		s := sessions[key]
+		if s == nil {
+			if fdsExhausted() {
+				mu.Unlock()
+				log.Printf("Near file descriptor limit, %d of %d in use, dropping datagram from `%s`\n", fdsInUse(), fds.limit, client)
+				continue
+			}
+			if isBanned(client) {
+				mu.Unlock()
+				if debug.Load() {
+					log.Printf("Client `%s` is banned, dropping datagram\n", client)
+				}
+				continue
+			}
+			if !accessAllowed(client, listener.LocalAddr()) {
+				mu.Unlock()
+				if debug.Load() {
+					log.Printf("Client `%s` is not allowed at this time, dropping datagram\n", client)
+				}
+				continue
+			}
+			if !geoAllowed(client) {
+				mu.Unlock()
+				if debug.Load() {
+					log.Printf("Client `%s` country is not allowed, dropping datagram\n", client)
+				}
+				continue
+			}
+			if clientQuota > 0 && overQuota(client.IP.String()) {
+				mu.Unlock()
+				if debug.Load() {
+					log.Printf("Client `%s` over transfer quota, dropping datagram\n", client)
+				}
+				continue
+			}
+			recordClient(client, 1, 0, "")
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			sum := h.Sum32()
+			target := hashTarget(groupTargets(*connectTo, uint(sum>>16), client, listener.LocalAddr()), uint(sum))
+			if target == "" {
+				mu.Unlock()
+				if debug.Load() {
+					log.Print("Don't know where to connect, dropping datagram\n")
+				}
+				continue
+			}
+			if portRange != "" {
+				target = mapPort(target, listener.LocalAddr())
+			}
+			// dial without mu, which would hold up the other listeners and
+			// replies of all sessions while the target is slow to answer
+			mu.Unlock()
+			id := newConnId()
+			out, err := dialUpstream(ctx, "udp", target)
+			if err != nil {
+				log.Printf("[%d] Conection to `%s` failed: %v error=dial\n", id, target, err)
+				continue
+			}
+			out = countFd(out)
+			mu.Lock()
+			if s = sessions[key]; s != nil {
+				// another listener got a datagram of the key meanwhile
+				out.Close()
+			} else {
+				if debug.Load() {
+					log.Printf("[%d] New UDP session `%s` from `%s` to `%s`\n", id, key, client, target)
+				}
+				s = newUdpSession(id, out, key, client, listener, target, mu, sessions)
+			}
+		}
+		s.listener = listener
+		s.client = client
+		s.lastSeen = time.Now()
+		mu.Unlock()
+
+		s.tracked.transferred(n, 0)
+		s.tracked.sample(true, buf[:n])
+		if _, err := s.out.Write(buf[:n]); err != nil {
+			if isIcmpError(err) {
+				failUdpSession(s, err)
+			} else if debug.Load() {
+				log.Printf("[%d] Failed to forward UDP datagram to `%s`: %v\n", s.id, s.out.RemoteAddr(), err)
+			}
+		}
+	}
+}
+
+// newUdpSession tracks a session of key to target and starts relaying its
+// replies; mu must be held
+func newUdpSession(id uint64, out net.Conn, key string, client *net.UDPAddr, listener *net.UDPConn, target string, mu *sync.Mutex, sessions map[string]*udpSession) *udpSession {
+	s := &udpSession{id: id, out: out}
+	sessions[key] = s
+	s.tracked = trackConn(id, "udp", client.String(), listener.LocalAddr().String(), target, func() {
+		untrackConn(id)
+		mu.Lock()
+		if sessions[key] == s {
+			delete(sessions, key)
+		}
+		loop := s.loop
+		mu.Unlock()
+		loop.stop()
+		out.Close()
+	})
+	if eventLoop {
+		s.loop = loopReceive(id, out, func(p []byte, err error) bool { return s.replied(p, err, mu) })
+	}
+	if s.loop == nil {
+		go replyUdp(s, mu)
+	}
+	return s
+}
+
+// replyUdp copies datagrams from the target back to the client that last
+// sent on the session
+func replyUdp(s *udpSession, mu *sync.Mutex) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := s.out.Read(buf)
+		if !s.replied(buf[:n], err, mu) {
+			return
+		}
+	}
+}
+
+// replied sends a datagram read from the target to the client, false once
+// the session is done
+func (s *udpSession) replied(p []byte, err error, mu *sync.Mutex) bool {
+	if err != nil {
+		if strings.Contains(err.Error(), "closed network connection") {
+			return false
+		}
+		if isIcmpError(err) {
+			failUdpSession(s, err)
+			return false
+		}
+		if debug.Load() {
+			log.Printf("[%d] Failed to read UDP datagram from `%s`: %v\n", s.id, s.out.RemoteAddr(), err)
+		}
+		return true
+	}
+	mu.Lock()
+	listener, client := s.listener, s.client
+	s.lastSeen = time.Now()
+	mu.Unlock()
+	s.tracked.transferred(0, len(p))
+	s.tracked.sample(false, p)
+	if _, err := listener.WriteToUDP(p, client); err != nil && debug.Load() {
+		log.Printf("[%d] Failed to send UDP datagram to `%s`: %v\n", s.id, client, err)
+	}
+	return true
+}
+
+// failUdpSession closes a session the target answered with an ICMP error, so
+// the client's next datagram starts a new session instead of being lost
+func failUdpSession(s *udpSession, err error) {
+	if verbose.Load() {
+		log.Printf("[%d] Target `%s` unreachable, closing UDP session: %v\n", s.id, s.tracked.target, err)
+	}
+	markUnreachable(s.tracked.target)
+	s.tracked.setCloseReason("unreachable")
+	s.tracked.close()
+}
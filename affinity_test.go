@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// sipMessage joins header lines with CRLF and appends the blank line and body
+func sipMessage(body string, lines ...string) []byte {
+	return []byte(strings.Join(lines, "\r\n") + "\r\n\r\n" + body)
+}
+
+func TestSipAffinityKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		key    string
+		ok     bool
+	}{
+		// the INVITE of RFC 3261 section 24.2
+		{"invite", sipMessage("v=0\r\no=bob 2890844527 2890844527 IN IP4 client.biloxi.example.com\r\n",
+			"INVITE sip:bob@biloxi.example.com SIP/2.0",
+			"Via: SIP/2.0/TCP client.atlanta.example.com:5060;branch=z9hG4bK74bf9",
+			"Max-Forwards: 70",
+			"From: Alice <sip:alice@atlanta.example.com>;tag=9fxced76sl",
+			"To: Bob <sip:bob@biloxi.example.com>",
+			"Call-ID: 3848276298220188511@atlanta.example.com",
+			"CSeq: 1 INVITE",
+			"Content-Type: application/sdp",
+			"Content-Length: 151"),
+			"sip:3848276298220188511@atlanta.example.com", true},
+		{"response", sipMessage("",
+			"SIP/2.0 180 Ringing",
+			"Via: SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds",
+			"call-id:   a84b4c76e66710@pc33.atlanta.com  ",
+			"CSeq: 314159 INVITE"),
+			"sip:a84b4c76e66710@pc33.atlanta.com", true},
+		{"compact form", sipMessage("",
+			"BYE sip:alice@pc33.atlanta.com SIP/2.0",
+			"v: SIP/2.0/UDP 192.0.2.4;branch=z9hG4bKnashds10",
+			"i: a84b4c76e66710",
+			"CSeq: 231 BYE"),
+			"sip:a84b4c76e66710", true},
+		{"call-id in body only", sipMessage("Call-ID: not-a-header\r\n",
+			"MESSAGE sip:bob@biloxi.example.com SIP/2.0",
+			"CSeq: 1 MESSAGE"),
+			"", false},
+		{"call-id on request line", []byte("Call-ID: x\r\nCSeq: 1 OPTIONS\r\n\r\n"), "", false},
+		{"empty call-id", sipMessage("", "OPTIONS sip:carol@chicago.com SIP/2.0", "Call-ID:  "), "", false},
+		{"truncated headers", []byte("REGISTER sip:registrar.biloxi.com SIP/2.0\r\nCall-ID: 843817637684230@998sdasdh09"),
+			"sip:843817637684230@998sdasdh09", true},
+		{"keep-alive", []byte("\r\n\r\n"), "", false},
+		{"empty", nil, "", false},
+		{"binary", []byte{0x80, 0x00, 0x3a, 0xff, 0x00}, "", false},
+	}
+	for _, test := range tests {
+		key, ok := sipAffinity{}.Key(test.packet)
+		if key != test.key || ok != test.ok {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, key, ok, test.key, test.ok)
+		}
+	}
+}
+
+func TestRtpAffinityKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		key    string
+		ok     bool
+	}{
+		// PCMU, sequence 1, timestamp 160, SSRC 0x3a2f1b7c, two bytes of payload
+		{"rtp", []byte{0x80, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0xa0, 0x3a, 0x2f, 0x1b, 0x7c, 0xff, 0xff}, "rtp:3a2f1b7c", true},
+		// marker bit and dynamic payload type 96, header only
+		{"rtp header only", []byte{0x80, 0xe0, 0x12, 0x34, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x2a}, "rtp:2a", true},
+		// RTCP sender report of SSRC 0x3a2f1b7c, truncated after the SSRC
+		{"rtcp sr", []byte{0x80, 0xc8, 0x00, 0x06, 0x3a, 0x2f, 0x1b, 0x7c}, "rtp:3a2f1b7c", true},
+		{"rtcp bye", []byte{0x81, 0xcb, 0x00, 0x01, 0xde, 0xad, 0xbe, 0xef}, "rtp:deadbeef", true},
+		{"truncated rtp", []byte{0x80, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0xa0, 0x3a, 0x2f}, "", false},
+		{"short", []byte{0x80, 0xc8, 0x00, 0x06}, "", false},
+		{"version 1", []byte{0x40, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0xa0, 0x3a, 0x2f, 0x1b, 0x7c}, "", false},
+		// a STUN binding request multiplexed on the RTP port
+		{"stun", []byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c}, "", false},
+		{"empty", nil, "", false},
+	}
+	for _, test := range tests {
+		key, ok := rtpAffinity{}.Key(test.packet)
+		if key != test.key || ok != test.ok {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, key, ok, test.key, test.ok)
+		}
+	}
+}
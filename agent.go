@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// serveAgentCheck binds the HAProxy agent-check listener and answers each
+// connection with one line in background: the state and, with
+// -agent-capacity, a weight falling as connections approach capacity
+func serveAgentCheck(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatalf(errBind, "Failed to setup agent-check listener on `%s`: %v\n", addr, err)
+	}
+	if verbose.Load() {
+		log.Printf("Agent-check listening on `%s`\n", listener.Addr())
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				fatalf(errBind, "Agent-check failed: %v\n", err)
+			}
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			fmt.Fprintf(conn, "%s\n", agentStatus())
+			conn.Close()
+		}
+	}()
+}
+
+// agentStatus reports drain while shutting down, down when there is no
+// target to forward to, and up otherwise; ready cancels a drain reported
+// earlier
+func agentStatus() string {
+	shutdown.Lock()
+	draining := shutdown.draining
+	shutdown.Unlock()
+	if draining {
+		return "drain"
+	}
+	usable := 0
+	targetState.Lock()
+	for _, target := range targetState.current {
+		if !targetState.draining[target.Addr] && !isBlacklisted(target.Addr) {
+			usable++
+		}
+	}
+	targetState.Unlock()
+	if usable == 0 {
+		return "down"
+	}
+	if agentCapacity <= 0 {
+		return "up ready"
+	}
+	connTable.Lock()
+	active := len(connTable.conns)
+	connTable.Unlock()
+	// keep a share of traffic at full load, HAProxy treats 0% as drain
+	weight := 100 - active*100/agentCapacity
+	if weight < 1 {
+		weight = 1
+	}
+	return fmt.Sprintf("up ready %d%%", weight)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditLog records control-plane changes to -audit-log, one JSON object per
+// line; the file is only appended to and reopened on SIGUSR2 after rotation
+var auditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+type auditRecord struct {
+	Time   time.Time   `json:"time"`
+	Actor  string      `json:"actor"`
+	Action string      `json:"action"`
+	Status int         `json:"status,omitempty"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+func openAuditLog(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	auditLog.Lock()
+	old := auditLog.file
+	auditLog.file = file
+	auditLog.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// reopenAuditLogOnSignal reopens the audit log on SIGUSR2, recording who
+// asked for it in the new file
+func reopenAuditLogOnSignal(path string) {
+	c := make(chan os.Signal, 1)
+	notifyLogReopen(c)
+	for range c {
+		if err := openAuditLog(path); err != nil {
+			log.Printf("Failed to reopen audit log `%s`: %v\n", path, err)
+			continue
+		}
+		audit("signal SIGUSR2", "reopen log files", nil, nil)
+	}
+}
+
+// audit appends a record of a change, before and after are the affected
+// state; a failed write is logged as the record can't be dropped silently
+func audit(actor, action string, before, after interface{}) {
+	auditStatus(actor, action, 0, before, after)
+}
+
+func auditStatus(actor, action string, status int, before, after interface{}) {
+	if auditLogPath == "" {
+		return
+	}
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(auditRecord{time.Now(), actor, action, status, before, after}); err != nil {
+		log.Printf("Failed to encode audit record of `%s`: %v\n", action, err)
+		return
+	}
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if _, err := auditLog.file.Write(line.Bytes()); err != nil {
+		log.Printf("Failed to write audit record of `%s` by `%s`: %v\n", action, actor, err)
+	}
+}
+
+// controlState is what admin actions and schedules change: the canary split,
+// target weights, drained and blacklisted targets
+type controlState struct {
+	Split       uint            `json:"split"`
+	Weights     map[string]uint `json:"weights,omitempty"`
+	Draining    []string        `json:"draining,omitempty"`
+	Blacklist   []string        `json:"blacklist,omitempty"`
+	Bans        []string        `json:"bans,omitempty"`
+	Maintenance []string        `json:"maintenance,omitempty"`
+	LogLevel    string          `json:"log_level"`
+}
+
+func currentControlState() controlState {
+	state := controlState{Split: getSplit().Percent, Weights: make(map[string]uint)}
+	targetState.Lock()
+	for target, w := range targetState.weights {
+		state.Weights[target] = w
+	}
+	for target := range targetState.draining {
+		state.Draining = append(state.Draining, target)
+	}
+	targetState.Unlock()
+	sort.Strings(state.Draining)
+	state.Blacklist = listBlacklist().Admin
+	bans.Lock()
+	for client := range bans.banned {
+		state.Bans = append(state.Bans, client)
+	}
+	bans.Unlock()
+	sort.Strings(state.Bans)
+	state.Maintenance = listMaintenance()
+	state.LogLevel = logLevel()
+	return state
+}
+
+// statusRecorder keeps the status code of an admin response for the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// auditAdmin records admin API calls that may change state, i.e. all but
+// GET and HEAD, with the client address, form values and state around them
+func auditAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auditLogPath == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the form is parsed from a copy so the handler can still read it
+		body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		form := r.Clone(r.Context())
+		form.Body = io.NopCloser(bytes.NewReader(body))
+		form.ParseForm()
+		var params []string
+		for key, values := range form.Form {
+			params = append(params, fmt.Sprintf("%s=%s", key, strings.Join(values, ",")))
+		}
+		sort.Strings(params)
+		action := r.Method + " " + r.URL.Path
+		if len(params) > 0 {
+			action += " " + strings.Join(params, "&")
+		}
+
+		before := currentControlState()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		client := r.RemoteAddr
+		if _, socket := adminSocketPath(admin); socket {
+			// peers on a Unix socket have no address
+			client = admin
+		}
+		auditStatus("admin "+client, action, rec.status, before, currentControlState())
+	})
+}
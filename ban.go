@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type clientActivity struct {
+	window   time.Time
+	conns    int
+	failures int
+}
+
+type banInfo struct {
+	Client  string    `json:"client"`
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Expires time.Time `json:"expires"`
+}
+
+// bans tracks per-client connection churn and failures (dial failures,
+// rejected and empty connections, typical for port scans) over a fixed
+// window, temporarily banning clients exceeding the thresholds
+var bans = struct {
+	sync.Mutex
+	activity map[string]*clientActivity
+	banned   map[string]*banInfo
+	allow    []*net.IPNet
+	total    uint64
+}{activity: make(map[string]*clientActivity), banned: make(map[string]*banInfo)}
+
+func banEnabled() bool {
+	return banChurn > 0 || banFailures > 0
+}
+
+func parseBanAllow(list string) error {
+	for _, c := range parseTargetList(list) {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return err
+		}
+		bans.allow = append(bans.allow, cidr)
+	}
+	return nil
+}
+
+// isBanned reports whether the client address is currently banned
+func isBanned(client net.Addr) bool {
+	if !banEnabled() {
+		return false
+	}
+	ip, _ := addrIpPort(client)
+	if ip == nil {
+		return false
+	}
+	bans.Lock()
+	defer bans.Unlock()
+	b, ok := bans.banned[ip.String()]
+	return ok && time.Now().Before(b.Expires)
+}
+
+// recordClient accounts a new connection and/or a failure of the client,
+// banning it when thresholds are exceeded
+func recordClient(client net.Addr, conns, failures int, reason string) {
+	if !banEnabled() {
+		return
+	}
+	ip, _ := addrIpPort(client)
+	if ip == nil {
+		return
+	}
+	for _, cidr := range bans.allow {
+		if cidr.Contains(ip) {
+			return
+		}
+	}
+	key := ip.String()
+	now := time.Now()
+
+	bans.Lock()
+	defer bans.Unlock()
+	if _, ok := bans.banned[key]; ok {
+		return
+	}
+	a := bans.activity[key]
+	if a == nil || now.Sub(a.window) > banWindow {
+		a = &clientActivity{window: now}
+		bans.activity[key] = a
+	}
+	a.conns += conns
+	a.failures += failures
+
+	if banChurn > 0 && a.conns > banChurn {
+		reason = "connection churn"
+	} else if !(banFailures > 0 && a.failures > banFailures) {
+		return
+	}
+	ban := &banInfo{key, reason, now, now.Add(banTime)}
+	bans.banned[key] = ban
+	bans.total++
+	publishEvent("ban", func() interface{} { return *ban })
+	audit("ban policy", "ban client `"+key+"`", nil, ban)
+	delete(bans.activity, key)
+	log.Printf("Banned client `%s` for %v: %s\n", key, banTime, reason)
+}
+
+// liftBan removes the ban on client IP before it expires
+func liftBan(client string) bool {
+	bans.Lock()
+	defer bans.Unlock()
+	_, ok := bans.banned[client]
+	delete(bans.banned, client)
+	if ok {
+		publishEvent("ban.lift", func() interface{} { return map[string]string{"client": client} })
+	}
+	return ok
+}
+
+// expireBans lifts expired bans and forgets stale client activity
+func expireBans(ctx context.Context) {
+	ticker := systemClock.NewTicker(banWindow)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.Chan():
+		}
+		bans.Lock()
+		for key, a := range bans.activity {
+			if now.Sub(a.window) > banWindow {
+				delete(bans.activity, key)
+			}
+		}
+		for key, b := range bans.banned {
+			if now.After(b.Expires) {
+				delete(bans.banned, key)
+				publishEvent("ban.lift", func() interface{} { return map[string]string{"client": key} })
+				audit("ban policy", "ban on client `"+key+"` expired", b, nil)
+				if verbose.Load() {
+					log.Printf("Ban on client `%s` expired\n", key)
+				}
+			}
+		}
+		bans.Unlock()
+	}
+}
+
+func listBans() map[string]interface{} {
+	bans.Lock()
+	defer bans.Unlock()
+	list := make([]*banInfo, 0, len(bans.banned))
+	for _, b := range bans.banned {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Since.Before(list[j].Since) })
+	return map[string]interface{}{"total": bans.total, "banned": list}
+}
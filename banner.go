@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// bannerTemplate is -banner, executed for every client
+var bannerTemplate *template.Template
+
+// bannerData is what -banner and -reject-payload can refer to
+type bannerData struct {
+	Id       uint64
+	Client   string
+	ClientIP string
+	Listener string
+	Target   string
+	Reason   string // why the client is refused, for -reject-payload
+	Time     time.Time
+}
+
+// parsePayload parses -banner or -reject-payload as a template, after
+// expanding escapes such as \r\n and \x00 so binary payloads can be given on
+// the command line
+func parsePayload(spec string) (*template.Template, error) {
+	text, err := strconv.Unquote(`"` + strings.ReplaceAll(spec, `"`, `\"`) + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid escape in `%s`", spec)
+	}
+	return template.New("payload").Option("missingkey=error").Parse(text)
+}
+
+// sendBanner writes -banner to the client after -banner-delay, before the
+// target is connected
+func sendBanner(ctx context.Context, id uint64, conn net.Conn, target string) error {
+	if bannerDelay > 0 {
+		wait := time.NewTimer(bannerDelay)
+		select {
+		case <-wait.C:
+		case <-ctx.Done():
+			wait.Stop()
+			return ctx.Err()
+		}
+	}
+	var buf bytes.Buffer
+	err := bannerTemplate.Execute(&buf, bannerData{
+		Id:       id,
+		Client:   conn.RemoteAddr().String(),
+		ClientIP: clientIp(conn.RemoteAddr().String()),
+		Listener: conn.LocalAddr().String(),
+		Target:   target,
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = conn.Write(buf.Bytes())
+	conn.SetWriteDeadline(time.Time{})
+	return err
+}
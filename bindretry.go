@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+const (
+	// backoff between bind attempts with -bind-retry, doubled on each
+	// failure
+	bindBackoffMin = 100 * time.Millisecond
+	bindBackoffMax = 5 * time.Second
+)
+
+// bindRetriable tells whether binding may succeed later: the address is
+// still held by the previous instance during a rolling restart, or not
+// assigned to the host yet
+func bindRetriable(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	if errno == syscall.EADDRINUSE || errno == syscall.EADDRNOTAVAIL {
+		return true
+	}
+	// WSAEADDRINUSE and WSAEADDRNOTAVAIL
+	return runtime.GOOS == "windows" && (errno == 10048 || errno == 10049)
+}
+
+// retryBind calls bind until it succeeds, fails with an error not worth
+// retrying, or -bind-retry has passed since the first attempt
+func retryBind(ctx context.Context, what, addr string, bind func() error) error {
+	err := bind()
+	if err == nil || bindRetry == 0 || !bindRetriable(err) {
+		return err
+	}
+	deadline := time.Now().Add(bindRetry)
+	backoff := bindBackoffMin
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return fmt.Errorf("%w, gave up after %v", err, bindRetry)
+		}
+		if backoff < wait {
+			wait = backoff
+		}
+		log.Printf("Failed to setup %s listener on `%s`, retrying in %v: %v\n", what, addr, wait, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if err = bind(); err == nil || !bindRetriable(err) {
+			if err == nil && verbose.Load() {
+				log.Printf("Bound %s listener on `%s`\n", what, addr)
+			}
+			return err
+		}
+		if backoff *= 2; backoff > bindBackoffMax {
+			backoff = bindBackoffMax
+		}
+	}
+}
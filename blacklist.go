@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blacklist holds target addresses never connected to, whatever DNS returns:
+// entries of -target-blacklist, of -target-blacklist-file, reloaded when it
+// changes, and added through the admin API
+var blacklist = struct {
+	sync.RWMutex
+	static  []*net.IPNet
+	file    []*net.IPNet
+	admin   []*net.IPNet
+	modTime time.Time
+}{}
+
+type blacklistInfo struct {
+	Static []string `json:"static"`
+	File   []string `json:"file"`
+	Admin  []string `json:"admin"`
+}
+
+// parseBlacklistEntry parses an IP address or CIDR
+func parseBlacklistEntry(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("expected IP address or CIDR, got `%s`", entry)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, cidr, err := net.ParseCIDR(entry)
+	return cidr, err
+}
+
+func parseBlacklist(list string) error {
+	for _, entry := range parseTargetList(list) {
+		cidr, err := parseBlacklistEntry(entry)
+		if err != nil {
+			return err
+		}
+		blacklist.static = append(blacklist.static, cidr)
+	}
+	return nil
+}
+
+// loadBlacklistFile reads an IP address or CIDR per line, # starts a comment
+func loadBlacklistFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var entries []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		cidr, err := parseBlacklistEntry(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		entries = append(entries, cidr)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	blacklist.Lock()
+	blacklist.file = entries
+	blacklist.modTime = info.ModTime()
+	blacklist.Unlock()
+	return nil
+}
+
+// reloadBlacklistFile rereads the file when it changes
+func reloadBlacklistFile(ctx context.Context, path string) {
+	ticker := systemClock.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Failed to check target blacklist `%s`: %v\n", path, err)
+			continue
+		}
+		blacklist.RLock()
+		changed := !info.ModTime().Equal(blacklist.modTime)
+		blacklist.RUnlock()
+		if !changed {
+			continue
+		}
+		before := listBlacklist().File
+		if err := loadBlacklistFile(path); err != nil {
+			log.Printf("Failed to reload target blacklist `%s`, keeping the previous one: %v\n", path, err)
+			continue
+		}
+		if verbose.Load() {
+			log.Printf("Reloaded target blacklist `%s`\n", path)
+		}
+		publishEvent("reload", func() interface{} { return map[string]string{"config": "blacklist", "path": path} })
+		audit("file watch", "reload target blacklist `"+path+"`", before, listBlacklist().File)
+	}
+}
+
+// isBlacklisted reports whether the target host:port is a blacklisted
+// address; targets by name are resolved by the OS at connect and not matched
+func isBlacklisted(target string) bool {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	blacklist.RLock()
+	defer blacklist.RUnlock()
+	for _, list := range [][]*net.IPNet{blacklist.static, blacklist.file, blacklist.admin} {
+		for _, cidr := range list {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blacklistTarget adds or removes an admin API entry
+func blacklistTarget(entry string, add bool) error {
+	cidr, err := parseBlacklistEntry(entry)
+	if err != nil {
+		return err
+	}
+	blacklist.Lock()
+	defer blacklist.Unlock()
+	for i, c := range blacklist.admin {
+		if c.String() == cidr.String() {
+			if !add {
+				blacklist.admin = append(blacklist.admin[:i:i], blacklist.admin[i+1:]...)
+				publishEvent("target.unblacklist", func() interface{} { return map[string]string{"address": cidr.String()} })
+			}
+			return nil
+		}
+	}
+	if !add {
+		return fmt.Errorf("`%s` is not blacklisted through the admin API", entry)
+	}
+	blacklist.admin = append(blacklist.admin, cidr)
+	publishEvent("target.blacklist", func() interface{} { return map[string]string{"address": cidr.String()} })
+	return nil
+}
+
+func listBlacklist() blacklistInfo {
+	strs := func(list []*net.IPNet) []string {
+		s := make([]string, 0, len(list))
+		for _, cidr := range list {
+			s = append(s, cidr.String())
+		}
+		sort.Strings(s)
+		return s
+	}
+	blacklist.RLock()
+	defer blacklist.RUnlock()
+	return blacklistInfo{strs(blacklist.static), strs(blacklist.file), strs(blacklist.admin)}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const copyBufferSize = 32 << 10
+
+// buffers accounts bytes read from one side of a connection and not yet
+// written to the other, which is what a slow receiver makes the proxy hold;
+// a connection holds at most a copy buffer per direction. Counters are
+// updated atomically, the lock is only taken to wait over -max-buffered
+var buffers = struct {
+	held   uint64
+	peak   uint64
+	pauses uint64 // reads delayed over -max-buffered
+	sync.Mutex
+	cond *sync.Cond
+}{}
+
+func init() {
+	buffers.cond = sync.NewCond(&buffers.Mutex)
+}
+
+// waitBuffered delays a read while -max-buffered bytes are held
+func waitBuffered() {
+	if atomic.LoadUint64(&buffers.held) < maxBuffered {
+		return
+	}
+	atomic.AddUint64(&buffers.pauses, 1)
+	buffers.Lock()
+	for atomic.LoadUint64(&buffers.held) >= maxBuffered {
+		buffers.cond.Wait()
+	}
+	buffers.Unlock()
+}
+
+func holdBuffered(c *trackedConn, n int) {
+	held := atomic.AddUint64(&buffers.held, uint64(n))
+	for peak := atomic.LoadUint64(&buffers.peak); held > peak; peak = atomic.LoadUint64(&buffers.peak) {
+		if atomic.CompareAndSwapUint64(&buffers.peak, peak, held) {
+			break
+		}
+	}
+	atomic.AddUint64(&c.buffered, uint64(n))
+	if c.limit != nil {
+		atomic.AddUint64(&c.limit.held, uint64(n))
+	}
+}
+
+func releaseBuffered(c *trackedConn, n int) {
+	atomic.AddUint64(&c.buffered, ^uint64(n-1))
+	atomic.AddUint64(&buffers.held, ^uint64(n-1))
+	if c.limit != nil {
+		c.limit.release(n)
+	}
+	if maxBuffered > 0 {
+		// under the lock so a reader about to wait doesn't miss it
+		buffers.Lock()
+		buffers.cond.Broadcast()
+		buffers.Unlock()
+	}
+}
+
+// copyBuffered is io.Copy accounting data between the read and the write,
+// the next read is delayed while the total held is over -max-buffered, or
+// the rule's held is over its -rule-limit, so the faster side is read no
+// faster than the slowest receivers drain
+func copyBuffered(dst io.Writer, src io.Reader, c *trackedConn) (written int64, err error) {
+	buf := make([]byte, copyBufferSize)
+	for {
+		if maxBuffered > 0 {
+			waitBuffered()
+		}
+		if c.limit != nil && c.limit.maxBuffered > 0 {
+			c.limit.waitBuffered()
+		}
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			holdBuffered(c, n)
+			w, werr := dst.Write(buf[:n])
+			releaseBuffered(c, n)
+			written += int64(w)
+			if werr == nil && w != n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// bufferStats returns bytes held now, the high watermark and the number of
+// reads delayed
+func bufferStats() (held, peak, pauses uint64) {
+	return atomic.LoadUint64(&buffers.held), atomic.LoadUint64(&buffers.peak), atomic.LoadUint64(&buffers.pauses)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackedConn is a live TCP connection or UDP session in the connection table
+type trackedConn struct {
+	id       uint64
+	proto    string
+	client   string
+	local    string // listener address the client connected to
+	target   string
+	rule     string // forwarding rule, see ruleOf
+	limit    *ruleLimit
+	started  time.Time
+	bytesIn  uint64 // client to target, updated atomically
+	bytesOut uint64 // target to client, updated atomically
+	pktsIn   uint64 // reads or datagrams from the client, updated atomically
+	pktsOut  uint64 // reads or datagrams from the target, updated atomically
+	active   int64  // unix nanoseconds of last transfer, updated atomically
+	buffered uint64 // read and not yet written, updated atomically
+	ja3      string // TLS client fingerprints, set under connTable lock
+	ja4      string
+	spliced  bool   // forwarded by the kernel, set under connTable lock
+	topIn    uint64 // bytes counted in top talkers, under topTalkers lock
+	topOut   uint64
+	// why it was closed, for -udp-session-log and -on-close; set under
+	// connTable lock
+	closeReason string
+	close       func()
+}
+
+type connInfo struct {
+	Id       uint64  `json:"id"`
+	Proto    string  `json:"proto"`
+	Client   string  `json:"client"`
+	Target   string  `json:"target"`
+	Rule     string  `json:"rule"`
+	Age      float64 `json:"age"`
+	Idle     float64 `json:"idle"`
+	BytesIn  uint64  `json:"bytes_in"`
+	BytesOut uint64  `json:"bytes_out"`
+	Buffered uint64  `json:"buffered"`
+	Ja3      string  `json:"ja3,omitempty"`
+	Ja4      string  `json:"ja4,omitempty"`
+}
+
+var connTable = struct {
+	sync.Mutex
+	conns map[uint64]*trackedConn
+}{conns: make(map[uint64]*trackedConn)}
+
+func trackConn(id uint64, proto, client, local, target string, close func()) *trackedConn {
+	now := time.Now()
+	c := &trackedConn{id: id, proto: proto, client: client, local: local, target: target, rule: ruleOf(local), started: now, active: now.UnixNano(), close: close}
+	c.limit = ruleLimits[c.rule]
+	if c.limit != nil && proto == "tcp" {
+		atomic.AddInt64(&c.limit.live, 1)
+	}
+	if zoneMaxConns > 0 && proto == "tcp" {
+		zoneConnOpened(target)
+	}
+	connTable.Lock()
+	connTable.conns[id] = c
+	connTable.Unlock()
+	accountOpen(c)
+	publishEvent("conn.open", func() interface{} {
+		return map[string]interface{}{"id": id, "proto": proto, "client": client, "target": target, "rule": c.rule}
+	})
+	if onOpen != "" {
+		runOpenHook(c)
+	}
+	return c
+}
+
+// idle returns the time since the last transfer
+func (c *trackedConn) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.active)))
+}
+
+func untrackConn(id uint64) {
+	connTable.Lock()
+	c, ok := connTable.conns[id]
+	delete(connTable.conns, id)
+	connTable.Unlock()
+	if ok {
+		if c.limit != nil && c.proto == "tcp" {
+			atomic.AddInt64(&c.limit.live, -1)
+		}
+		if zoneMaxConns > 0 && c.proto == "tcp" {
+			zoneConnClosed(c.target)
+		}
+		accountClose(c)
+		publishEvent("conn.close", func() interface{} {
+			return map[string]interface{}{"id": id, "proto": c.proto, "client": c.client, "target": c.target, "rule": c.rule,
+				"age": time.Since(c.started).Seconds(), "bytes_in": atomic.LoadUint64(&c.bytesIn), "bytes_out": atomic.LoadUint64(&c.bytesOut)}
+		})
+		if flowCollector != "" {
+			exportFlow(c)
+		}
+		if udpSessionLog && c.proto == "udp" {
+			logUdpSession(c)
+		}
+		if onClose != "" {
+			runCloseHook(c)
+		}
+	}
+}
+
+func (c *trackedConn) setFingerprint(ja3, ja4 string) {
+	connTable.Lock()
+	c.ja3, c.ja4 = ja3, ja4
+	connTable.Unlock()
+}
+
+func (c *trackedConn) setSpliced() {
+	connTable.Lock()
+	c.spliced = true
+	connTable.Unlock()
+}
+
+func (c *trackedConn) transferred(in, out int) {
+	if in > 0 {
+		atomic.AddUint64(&c.bytesIn, uint64(in))
+		atomic.AddUint64(&c.pktsIn, 1)
+	}
+	if out > 0 {
+		atomic.AddUint64(&c.bytesOut, uint64(out))
+		atomic.AddUint64(&c.pktsOut, 1)
+	}
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+}
+
+// countingReader accounts bytes read from the client (in) or the target
+// (!in) to the tracked connection
+type countingReader struct {
+	r  io.Reader
+	c  *trackedConn
+	in bool
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if r.in {
+			r.c.transferred(n, 0)
+		} else {
+			r.c.transferred(0, n)
+		}
+		r.c.sample(r.in, p[:n])
+	}
+	return n, err
+}
+
+// splicedBytes accounts bytes the kernel forwarded, given as totals received
+// from the client (in) and the target (out)
+func (c *trackedConn) splicedBytes(in, out uint64) {
+	if counted := atomic.LoadUint64(&c.bytesIn); in > counted {
+		atomic.AddUint64(&c.bytesIn, in-counted)
+	}
+	if counted := atomic.LoadUint64(&c.bytesOut); out > counted {
+		atomic.AddUint64(&c.bytesOut, out-counted)
+	}
+}
+
+func listConns() []connInfo {
+	now := time.Now()
+	connTable.Lock()
+	list := make([]connInfo, 0, len(connTable.conns))
+	for _, c := range connTable.conns {
+		list = append(list, connInfo{
+			Id:       c.id,
+			Proto:    c.proto,
+			Client:   c.client,
+			Target:   c.target,
+			Rule:     c.rule,
+			Age:      now.Sub(c.started).Seconds(),
+			Idle:     c.idle(now).Seconds(),
+			BytesIn:  atomic.LoadUint64(&c.bytesIn),
+			BytesOut: atomic.LoadUint64(&c.bytesOut),
+			Buffered: atomic.LoadUint64(&c.buffered),
+			Ja3:      c.ja3,
+			Ja4:      c.ja4,
+		})
+	}
+	connTable.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// killConns forcefully closes the connection with the given ID, or all
+// connections to the target when id is 0; returns number of closed connections
+func killConns(id uint64, target string) int {
+	var kill []*trackedConn
+	connTable.Lock()
+	for _, c := range connTable.conns {
+		if (id != 0 && c.id == id) || (id == 0 && target != "" && c.target == target) {
+			kill = append(kill, c)
+		}
+	}
+	connTable.Unlock()
+	for _, c := range kill {
+		c.close()
+	}
+	return len(kill)
+}
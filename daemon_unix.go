@@ -0,0 +1,101 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// set in the environment of the re-executed daemon process
+const daemonEnv = "GOPROXY_DAEMON"
+
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// daemonize re-executes goproxy in a new session detached from the terminal
+// and exits once the child is listening, or with the exit status of the
+// child when it fails to start; startup errors and the announced address of
+// the child are printed
+func daemonize() {
+	r, w, err := os.Pipe()
+	if err != nil {
+		fatalf(errOther, "Failed to daemonize: %v\n", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fatalf(errOther, "Failed to daemonize: %v\n", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fatalf(errOther, "Failed to daemonize: %v\n", err)
+	}
+	w.Close()
+	if n, _ := r.Read(make([]byte, 1)); n == 0 {
+		cmd.Wait()
+		if code := cmd.ProcessState.ExitCode(); code > 0 {
+			os.Exit(code)
+		}
+		os.Exit(1)
+	}
+	if verbose.Load() {
+		log.Printf("Started daemon with PID %d\n", cmd.Process.Pid)
+	}
+	os.Exit(0)
+}
+
+// notifyReady tells the parent of a daemon that startup succeeded and
+// detaches from the terminal
+func notifyReady() {
+	if !isDaemonChild() {
+		return
+	}
+	ready := os.NewFile(3, "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		log.Printf("Failed to open `%s`: %v\n", os.DevNull, err)
+		return
+	}
+	for fd := 0; fd <= 2; fd++ {
+		unix.Dup2(int(null.Fd()), fd)
+	}
+	null.Close()
+}
+
+// notifyShutdown drains connections on SIGTERM or SIGINT, which also marks
+// -health-file unhealthy, releases the -leader lease, saves -stats-file and
+// removes the PID file and the admin API socket; a second signal exits
+// immediately
+func notifyShutdown() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-c
+		if verbose.Load() {
+			log.Printf("Received %v, exiting\n", sig)
+		}
+		go func() {
+			<-c
+			removePidFile()
+			removeAdminSocket()
+			os.Exit(1)
+		}()
+		drain(drainTimeout)
+	}()
+}
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// dnsDenyClasses are the address classes -dns-deny accepts by name besides
+// CIDRs
+var dnsDenyClasses = map[string][]string{
+	"unspecified": {"0.0.0.0/8", "::/128"},
+	"loopback":    {"127.0.0.0/8", "::1/128"},
+	"link-local":  {"169.254.0.0/16", "fe80::/10"},
+	"multicast":   {"224.0.0.0/4", "ff00::/8"},
+	"private":     {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"},
+}
+
+// dnsDeny is the list of networks resolved target addresses are dropped from
+var dnsDeny []*net.IPNet
+
+// parseDnsDeny parses comma-separated CIDRs and address class names
+func parseDnsDeny(list string) error {
+	for _, entry := range parseTargetList(list) {
+		cidrs, ok := dnsDenyClasses[strings.ToLower(entry)]
+		if !ok {
+			if !strings.Contains(entry, "/") {
+				return fmt.Errorf("expected CIDR or one of unspecified, loopback, link-local, multicast, private, got `%s`", entry)
+			}
+			cidrs = []string{entry}
+		}
+		for _, c := range cidrs {
+			_, cidr, err := net.ParseCIDR(c)
+			if err != nil {
+				return err
+			}
+			dnsDeny = append(dnsDeny, cidr)
+		}
+	}
+	return nil
+}
+
+// dnsDenied reports whether a resolved address must not become a target
+func dnsDenied(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range dnsDeny {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterDnsDeny drops the addresses of name in -dns-deny, which most likely
+// come from a DNS or service registry misconfiguration
+func filterDnsDeny(name string, ips []HostPort) []HostPort {
+	kept := ips[:0]
+	for _, ip := range ips {
+		if dnsDenied(ip.host) {
+			log.Printf("Dropping `%s` resolved for `%s`, denied by -dns-deny error=dns\n", ip.host, name)
+			continue
+		}
+		kept = append(kept, ip)
+	}
+	return kept
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// how long a client that received a truncated UDP response is pinned to the
+// target that served it, so the TCP retry lands on the same backend
+const dnsAffinityTtl = 30 * time.Second
+
+// queries in flight at most, a quarter of the ID space so a free upstream ID
+// is found in a few tries; more are answered with SERVFAIL
+const dnsMaxPending = 16384
+
+type dnsQuery struct {
+	conn     uint64
+	listener *net.UDPConn
+	client   *net.UDPAddr
+	id       uint16 // query ID as sent by the client
+	name     string
+	msg      []byte
+	roll     uint
+	tried    []string     // target addresses as configured, the last one is current
+	target   *net.UDPAddr // the current target resolved
+	timer    *time.Timer
+}
+
+type dnsAffinity struct {
+	target  string
+	expires time.Time
+}
+
+type dnsBalancer struct {
+	listeners []*net.UDPConn
+	upstream  *net.UDPConn
+
+	mu       sync.Mutex
+	targets  []Target
+	addrs    map[string]*net.UDPAddr
+	next     uint
+	pending  map[uint16]*dnsQuery
+	affinity map[string]dnsAffinity
+}
+
+func newDnsBalancer(listeners []*net.UDPConn) *dnsBalancer {
+	conn, err := listenUpstream()
+	if err != nil {
+		fatalf(errBind, "Failed to setup upstream UDP socket: %v\n", err)
+	}
+	return &dnsBalancer{
+		listeners: listeners,
+		upstream:  conn,
+		pending:   make(map[uint16]*dnsQuery),
+		affinity:  make(map[string]dnsAffinity),
+	}
+}
+
+// manage consumes target updates and passes them on to the TCP manager,
+// which serves the TCP fallback for truncated responses
+func (lb *dnsBalancer) manage(ctx context.Context, resolver chan []Target, tcpResolver chan []Target) {
+	for _, listener := range lb.listeners {
+		go lb.readQueries(listener)
+	}
+	go lb.readResponses()
+	go lb.expireAffinity(ctx)
+	for {
+		var connectTo []Target
+		select {
+		case <-ctx.Done():
+			// stops readResponses
+			lb.upstream.Close()
+			return
+		case connectTo = <-resolver:
+		}
+		var targets []Target
+		addrs := make(map[string]*net.UDPAddr)
+		for _, target := range connectTo {
+			addr, err := net.ResolveUDPAddr("udp", nat64Addr(ctx, target.Addr))
+			if err != nil {
+				log.Printf("Error resolving `%s`: %v error=dns\n", target, err)
+				continue
+			}
+			targets = append(targets, target)
+			addrs[target.Addr] = addr
+		}
+		lb.mu.Lock()
+		lb.targets = targets
+		lb.addrs = addrs
+		lb.mu.Unlock()
+		setTargets(connectTo)
+		select {
+		case tcpResolver <- connectTo:
+		case <-ctx.Done():
+		}
+	}
+}
+
+func (lb *dnsBalancer) readQueries(listener *net.UDPConn) {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, client, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("Failed to read DNS query: %v\n", err)
+			if strings.Contains(err.Error(), "closed network connection") {
+				return
+			}
+			continue
+		}
+		req := &dns.Msg{}
+		if err := req.Unpack(buf[:n]); err != nil || req.Response || len(req.Question) == 0 {
+			if debug.Load() {
+				log.Printf("Dropping malformed DNS query from `%s`: %v\n", client, err)
+			}
+			continue
+		}
+		if isBanned(client) {
+			if debug.Load() {
+				log.Printf("Client `%s` is banned, dropping DNS query\n", client)
+			}
+			continue
+		}
+		if !accessAllowed(client, listener.LocalAddr()) {
+			if debug.Load() {
+				log.Printf("Client `%s` is not allowed at this time, dropping DNS query\n", client)
+			}
+			continue
+		}
+		if !geoAllowed(client) {
+			if debug.Load() {
+				log.Printf("Client `%s` country is not allowed, dropping DNS query\n", client)
+			}
+			continue
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		q := &dnsQuery{conn: newConnId(), listener: listener, client: client, id: req.Id, name: req.Question[0].Name, msg: msg}
+
+		lb.mu.Lock()
+		q.roll = uint(rand.Uint32())
+		lb.send(q)
+		lb.mu.Unlock()
+	}
+}
+
+// send transmits the query to the next untried target; lb.mu must be held
+func (lb *dnsBalancer) send(q *dnsQuery) {
+	var untried []Target
+	for _, target := range groupTargets(lb.targets, q.roll, q.client, q.listener.LocalAddr()) {
+		tried := false
+		for _, t := range q.tried {
+			if t == target.Addr {
+				tried = true
+				break
+			}
+		}
+		if !tried {
+			untried = append(untried, target)
+		}
+	}
+	target := pickTarget(untried)
+	if target == "" {
+		if len(q.tried) == 0 {
+			if debug.Load() {
+				log.Printf("[%d] Don't know where to send DNS query for `%s`, dropping\n", q.conn, q.name)
+			}
+		} else if verbose.Load() {
+			log.Printf("[%d] DNS query for `%s` from `%s` timed out on all targets\n", q.conn, q.name, q.client)
+		}
+		return
+	}
+	q.tried = append(q.tried, target)
+	q.target = lb.addrs[target]
+	if q.target == nil {
+		// canary targets are resolved on first use
+		addr, err := net.ResolveUDPAddr("udp", nat64Addr(context.Background(), target))
+		if err != nil {
+			log.Printf("[%d] Error resolving `%s`: %v error=dns\n", q.conn, target, err)
+			lb.send(q)
+			return
+		}
+		lb.addrs[target] = addr
+		q.target = addr
+	}
+
+	if len(lb.pending) >= dnsMaxPending {
+		if verbose.Load() {
+			log.Printf("[%d] Too many DNS queries in flight, answering `%s` from `%s` with SERVFAIL\n", q.conn, q.name, q.client)
+		}
+		lb.fail(q)
+		return
+	}
+	id := dns.Id()
+	for lb.pending[id] != nil {
+		id = dns.Id()
+	}
+	binary.BigEndian.PutUint16(q.msg, id)
+	lb.pending[id] = q
+	q.timer = time.AfterFunc(dnsLbTimeout, func() {
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		if lb.pending[id] != q {
+			return
+		}
+		delete(lb.pending, id)
+		if debug.Load() {
+			log.Printf("[%d] DNS query for `%s` to `%s` timed out, retransmitting\n", q.conn, q.name, q.target)
+		}
+		lb.send(q)
+	})
+
+	if debug.Load() {
+		log.Printf("[%d] Forwarding DNS query for `%s` from `%s` to `%s`\n", q.conn, q.name, q.client, q.target)
+	}
+	if _, err := lb.upstream.WriteToUDP(q.msg, q.target); err != nil {
+		log.Printf("[%d] Failed to send DNS query to `%s`: %v\n", q.conn, q.target, err)
+	}
+}
+
+// fail answers the client's query with SERVFAIL
+func (lb *dnsBalancer) fail(q *dnsQuery) {
+	req := &dns.Msg{}
+	if err := req.Unpack(q.msg); err != nil {
+		return
+	}
+	resp := &dns.Msg{}
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	resp.Id = q.id
+	msg, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	if _, err := q.listener.WriteToUDP(msg, q.client); err != nil {
+		log.Printf("[%d] Failed to send DNS response to `%s`: %v\n", q.conn, q.client, err)
+	}
+}
+
+func (lb *dnsBalancer) readResponses() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, from, err := lb.upstream.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("Failed to read DNS response: %v\n", err)
+			if strings.Contains(err.Error(), "closed network connection") {
+				return
+			}
+			continue
+		}
+		resp := &dns.Msg{}
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response {
+			if debug.Load() {
+				log.Printf("Dropping malformed DNS response from `%s`: %v\n", from, err)
+			}
+			continue
+		}
+
+		lb.mu.Lock()
+		q := lb.pending[resp.Id]
+		if q == nil || !q.target.IP.Equal(from.IP) || q.target.Port != from.Port ||
+			len(resp.Question) == 0 || !strings.EqualFold(resp.Question[0].Name, q.name) {
+			lb.mu.Unlock()
+			if debug.Load() {
+				log.Printf("Dropping unexpected DNS response from `%s` with ID %d\n", from, resp.Id)
+			}
+			continue
+		}
+		delete(lb.pending, resp.Id)
+		q.timer.Stop()
+		if resp.Truncated {
+			lb.affinity[q.client.IP.String()] = dnsAffinity{q.tried[len(q.tried)-1], time.Now().Add(dnsAffinityTtl)}
+		}
+		lb.mu.Unlock()
+
+		binary.BigEndian.PutUint16(buf, q.id)
+		if _, err := q.listener.WriteToUDP(buf[:n], q.client); err != nil {
+			log.Printf("[%d] Failed to send DNS response to `%s`: %v\n", q.conn, q.client, err)
+		}
+	}
+}
+
+// pinned returns the target that served a truncated UDP response to the
+// client, if any, so the TCP retry goes to the same backend
+func (lb *dnsBalancer) pinned(conn net.Conn) string {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	client := addr.IP.String()
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	a, ok := lb.affinity[client]
+	if !ok {
+		return ""
+	}
+	if time.Now().After(a.expires) {
+		delete(lb.affinity, client)
+		return ""
+	}
+	return a.target
+}
+
+func (lb *dnsBalancer) expireAffinity(ctx context.Context) {
+	ticker := systemClock.NewTicker(dnsAffinityTtl)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.Chan():
+		}
+		lb.mu.Lock()
+		for client, a := range lb.affinity {
+			if now.After(a.expires) {
+				delete(lb.affinity, client)
+			}
+		}
+		lb.mu.Unlock()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix prefixes environment variables setting flags, e.g.
+// GOPROXY_DNS_INTERVAL for -dns-interval
+const envPrefix = "GOPROXY_"
+
+// flagEnv returns the environment variable of a flag
+func flagEnv(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets flags not given on the command line from their environment
+// variables; repeatable flags take one value per line
+func applyEnv(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		value, ok := os.LookupEnv(flagEnv(f.Name))
+		if !ok {
+			return
+		}
+		values := []string{value}
+		if _, repeated := f.Value.(*stringList); repeated {
+			values = strings.Split(strings.TrimSpace(value), "\n")
+		}
+		for _, v := range values {
+			if e := fs.Set(f.Name, strings.TrimSpace(v)); e != nil {
+				err = fmt.Errorf("%s=`%s`: %v", flagEnv(f.Name), v, e)
+				return
+			}
+		}
+	})
+	return err
+}
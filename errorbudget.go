@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errorBudget tracks connection attempts and errors per target, failed
+// connects and, with -first-byte-timeout, targets not answering, over a
+// rolling -error-window; a target over -error-budget is flagged alerting
+// until its error rate falls back within budget
+var errorBudget = struct {
+	sync.Mutex
+	budget  float64 // fraction of attempts, 0 when disabled
+	targets map[string]*targetErrors
+}{targets: make(map[string]*targetErrors)}
+
+// targetErrors counts the current window and the previous one, weighted by
+// how much of it is still within the rolling window
+type targetErrors struct {
+	start          time.Time
+	attempts, errs uint64
+	prevAttempts   uint64
+	prevErrs       uint64
+	alerting       bool
+}
+
+// parseErrorBudget parses a percentage such as 5% or 0.5%
+func parseErrorBudget(spec string) error {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(spec, "%"), 64)
+	if err != nil || !strings.HasSuffix(spec, "%") || p <= 0 || p > 100 {
+		return fmt.Errorf("expected percentage of connection attempts, got `%s`", spec)
+	}
+	errorBudget.budget = p / 100
+	return nil
+}
+
+// rate returns the rolling error rate and the attempts it is based on
+func (t *targetErrors) rate(now time.Time) (float64, float64) {
+	if elapsed := now.Sub(t.start); elapsed >= 2*errorWindow {
+		t.start, t.attempts, t.errs, t.prevAttempts, t.prevErrs = now, 0, 0, 0, 0
+	} else if elapsed >= errorWindow {
+		t.start = t.start.Add(errorWindow)
+		t.prevAttempts, t.prevErrs, t.attempts, t.errs = t.attempts, t.errs, 0, 0
+	}
+	weight := 1 - float64(now.Sub(t.start))/float64(errorWindow)
+	attempts := float64(t.attempts) + weight*float64(t.prevAttempts)
+	if attempts == 0 {
+		return 0, 0
+	}
+	return (float64(t.errs) + weight*float64(t.prevErrs)) / attempts, attempts
+}
+
+// recordAttempt counts a connection attempt to the target, failed or not
+func recordAttempt(target string, failed bool) {
+	recordTargetResult(target, 1, failed)
+}
+
+// recordNoAnswer counts an error of a target connected to before, which
+// didn't answer
+func recordNoAnswer(target string) {
+	recordTargetResult(target, 0, true)
+}
+
+func recordTargetResult(target string, attempts uint64, failed bool) {
+	if errorBudget.budget == 0 {
+		return
+	}
+	now := time.Now()
+	errorBudget.Lock()
+	defer errorBudget.Unlock()
+	t := errorBudget.targets[target]
+	if t == nil {
+		t = &targetErrors{start: now}
+		errorBudget.targets[target] = t
+	}
+	t.rate(now)
+	t.attempts += attempts
+	if failed {
+		t.errs++
+	}
+	checkErrorBudget(target, t, now)
+}
+
+// checkErrorBudget flips the alerting state of the target when its error
+// rate crosses the budget; errorBudget must be locked
+func checkErrorBudget(target string, t *targetErrors, now time.Time) {
+	rate, attempts := t.rate(now)
+	alerting := t.alerting
+	if attempts >= float64(errorMin) {
+		alerting = rate > errorBudget.budget
+	} else if attempts == 0 {
+		alerting = false
+	}
+	if alerting == t.alerting {
+		return
+	}
+	t.alerting = alerting
+	typ := "target.recover"
+	if alerting {
+		typ = "target.alert"
+		log.Printf("Target `%s` error rate %.1f%% over %v is over budget of %.1f%%\n", target, rate*100, errorWindow, errorBudget.budget*100)
+	} else {
+		log.Printf("Target `%s` error rate %.1f%% over %v is back within budget\n", target, rate*100, errorWindow)
+	}
+	data := map[string]interface{}{"target": target, "error_rate": rate, "budget": errorBudget.budget, "attempts": attempts}
+	publishEvent(typ, func() interface{} { return data })
+	if alertWebhook != "" {
+		go postWebhook(event{now, typ, data})
+	}
+}
+
+// expireErrorBudgets re-evaluates targets without new attempts, so a target
+// taken out of rotation recovers, and forgets targets idle for long
+func expireErrorBudgets(ctx context.Context) {
+	ticker := systemClock.NewTicker(errorWindow / 4)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.Chan():
+		}
+		errorBudget.Lock()
+		for target, t := range errorBudget.targets {
+			checkErrorBudget(target, t, now)
+			if t.attempts == 0 && t.prevAttempts == 0 {
+				delete(errorBudget.targets, target)
+			}
+		}
+		errorBudget.Unlock()
+	}
+}
+
+// targetErrorRate returns the rolling error rate of the target and whether
+// it is over budget
+func targetErrorRate(target string) (float64, bool) {
+	errorBudget.Lock()
+	defer errorBudget.Unlock()
+	t := errorBudget.targets[target]
+	if t == nil {
+		return 0, false
+	}
+	rate, _ := t.rate(time.Now())
+	return rate, t.alerting
+}
+
+// postWebhook sends the event as JSON to -alert-webhook
+func postWebhook(e event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode `%s` webhook: %v\n", e.Type, err)
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(alertWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to post `%s` webhook: %v\n", e.Type, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Webhook `%s` returned %s for `%s`\n", alertWebhook, resp.Status, e.Type)
+	}
+}
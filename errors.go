@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// errorKind categorizes failures so supervisors and alerting can tell, e.g.,
+// a port already in use from a backend being down: fatal errors exit with
+// the code of their kind, and failures are logged with an `error=kind` field
+type errorKind int
+
+const (
+	errOther errorKind = iota
+	errConfig
+	errBind
+	errDns
+	errDial
+)
+
+var errorKinds = [...]struct {
+	name string
+	exit int
+}{
+	errOther:  {"other", 1},
+	errConfig: {"config", 2},
+	errBind:   {"bind", 3},
+	errDns:    {"dns", 4},
+	errDial:   {"dial", 5},
+}
+
+func (k errorKind) String() string {
+	return errorKinds[k].name
+}
+
+// fatalf logs the message with the error kind field and exits with the exit
+// code of the kind
+func fatalf(kind errorKind, format string, v ...interface{}) {
+	log.Printf("%s error=%s\n", strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"), kind)
+	os.Exit(errorKinds[kind].exit)
+}
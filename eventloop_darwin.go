@@ -0,0 +1,65 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// poller waits for sockets with kqueue, a read and a write filter per
+// socket enabled as needed
+type poller struct {
+	fd     int
+	events []unix.Kevent_t
+}
+
+func newPoller() (*poller, error) {
+	fd, err := unix.Kqueue()
+	if err != nil {
+		return nil, err
+	}
+	unix.CloseOnExec(fd)
+	return &poller{fd: fd, events: make([]unix.Kevent_t, loopEvents)}, nil
+}
+
+func (p *poller) close() {
+	unix.Close(p.fd)
+}
+
+func (p *poller) change(fd int, read, write uint16) error {
+	changes := make([]unix.Kevent_t, 2)
+	unix.SetKevent(&changes[0], fd, unix.EVFILT_READ, int(read))
+	unix.SetKevent(&changes[1], fd, unix.EVFILT_WRITE, int(write))
+	_, err := unix.Kevent(p.fd, changes, nil, nil)
+	return err
+}
+
+func (p *poller) add(fd int) error {
+	return p.change(fd, unix.EV_ADD, unix.EV_ADD|unix.EV_DISABLE)
+}
+
+func (p *poller) modify(fd int, read, write bool) error {
+	flag := func(enable bool) uint16 {
+		if enable {
+			return unix.EV_ENABLE
+		}
+		return unix.EV_DISABLE
+	}
+	return p.change(fd, flag(read), flag(write))
+}
+
+func (p *poller) remove(fd int) error {
+	return p.change(fd, unix.EV_DELETE, unix.EV_DELETE)
+}
+
+func (p *poller) wait(events []loopEvent) (int, error) {
+	n, err := unix.Kevent(p.fd, nil, p.events[:len(events)], nil)
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range p.events[:n] {
+		events[i] = loopEvent{
+			fd:       int(e.Ident),
+			readable: e.Filter == unix.EVFILT_READ,
+			writable: e.Filter == unix.EVFILT_WRITE,
+			hangup:   e.Flags&unix.EV_ERROR != 0,
+		}
+	}
+	return n, nil
+}
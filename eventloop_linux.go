@@ -0,0 +1,56 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// poller waits for sockets with epoll, level-triggered
+type poller struct {
+	fd     int
+	events []unix.EpollEvent
+}
+
+func newPoller() (*poller, error) {
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &poller{fd: fd, events: make([]unix.EpollEvent, loopEvents)}, nil
+}
+
+func (p *poller) close() {
+	unix.Close(p.fd)
+}
+
+func (p *poller) add(fd int) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)})
+}
+
+func (p *poller) modify(fd int, read, write bool) error {
+	var events uint32
+	if read {
+		events |= unix.EPOLLIN
+	}
+	if write {
+		events |= unix.EPOLLOUT
+	}
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Events: events, Fd: int32(fd)})
+}
+
+func (p *poller) remove(fd int) error {
+	return unix.EpollCtl(p.fd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (p *poller) wait(events []loopEvent) (int, error) {
+	n, err := unix.EpollWait(p.fd, p.events[:len(events)], -1)
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range p.events[:n] {
+		events[i] = loopEvent{
+			fd:       int(e.Fd),
+			readable: e.Events&unix.EPOLLIN != 0,
+			writable: e.Events&unix.EPOLLOUT != 0,
+			hangup:   e.Events&(unix.EPOLLERR|unix.EPOLLHUP) != 0,
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"log"
+	"net"
+)
+
+type loopSocket struct{}
+
+type loopPair struct{}
+
+func initEventLoop() {
+	log.Printf("Event loop is only supported on Linux and macOS, forwarding with goroutines\n")
+}
+
+func loopReceive(id uint64, conn net.Conn, received func(p []byte, err error) bool) *loopSocket {
+	return nil
+}
+
+func (s *loopSocket) stop() {}
+
+func loopForward(id uint64, client, target net.Conn, c *trackedConn, close func()) *loopPair {
+	return nil
+}
+
+func (p *loopPair) stop() {}
@@ -0,0 +1,374 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// loopWorkers are the event loop workers of -event-loop, one per CPU,
+// sockets are spread over them by connection id
+var loopWorkers []*loopWorker
+
+const (
+	loopBufSize = 64 << 10 // fits any UDP datagram
+	loopEvents  = 256
+	// loopBatch is the number of reads of a socket per readiness, so a
+	// busy connection can't starve the others of its worker
+	loopBatch = 16
+)
+
+type loopEvent struct {
+	fd                         int
+	readable, writable, hangup bool
+}
+
+// loopWorker waits for the sockets registered with it to be ready and calls
+// their handlers, from one goroutine reading into one buffer
+type loopWorker struct {
+	poller  *poller
+	buf     []byte
+	mu      sync.Mutex
+	sockets map[int]*loopSocket // by descriptor
+}
+
+// loopSocket is a connection registered with a worker; its descriptor is
+// used through the runtime, so a connection closed meanwhile fails reads
+// and writes rather than reaching a reused descriptor
+type loopSocket struct {
+	w           *loopWorker
+	fd          int
+	raw         syscall.RawConn
+	ready       func(readable, writable, hangup bool)
+	read, write bool // readiness waited for
+}
+
+// initEventLoop starts the workers, when it fails connections are forwarded
+// by goroutines of their own as without -event-loop
+func initEventLoop() {
+	for i := 0; i < runtime.NumCPU(); i++ {
+		p, err := newPoller()
+		if err != nil {
+			log.Printf("Event loop is not available, forwarding with goroutines: %v\n", err)
+			for _, w := range loopWorkers {
+				w.poller.close()
+			}
+			loopWorkers = nil
+			return
+		}
+		loopWorkers = append(loopWorkers, &loopWorker{poller: p, buf: make([]byte, loopBufSize), sockets: make(map[int]*loopSocket)})
+	}
+	for _, w := range loopWorkers {
+		go w.run()
+	}
+	if verbose.Load() {
+		log.Printf("Forwarding with %d event loop workers\n", len(loopWorkers))
+	}
+}
+
+func (w *loopWorker) run() {
+	events := make([]loopEvent, loopEvents)
+	for {
+		n, err := w.poller.wait(events)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			log.Printf("Event loop failed: %v\n", err)
+			return
+		}
+		for _, e := range events[:n] {
+			w.mu.Lock()
+			s := w.sockets[e.fd]
+			w.mu.Unlock()
+			// a socket removed meanwhile, or one reusing its descriptor
+			// that isn't ready, finds nothing to do
+			if s != nil {
+				s.ready(e.readable, e.writable, e.hangup)
+			}
+		}
+	}
+}
+
+// add registers a connection waiting for it to be readable, nil when the
+// connection has no descriptor of its own
+func (w *loopWorker) add(conn net.Conn, ready func(readable, writable, hangup bool)) *loopSocket {
+	sc, ok := unwrapFd(conn).(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	s := &loopSocket{w: w, raw: raw, ready: ready, read: true}
+	if ctlErr := raw.Control(func(fd uintptr) {
+		s.fd = int(fd)
+		w.mu.Lock()
+		if err = w.poller.add(s.fd); err == nil {
+			w.sockets[s.fd] = s
+		}
+		w.mu.Unlock()
+	}); ctlErr != nil {
+		err = ctlErr
+	}
+	if err != nil {
+		if debug.Load() {
+			log.Printf("Failed to add connection to event loop: %v\n", err)
+		}
+		return nil
+	}
+	return s
+}
+
+// watch changes the readiness waited for
+func (s *loopSocket) watch(read, write bool) {
+	if s.read == read && s.write == write {
+		return
+	}
+	s.read, s.write = read, write
+	s.raw.Control(func(fd uintptr) {
+		if err := s.w.poller.modify(int(fd), read, write); err != nil && debug.Load() {
+			log.Printf("Failed to watch connection in event loop: %v\n", err)
+		}
+	})
+}
+
+// stop removes the socket from its worker, before the connection is closed
+func (s *loopSocket) stop() {
+	if s == nil {
+		return
+	}
+	s.w.mu.Lock()
+	if s.w.sockets[s.fd] == s {
+		delete(s.w.sockets, s.fd)
+		s.raw.Control(func(fd uintptr) { s.w.poller.remove(int(fd)) })
+	}
+	s.w.mu.Unlock()
+}
+
+func (s *loopSocket) recv(p []byte) (n int, err error) {
+	if ctlErr := s.raw.Control(func(fd uintptr) {
+		for {
+			if n, err = unix.Read(int(fd), p); err != unix.EINTR {
+				return
+			}
+		}
+	}); ctlErr != nil {
+		return 0, ctlErr
+	}
+	return
+}
+
+func (s *loopSocket) send(p []byte) (n int, err error) {
+	if ctlErr := s.raw.Control(func(fd uintptr) {
+		for {
+			if n, err = unix.Write(int(fd), p); err != unix.EINTR {
+				return
+			}
+		}
+	}); ctlErr != nil {
+		return 0, ctlErr
+	}
+	if n < 0 {
+		n = 0
+	}
+	return
+}
+
+// loopReceive hands reads of a connection over to a worker, which calls
+// received with each datagram or error until it returns false; nil when the
+// connection is to be read by a goroutine
+func loopReceive(id uint64, conn net.Conn, received func(p []byte, err error) bool) *loopSocket {
+	if len(loopWorkers) == 0 {
+		return nil
+	}
+	w := loopWorkers[id%uint64(len(loopWorkers))]
+	var s *loopSocket
+	s = w.add(conn, func(readable, writable, hangup bool) {
+		for i := 0; i < loopBatch; i++ {
+			n, err := s.recv(w.buf)
+			if err == unix.EAGAIN {
+				return
+			}
+			if n < 0 {
+				n = 0
+			}
+			if !received(w.buf[:n], err) {
+				s.stop()
+				return
+			}
+		}
+	})
+	return s
+}
+
+// loopPair is a client and target connection pair forwarded by a worker;
+// data that can't be written right away is kept until the socket it goes
+// to is writable, reading what would follow it meanwhile
+type loopPair struct {
+	id      uint64
+	c       *trackedConn
+	client  net.Addr
+	socks   [2]*loopSocket // the client's and the target's
+	dirs    [2]loopDir     // from the client and from the target
+	mu      sync.Mutex
+	stopped bool
+	close   func()
+}
+
+type loopDir struct {
+	pending []byte
+	total   int64
+	err     error
+}
+
+// loopForward hands a pair over to a worker, close is called once either
+// direction ends; nil when the pair is to be copied by goroutines
+func loopForward(id uint64, client, target net.Conn, c *trackedConn, close func()) *loopPair {
+	if len(loopWorkers) == 0 {
+		return nil
+	}
+	_, ok1 := unwrapFd(client).(*net.TCPConn)
+	_, ok2 := unwrapFd(target).(*net.TCPConn)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	w := loopWorkers[id%uint64(len(loopWorkers))]
+	p := &loopPair{id: id, c: c, client: client.RemoteAddr(), close: close}
+	// the worker may call the handlers before both sockets are added
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, conn := range []net.Conn{client, target} {
+		i := i
+		if p.socks[i] = w.add(conn, func(readable, writable, hangup bool) { p.ready(i, readable, writable, hangup) }); p.socks[i] == nil {
+			// a handler of the first socket may be waiting for the lock,
+			// it must find the pair stopped before goroutines copy it
+			p.stopped = true
+			p.socks[0].stop()
+			return nil
+		}
+	}
+	return p
+}
+
+// ready forwards what socket i is ready for, only the worker calls it
+func (p *loopPair) ready(i int, readable, writable, hangup bool) {
+	p.mu.Lock()
+	stopped := p.stopped
+	p.mu.Unlock()
+	if stopped {
+		return
+	}
+	if hangup {
+		p.finish(i, unix.ECONNRESET)
+		return
+	}
+	if writable && p.dirs[1-i].pending != nil && !p.flush(1-i) {
+		return
+	}
+	if readable && p.dirs[i].pending == nil && !p.forward(i) {
+		return
+	}
+	for j, s := range p.socks {
+		s.watch(p.dirs[j].pending == nil, p.dirs[1-j].pending != nil)
+	}
+}
+
+// forward reads from socket i and writes to the other one, false once the
+// pair is finished
+func (p *loopPair) forward(i int) bool {
+	d, from, to := &p.dirs[i], p.socks[i], p.socks[1-i]
+	buf := from.w.buf
+	for n := 0; n < loopBatch; n++ {
+		r, err := from.recv(buf)
+		if err == unix.EAGAIN {
+			return true
+		}
+		if err != nil || r <= 0 {
+			p.finish(i, err)
+			return false
+		}
+		if i == 0 {
+			p.c.transferred(r, 0)
+		} else {
+			p.c.transferred(0, r)
+		}
+		w, err := to.send(buf[:r])
+		if err != nil && err != unix.EAGAIN {
+			p.finish(i, err)
+			return false
+		}
+		d.total += int64(w)
+		if w < r {
+			d.pending = append([]byte(nil), buf[w:r]...)
+			return true
+		}
+	}
+	return true
+}
+
+// flush writes what direction i kept, false once the pair is finished
+func (p *loopPair) flush(i int) bool {
+	d := &p.dirs[i]
+	w, err := p.socks[1-i].send(d.pending)
+	if err != nil && err != unix.EAGAIN {
+		p.finish(i, err)
+		return false
+	}
+	d.total += int64(w)
+	if d.pending = d.pending[w:]; len(d.pending) == 0 {
+		d.pending = nil
+	}
+	return true
+}
+
+// finish ends forwarding when direction i ends, as copying does the first
+// direction to end tells which side closed
+func (p *loopPair) finish(i int, err error) {
+	p.dirs[i].err = err
+	p.mu.Lock()
+	stopped := p.stopped
+	p.mu.Unlock()
+	if stopped {
+		return
+	}
+	if i == 0 {
+		p.c.setCloseReason("client")
+	} else {
+		p.c.setCloseReason("target")
+	}
+	p.stop()
+	go p.closed()
+}
+
+// stop ends forwarding of a pair, before its connections are closed
+func (p *loopPair) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	for _, s := range p.socks {
+		s.stop()
+	}
+}
+
+func (p *loopPair) closed() {
+	in, out := p.dirs[0], p.dirs[1]
+	if debug.Load() {
+		log.Printf("[%d] Incoming TCP connection closed: %v; %v bytes forwarded\n", p.id, in.err, in.total)
+		log.Printf("[%d] Outgoing TCP connection closed: %v; %v bytes forwarded\n", p.id, out.err, out.total)
+	}
+	if in.total == 0 {
+		recordClient(p.client, 0, 1, "empty connections")
+	}
+	p.close()
+}
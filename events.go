@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// events fans out control-plane and connection events to admin API
+// subscribers of /events; a subscriber too slow to keep up loses events
+// rather than stalling the proxy
+var events = struct {
+	sync.Mutex
+	subscribers map[chan event]bool
+	count       int32 // subscribers, read atomically to skip building events
+}{subscribers: make(map[chan event]bool)}
+
+const eventBuffer = 256
+
+type event struct {
+	Time time.Time   `json:"time"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// publishEvent sends an event to subscribers, data is built only when there
+// are any
+func publishEvent(typ string, data func() interface{}) {
+	if atomic.LoadInt32(&events.count) == 0 {
+		return
+	}
+	e := event{Time: time.Now(), Type: typ, Data: data()}
+	events.Lock()
+	for ch := range events.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	events.Unlock()
+}
+
+func subscribeEvents() chan event {
+	ch := make(chan event, eventBuffer)
+	events.Lock()
+	events.subscribers[ch] = true
+	atomic.StoreInt32(&events.count, int32(len(events.subscribers)))
+	events.Unlock()
+	return ch
+}
+
+func unsubscribeEvents(ch chan event) {
+	events.Lock()
+	delete(events.subscribers, ch)
+	atomic.StoreInt32(&events.count, int32(len(events.subscribers)))
+	events.Unlock()
+}
+
+// serveEvents streams events as Server-Sent Events, optionally only those
+// with a type prefix in the comma-separated `types` parameter, e.g. `conn,target`
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	var types []string
+	if v := r.FormValue("types"); v != "" {
+		types = strings.Split(v, ",")
+	}
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := systemClock.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.Chan():
+			// a comment line keeps idle proxies from closing the stream
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e := <-ch:
+			if !eventWanted(e.Type, types) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func eventWanted(typ string, types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, prefix := range types {
+		if typ == prefix || strings.HasPrefix(typ, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
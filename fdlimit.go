@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// fds estimates file descriptors in use as those open once listeners are
+// bound plus accepted and dialed connections not closed yet; counting open
+// descriptors on every connection would be too expensive
+var fds struct {
+	base  int64
+	limit int64
+	conns int64 // updated atomically
+}
+
+// fdConn counts its descriptor in the budget until closed
+type fdConn struct {
+	net.Conn
+	once sync.Once
+}
+
+// unwrapFd returns the connection counted by countFd
+func unwrapFd(conn net.Conn) net.Conn {
+	if c, ok := conn.(*fdConn); ok {
+		return c.Conn
+	}
+	return conn
+}
+
+func (c *fdConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(&fds.conns, -1) })
+	return c.Conn.Close()
+}
+
+// countFd wraps a new connection to count it in the budget
+func countFd(conn net.Conn) net.Conn {
+	if fds.limit == 0 || fdReserve <= 0 {
+		return conn
+	}
+	atomic.AddInt64(&fds.conns, 1)
+	return &fdConn{Conn: conn}
+}
+
+// initFdBudget records the descriptor limit and the descriptors in use once
+// listeners are bound
+func initFdBudget() {
+	limit, err := nofileLimit()
+	if err != nil {
+		if verbose.Load() {
+			log.Printf("Failed to get file descriptor limit, not tracking descriptors: %v\n", err)
+		}
+		return
+	}
+	fds.limit, fds.base = int64(limit), int64(countFds())
+	if verbose.Load() && fds.limit > 0 {
+		log.Printf("File descriptor limit %d, %d in use\n", fds.limit, fds.base)
+	}
+}
+
+// fdsExhausted reports whether a new connection would leave fewer than
+// -fd-reserve descriptors, counting the connection as shed if so
+func fdsExhausted() bool {
+	if fds.limit == 0 || fdReserve <= 0 {
+		return false
+	}
+	if fdsInUse()+int64(fdReserve) < fds.limit {
+		return false
+	}
+	accounting.Lock()
+	accounting.Shed++
+	accounting.Unlock()
+	return true
+}
+
+func fdsInUse() int64 {
+	return fds.base + atomic.LoadInt64(&fds.conns)
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+var errNofile = errors.New("file descriptor limit is only supported on Linux and macOS")
+
+func setNofile(n uint64) error {
+	return errNofile
+}
+
+func nofileLimit() (uint64, error) {
+	return 0, errNofile
+}
+
+func countFds() int {
+	return 0
+}
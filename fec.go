@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Forward error correction of the KCP transport of -mux: every group of
+// data packets is followed by parity packets computed with Reed-Solomon
+// coding over GF(2^8), so the receiver rebuilds lost data packets from any
+// data-many packets of the group instead of waiting for a retransmit. Each
+// packet starts with a 6-byte header: sequence number and type; the shard of
+// a data packet is the 2-byte length of the shard and the KCP packet, data
+// shards shorter than the longest of the group count as zero-padded.
+const (
+	fecHeaderSize = 6
+	fecData       = 0xf1
+	fecParity     = 0xf2
+	// groups the decoder keeps before and after the newest one, shards of
+	// older groups are dropped
+	fecGroups = 16
+)
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i], gfExp[i+255] = byte(x), byte(x)
+		gfLog[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*n%255]
+}
+
+// gfInvert returns the inverse of the square matrix by Gauss-Jordan
+// elimination
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for i, row := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], row)
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		inv := gfExp[255-int(gfLog[work[col][col]])]
+		for j := range work[col] {
+			work[col][j] = gfMul[inv][work[col][j]]
+		}
+		for i := 0; i < n; i++ {
+			if f := work[i][col]; i != col && f != 0 {
+				for j := range work[i] {
+					work[i][j] ^= gfMul[f][work[col][j]]
+				}
+			}
+		}
+	}
+	for i := range work {
+		work[i] = work[i][n:]
+	}
+	return work, nil
+}
+
+// fecMatrix returns the systematic encoding matrix with data+parity rows:
+// a Vandermonde matrix times the inverse of its top square, so the data
+// shards are sent as they are and any data-many rows are invertible
+func fecMatrix(data, parity int) [][]byte {
+	vandermonde := make([][]byte, data+parity)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, data)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, _ := gfInvert(vandermonde[:data])
+	m := make([][]byte, data+parity)
+	for r := range m {
+		m[r] = make([]byte, data)
+		for c := range m[r] {
+			var v byte
+			for k := 0; k < data; k++ {
+				v ^= gfMul[vandermonde[r][k]][top[k][c]]
+			}
+			m[r][c] = v
+		}
+	}
+	return m
+}
+
+// gfMulAdd adds shard times c to out
+func gfMulAdd(out []byte, c byte, shard []byte) {
+	row := &gfMul[c]
+	for i, b := range shard {
+		out[i] ^= row[b]
+	}
+}
+
+// parseFec parses -mux-fec data,parity, 0 parity turns it off
+func parseFec(s string) (data, parity int, err error) {
+	d, p, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected data,parity, got `%s`", s)
+	}
+	if data, err = strconv.Atoi(d); err != nil {
+		return 0, 0, err
+	}
+	if parity, err = strconv.Atoi(p); err != nil {
+		return 0, 0, err
+	}
+	if parity == 0 {
+		return 0, 0, nil
+	}
+	if data < 1 || parity < 0 || data+parity > 255 {
+		return 0, 0, fmt.Errorf("shards must be at least 1 data and at most 255 in all, got %d,%d", data, parity)
+	}
+	return data, parity, nil
+}
+
+type fecEncoder struct {
+	data, parity int
+	matrix       [][]byte
+	next         uint32   // sequence number of the next packet
+	shards       [][]byte // data shards of the current group
+	longest      int
+}
+
+func newFecEncoder(data, parity int) *fecEncoder {
+	return &fecEncoder{data: data, parity: parity, matrix: fecMatrix(data, parity)}
+}
+
+// encode returns the data packet carrying the KCP packet, followed by the
+// parity packets of the group when it is complete
+func (e *fecEncoder) encode(pkt []byte) [][]byte {
+	out := make([]byte, fecHeaderSize+2+len(pkt))
+	binary.LittleEndian.PutUint32(out, e.next)
+	binary.LittleEndian.PutUint16(out[4:], fecData)
+	binary.LittleEndian.PutUint16(out[6:], uint16(2+len(pkt)))
+	copy(out[8:], pkt)
+	e.next++
+	packets := [][]byte{out}
+	e.shards = append(e.shards, out[fecHeaderSize:])
+	if len(out)-fecHeaderSize > e.longest {
+		e.longest = len(out) - fecHeaderSize
+	}
+	if len(e.shards) < e.data {
+		return packets
+	}
+	for i := 0; i < e.parity; i++ {
+		p := make([]byte, fecHeaderSize+e.longest)
+		binary.LittleEndian.PutUint32(p, e.next)
+		binary.LittleEndian.PutUint16(p[4:], fecParity)
+		e.next++
+		for j, shard := range e.shards {
+			gfMulAdd(p[fecHeaderSize:], e.matrix[e.data+i][j], shard)
+		}
+		packets = append(packets, p)
+	}
+	e.shards, e.longest = e.shards[:0], 0
+	// restart at a group boundary before the sequence number wraps
+	if e.next > math.MaxUint32-uint32(e.data+e.parity) {
+		e.next = 0
+	}
+	return packets
+}
+
+type fecGroup struct {
+	shards [][]byte // nil when not received
+	count  int
+	done   bool // all data shards were received or recovered
+}
+
+type fecDecoder struct {
+	data, parity int
+	matrix       [][]byte
+	groups       map[uint32]*fecGroup
+	newest       uint32
+}
+
+func newFecDecoder(data, parity int) *fecDecoder {
+	return &fecDecoder{data: data, parity: parity, matrix: fecMatrix(data, parity), groups: make(map[uint32]*fecGroup)}
+}
+
+// fecPayload returns the KCP packet of a data shard
+func fecPayload(shard []byte) []byte {
+	if len(shard) < 2 {
+		return nil
+	}
+	n := int(binary.LittleEndian.Uint16(shard))
+	if n < 2 || n > len(shard) {
+		return nil
+	}
+	return shard[2:n]
+}
+
+// decode returns the KCP packet of a data packet and those of the data
+// packets the packet lets recover
+func (d *fecDecoder) decode(pkt []byte) [][]byte {
+	if len(pkt) < fecHeaderSize {
+		return nil
+	}
+	seq, typ := binary.LittleEndian.Uint32(pkt), binary.LittleEndian.Uint16(pkt[4:])
+	n := uint32(d.data + d.parity)
+	base, i := seq-seq%n, int(seq%n)
+	if typ != fecData && typ != fecParity || (typ == fecData) != (i < d.data) {
+		return nil
+	}
+	shard := pkt[fecHeaderSize:]
+	var out [][]byte
+	if typ == fecData {
+		if payload := fecPayload(shard); payload != nil {
+			out = append(out, payload)
+		}
+	}
+	g := d.groups[base]
+	if g == nil {
+		if int32(base-d.newest) > 0 || len(d.groups) == 0 {
+			d.newest = base
+		}
+		if len(d.groups) >= fecGroups {
+			for k := range d.groups {
+				if dist := int32(d.newest - k); dist > fecGroups*int32(n) || dist < -fecGroups*int32(n) {
+					delete(d.groups, k)
+				}
+			}
+		}
+		if dist := int32(d.newest - base); dist > fecGroups*int32(n) {
+			return out
+		}
+		g = &fecGroup{shards: make([][]byte, n)}
+		d.groups[base] = g
+	}
+	if g.done || g.shards[i] != nil {
+		return out
+	}
+	g.shards[i] = append([]byte(nil), shard...)
+	if g.count++; g.count < d.data {
+		return out
+	}
+	g.done = true
+	out = append(out, d.recover(g.shards)...)
+	g.shards = nil
+	return out
+}
+
+// recover rebuilds the missing data shards from data-many received shards
+// and returns their KCP packets
+func (d *fecDecoder) recover(shards [][]byte) [][]byte {
+	var missing []int
+	for i := 0; i < d.data; i++ {
+		if shards[i] == nil {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	rows := make([][]byte, 0, d.data)
+	present := make([][]byte, 0, d.data)
+	longest := 0
+	for i, shard := range shards {
+		if shard == nil || len(rows) == d.data {
+			continue
+		}
+		rows = append(rows, d.matrix[i])
+		present = append(present, shard)
+		if len(shard) > longest {
+			longest = len(shard)
+		}
+	}
+	inv, err := gfInvert(rows)
+	if err != nil {
+		return nil
+	}
+	var out [][]byte
+	for _, i := range missing {
+		shard := make([]byte, longest)
+		for t, p := range present {
+			gfMulAdd(shard, inv[i][t], p)
+		}
+		if payload := fecPayload(shard); payload != nil {
+			out = append(out, payload)
+		}
+	}
+	return out
+}
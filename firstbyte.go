@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// firstByteReplay is how much of the client's request is kept to replay to
+// another target; a backend not answering a longer request isn't failed
+// over
+const firstByteReplay = 64 * 1024
+
+// awaitFirstByte relays the client's data to the target until the target
+// sends its first byte; when that takes longer than -first-byte-timeout
+// after the client's first data, or the target closes, the data is replayed
+// to another target not tried yet. Server-first protocols answer right
+// away, a client not sending anything is waited for. Returns the target
+// connection, with the first byte buffered, the target and the number of
+// client bytes relayed
+func awaitFirstByte(ctx context.Context, id uint64, client, fwd net.Conn, target string) (net.Conn, string, int, error) {
+	var mu sync.Mutex
+	var sent []byte
+	overflow := false
+	relayed := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := client.Read(buf)
+			mu.Lock()
+			if n > 0 {
+				if len(sent) == 0 {
+					fwd.SetReadDeadline(time.Now().Add(firstByteTimeout))
+				}
+				if len(sent)+n <= firstByteReplay {
+					sent = append(sent, buf[:n]...)
+				} else {
+					overflow = true
+				}
+				relayed += n
+				// a failed write shows as the target not answering
+				fwd.Write(buf[:n])
+			}
+			mu.Unlock()
+			if err != nil {
+				// client EOF is seen again by the forwarder
+				return
+			}
+		}
+	}()
+	// a connection waiting here isn't tracked yet, close it on shutdown
+	watch := make(chan struct{})
+	defer close(watch)
+	go func() {
+		select {
+		case <-ctx.Done():
+			mu.Lock()
+			fwd.SetReadDeadline(time.Unix(1, 0))
+			mu.Unlock()
+		case <-watch:
+		}
+	}()
+	stop := func() {
+		client.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		client.SetReadDeadline(time.Time{})
+	}
+
+	tried := map[string]bool{target: true}
+	for {
+		peeked := newPeekedConn(fwd, 32*1024)
+		_, err := peeked.r.Peek(1)
+		if err == nil {
+			fwd.SetReadDeadline(time.Time{})
+			stop()
+			return peeked, target, relayed, nil
+		}
+		if ctx.Err() != nil {
+			stop()
+			fwd.Close()
+			return nil, target, relayed, ctx.Err()
+		}
+		reason := "closed the connection"
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			reason = fmt.Sprintf("didn't answer in %v", firstByteTimeout)
+		}
+		recordNoAnswer(target)
+		mu.Lock()
+		if overflow {
+			mu.Unlock()
+			stop()
+			fwd.Close()
+			return nil, target, relayed, fmt.Errorf("`%s` %s, request too long to replay", target, reason)
+		}
+		fwd.Close()
+		failed := fmt.Errorf("`%s` %s, no other target to try", target, reason)
+		next, conn := "", net.Conn(nil)
+		for _, t := range targetAddrs(currentTargets()) {
+			if tried[t] || isDraining(t) || isBlacklisted(t) {
+				continue
+			}
+			tried[t] = true
+			log.Printf("[%d] Target `%s` %s, retrying with `%s`\n", id, target, reason, t)
+			if conn, err = dialTcp(ctx, t, client); err == nil && len(sent) > 0 {
+				conn.SetReadDeadline(time.Now().Add(firstByteTimeout))
+				if _, err = conn.Write(sent); err != nil {
+					conn.Close()
+				}
+			}
+			if err == nil {
+				next = t
+				break
+			}
+			failed = fmt.Errorf("connection to `%s` failed: %v", t, err)
+		}
+		if next == "" {
+			mu.Unlock()
+			stop()
+			return nil, target, relayed, failed
+		}
+		fwd, target = conn, next
+		mu.Unlock()
+	}
+}
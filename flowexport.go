@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// NetFlow v9 / IPFIX information elements
+const (
+	ieOctets          = 1
+	iePackets         = 2
+	ieProtocol        = 4
+	ieSrcPort         = 7
+	ieSrcIpv4         = 8
+	ieDstPort         = 11
+	ieDstIpv4         = 12
+	ieLastSwitched    = 21
+	ieFirstSwitched   = 22
+	iePostOctets      = 23
+	iePostPackets     = 24
+	ieSrcIpv6         = 27
+	ieDstIpv6         = 28
+	ieFlowStartMillis = 152
+	ieFlowEndMillis   = 153
+	iePostNatDstIpv4  = 226
+	iePostNaptDstPort = 228
+	iePostNatDstIpv6  = 282
+)
+
+const (
+	flowTemplateIpv4 = 256
+	flowTemplateIpv6 = 257
+	flowBatch        = 20
+)
+
+type flowRecord struct {
+	proto             byte
+	src, dst, natDst  net.IP
+	srcPort, dstPort  uint16
+	natDstPort        uint16
+	bytesIn, bytesOut uint64
+	pktsIn, pktsOut   uint64
+	start, end        time.Time
+}
+
+var flowRecords = make(chan flowRecord, 1024)
+
+// NetFlow v9 timestamps are milliseconds of uptime
+var processStart = time.Now()
+
+func splitIpPort(addr string) (net.IP, uint16) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	p, _ := strconv.Atoi(port)
+	return net.ParseIP(host), uint16(p)
+}
+
+// exportFlow queues a flow record for the closed connection or session
+func exportFlow(c *trackedConn) {
+	r := flowRecord{
+		proto:    6,
+		bytesIn:  atomic.LoadUint64(&c.bytesIn),
+		bytesOut: atomic.LoadUint64(&c.bytesOut),
+		pktsIn:   atomic.LoadUint64(&c.pktsIn),
+		pktsOut:  atomic.LoadUint64(&c.pktsOut),
+		start:    c.started,
+		end:      time.Now(),
+	}
+	if c.proto == "udp" {
+		r.proto = 17
+	} else if c.proto == "ip" {
+		r.proto = byte(ipProto)
+	}
+	r.src, r.srcPort = splitIpPort(c.client)
+	r.dst, r.dstPort = splitIpPort(c.local)
+	r.natDst, r.natDstPort = splitIpPort(c.target)
+	select {
+	case flowRecords <- r:
+	default:
+		if debug.Load() {
+			log.Printf("[%d] Flow export queue is full, dropping flow record\n", c.id)
+		}
+	}
+}
+
+type flowField struct {
+	id, length uint16
+}
+
+func flowTemplate(v6 bool) []flowField {
+	addr, natAddr := flowField{ieSrcIpv4, 4}, flowField{iePostNatDstIpv4, 4}
+	dstAddr := flowField{ieDstIpv4, 4}
+	if v6 {
+		addr, natAddr = flowField{ieSrcIpv6, 16}, flowField{iePostNatDstIpv6, 16}
+		dstAddr = flowField{ieDstIpv6, 16}
+	}
+	fields := []flowField{addr, dstAddr, {ieSrcPort, 2}, {ieDstPort, 2}, {ieProtocol, 1},
+		{ieOctets, 8}, {iePackets, 8}, {iePostOctets, 8}, {iePostPackets, 8}, natAddr, {iePostNaptDstPort, 2}}
+	if flowFormat == "ipfix" {
+		return append(fields, flowField{ieFlowStartMillis, 8}, flowField{ieFlowEndMillis, 8})
+	}
+	return append(fields, flowField{ieFirstSwitched, 4}, flowField{ieLastSwitched, 4})
+}
+
+// flowExporter batches flow records into NetFlow v9 or IPFIX packets sent to
+// the collector over UDP, with templates resent every minute
+type flowExporter struct {
+	conn     net.Conn
+	epoch    time.Time
+	sequence uint32
+	lastTmpl time.Time
+}
+
+func exportFlows(ctx context.Context, collector string) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		fatalf(errDial, "Failed to setup flow export to `%s`: %v\n", collector, err)
+	}
+	e := &flowExporter{conn: conn, epoch: processStart}
+
+	var batch []flowRecord
+	ticker := systemClock.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// flush records of connections closed on shutdown
+			for len(flowRecords) > 0 {
+				batch = append(batch, <-flowRecords)
+			}
+			if len(batch) > 0 {
+				e.send(batch)
+			}
+			return
+		case r := <-flowRecords:
+			batch = append(batch, r)
+			if len(batch) < flowBatch {
+				continue
+			}
+		case <-ticker.Chan():
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		e.send(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *flowExporter) send(batch []flowRecord) {
+	var sets bytes.Buffer
+	records := 0
+
+	now := time.Now()
+	if now.Sub(e.lastTmpl) > time.Minute {
+		e.lastTmpl = now
+		var tmpl bytes.Buffer
+		for _, id := range []uint16{flowTemplateIpv4, flowTemplateIpv6} {
+			fields := flowTemplate(id == flowTemplateIpv6)
+			binary.Write(&tmpl, binary.BigEndian, [2]uint16{id, uint16(len(fields))})
+			for _, f := range fields {
+				binary.Write(&tmpl, binary.BigEndian, [2]uint16{f.id, f.length})
+			}
+			records++
+		}
+		setId := uint16(0)
+		if flowFormat == "ipfix" {
+			setId = 2
+		}
+		writeFlowSet(&sets, setId, tmpl.Bytes())
+	}
+
+	var v4, v6 bytes.Buffer
+	for _, r := range batch {
+		buf, v6rec := &v4, false
+		if r.src != nil && r.src.To4() == nil {
+			buf, v6rec = &v6, true
+		}
+		e.writeRecord(buf, r, v6rec)
+		records++
+	}
+	if v4.Len() > 0 {
+		writeFlowSet(&sets, flowTemplateIpv4, v4.Bytes())
+	}
+	if v6.Len() > 0 {
+		writeFlowSet(&sets, flowTemplateIpv6, v6.Bytes())
+	}
+
+	var msg bytes.Buffer
+	if flowFormat == "ipfix" {
+		binary.Write(&msg, binary.BigEndian, struct {
+			Version, Length              uint16
+			ExportTime, Sequence, Domain uint32
+		}{10, uint16(16 + sets.Len()), uint32(now.Unix()), e.sequence, 0})
+		e.sequence += uint32(len(batch))
+	} else {
+		binary.Write(&msg, binary.BigEndian, struct {
+			Version, Count                       uint16
+			Uptime, UnixSecs, Sequence, SourceId uint32
+		}{9, uint16(records), uint32(now.Sub(e.epoch).Milliseconds()), uint32(now.Unix()), e.sequence, 0})
+		e.sequence++
+	}
+	msg.Write(sets.Bytes())
+	if _, err := e.conn.Write(msg.Bytes()); err != nil {
+		log.Printf("Failed to export flows to `%s`: %v\n", e.conn.RemoteAddr(), err)
+	} else if debug.Load() {
+		log.Printf("Exported %d flow record(s) to `%s`\n", len(batch), e.conn.RemoteAddr())
+	}
+}
+
+func (e *flowExporter) writeRecord(buf *bytes.Buffer, r flowRecord, v6 bool) {
+	ip := func(addr net.IP) {
+		if v6 {
+			if a := addr.To16(); a != nil && addr.To4() == nil {
+				buf.Write(a)
+			} else {
+				buf.Write(make([]byte, 16))
+			}
+		} else {
+			if a := addr.To4(); a != nil {
+				buf.Write(a)
+			} else {
+				buf.Write(make([]byte, 4))
+			}
+		}
+	}
+	ip(r.src)
+	ip(r.dst)
+	binary.Write(buf, binary.BigEndian, [2]uint16{r.srcPort, r.dstPort})
+	buf.WriteByte(r.proto)
+	binary.Write(buf, binary.BigEndian, [4]uint64{r.bytesIn, r.pktsIn, r.bytesOut, r.pktsOut})
+	ip(r.natDst)
+	binary.Write(buf, binary.BigEndian, r.natDstPort)
+	if flowFormat == "ipfix" {
+		binary.Write(buf, binary.BigEndian, [2]uint64{uint64(r.start.UnixMilli()), uint64(r.end.UnixMilli())})
+	} else {
+		binary.Write(buf, binary.BigEndian, [2]uint32{uptime(e.epoch, r.start), uptime(e.epoch, r.end)})
+	}
+}
+
+// uptime converts t to milliseconds since epoch, as NetFlow v9
+// timestamps are relative to the device uptime
+func uptime(epoch, t time.Time) uint32 {
+	if t.Before(epoch) {
+		return 0
+	}
+	return uint32(t.Sub(epoch).Milliseconds())
+}
+
+// writeFlowSet appends a set with its header, padded to 4 bytes
+func writeFlowSet(buf *bytes.Buffer, id uint16, body []byte) {
+	pad := (4 - len(body)%4) % 4
+	binary.Write(buf, binary.BigEndian, [2]uint16{id, uint16(4 + len(body) + pad)})
+	buf.Write(body)
+	buf.Write(make([]byte, pad))
+}
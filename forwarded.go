@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxHttpHead limits request and response heads held in memory
+const maxHttpHead = 64 << 10
+
+// errHttpFraming closes a connection whose requests were rewritten once a
+// later request can't be followed, as passing it through unchanged would
+// let the client forge forwarding headers
+var errHttpFraming = errors.New("HTTP request can't be followed after rewriting earlier ones")
+
+// forwardedReader adds the client address to X-Forwarded-For and Forwarded
+// headers and sets X-Forwarded-Port in every request of a plaintext HTTP/1.x
+// connection, following message framing to find the next request head;
+// connections switching protocols, on a 101 response to an Upgrade request
+// or a 2xx response to CONNECT, are passed through from then on, as is a
+// connection not looking like HTTP/1.x from the start
+type forwardedReader struct {
+	r         *bufio.Reader
+	id        uint64
+	client    net.IP
+	port      int
+	x         *httpExchange
+	out       []byte
+	body      int64 // bytes of body left, including CRLF after a chunk
+	chunked   bool  // reading the body in chunks
+	trailer   bool  // reading trailer fields after the last chunk
+	upgrade   bool  // waiting for the response to a CONNECT or Upgrade request
+	rewritten bool  // a request head was rewritten
+	raw       bool
+	err       error
+}
+
+// httpExchange pairs the requests of a connection with the responses of the
+// target, to learn whether the target switched protocols
+type httpExchange struct {
+	mu      sync.Mutex
+	pending []httpRequest // sent, waiting for their responses
+	// whether the target switched protocols on the upgrade request waited for
+	switched chan bool
+	lost     chan struct{} // closed when responses can't be followed
+	once     sync.Once
+}
+
+type httpRequest struct {
+	method  string
+	upgrade bool
+}
+
+func (x *httpExchange) sent(r httpRequest) {
+	x.mu.Lock()
+	x.pending = append(x.pending, r)
+	x.mu.Unlock()
+}
+
+// answered returns the oldest request without a response, false when there
+// is none
+func (x *httpExchange) answered() (httpRequest, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if len(x.pending) == 0 {
+		return httpRequest{}, false
+	}
+	r := x.pending[0]
+	x.pending = x.pending[1:]
+	return r, true
+}
+
+func (x *httpExchange) lose() {
+	x.once.Do(func() { close(x.lost) })
+}
+
+func newForwardedReader(r io.Reader, id uint64, client, local net.Addr) *forwardedReader {
+	ip, _ := addrIpPort(client)
+	_, port := addrIpPort(local)
+	x := &httpExchange{switched: make(chan bool, 1), lost: make(chan struct{})}
+	return &forwardedReader{r: bufio.NewReaderSize(r, maxHttpHead), id: id, client: ip, port: port, x: x}
+}
+
+func (f *forwardedReader) Read(p []byte) (int, error) {
+	for len(f.out) == 0 && f.err == nil {
+		switch {
+		case f.raw:
+			return f.r.Read(p)
+		case f.body > 0:
+			if int64(len(p)) > f.body {
+				p = p[:f.body]
+			}
+			n, err := f.r.Read(p)
+			f.body -= int64(n)
+			return n, err
+		case f.trailer:
+			line, err := f.line()
+			f.out, f.err = line, err
+			f.trailer = len(bytes.TrimSpace(line)) > 0
+		case f.chunked:
+			line, err := f.line()
+			f.out, f.err = line, err
+			if err != nil {
+				break
+			}
+			if n, ok := parseChunkSize(line); !ok {
+				f.err = f.fail("malformed chunk size")
+			} else if n == 0 {
+				f.chunked, f.trailer = false, true
+			} else {
+				f.body = n + 2
+			}
+		case f.upgrade:
+			f.upgrade = false
+			select {
+			case f.raw = <-f.x.switched:
+			case <-f.x.lost:
+				select {
+				case f.raw = <-f.x.switched:
+				default:
+					f.err = f.fail("responses can't be followed")
+				}
+			}
+		default:
+			f.out, f.err = f.head()
+		}
+	}
+	if f.err == errHttpFraming {
+		f.out = nil
+	}
+	if len(f.out) > 0 {
+		n := copy(p, f.out)
+		f.out = f.out[n:]
+		return n, nil
+	}
+	return 0, f.err
+}
+
+func (f *forwardedReader) line() ([]byte, error) {
+	line, err := f.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = f.fail("line too long")
+	}
+	return append([]byte(nil), line...), err
+}
+
+// fail passes the rest of the connection through unchanged when no request
+// was rewritten yet, and returns errHttpFraming to close it otherwise
+func (f *forwardedReader) fail(reason string) error {
+	if !f.rewritten {
+		if debug.Load() {
+			log.Printf("[%d] Not a plaintext HTTP/1.x request, %s; forwarding unchanged\n", f.id, reason)
+		}
+		f.raw = true
+		return nil
+	}
+	if verbose.Load() {
+		log.Printf("[%d] HTTP request can't be followed, %s; closing\n", f.id, reason)
+	}
+	return errHttpFraming
+}
+
+// head reads a request head and returns it with forwarding headers added,
+// or the bytes read so far when it doesn't look like HTTP/1.x
+func (f *forwardedReader) head() ([]byte, error) {
+	var lines [][]byte
+	size := 0
+	for {
+		line, err := f.line()
+		size += len(line)
+		if err == nil && size > maxHttpHead {
+			err = f.fail("request head too long")
+		}
+		if f.raw || err != nil {
+			return bytes.Join(append(lines, line), nil), err
+		}
+		if len(lines) == 0 {
+			// empty lines between requests are tolerated
+			if len(bytes.TrimSpace(line)) == 0 {
+				return line, nil
+			}
+			if !isRequestLine(line) {
+				return line, f.fail("unknown request line")
+			}
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			return f.rewrite(lines, line), nil
+		}
+		lines = append(lines, line)
+	}
+}
+
+func isRequestLine(line []byte) bool {
+	f := strings.Fields(string(line))
+	return len(f) == 3 && (f[2] == "HTTP/1.1" || f[2] == "HTTP/1.0")
+}
+
+// parseChunkSize parses the size line of a chunk, false when malformed
+func parseChunkSize(line []byte) (int64, bool) {
+	size := string(bytes.TrimSpace(line))
+	if semi := strings.IndexByte(size, ';'); semi >= 0 {
+		size = size[:semi]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	return n, err == nil && n >= 0
+}
+
+// rewrite appends the client to the last X-Forwarded-For and Forwarded
+// fields, or adds them, replaces X-Forwarded-Port, and sets up reading of
+// the body
+func (f *forwardedReader) rewrite(lines [][]byte, end []byte) []byte {
+	method := strings.Fields(string(lines[0]))[0]
+	xff, fwd := -1, -1
+	var head [][]byte
+	var length int64
+	upgrade := method == "CONNECT"
+	for i, line := range lines {
+		name, value := string(line), ""
+		if colon := bytes.IndexByte(line, ':'); i > 0 && colon > 0 {
+			name, value = string(line[:colon]), strings.TrimSpace(string(line[colon+1:]))
+		}
+		switch strings.ToLower(name) {
+		case "x-forwarded-port":
+			continue
+		case "x-forwarded-for":
+			xff = len(head)
+		case "forwarded":
+			fwd = len(head)
+		case "content-length":
+			length, _ = strconv.ParseInt(value, 10, 64)
+		case "transfer-encoding":
+			f.chunked = strings.HasSuffix(strings.ToLower(value), "chunked")
+		case "upgrade":
+			upgrade = true
+		}
+		head = append(head, line)
+	}
+	if f.client != nil {
+		forwardedFor := "for=" + f.client.String()
+		if f.client.To4() == nil {
+			forwardedFor = `for="[` + f.client.String() + `]"`
+		}
+		head = appendField(head, xff, "X-Forwarded-For", f.client.String())
+		head = appendField(head, fwd, "Forwarded", forwardedFor+";proto=http")
+	}
+	head = append(head, []byte(fmt.Sprintf("X-Forwarded-Port: %d\r\n", f.port)))
+	if !f.chunked && length > 0 {
+		f.body = length
+	}
+	// after the body, the next request waits for the target to agree to
+	// switch protocols or not
+	f.upgrade = upgrade
+	f.rewritten = true
+	f.x.sent(httpRequest{method, upgrade})
+	return bytes.Join(append(head, end), nil)
+}
+
+// appendField adds value to the field at index i as the last element of
+// its list, or adds the field when i is negative
+func appendField(head [][]byte, i int, name, value string) [][]byte {
+	if i < 0 {
+		return append(head, []byte(name+": "+value+"\r\n"))
+	}
+	head[i] = []byte(strings.TrimRight(string(head[i]), "\r\n") + ", " + value + "\r\n")
+	return head
+}
+
+// responses follows the responses of the target, unchanged, to tell the
+// requests whether the target switched protocols
+func (f *forwardedReader) responses(r io.Reader) io.Reader {
+	return &responseReader{r: bufio.NewReaderSize(r, maxHttpHead), x: f.x}
+}
+
+type responseReader struct {
+	r       *bufio.Reader
+	x       *httpExchange
+	out     []byte
+	body    int64
+	chunked bool
+	trailer bool
+	raw     bool
+	err     error
+}
+
+func (r *responseReader) Read(p []byte) (int, error) {
+	n, err := r.read(p)
+	if err != nil {
+		// nothing more is answered
+		r.x.lose()
+	}
+	return n, err
+}
+
+func (r *responseReader) read(p []byte) (int, error) {
+	for len(r.out) == 0 && r.err == nil {
+		switch {
+		case r.raw:
+			return r.r.Read(p)
+		case r.body > 0:
+			if int64(len(p)) > r.body {
+				p = p[:r.body]
+			}
+			n, err := r.r.Read(p)
+			r.body -= int64(n)
+			return n, err
+		case r.trailer:
+			r.out, r.err = r.line()
+			r.trailer = len(bytes.TrimSpace(r.out)) > 0
+		case r.chunked:
+			r.out, r.err = r.line()
+			if r.err != nil || r.raw {
+				break
+			}
+			if n, ok := parseChunkSize(r.out); !ok {
+				r.lose()
+			} else if n == 0 {
+				r.chunked, r.trailer = false, true
+			} else {
+				r.body = n + 2
+			}
+		default:
+			r.out, r.err = r.head()
+		}
+	}
+	if len(r.out) > 0 {
+		n := copy(p, r.out)
+		r.out = r.out[n:]
+		return n, nil
+	}
+	return 0, r.err
+}
+
+func (r *responseReader) line() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		r.lose()
+		err = nil
+	}
+	return append([]byte(nil), line...), err
+}
+
+// lose passes the rest of the responses through, the requests can't learn
+// whether the target switched protocols anymore
+func (r *responseReader) lose() {
+	r.raw = true
+	r.x.lose()
+}
+
+// head reads a response head, pairs it with its request and sets up reading
+// of the body
+func (r *responseReader) head() ([]byte, error) {
+	var head []byte
+	status := 0
+	length := int64(-1)
+	chunked := false
+	for {
+		line, err := r.line()
+		head = append(head, line...)
+		if err == nil && len(head) > maxHttpHead {
+			r.lose()
+		}
+		if r.raw || err != nil {
+			return head, err
+		}
+		if status == 0 {
+			if status = statusCode(line); status == 0 {
+				r.lose()
+				return head, nil
+			}
+			continue
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+		if colon := bytes.IndexByte(line, ':'); colon > 0 {
+			value := strings.TrimSpace(string(line[colon+1:]))
+			switch strings.ToLower(string(line[:colon])) {
+			case "content-length":
+				length, _ = strconv.ParseInt(value, 10, 64)
+			case "transfer-encoding":
+				chunked = strings.HasSuffix(strings.ToLower(value), "chunked")
+			}
+		}
+	}
+	if status < 200 && status != 101 {
+		// interim response, the final one follows
+		return head, nil
+	}
+	req, ok := r.x.answered()
+	if !ok {
+		r.lose()
+		return head, nil
+	}
+	switched := status == 101 || req.method == "CONNECT" && status/100 == 2
+	if req.upgrade {
+		select {
+		case r.x.switched <- switched:
+		default:
+		}
+	}
+	switch {
+	case switched:
+		r.raw = true
+	case req.method == "HEAD" || status == 204 || status == 304:
+	case chunked:
+		r.chunked = true
+	case length >= 0:
+		r.body = length
+	default:
+		// the body ends when the target closes the connection
+		r.raw = true
+	}
+	return head, nil
+}
+
+// statusCode returns the status of an HTTP/1.x status line, 0 when it isn't
+// one
+func statusCode(line []byte) int {
+	f := strings.Fields(string(line))
+	if len(f) < 2 || !strings.HasPrefix(f[0], "HTTP/1.") || len(f[1]) != 3 {
+		return 0
+	}
+	code, err := strconv.Atoi(f[1])
+	if err != nil || code < 100 {
+		return 0
+	}
+	return code
+}
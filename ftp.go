@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ftpPortLow, ftpPortHigh int
+	ftpPortArgs             = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+	ftpExtendedPort         = regexp.MustCompile(`\([^\d)]{3}(\d+)[^\d)]\)`)
+)
+
+// ftpDataConn is a data connection opened by the FTP helper, forwarded as
+// is
+type ftpDataConn struct {
+	net.Conn
+}
+
+// ftpSession rewrites addresses in PORT, EPRT, PASV and EPSV exchanges of
+// an FTP control connection to goproxy's own, opening a one-shot data
+// listener for each
+type ftpSession struct {
+	ctx    context.Context
+	id     uint64
+	client net.Conn // control connection from the client
+	server net.Conn // control connection to the target
+	mu     sync.Mutex
+	auth   chan bool // AUTH sent, waiting for the server to accept TLS
+}
+
+// ftpLines rewrites a control channel one line at a time, until TLS makes
+// it unreadable, then passes it through
+type ftpLines struct {
+	r     *bufio.Reader
+	line  func(line string) (string, func() bool)
+	out   []byte
+	err   error
+	after func() bool // decides whether the rest is passed through
+	raw   bool
+}
+
+func (f *ftpLines) Read(p []byte) (int, error) {
+	if len(f.out) == 0 && f.after != nil {
+		f.raw, f.after = f.after(), nil
+	}
+	if len(f.out) == 0 && f.err == nil && !f.raw {
+		line, err := f.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			f.out = append([]byte(nil), line...)
+		} else {
+			if len(line) > 0 {
+				out, after := f.line(string(line))
+				f.out, f.after = []byte(out), after
+			}
+			f.err = err
+		}
+	}
+	if len(f.out) > 0 {
+		n := copy(p, f.out)
+		f.out = f.out[n:]
+		return n, nil
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.r.Read(p)
+}
+
+func (s *ftpSession) commands(r io.Reader) io.Reader {
+	return &ftpLines{r: bufio.NewReader(r), line: s.command}
+}
+
+func (s *ftpSession) replies(r io.Reader) io.Reader {
+	return &ftpLines{r: bufio.NewReader(r), line: s.reply}
+}
+
+func (s *ftpSession) command(line string) (string, func() bool) {
+	verb, args := line, ""
+	if sp := strings.IndexByte(line, ' '); sp >= 0 {
+		verb, args = line[:sp], strings.TrimSpace(line[sp+1:])
+	}
+	switch strings.ToUpper(strings.TrimSpace(verb)) {
+	case "AUTH":
+		auth := make(chan bool, 1)
+		s.mu.Lock()
+		s.auth = auth
+		s.mu.Unlock()
+		return line, func() bool {
+			select {
+			case ok := <-auth:
+				return ok
+			case <-s.ctx.Done():
+				return true
+			}
+		}
+	case "PORT":
+		if m := ftpPortArgs.FindStringSubmatch(args); m != nil {
+			return s.active(line, atoi(m[5])<<8|atoi(m[6])), nil
+		}
+	case "EPRT":
+		// |af|address|port| with any delimiter
+		if len(args) > 0 {
+			if f := strings.Split(args, args[:1]); len(f) == 5 {
+				return s.active(line, atoi(f[3])), nil
+			}
+		}
+	}
+	return line, nil
+}
+
+func (s *ftpSession) reply(line string) (string, func() bool) {
+	s.mu.Lock()
+	auth := s.auth
+	if auth != nil && len(line) > 3 && line[3] == ' ' {
+		s.auth = nil
+	}
+	s.mu.Unlock()
+	switch {
+	case auth != nil && len(line) > 3 && line[3] == ' ':
+		ok := strings.HasPrefix(line, "234")
+		auth <- ok
+		if ok {
+			if debug.Load() {
+				log.Printf("[%d] FTP control connection switched to TLS, data connections are not forwarded\n", s.id)
+			}
+			return line, func() bool { return true }
+		}
+	case strings.HasPrefix(line, "227 "):
+		if m := ftpPortArgs.FindStringSubmatch(line); m != nil {
+			return s.passive(line, atoi(m[5])<<8|atoi(m[6]), false), nil
+		}
+	case strings.HasPrefix(line, "229 "):
+		if m := ftpExtendedPort.FindStringSubmatch(line); m != nil {
+			return s.passive(line, atoi(m[1]), true), nil
+		}
+	}
+	return line, nil
+}
+
+// passive opens a data listener for the client in place of the one the
+// server announced; the data connection goes to the address of the server
+// control connection, servers behind NAT often announce a private address
+func (s *ftpSession) passive(line string, port int, extended bool) string {
+	ip, _ := addrIpPort(s.client.LocalAddr())
+	serverIp, _ := addrIpPort(s.server.RemoteAddr())
+	if !extended && ip.To4() == nil {
+		return line
+	}
+	listener, err := listenFtpData(ip)
+	if err != nil {
+		log.Printf("[%d] Failed to open FTP data listener: %v\n", s.id, err)
+		return "425 Can't open data connection.\r\n"
+	}
+	clientIp, _ := addrIpPort(s.client.RemoteAddr())
+	go s.forwardData(listener, time.Now().Add(timeout), clientIp, net.JoinHostPort(serverIp.String(), strconv.Itoa(port)))
+	_, local := addrIpPort(listener.Addr())
+	if extended {
+		return fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)\r\n", local)
+	}
+	return fmt.Sprintf("227 Entering Passive Mode (%s,%d,%d).\r\n", ftpHost(ip), local>>8, local&0xff)
+}
+
+// active opens a data listener for the server, the data connection goes to
+// the port announced by the client at the address of its control
+// connection, so the proxy cannot be used to connect elsewhere
+func (s *ftpSession) active(line string, port int) string {
+	ip, _ := addrIpPort(s.server.LocalAddr())
+	listener, err := listenFtpData(ip)
+	if err != nil {
+		log.Printf("[%d] Failed to open FTP data listener: %v\n", s.id, err)
+		return line
+	}
+	clientIp, _ := addrIpPort(s.client.RemoteAddr())
+	serverIp, _ := addrIpPort(s.server.RemoteAddr())
+	go s.forwardData(listener, time.Now().Add(timeout), serverIp, net.JoinHostPort(clientIp.String(), strconv.Itoa(port)))
+	_, local := addrIpPort(listener.Addr())
+	if ip.To4() != nil {
+		return fmt.Sprintf("PORT %s,%d,%d\r\n", ftpHost(ip), local>>8, local&0xff)
+	}
+	return fmt.Sprintf("EPRT |2|%s|%d|\r\n", ip, local)
+}
+
+// forwardData accepts a single data connection from the peer until the
+// deadline, -timeout after the address was sent, and forwards it to target
+func (s *ftpSession) forwardData(listener *net.TCPListener, deadline time.Time, peer net.IP, target string) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			listener.Close()
+		case <-done:
+		}
+	}()
+	listener.SetDeadline(deadline)
+	conn, err := listener.Accept()
+	close(done)
+	listener.Close()
+	if err != nil {
+		if debug.Load() {
+			log.Printf("[%d] No FTP data connection: %v\n", s.id, err)
+		}
+		return
+	}
+	if ip, _ := addrIpPort(conn.RemoteAddr()); !ip.Equal(peer) {
+		log.Printf("[%d] FTP data connection from unexpected `%s`, closing\n", s.id, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	id := newConnId()
+	if debug.Load() {
+		log.Printf("[%d] FTP data connection of [%d] from `%s` to `%s`\n", id, s.id, conn.RemoteAddr(), target)
+	}
+	forwardTcp(s.ctx, id, ftpDataConn{countFd(conn)}, target)
+}
+
+// listenFtpData binds a data listener on the address, on a port of
+// -ftp-data-ports if set
+func listenFtpData(ip net.IP) (*net.TCPListener, error) {
+	if ftpPortLow == 0 {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	}
+	ports := ftpPortHigh - ftpPortLow + 1
+	start := rand.Intn(ports)
+	var err error
+	for i := 0; i < ports && i < sourcePortTries; i++ {
+		var listener *net.TCPListener
+		listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: ftpPortLow + (start+i)%ports})
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return listener, err
+		}
+	}
+	return nil, fmt.Errorf("no free data port: %v", err)
+}
+
+func ftpHost(ip net.IP) string {
+	return strings.ReplaceAll(ip.To4().String(), ".", ",")
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+// newTestFtpSession returns a session with control connections on the
+// loopback, its data listeners are closed with the test
+func newTestFtpSession(t *testing.T) *ftpSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	_, client := tcpPair(t)
+	server, _ := tcpPair(t)
+	return &ftpSession{ctx: ctx, client: client, server: server}
+}
+
+func TestFtpReplies(t *testing.T) {
+	long := "220-" + strings.Repeat("x", 5000) + "\r\n"
+	tests := []struct {
+		reply string
+		want  string // regexp of the rewritten reply
+	}{
+		// vsftpd behind NAT announcing its private address
+		{"227 Entering Passive Mode (192,168,1,20,156,64).\r\n", `^227 Entering Passive Mode \(127,0,0,1,\d+,\d+\)\.\r\n$`},
+		{"229 Entering Extended Passive Mode (|||40001|)\r\n", `^229 Entering Extended Passive Mode \(\|\|\|\d+\|\)\r\n$`},
+		{"229 Entering Extended Passive Mode (!!!40001!)\r\n", `^229 Entering Extended Passive Mode \(\|\|\|\d+\|\)\r\n$`},
+		{"227 Entering Passive Mode (192,168,1,20).\r\n", `^227 Entering Passive Mode \(192,168,1,20\)\.\r\n$`},
+		{"229 Entering Extended Passive Mode (40001)\r\n", `^229 Entering Extended Passive Mode \(40001\)\r\n$`},
+		{"227-Entering Passive Mode (192,168,1,20,156,64).\r\n", `^227-Entering Passive Mode \(192,168,1,20,156,64\)\.\r\n$`},
+		{"220 ProFTPD Server (Debian) [192.168.1.20]\r\n", `^220 ProFTPD Server \(Debian\) \[192\.168\.1\.20\]\r\n$`},
+		{long, "^" + regexp.QuoteMeta(long) + "$"},
+		{"227 Entering Passive Mode (192,168,1,20,156,64).", `^227 Entering Passive Mode \(127,0,0,1,\d+,\d+\)\.\r\n$`},
+	}
+	for _, test := range tests {
+		s := newTestFtpSession(t)
+		got, err := io.ReadAll(s.replies(strings.NewReader(test.reply)))
+		if err != nil {
+			t.Errorf("%q: %v", test.reply, err)
+		} else if !regexp.MustCompile(test.want).Match(got) {
+			t.Errorf("%q: got %q", test.reply, got)
+		}
+	}
+}
+
+func TestFtpCommands(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string // regexp of the rewritten command
+	}{
+		{"PORT 192,168,1,50,195,149\r\n", `^PORT 127,0,0,1,\d+,\d+\r\n$`},
+		// the examples of RFC 2428
+		{"EPRT |1|132.235.1.2|6275|\r\n", `^PORT 127,0,0,1,\d+,\d+\r\n$`},
+		{"EPRT |2|1080::8:800:200C:417A|5282|\r\n", `^PORT 127,0,0,1,\d+,\d+\r\n$`},
+		{"port 192,168,1,50,195,149\r\n", `^PORT 127,0,0,1,\d+,\d+\r\n$`},
+		{"PORT 192,168,1,50\r\n", `^PORT 192,168,1,50\r\n$`},
+		{"EPRT |1|132.235.1.2\r\n", `^EPRT \|1\|132\.235\.1\.2\r\n$`},
+		{"EPRT\r\n", `^EPRT\r\n$`},
+		{"RETR report.csv\r\n", `^RETR report\.csv\r\n$`},
+	}
+	for _, test := range tests {
+		s := newTestFtpSession(t)
+		got, err := io.ReadAll(s.commands(strings.NewReader(test.command)))
+		if err != nil {
+			t.Errorf("%q: %v", test.command, err)
+		} else if !regexp.MustCompile(test.want).Match(got) {
+			t.Errorf("%q: got %q", test.command, got)
+		}
+	}
+}
+
+func TestFtpAuthTls(t *testing.T) {
+	tests := []struct {
+		reply string
+		raw   bool // the rest is passed through
+	}{
+		{"234 AUTH TLS successful\r\n", true},
+		{"234-Using TLS\r\n234 Proceed\r\n", true},
+		{"534 Policy requires SSL\r\n", false},
+		{"500 AUTH not understood\r\n", false},
+	}
+	for _, test := range tests {
+		s := newTestFtpSession(t)
+		// once TLS starts, text that looks like PORT is part of records
+		after := "PORT 192,168,1,50,195,149\r\n"
+		r := s.commands(strings.NewReader("AUTH TLS\r\n" + after))
+		auth := make([]byte, len("AUTH TLS\r\n"))
+		if _, err := io.ReadFull(r, auth); err != nil {
+			t.Fatal(err)
+		}
+		commands := make(chan string)
+		go func() {
+			got, _ := io.ReadAll(r)
+			commands <- string(got)
+		}()
+		io.ReadAll(s.replies(strings.NewReader(test.reply)))
+		got := <-commands
+		if test.raw != (got == after) {
+			t.Errorf("%q: got %q after AUTH", test.reply, got)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// unknown country code, for clients not found in the database
+const geoUnknown = "--"
+
+var geoip = struct {
+	sync.RWMutex
+	db      *maxminddb.Reader
+	modTime time.Time
+	allow   map[string]bool
+	deny    map[string]bool
+	routes  []*geoRoute
+}{}
+
+// geoRoute sends clients from the listed countries to a dedicated target group
+type geoRoute struct {
+	name      string
+	countries map[string]bool
+	mu        sync.Mutex
+	targets   []Target
+}
+
+func parseCountries(list string) map[string]bool {
+	countries := make(map[string]bool)
+	for _, c := range parseTargetList(list) {
+		countries[strings.ToUpper(c)] = true
+	}
+	return countries
+}
+
+// parseGeoRoute parses `CC[,CC]=host:port[,host:port]`
+func parseGeoRoute(spec string) (*geoRoute, []string, error) {
+	eq := strings.IndexByte(spec, '=')
+	if eq < 0 {
+		return nil, nil, fmt.Errorf("expected CC[,CC]=host:port[,host:port], got `%s`", spec)
+	}
+	countries := parseCountries(spec[:eq])
+	targets := parseTargetList(spec[eq+1:])
+	if len(countries) == 0 || len(targets) == 0 {
+		return nil, nil, fmt.Errorf("expected CC[,CC]=host:port[,host:port], got `%s`", spec)
+	}
+	return &geoRoute{name: "geo:" + strings.ToUpper(spec[:eq]), countries: countries}, targets, nil
+}
+
+func loadGeoDb(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	geoip.Lock()
+	old := geoip.db
+	geoip.db = db
+	geoip.modTime = info.ModTime()
+	geoip.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// reloadGeoDb reopens the database when the file is replaced, e.g. by
+// geoipupdate
+func reloadGeoDb(ctx context.Context, path string) {
+	ticker := systemClock.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Failed to check GeoIP database `%s`: %v\n", path, err)
+			continue
+		}
+		geoip.RLock()
+		changed := !info.ModTime().Equal(geoip.modTime)
+		geoip.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := loadGeoDb(path); err != nil {
+			log.Printf("Failed to reload GeoIP database `%s`: %v\n", path, err)
+			continue
+		}
+		if verbose.Load() {
+			log.Printf("Reloaded GeoIP database `%s`\n", path)
+		}
+		publishEvent("reload", func() interface{} { return map[string]string{"config": "geoip", "path": path} })
+		audit("file watch", "reload GeoIP database `"+path+"`", nil, nil)
+	}
+}
+
+// geoCountry returns ISO country code of the client IP, or geoUnknown
+func geoCountry(ip net.IP) string {
+	var record struct {
+		Country struct {
+			IsoCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	geoip.RLock()
+	defer geoip.RUnlock()
+	if geoip.db == nil || ip == nil {
+		return geoUnknown
+	}
+	if err := geoip.db.Lookup(ip, &record); err != nil || record.Country.IsoCode == "" {
+		return geoUnknown
+	}
+	return record.Country.IsoCode
+}
+
+// geoAllowed checks the client address against country allow and deny lists
+func geoAllowed(client net.Addr) bool {
+	if len(geoip.allow) == 0 && len(geoip.deny) == 0 {
+		return true
+	}
+	ip, _ := addrIpPort(client)
+	country := geoCountry(ip)
+	if geoip.deny[country] {
+		return false
+	}
+	return len(geoip.allow) == 0 || geoip.allow[country]
+}
+
+// geoTargets returns the region-specific target group for the client, if any
+func geoTargets(client net.Addr) []Target {
+	if len(geoip.routes) == 0 {
+		return nil
+	}
+	ip, _ := addrIpPort(client)
+	if ip == nil {
+		return nil
+	}
+	country := geoCountry(ip)
+	for _, r := range geoip.routes {
+		if r.countries[country] {
+			r.mu.Lock()
+			targets := r.targets
+			r.mu.Unlock()
+			if len(targets) > 0 {
+				return targets
+			}
+		}
+	}
+	return nil
+}
+
+func (r *geoRoute) manage(ctx context.Context, connectTo []string) {
+	resolveGroup(ctx, connectTo, func(targets []Target) {
+		r.mu.Lock()
+		r.targets = targets
+		r.mu.Unlock()
+	})
+}
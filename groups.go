@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// groups holds the canary target group and the share of new connections
+// routed to it; the targets given as arguments form the stable group
+var groups = struct {
+	sync.Mutex
+	canary      []Target
+	split       uint
+	canaryCidrs []*net.IPNet
+	canaryPorts map[int]bool
+}{}
+
+type splitInfo struct {
+	Stable  string `json:"stable"`
+	Canary  string `json:"canary"`
+	Percent uint   `json:"percent"`
+}
+
+// resolveGroup resolves targets of an additional group the same way as
+// stable ones, passing updates to the callback
+func resolveGroup(ctx context.Context, connectTo []string, update func([]Target)) {
+	resolver := make(chan []Target, 1)
+	if dnsServer != "" {
+		go refreshDns(ctx, connectTo, resolver, nil)
+	} else {
+		resolver <- staticTargets(connectTo)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case targets := <-resolver:
+			update(targets)
+		}
+	}
+}
+
+func manageCanary(ctx context.Context, canaryTo []string) {
+	resolveGroup(ctx, canaryTo, func(targets []Target) {
+		groups.Lock()
+		groups.canary = targets
+		groups.Unlock()
+	})
+}
+
+// groupTargets returns the target group for a new connection: the group of
+// the listener port with -port-route, the GeoIP route group of the client
+// country, canary if the client address or
+// listener port matches a canary rule, or roll falls into the split
+// percentage, and the canary group is not empty; client and local addresses
+// may be nil when unknown
+func groupTargets(connectTo []Target, roll uint, client, local net.Addr) []Target {
+	if targets, ok := portTargets(local); ok {
+		return targets
+	}
+	if targets := geoTargets(client); targets != nil {
+		return targets
+	}
+	groups.Lock()
+	defer groups.Unlock()
+	if len(groups.canary) == 0 {
+		return connectTo
+	}
+	if roll%100 < groups.split {
+		return groups.canary
+	}
+	if ip, _ := addrIpPort(client); ip != nil {
+		for _, cidr := range groups.canaryCidrs {
+			if cidr.Contains(ip) {
+				return groups.canary
+			}
+		}
+	}
+	if _, port := addrIpPort(local); groups.canaryPorts[port] {
+		return groups.canary
+	}
+	return connectTo
+}
+
+func addrIpPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case *net.IPAddr:
+		return a.IP, 0
+	}
+	return nil, 0
+}
+
+// parseCanaryRules parses comma-separated client CIDRs and listener ports
+// routed to the canary group
+func parseCanaryRules(cidrs, ports string) error {
+	for _, c := range parseTargetList(cidrs) {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return err
+		}
+		groups.canaryCidrs = append(groups.canaryCidrs, cidr)
+	}
+	groups.canaryPorts = make(map[int]bool)
+	for _, p := range parseTargetList(ports) {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return fmt.Errorf("invalid port `%s`", p)
+		}
+		groups.canaryPorts[port] = true
+	}
+	return nil
+}
+
+func canaryTargets() []Target {
+	groups.Lock()
+	defer groups.Unlock()
+	return groups.canary
+}
+
+func setSplit(percent uint) {
+	groups.Lock()
+	groups.split = percent
+	groups.Unlock()
+	publishEvent("split", func() interface{} { return map[string]uint{"percent": percent} })
+	if verbose.Load() {
+		log.Printf("Routing %d%% of new connections to `%s` group\n", percent, canaryName)
+	}
+}
+
+func getSplit() splitInfo {
+	groups.Lock()
+	defer groups.Unlock()
+	return splitInfo{stableName, canaryName, groups.split}
+}
+
+func parseTargetList(list string) []string {
+	var targets []string
+	for _, target := range strings.Split(list, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// healthInfo tells whether the proxy can forward: at least -health-min of
+// the targets not draining accept a TCP connection
+type healthInfo struct {
+	Healthy   bool `json:"healthy"`
+	Reachable int  `json:"reachable"`
+	Targets   int  `json:"targets"`
+	Min       int  `json:"min"`
+}
+
+// checkHealth probes the current targets; UDP targets can't be probed and
+// count as reachable once resolved
+func checkHealth(ctx context.Context) healthInfo {
+	var usable []string
+	targetState.Lock()
+	for _, target := range targetState.current {
+		if !targetState.draining[target.Addr] && !isBlacklisted(target.Addr) {
+			usable = append(usable, target.Addr)
+		}
+	}
+	targetState.Unlock()
+	h := healthInfo{Targets: len(usable), Min: healthMin}
+	if udp {
+		h.Reachable = len(usable)
+	} else {
+		h.Reachable = probeTargets(ctx, usable)
+	}
+	h.Healthy = h.Reachable >= healthMin
+	return h
+}
+
+// serveHealth answers 200 when healthy and 503 otherwise, for load balancer
+// and keepalived HTTP checks
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	h := checkHealth(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if !h.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// healthState serializes -health-file writes between the prober and drain,
+// which marks the proxy unhealthy as soon as listeners are closed
+var healthState struct {
+	sync.Mutex
+	stopped bool
+}
+
+func setHealthFile(path string, healthy bool) {
+	healthState.Lock()
+	defer healthState.Unlock()
+	if healthState.stopped {
+		return
+	}
+	status := "1\n"
+	if healthy {
+		status = "0\n"
+	}
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, []byte(status), 0644)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.Printf("Failed to write health file `%s`: %v\n", path, err)
+	}
+}
+
+// stopHealthFile sets -health-file to 1 for good, called on shutdown
+func stopHealthFile() {
+	if healthFile != "" {
+		setHealthFile(healthFile, false)
+		healthState.Lock()
+		healthState.stopped = true
+		healthState.Unlock()
+	}
+}
+
+// writeHealthFile keeps -health-file at 0 while healthy and 1 otherwise, as
+// keepalived track_file expects
+func writeHealthFile(ctx context.Context, path string) {
+	healthy := false
+	setHealthFile(path, false)
+	ticker := systemClock.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		h := checkHealth(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if h.Healthy != healthy {
+			healthy = h.Healthy
+			state := "unhealthy"
+			if healthy {
+				state = "healthy"
+			}
+			log.Printf("Health changed to %s, %d of %d targets reachable\n", state, h.Reachable, h.Targets)
+		}
+		setHealthFile(path, healthy)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+	}
+}
+
+// runHealth implements `goproxy health` which exits with 0 when the proxy
+// is healthy and 1 otherwise, for keepalived MISC_CHECK and vrrp_script
+func runHealth(args []string) {
+	cmd := flag.NewFlagSet("goproxy health", flag.ExitOnError)
+	admin := adminFlags(cmd)
+	quiet := cmd.Bool("quiet", false, "Print nothing, only set the exit status")
+	cmd.Parse(args)
+
+	var h healthInfo
+	if err := adminRequest(admin, http.MethodGet, "/health", nil, &h); err != nil {
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Failed to check health: %v\n", err)
+		}
+		os.Exit(1)
+	}
+	if !*quiet {
+		state := "Unhealthy"
+		if h.Healthy {
+			state = "Healthy"
+		}
+		fmt.Printf("%s, %d of %d targets reachable, %d required\n", state, h.Reachable, h.Targets, h.Min)
+	}
+	if !h.Healthy {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// bucket upper bounds of the histograms, the last bucket is unbounded
+var (
+	durationBounds = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+	sizeBounds     = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+	dialBounds     = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// histogram counts observations per bucket, Counts has one more entry than
+// Bounds for values above the last bound
+type histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Count  uint64    `json:"count"`
+	Sum    float64   `json:"sum"`
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.Counts[sort.SearchFloat64s(h.Bounds, v)]++
+	h.Count++
+	h.Sum += v
+}
+
+func (h *histogram) copy() *histogram {
+	c := *h
+	c.Counts = append([]uint64(nil), h.Counts...)
+	return &c
+}
+
+// quantile estimates the q quantile as the upper bound of its bucket, the
+// last bound when it falls beyond
+func (h *histogram) quantile(q float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.Counts[:len(h.Bounds)] {
+		if seen += n; seen >= rank {
+			return h.Bounds[i]
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// valid tells whether a histogram loaded from -stats-file has the current
+// buckets, older ones are started over
+func (h *histogram) valid(bounds []float64) bool {
+	if h == nil || len(h.Bounds) != len(bounds) || len(h.Counts) != len(bounds)+1 {
+		return false
+	}
+	for i, b := range bounds {
+		if h.Bounds[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// recordDial adds the time a successful connect to the target took to its
+// dial latency histogram
+func recordDial(target string, d time.Duration) {
+	accounting.Lock()
+	h := accounting.Dial[target]
+	if h == nil {
+		h = newHistogram(dialBounds)
+		accounting.Dial[target] = h
+	}
+	h.observe(d.Seconds())
+	accounting.Unlock()
+}
+
+// bucketDuration converts a bucket bound in seconds for printing
+func bucketDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
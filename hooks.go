@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// hookTimeout is how long a -on-open or -on-close command may run before it
+// is killed
+const hookTimeout = 30 * time.Second
+
+// hookSlots bounds the hook commands running at once, more wait their turn
+var hookSlots = make(chan struct{}, 32)
+
+// runOpenHook runs -on-open for a connection or session just opened
+func runOpenHook(c *trackedConn) {
+	go runHook(onOpen, c.id, hookEnv("open", c))
+}
+
+// runCloseHook runs -on-close for a connection or session just closed, with
+// the bytes transferred, its duration and why it was closed
+func runCloseHook(c *trackedConn) {
+	env := append(hookEnv("close", c),
+		fmt.Sprintf("GOPROXY_BYTES_IN=%d", atomic.LoadUint64(&c.bytesIn)),
+		fmt.Sprintf("GOPROXY_BYTES_OUT=%d", atomic.LoadUint64(&c.bytesOut)),
+		fmt.Sprintf("GOPROXY_DURATION=%.3f", time.Since(c.started).Seconds()),
+		"GOPROXY_REASON="+connCloseReason(c))
+	go runHook(onClose, c.id, env)
+}
+
+func hookEnv(event string, c *trackedConn) []string {
+	return []string{
+		"GOPROXY_EVENT=" + event,
+		fmt.Sprintf("GOPROXY_ID=%d", c.id),
+		"GOPROXY_PROTO=" + c.proto,
+		"GOPROXY_CLIENT=" + c.client,
+		"GOPROXY_LISTENER=" + c.local,
+		"GOPROXY_TARGET=" + c.target,
+		"GOPROXY_RULE=" + c.rule,
+	}
+}
+
+// runHook runs the command with the shell, logging its output when it fails
+func runHook(command string, id uint64, env []string) {
+	hookSlots <- struct{}{}
+	defer func() { <-hookSlots }()
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("[%d] Hook `%s` failed: %v %s\n", id, command, err, strings.TrimSpace(string(out)))
+	}
+}
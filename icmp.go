@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// unreachable holds UDP targets that answered with an ICMP destination
+// unreachable error, out of rotation until -udp-unreachable-hold passes
+var unreachable = struct {
+	sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+// isIcmpError reports whether err is an ICMP error the kernel reported on a
+// connected UDP socket: port unreachable, or host or network unreachable,
+// including administratively prohibited
+func isIcmpError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+// markUnreachable takes the target out of rotation for -udp-unreachable-hold
+func markUnreachable(target string) {
+	if udpUnreachableHold <= 0 {
+		return
+	}
+	unreachable.Lock()
+	_, held := unreachable.until[target]
+	unreachable.until[target] = time.Now().Add(udpUnreachableHold)
+	unreachable.Unlock()
+	if !held {
+		log.Printf("Target `%s` is unreachable, out of rotation for %v\n", target, udpUnreachableHold)
+		publishEvent("target.unreachable", func() interface{} { return map[string]string{"target": target} })
+	}
+}
+
+// isUnreachable reports whether the target is held out of rotation after an
+// ICMP error, forgetting expired holds
+func isUnreachable(target string) bool {
+	unreachable.Lock()
+	defer unreachable.Unlock()
+	until, ok := unreachable.until[target]
+	if ok && time.Now().After(until) {
+		delete(unreachable.until, target)
+		return false
+	}
+	return ok
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stdioConn is a connection over stdin and stdout, when they are pipes as
+// for an SSH ProxyCommand
+type stdioConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// stdioClient returns the client connection of -inetd mode: the socket
+// passed by inetd or a systemd socket unit with Accept=yes as stdin, or
+// stdin and stdout otherwise
+func stdioClient() io.ReadWriteCloser {
+	if conn, err := net.FileConn(os.Stdin); err == nil {
+		if sameFile(os.Stdin, os.Stderr) && logFilePath == "" {
+			// inetd passes the socket as stderr too
+			log.SetOutput(io.Discard)
+		}
+		if debug.Load() {
+			log.Printf("Serving connection from `%s`\n", conn.RemoteAddr())
+		}
+		return conn
+	}
+	return stdioConn{os.Stdin, os.Stdout}
+}
+
+// resolveTargets waits up to -timeout for the first resolution of targets;
+// SRV names are resolved with the system resolver without -dns, the targets
+// are then ordered by preference
+func resolveTargets(ctx context.Context, connectTo []string) (targets []Target, ordered bool) {
+	if srv && dnsServer == "" {
+		return lookupSrv(connectTo), true
+	}
+	if dnsServer == "" {
+		return staticTargets(connectTo), false
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resolver := make(chan []Target, 1)
+	go refreshDns(ctx, connectTo, resolver, nil)
+	select {
+	case targets = <-resolver:
+	case <-ctx.Done():
+	}
+	return
+}
+
+// lookupSrv returns targets of SRV names ordered by priority and randomized
+// by weight
+func lookupSrv(names []string) []Target {
+	var targets []Target
+	for _, name := range names {
+		_, addrs, err := net.LookupSRV("", "", name)
+		if err != nil {
+			log.Printf("Error resolving `%s`: %v error=dns\n", name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			host := strings.TrimSuffix(addr.Target, ".")
+			targets = append(targets, Target{Addr: net.JoinHostPort(host, strconv.Itoa(int(addr.Port))), Source: sourceSrv,
+				Name: host, Priority: addr.Priority, Weight: addr.Weight})
+		}
+	}
+	return withZones(targets)
+}
+
+// dialAny connects to the first of ordered targets or one picked as for
+// proxied connections, trying the remaining targets in turn when the
+// connection fails
+func dialAny(ctx context.Context, targets []Target, ordered bool) (net.Conn, string, error) {
+	var err error
+	for len(targets) > 0 {
+		target := targets[0].Addr
+		if !ordered {
+			target = pickTarget(targets)
+		}
+		if target == "" {
+			break
+		}
+		var conn net.Conn
+		if conn, err = dialTcp(ctx, target, nil); err == nil {
+			return conn, target, nil
+		}
+		log.Printf("Conection to `%s` failed: %v error=dial\n", target, err)
+		var rest []Target
+		for _, t := range targets {
+			if t.Addr != target {
+				rest = append(rest, t)
+			}
+		}
+		targets = rest
+	}
+	return nil, "", err
+}
+
+// serveInetd forwards a single client connection on stdin/stdout to a
+// target and returns when the target closes the connection
+func serveInetd(ctx context.Context, connectTo []string) {
+	client := stdioClient()
+	rand.Seed(time.Now().UnixNano())
+	setupNat64()
+
+	targets, ordered := resolveTargets(ctx, connectTo)
+	if len(targets) == 0 {
+		fatalf(errDns, "No targets resolved from %v\n", connectTo)
+	}
+	fwd, target, err := dialAny(ctx, targets, ordered)
+	if err != nil {
+		fatalf(errDial, "Failed to connect to any of %v: %v\n", targets, err)
+	}
+	if verbose.Load() {
+		log.Printf("Connected to `%s`\n", target)
+	}
+	go func() {
+		io.Copy(fwd, client)
+		// pass on EOF, e.g. for ssh to see the end of the session
+		if cw, ok := fwd.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			fwd.Close()
+		}
+	}()
+	io.Copy(client, fwd)
+	client.Close()
+}
+
+// runConnect is the netcat-like `goproxy connect` mode: -inetd with targets
+// given as `host:port` or SRV names like `_ssh._tcp.example.com`
+func runConnect(args []string) {
+	os.Args = append(os.Args[:1], args...)
+	parseFlags()
+	if len(flags.Args()) == 0 {
+		usage()
+		os.Exit(errorKinds[errConfig].exit)
+	}
+	names := 0
+	for _, target := range flags.Args() {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			names++
+		}
+	}
+	if names > 0 && names < len(flags.Args()) {
+		fatalf(errConfig, "Targets must be either all SRV names or all host:port\n")
+	}
+	srv = srv || names > 0
+	serveInetd(serveCtx, flags.Args())
+}
+
+func sameFile(a, b *os.File) bool {
+	ai, err1 := a.Stat()
+	bi, err2 := b.Stat()
+	return err1 == nil && err2 == nil && os.SameFile(ai, bi)
+}
@@ -0,0 +1,841 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The KCP transport of -mux carries the multiplexing connections over UDP
+// with KCP's ARQ: segments are acknowledged one by one as well as
+// cumulatively, a lost segment is sent again after a retransmission timeout
+// growing by half, or as soon as two later segments were acknowledged, and
+// there is no congestion window, so a long-fat or lossy link doesn't stall
+// the way TCP carried over TCP does. A UDP packet holds segments with the
+// 24-byte little-endian header of KCP: conversation, command, fragment
+// (unused, the connection is a stream), receive window, timestamp,
+// sequence number, next expected sequence number and length.
+const (
+	kcpPush  = 81
+	kcpAck   = 82
+	kcpWask  = 83 // asks for the receive window, also a keepalive
+	kcpWins  = 84 // tells the receive window
+	kcpClose = 85 // the sender closed the connection
+
+	kcpHeaderSize = 24
+	kcpMtu        = 1400
+	// segments in flight and queued for reading
+	kcpWindow   = 1024
+	kcpInterval = 10 * time.Millisecond
+	// retransmission timeouts in milliseconds
+	kcpMinRto = 30
+	kcpDefRto = 200
+	kcpMaxRto = 60000
+	// acknowledgements of later segments before a segment is sent again
+	kcpFastResend = 2
+	// transmissions of a segment before the peer is given up on
+	kcpDeadLink = 20
+	// window asks to the peer while its window is closed and when idle
+	kcpProbe     = 500 * time.Millisecond
+	kcpKeepalive = 10 * time.Second
+	kcpIdle      = 30 * time.Second
+	// copies of the unacknowledged close, the idle timeout of the peer
+	// ends the connection when all are lost
+	kcpCloses = 3
+)
+
+var (
+	errKcpReset    = errors.New("connection closed by peer")
+	errKcpIdle     = fmt.Errorf("no packets from peer for %v", kcpIdle)
+	errKcpDead     = fmt.Errorf("segment sent %d times without acknowledgement", kcpDeadLink)
+	errKcpNoAnswer = errors.New("no answer over KCP")
+)
+
+// muxFecData and muxFecParity are the shards of -mux-fec, 0 without FEC
+var muxFecData, muxFecParity int
+
+type kcpSegment struct {
+	sn       uint32
+	ts       uint32 // of the last transmission
+	resendAt uint32
+	rto      uint32
+	fastack  int
+	xmit     int
+	data     []byte
+}
+
+type kcpAckEntry struct {
+	sn, ts uint32
+}
+
+// kcpConn is a reliable stream over UDP, sending with output and fed by
+// the packet reader of the dialed socket or of the listener
+type kcpConn struct {
+	conv          uint32
+	local, remote net.Addr
+	start         time.Time
+	mtu, mss      int
+
+	smu    sync.Mutex // serializes output and the FEC encoder
+	output func([]byte) error
+	enc    *fecEncoder
+	dec    *fecDecoder // used by the packet reader only
+
+	mu             sync.Mutex
+	sndUna, sndNxt uint32
+	rcvNxt         uint32
+	rmtWnd         uint32
+	sndQueue       bytes.Buffer
+	sndBuf         []*kcpSegment
+	rcvBuf         map[uint32][]byte
+	rcvQueue       bytes.Buffer
+	acks           []kcpAckEntry
+	srtt, rttval   int32
+	rto            uint32
+	tell           bool // send the window, asked or reopened by a read
+	probeAt        time.Time
+	lastRecv       time.Time
+	lastSend       time.Time
+	established    bool
+	closed         bool  // closed locally
+	err            error // the connection failed or the peer closed it
+	readDeadline   time.Time
+	writeDeadline  time.Time
+
+	wake      chan struct{} // data, an error or a new read deadline
+	written   chan struct{} // room in the send queue or a new write deadline
+	kick      chan struct{} // something to send
+	answered  chan struct{} // closed on the first packet from the peer
+	done      chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+}
+
+func newKcpConn(conv uint32, local, remote net.Addr, output func([]byte) error) *kcpConn {
+	c := &kcpConn{conv: conv, local: local, remote: remote, start: time.Now(), mtu: kcpMtu, output: output,
+		rmtWnd: kcpWindow, rcvBuf: make(map[uint32][]byte), rto: kcpDefRto, lastRecv: time.Now(), lastSend: time.Now(),
+		wake: make(chan struct{}, 1), written: make(chan struct{}, 1), kick: make(chan struct{}, 1),
+		answered: make(chan struct{}), done: make(chan struct{})}
+	if muxFecParity > 0 {
+		c.enc, c.dec = newFecEncoder(muxFecData, muxFecParity), newFecDecoder(muxFecData, muxFecParity)
+		c.mtu -= fecHeaderSize + 2
+	}
+	c.mss = c.mtu - kcpHeaderSize
+	return c
+}
+
+// now returns the milliseconds since the connection started, for
+// timestamps and timeouts
+func (c *kcpConn) now() uint32 {
+	return uint32(time.Since(c.start).Milliseconds())
+}
+
+func (c *kcpConn) segment(cmd byte, wnd uint16, ts, sn uint32, data []byte) []byte {
+	b := make([]byte, kcpHeaderSize, kcpHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(b, c.conv)
+	b[4] = cmd
+	binary.LittleEndian.PutUint16(b[6:], wnd)
+	binary.LittleEndian.PutUint32(b[8:], ts)
+	binary.LittleEndian.PutUint32(b[12:], sn)
+	binary.LittleEndian.PutUint32(b[16:], c.rcvNxt)
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(data)))
+	return append(b, data...)
+}
+
+// rcvWindow returns the segments the peer may send beyond those read
+func (c *kcpConn) rcvWindow() uint16 {
+	queued := (c.rcvQueue.Len() + c.mss - 1) / c.mss
+	if queued >= kcpWindow {
+		return 0
+	}
+	return uint16(kcpWindow - queued)
+}
+
+// receive passes a packet from the peer through the FEC decoder
+func (c *kcpConn) receive(pkt []byte) {
+	if c.dec == nil {
+		c.input(pkt)
+		return
+	}
+	for _, p := range c.dec.decode(pkt) {
+		c.input(p)
+	}
+}
+
+func (c *kcpConn) input(pkt []byte) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	now := c.now()
+	valid, acked, freed := false, false, false
+	var maxAck uint32
+loop:
+	for len(pkt) >= kcpHeaderSize {
+		conv, cmd, wnd := binary.LittleEndian.Uint32(pkt), pkt[4], binary.LittleEndian.Uint16(pkt[6:])
+		ts, sn := binary.LittleEndian.Uint32(pkt[8:]), binary.LittleEndian.Uint32(pkt[12:])
+		una, length := binary.LittleEndian.Uint32(pkt[16:]), binary.LittleEndian.Uint32(pkt[20:])
+		if conv != c.conv || int64(length) > int64(len(pkt)-kcpHeaderSize) {
+			break
+		}
+		data := pkt[kcpHeaderSize : kcpHeaderSize+length]
+		pkt = pkt[kcpHeaderSize+length:]
+		switch cmd {
+		case kcpAck:
+			if rtt := int32(now - ts); rtt >= 0 {
+				c.updateRtt(rtt)
+			}
+			if c.ackSegment(sn) {
+				freed = true
+			}
+			if !acked || int32(sn-maxAck) > 0 {
+				maxAck, acked = sn, true
+			}
+		case kcpPush:
+			if int32(sn-c.rcvNxt-kcpWindow) < 0 {
+				c.acks = append(c.acks, kcpAckEntry{sn, ts})
+				if _, dup := c.rcvBuf[sn]; !dup && int32(sn-c.rcvNxt) >= 0 {
+					c.rcvBuf[sn] = append([]byte(nil), data...)
+				}
+			}
+		case kcpWask:
+			c.tell = true
+		case kcpWins:
+		case kcpClose:
+			c.err = errKcpReset
+		default:
+			break loop
+		}
+		valid = true
+		c.rmtWnd = uint32(wnd)
+		if c.ackUna(una) {
+			freed = true
+		}
+	}
+	if acked {
+		for _, seg := range c.sndBuf {
+			if int32(seg.sn-maxAck) < 0 {
+				seg.fastack++
+			}
+		}
+	}
+	moved := false
+	for {
+		data, ok := c.rcvBuf[c.rcvNxt]
+		if !ok {
+			break
+		}
+		c.rcvQueue.Write(data)
+		delete(c.rcvBuf, c.rcvNxt)
+		c.rcvNxt++
+		moved = true
+	}
+	if c.closed {
+		c.rcvQueue.Reset()
+	}
+	answered := false
+	if valid {
+		c.lastRecv = time.Now()
+		answered, c.established = !c.established, true
+	}
+	send := len(c.acks) > 0 || c.tell || freed
+	failed := c.err != nil
+	c.mu.Unlock()
+	if answered {
+		close(c.answered)
+	}
+	if moved || failed {
+		notify(c.wake)
+	}
+	if send {
+		notify(c.kick)
+	}
+	if failed {
+		c.shutdown()
+	}
+}
+
+func (c *kcpConn) updateRtt(rtt int32) {
+	if c.srtt == 0 {
+		c.srtt, c.rttval = rtt, rtt/2
+	} else {
+		delta := rtt - c.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttval = (3*c.rttval + delta) / 4
+		if c.srtt = (7*c.srtt + rtt) / 8; c.srtt < 1 {
+			c.srtt = 1
+		}
+	}
+	variance := 4 * c.rttval
+	if interval := int32(kcpInterval / time.Millisecond); variance < interval {
+		variance = interval
+	}
+	rto := c.srtt + variance
+	if rto < kcpMinRto {
+		rto = kcpMinRto
+	} else if rto > kcpMaxRto {
+		rto = kcpMaxRto
+	}
+	c.rto = uint32(rto)
+}
+
+// ackUna drops the segments before una, received by the peer in order
+func (c *kcpConn) ackUna(una uint32) bool {
+	n := 0
+	for n < len(c.sndBuf) && int32(c.sndBuf[n].sn-una) < 0 {
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+	c.sndBuf = c.sndBuf[n:]
+	c.updateUna()
+	return true
+}
+
+// ackSegment drops the segment received by the peer out of order
+func (c *kcpConn) ackSegment(sn uint32) bool {
+	if int32(sn-c.sndUna) < 0 || int32(sn-c.sndNxt) >= 0 {
+		return false
+	}
+	for i, seg := range c.sndBuf {
+		if seg.sn == sn {
+			c.sndBuf = append(c.sndBuf[:i], c.sndBuf[i+1:]...)
+			c.updateUna()
+			return true
+		}
+		if int32(seg.sn-sn) > 0 {
+			break
+		}
+	}
+	return false
+}
+
+func (c *kcpConn) updateUna() {
+	if len(c.sndBuf) > 0 {
+		c.sndUna = c.sndBuf[0].sn
+	} else {
+		c.sndUna = c.sndNxt
+	}
+}
+
+// flush returns the packets of the pending acknowledgements, window asks
+// and tells, and the segments due to be sent
+func (c *kcpConn) flush() ([][]byte, error) {
+	var packets [][]byte
+	var pkt []byte
+	now := c.now()
+	wnd := c.rcvWindow()
+	emit := func(cmd byte, ts, sn uint32, data []byte) {
+		if len(pkt)+kcpHeaderSize+len(data) > c.mtu {
+			packets, pkt = append(packets, pkt), nil
+		}
+		pkt = append(pkt, c.segment(cmd, wnd, ts, sn, data)...)
+	}
+	for _, a := range c.acks {
+		emit(kcpAck, a.ts, a.sn, nil)
+	}
+	c.acks = c.acks[:0]
+	if c.tell {
+		emit(kcpWins, now, 0, nil)
+		c.tell = false
+	}
+	if c.rmtWnd == 0 && time.Now().After(c.probeAt) {
+		emit(kcpWask, now, 0, nil)
+		c.probeAt = time.Now().Add(kcpProbe)
+	}
+
+	window := c.rmtWnd
+	if window > kcpWindow {
+		window = kcpWindow
+	}
+	queued := false
+	for c.sndQueue.Len() > 0 && int32(c.sndNxt-c.sndUna-window) < 0 {
+		n := c.sndQueue.Len()
+		if n > c.mss {
+			n = c.mss
+		}
+		data := make([]byte, n)
+		c.sndQueue.Read(data)
+		c.sndBuf = append(c.sndBuf, &kcpSegment{sn: c.sndNxt, data: data})
+		c.sndNxt++
+		queued = true
+	}
+	if queued {
+		notify(c.written)
+	}
+	for _, seg := range c.sndBuf {
+		switch {
+		case seg.xmit == 0:
+			seg.rto = c.rto
+		case int32(now-seg.resendAt) >= 0:
+			if seg.rto += seg.rto / 2; seg.rto > kcpMaxRto {
+				seg.rto = kcpMaxRto
+			}
+		case seg.fastack >= kcpFastResend:
+		default:
+			continue
+		}
+		if seg.xmit++; seg.xmit > kcpDeadLink {
+			return nil, errKcpDead
+		}
+		seg.ts, seg.resendAt, seg.fastack = now, now+seg.rto, 0
+		emit(kcpPush, now, seg.sn, seg.data)
+	}
+	if pkt == nil && time.Since(c.lastSend) >= kcpKeepalive {
+		emit(kcpWask, now, 0, nil)
+	}
+	if pkt != nil {
+		packets = append(packets, pkt)
+	}
+	if len(packets) > 0 {
+		c.lastSend = time.Now()
+	}
+	return packets, nil
+}
+
+func (c *kcpConn) send(packets [][]byte) {
+	c.smu.Lock()
+	defer c.smu.Unlock()
+	for _, pkt := range packets {
+		if c.enc == nil {
+			c.output(pkt)
+			continue
+		}
+		for _, p := range c.enc.encode(pkt) {
+			c.output(p)
+		}
+	}
+}
+
+// run sends what is due every interval while segments are in flight, and
+// on demand or for the keepalive otherwise
+func (c *kcpConn) run() {
+	timer := time.NewTimer(kcpInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.kick:
+		case <-timer.C:
+		}
+		c.mu.Lock()
+		packets, err := c.flush()
+		if err == nil && time.Since(c.lastRecv) > kcpIdle {
+			err = errKcpIdle
+		}
+		if err != nil {
+			c.err = err
+			c.mu.Unlock()
+			if debug.Load() {
+				log.Printf("KCP connection with `%s` failed: %v\n", c.remote, err)
+			}
+			notify(c.wake)
+			notify(c.written)
+			c.shutdown()
+			return
+		}
+		wait := kcpKeepalive
+		if len(c.sndBuf) > 0 || c.sndQueue.Len() > 0 || c.rmtWnd == 0 {
+			wait = kcpInterval
+		}
+		// closed with everything delivered
+		delivered := c.closed && len(c.sndBuf) == 0 && c.sndQueue.Len() == 0
+		if delivered {
+			for i := 0; i < kcpCloses; i++ {
+				packets = append(packets, c.segment(kcpClose, 0, c.now(), 0, nil))
+			}
+		}
+		c.mu.Unlock()
+		c.send(packets)
+		if delivered {
+			c.shutdown()
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// handshake asks the peer for its window until it answers, so a dial
+// fails when no goproxy listens
+func (c *kcpConn) handshake(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(kcpProbe / 2)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		pkt := c.segment(kcpWask, c.rcvWindow(), c.now(), 0, nil)
+		c.mu.Unlock()
+		c.send([][]byte{pkt})
+		select {
+		case <-c.answered:
+			return nil
+		case <-ctx.Done():
+			return errKcpNoAnswer
+		case <-ticker.C:
+		}
+	}
+}
+
+// shutdown stops the connection once, releasing its socket or its slot in
+// the listener
+func (c *kcpConn) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+}
+
+// wait blocks until ch is notified, the deadline passes or the connection
+// is shut down
+func (c *kcpConn) wait(ch chan struct{}, deadline time.Time) error {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-c.done:
+		return nil
+	}
+}
+
+func (c *kcpConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.rcvQueue.Len() > 0 {
+			full := c.rcvWindow() == 0
+			n, _ := c.rcvQueue.Read(p)
+			reopened := full && c.rcvWindow() > 0
+			if reopened {
+				c.tell = true
+			}
+			c.mu.Unlock()
+			if reopened {
+				notify(c.kick)
+			}
+			return n, nil
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if c.err == errKcpReset {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if err := c.wait(c.wake, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *kcpConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		room := kcpWindow*c.mss - c.sndQueue.Len()
+		if room <= 0 {
+			deadline := c.writeDeadline
+			c.mu.Unlock()
+			if err := c.wait(c.written, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if room > len(p)-written {
+			room = len(p) - written
+		}
+		c.sndQueue.Write(p[written : written+room])
+		written += room
+		c.mu.Unlock()
+		notify(c.kick)
+	}
+	return written, nil
+}
+
+// Close tells the peer once the data written is delivered, or right away
+// when the connection failed
+func (c *kcpConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.rcvQueue.Reset()
+	pending := c.err == nil && (len(c.sndBuf) > 0 || c.sndQueue.Len() > 0)
+	var packets [][]byte
+	if c.err == nil && !pending {
+		for i := 0; i < kcpCloses; i++ {
+			packets = append(packets, c.segment(kcpClose, 0, c.now(), 0, nil))
+		}
+	}
+	c.mu.Unlock()
+	notify(c.wake)
+	notify(c.written)
+	if pending {
+		notify(c.kick)
+		return nil
+	}
+	c.send(packets)
+	c.shutdown()
+	return nil
+}
+
+func (c *kcpConn) LocalAddr() net.Addr  { return c.local }
+func (c *kcpConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *kcpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *kcpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.wake)
+	return nil
+}
+
+func (c *kcpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.written)
+	return nil
+}
+
+// dialKcp connects a multiplexing connection to the goproxy with -mux
+// listen -mux-transport kcp at target
+func dialKcp(ctx context.Context, target string) (net.Conn, error) {
+	conn, err := dialUpstream(ctx, "udp", target)
+	if err != nil {
+		return nil, err
+	}
+	conn = countFd(conn)
+	c := newKcpConn(rand.Uint32(), conn.LocalAddr(), conn.RemoteAddr(), func(p []byte) error {
+		_, err := conn.Write(p)
+		return err
+	})
+	c.onClose = func() { conn.Close() }
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := conn.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// port unreachable until the peer listens is left to the
+			// handshake and idle timeouts
+			if err == nil {
+				c.receive(buf[:n])
+			}
+		}
+	}()
+	if err := c.handshake(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go c.run()
+	return c, nil
+}
+
+// kcpListener accepts KCP connections on a UDP socket, telling them apart
+// by the peer address
+type kcpListener struct {
+	conn   *net.UDPConn
+	mu     sync.Mutex
+	conns  map[string]*kcpConn
+	accept chan net.Conn
+	done   chan struct{}
+	closed bool
+}
+
+func newKcpListener(conn *net.UDPConn) *kcpListener {
+	l := &kcpListener{conn: conn, conns: make(map[string]*kcpConn), accept: make(chan net.Conn, muxAcceptQueue), done: make(chan struct{})}
+	go l.readPackets()
+	return l
+}
+
+// kcpOpening returns the conversation of a packet that may start a
+// connection: a window ask or the first segment, as sent by dialKcp
+func kcpOpening(pkt []byte) (uint32, bool) {
+	if muxFecParity > 0 {
+		if len(pkt) < fecHeaderSize || binary.LittleEndian.Uint16(pkt[4:]) != fecData {
+			return 0, false
+		}
+		if pkt = fecPayload(pkt[fecHeaderSize:]); pkt == nil {
+			return 0, false
+		}
+	}
+	if len(pkt) < kcpHeaderSize || binary.LittleEndian.Uint32(pkt[16:]) != 0 {
+		return 0, false
+	}
+	switch pkt[4] {
+	case kcpWask:
+		return binary.LittleEndian.Uint32(pkt), true
+	case kcpPush:
+		return binary.LittleEndian.Uint32(pkt), binary.LittleEndian.Uint32(pkt[12:]) == 0
+	}
+	return 0, false
+}
+
+func (l *kcpListener) readPackets() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		key := addr.String()
+		l.mu.Lock()
+		c := l.conns[key]
+		if c == nil && !l.closed {
+			if conv, ok := kcpOpening(buf[:n]); ok {
+				c = l.newConn(conv, addr)
+			}
+		}
+		l.mu.Unlock()
+		if c != nil {
+			c.receive(buf[:n])
+		}
+	}
+}
+
+// newConn queues a new connection for accepting, nil when the queue is
+// full and the peer has to try again
+func (l *kcpListener) newConn(conv uint32, addr *net.UDPAddr) *kcpConn {
+	key := addr.String()
+	c := newKcpConn(conv, l.conn.LocalAddr(), addr, func(p []byte) error {
+		_, err := l.conn.WriteToUDP(p, addr)
+		return err
+	})
+	c.onClose = func() { l.remove(key, c) }
+	select {
+	case l.accept <- c:
+	default:
+		return nil
+	}
+	l.conns[key] = c
+	go c.run()
+	return c
+}
+
+func (l *kcpListener) remove(key string, c *kcpConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[key] == c {
+		delete(l.conns, key)
+	}
+	if l.closed && len(l.conns) == 0 {
+		l.conn.Close()
+	}
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting, the socket stays open for the connections already
+// accepted until they are closed
+func (l *kcpListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	l.mu.Unlock()
+	for {
+		select {
+		case c := <-l.accept:
+			c.Close()
+			continue
+		default:
+		}
+		break
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.conns) == 0 {
+		return l.conn.Close()
+	}
+	return nil
+}
+
+func (l *kcpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// listenKcp binds the UDP socket of -mux listen -mux-transport kcp
+func listenKcp(ctx context.Context, listenOn string) net.Listener {
+	var conn *net.UDPConn
+	err := retryBind(ctx, "KCP", listenOn, func() (err error) {
+		conn, err = listenUdp(listenOn)
+		return
+	})
+	if err != nil {
+		fatalf(errBind, "Failed to setup KCP listener on `%s`: %v%s\n", listenOn, err, freebindHint(err))
+	}
+	listener := newMuxListener(newKcpListener(conn))
+	addListener(listener)
+	return listener
+}
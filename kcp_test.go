@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// kcpPair returns two connected KCP connections whose packets are dropped
+// with the given probability
+func kcpPair(t *testing.T, loss float64) (*kcpConn, *kcpConn) {
+	t.Helper()
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	var a, b *kcpConn
+	link := func(to **kcpConn, seed int64) func([]byte) error {
+		packets := make(chan []byte, 4096)
+		go func() {
+			r := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case p := <-packets:
+					if r.Float64() >= loss {
+						(*to).receive(p)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+		return func(p []byte) error {
+			select {
+			case packets <- append([]byte(nil), p...):
+			default:
+			}
+			return nil
+		}
+	}
+	a = newKcpConn(7, addr, addr, link(&b, 1))
+	b = newKcpConn(7, addr, addr, link(&a, 2))
+	go a.run()
+	go b.run()
+	return a, b
+}
+
+func TestKcpTransfer(t *testing.T) {
+	defer func(data, parity int) { muxFecData, muxFecParity = data, parity }(muxFecData, muxFecParity)
+	tests := []struct {
+		name         string
+		loss         float64
+		data, parity int
+	}{
+		{"clean", 0, 0, 0},
+		{"lossy", 0.1, 0, 0},
+		{"lossy with fec", 0.1, 10, 3},
+		{"clean with fec", 0, 4, 1},
+	}
+	for _, test := range tests {
+		muxFecData, muxFecParity = test.data, test.parity
+		a, b := kcpPair(t, test.loss)
+		sent := make([]byte, 2*1024*1024)
+		rand.New(rand.NewSource(3)).Read(sent)
+		go func() {
+			a.Write(sent)
+			a.Close()
+		}()
+		b.SetReadDeadline(time.Now().Add(20 * time.Second))
+		got, err := io.ReadAll(b)
+		if err != nil || !bytes.Equal(got, sent) {
+			t.Errorf("%s: read %d of %d bytes, error %v", test.name, len(got), len(sent), err)
+		}
+		b.Close()
+	}
+}
+
+func TestKcpClose(t *testing.T) {
+	a, b := kcpPair(t, 0)
+	if _, err := a.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, error %v", buf, err)
+	}
+	b.Close()
+	if _, err := b.Read(buf); err != net.ErrClosed {
+		t.Errorf("read after close: %v, want %v", err, net.ErrClosed)
+	}
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := a.Read(buf); err != io.EOF {
+		t.Errorf("read after the peer closed: %v, want EOF", err)
+	}
+	if _, err := a.Write(buf); err != errKcpReset {
+		t.Errorf("write after the peer closed: %v, want %v", err, errKcpReset)
+	}
+}
+
+func TestKcpOpening(t *testing.T) {
+	defer func(data, parity int) { muxFecData, muxFecParity = data, parity }(muxFecData, muxFecParity)
+	muxFecData, muxFecParity = 0, 0
+	c := newKcpConn(42, nil, nil, nil)
+	tests := []struct {
+		name string
+		pkt  []byte
+		ok   bool
+	}{
+		{"window ask", c.segment(kcpWask, kcpWindow, 0, 0, nil), true},
+		{"first segment", c.segment(kcpPush, kcpWindow, 0, 0, []byte("goproxy-mux/1\n")), true},
+		{"later segment", c.segment(kcpPush, kcpWindow, 0, 5, []byte("x")), false},
+		{"acknowledgement", c.segment(kcpAck, kcpWindow, 0, 0, nil), false},
+		{"truncated", c.segment(kcpWask, kcpWindow, 0, 0, nil)[:20], false},
+	}
+	for _, test := range tests {
+		if conv, ok := kcpOpening(test.pkt); ok != test.ok || ok && conv != 42 {
+			t.Errorf("%s: conversation %d, opening %v", test.name, conv, ok)
+		}
+	}
+	muxFecData, muxFecParity = 10, 3
+	wask := c.segment(kcpWask, kcpWindow, 0, 0, nil)
+	if _, ok := kcpOpening(wask); ok {
+		t.Error("opening without FEC header with -mux-fec")
+	}
+	if _, ok := kcpOpening(newFecEncoder(10, 3).encode(wask)[0]); !ok {
+		t.Error("no opening with FEC header")
+	}
+}
+
+func TestFecRecover(t *testing.T) {
+	const data, parity = 10, 3
+	var payloads, packets [][]byte
+	r := rand.New(rand.NewSource(4))
+	e := newFecEncoder(data, parity)
+	for i := 0; i < data; i++ {
+		p := make([]byte, 20+r.Intn(1000))
+		r.Read(p)
+		payloads = append(payloads, p)
+		packets = append(packets, e.encode(p)...)
+	}
+	if len(packets) != data+parity {
+		t.Fatalf("%d packets, want %d", len(packets), data+parity)
+	}
+	tests := []struct {
+		name      string
+		lost      []int
+		recovered int
+	}{
+		{"nothing lost", nil, data},
+		{"parity lost", []int{10, 11, 12}, data},
+		{"data lost", []int{0, 5, 9}, data},
+		{"mixed", []int{3, 10, 12}, data},
+		{"too many lost", []int{0, 1, 2, 3}, data - 4},
+	}
+	for _, test := range tests {
+		d := newFecDecoder(data, parity)
+		lost := make(map[int]bool)
+		for _, i := range test.lost {
+			lost[i] = true
+		}
+		got := make(map[string]bool)
+		for i, p := range packets {
+			if !lost[i] {
+				for _, payload := range d.decode(p) {
+					got[string(payload)] = true
+				}
+			}
+		}
+		n := 0
+		for _, p := range payloads {
+			if got[string(p)] {
+				n++
+			}
+		}
+		if n != test.recovered || len(got) != test.recovered {
+			t.Errorf("%s: %d of %d payloads and %d in all, want %d", test.name, n, data, len(got), test.recovered)
+		}
+	}
+}
+
+func TestParseFec(t *testing.T) {
+	tests := []struct {
+		s            string
+		data, parity int
+		fails        bool
+	}{
+		{"10,3", 10, 3, false},
+		{"1,1", 1, 1, false},
+		{"10,0", 0, 0, false},
+		{"0,3", 0, 0, true},
+		{"200,56", 0, 0, true},
+		{"10,-1", 0, 0, true},
+		{"10", 0, 0, true},
+		{"x,3", 0, 0, true},
+	}
+	for _, test := range tests {
+		data, parity, err := parseFec(test.s)
+		if (err != nil) != test.fails || data != test.data || parity != test.parity {
+			t.Errorf("%s: %d,%d error %v", test.s, data, parity, err)
+		}
+	}
+}
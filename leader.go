@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// leaderLease is a lease held by one of the instances sharing -leader; the
+// others wait for it to be released or to expire
+type leaderLease interface {
+	// acquire tries once to take the lease, returning false while another
+	// instance holds it
+	acquire(ctx context.Context) (bool, error)
+	// renew extends the lease, errLeaseLost means another instance holds it
+	renew(ctx context.Context) error
+	release()
+}
+
+var errLeaseLost = errors.New("lease is held by another instance")
+
+// leader holds the -leader lease, held once acquired
+var leader struct {
+	sync.Mutex
+	lease leaderLease
+	held  bool
+}
+
+// parseLeader returns the lease named by -leader: consul://host:port/key for
+// a Consul session lock, or a file path on shared storage
+func parseLeader(spec string, ttl time.Duration) (leaderLease, error) {
+	host, _ := os.Hostname()
+	id := fmt.Sprintf("%s:%d", host, os.Getpid())
+	if !strings.Contains(spec, "://") {
+		return &fileLease{path: spec, id: id, ttl: ttl}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return &fileLease{path: u.Path, id: id, ttl: ttl}, nil
+	case "consul":
+		key := strings.Trim(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return nil, fmt.Errorf("consul://host:port/key expected")
+		}
+		if ttl < 10*time.Second {
+			return nil, fmt.Errorf("Consul sessions need -leader-ttl of at least 10s")
+		}
+		return &consulLease{addr: u.Host, key: key, id: id, ttl: ttl,
+			client: &http.Client{Timeout: ttl / 3}}, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme `%s`", u.Scheme)
+}
+
+// waitLeadership holds startup, before listeners are bound, until this
+// instance holds the -leader lease, then keeps renewing it in background;
+// when the lease is lost the process exits so that only the new leader
+// forwards, and the supervisor restarts it as standby
+func waitLeadership(ctx context.Context) {
+	lease := leader.lease
+	interval := leaderTtl / 3
+	waiting := false
+	for {
+		ok, err := lease.acquire(ctx)
+		if err != nil {
+			log.Printf("Failed to acquire leadership `%s`: %v\n", leaderSpec, err)
+		} else if ok {
+			break
+		} else if !waiting {
+			log.Printf("Standing by, leadership `%s` is held by another instance\n", leaderSpec)
+			waiting = true
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+	leader.Lock()
+	leader.held = true
+	leader.Unlock()
+	log.Printf("Acquired leadership `%s`\n", leaderSpec)
+	audit("leader election", "acquire leadership "+leaderSpec, nil, nil)
+	go keepLeadership(ctx, lease, interval)
+}
+
+func keepLeadership(ctx context.Context, lease leaderLease, interval time.Duration) {
+	renewed := time.Now()
+	ticker := systemClock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.Chan():
+		case <-ctx.Done():
+			return
+		}
+		err := lease.renew(ctx)
+		if err == nil {
+			renewed = time.Now()
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// keep forwarding through transient failures while the lease
+		// can't have expired yet
+		if err != errLeaseLost && time.Since(renewed) < leaderTtl-interval {
+			log.Printf("Failed to renew leadership `%s`: %v\n", leaderSpec, err)
+			continue
+		}
+		audit("leader election", "lose leadership "+leaderSpec, nil, nil)
+		fatalf(errOther, "Lost leadership `%s`: %v\n", leaderSpec, err)
+	}
+}
+
+// releaseLeadership gives the lease up on shutdown so the standby takes
+// over without waiting for it to expire
+func releaseLeadership() {
+	leader.Lock()
+	defer leader.Unlock()
+	if leader.held {
+		leader.lease.release()
+		leader.held = false
+	}
+}
+
+// fileLease is a lease file on storage shared by the instances, rewritten
+// by rename; the instances' clocks must agree to well within the TTL
+type fileLease struct {
+	path string
+	id   string
+	ttl  time.Duration
+}
+
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+func (l *fileLease) read() (leaseRecord, error) {
+	var rec leaseRecord
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	// a torn or foreign file is taken as expired
+	json.Unmarshal(data, &rec)
+	return rec, nil
+}
+
+func (l *fileLease) write() error {
+	data, err := json.Marshal(leaseRecord{l.id, time.Now().Add(l.ttl)})
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", l.path, os.Getpid())
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+func (l *fileLease) acquire(ctx context.Context) (bool, error) {
+	rec, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	if rec.Holder != l.id && time.Now().Before(rec.Expires) {
+		return false, nil
+	}
+	if err := l.write(); err != nil {
+		return false, err
+	}
+	// another standby may have found the lease expired at the same time,
+	// the last rename wins
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	rec, err = l.read()
+	return err == nil && rec.Holder == l.id, err
+}
+
+func (l *fileLease) renew(ctx context.Context) error {
+	rec, err := l.read()
+	if err != nil {
+		return err
+	}
+	if rec.Holder != l.id {
+		return errLeaseLost
+	}
+	return l.write()
+}
+
+func (l *fileLease) release() {
+	if rec, err := l.read(); err == nil && rec.Holder == l.id {
+		os.Remove(l.path)
+	}
+}
+
+// consulLease is a Consul KV lock held by a session with a TTL; the key is
+// deleted when the session expires. A token is taken from
+// CONSUL_HTTP_TOKEN
+type consulLease struct {
+	addr    string
+	key     string
+	id      string
+	ttl     time.Duration
+	client  *http.Client
+	session string
+}
+
+func (l *consulLease) request(ctx context.Context, method, path string, body, v interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+l.addr+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("Consul returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (l *consulLease) acquire(ctx context.Context) (bool, error) {
+	if l.session == "" {
+		var created struct{ ID string }
+		session := map[string]string{"Name": "goproxy " + l.id, "TTL": l.ttl.String(), "Behavior": "delete", "LockDelay": "0s"}
+		if _, err := l.request(ctx, http.MethodPut, "/v1/session/create", session, &created); err != nil {
+			return false, err
+		}
+		l.session = created.ID
+	}
+	var acquired bool
+	if _, err := l.request(ctx, http.MethodPut, "/v1/kv/"+l.key+"?acquire="+l.session, l.id, &acquired); err != nil {
+		// the session may have expired while waiting
+		l.session = ""
+		return false, err
+	}
+	if !acquired {
+		// renew the session while standing by, it's reused once the key
+		// is free
+		if _, err := l.request(ctx, http.MethodPut, "/v1/session/renew/"+l.session, nil, nil); err != nil {
+			l.session = ""
+		}
+	}
+	return acquired, nil
+}
+
+func (l *consulLease) renew(ctx context.Context) error {
+	status, err := l.request(ctx, http.MethodPut, "/v1/session/renew/"+l.session, nil, nil)
+	if status == http.StatusNotFound {
+		return errLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+	var entries []struct{ Session string }
+	status, err = l.request(ctx, http.MethodGet, "/v1/kv/"+l.key, nil, &entries)
+	if status == http.StatusNotFound || err == nil && (len(entries) == 0 || entries[0].Session != l.session) {
+		return errLeaseLost
+	}
+	return err
+}
+
+func (l *consulLease) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+	defer cancel()
+	l.request(ctx, http.MethodPut, "/v1/kv/"+l.key+"?release="+l.session, nil, nil)
+	l.request(ctx, http.MethodPut, "/v1/session/destroy/"+l.session, nil, nil)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// listenOpts are socket options of -listen-opts applied to listeners
+var listenOpts struct {
+	rcvbuf, sndbuf int
+	backlog        int
+	deferAccept    time.Duration
+	freebind       bool
+}
+
+// parseListenOpts parses comma-separated rcvbuf=size, sndbuf=size,
+// backlog=N, defer-accept=duration and freebind
+func parseListenOpts(spec string) error {
+	for _, opt := range parseTargetList(spec) {
+		key, value, hasValue := strings.Cut(opt, "=")
+		var err error
+		switch key {
+		case "rcvbuf", "sndbuf":
+			var size uint64
+			if size, err = parseBytes(value); err == nil && (size == 0 || size > 1<<30) {
+				err = fmt.Errorf("expected size up to 1G")
+			}
+			if key == "rcvbuf" {
+				listenOpts.rcvbuf = int(size)
+			} else {
+				listenOpts.sndbuf = int(size)
+			}
+		case "backlog":
+			if listenOpts.backlog, err = strconv.Atoi(value); err == nil && listenOpts.backlog < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "defer-accept":
+			if listenOpts.deferAccept, err = time.ParseDuration(value); err == nil && listenOpts.deferAccept < time.Second {
+				err = fmt.Errorf("must be at least 1s")
+			}
+		case "freebind":
+			if hasValue {
+				err = fmt.Errorf("takes no value")
+			}
+			listenOpts.freebind = true
+		default:
+			err = fmt.Errorf("unknown option, expected rcvbuf, sndbuf, backlog, defer-accept or freebind")
+		}
+		if err != nil {
+			return fmt.Errorf("`%s`: %v", opt, err)
+		}
+	}
+	return nil
+}
+
+// setListenOpts applies -listen-opts to a listener socket before it is
+// bound; defer-accept only applies to TCP
+func setListenOpts(network string, fd uintptr) error {
+	if listenOpts.rcvbuf > 0 {
+		if err := setRcvbuf(fd, listenOpts.rcvbuf); err != nil {
+			return fmt.Errorf("failed to set SO_RCVBUF: %v", err)
+		}
+	}
+	if listenOpts.sndbuf > 0 {
+		if err := setSndbuf(fd, listenOpts.sndbuf); err != nil {
+			return fmt.Errorf("failed to set SO_SNDBUF: %v", err)
+		}
+	}
+	if listenOpts.freebind {
+		if err := setFreebind(fd); err != nil {
+			return fmt.Errorf("failed to set IP_FREEBIND: %v", err)
+		}
+	}
+	if listenOpts.deferAccept > 0 && strings.HasPrefix(network, "tcp") {
+		if err := setDeferAccept(fd, int(listenOpts.deferAccept/time.Second)); err != nil {
+			return fmt.Errorf("failed to set TCP_DEFER_ACCEPT: %v", err)
+		}
+	}
+	return nil
+}
+
+// freebindHint suggests -freebind when a listener failed to bind an address
+// not assigned to the host
+func freebindHint(err error) string {
+	if listenOpts.freebind || !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		return ""
+	}
+	hint := "; the address is not assigned to the host"
+	if runtime.GOOS == "linux" {
+		hint += ", use -freebind to bind it before it is"
+	}
+	return hint
+}
+
+// setListenBacklog changes the accept queue length of a listening socket,
+// which Go sets from the system maximum
+func setListenBacklog(l net.Listener) error {
+	if listenOpts.backlog == 0 {
+		return nil
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+	raw, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	raw.Control(func(fd uintptr) {
+		err = setBacklog(fd, listenOpts.backlog)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set backlog: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// variable parts of a log line: connection IDs, quoted values and numbers
+var logVariables = regexp.MustCompile("\\[\\d+\\]|`[^`]*`|[0-9.:]+")
+
+type logClass struct {
+	seen       uint64
+	suppressed uint64
+	window     time.Time
+	inWindow   int
+	example    string
+}
+
+// logLimiter samples and rate limits log lines per class, a class being the
+// line with its variable parts masked, so thousands of identical errors don't
+// fill the disk; suppressed lines are reported as periodic summaries
+type logLimiter struct {
+	out     io.Writer
+	sample  uint64
+	rate    int
+	summary *log.Logger
+
+	mu      sync.Mutex
+	classes map[string]*logClass
+}
+
+func newLogLimiter(out io.Writer, sample uint64, rate int, interval time.Duration) *logLimiter {
+	l := &logLimiter{
+		out:     out,
+		sample:  sample,
+		rate:    rate,
+		summary: log.New(out, "", log.LstdFlags),
+		classes: make(map[string]*logClass),
+	}
+	go l.summarize(interval)
+	return l
+}
+
+func (l *logLimiter) Write(p []byte) (int, error) {
+	line := string(p)
+	// strip the date and time prefix of the standard logger
+	msg := line
+	if len(msg) > 20 {
+		msg = msg[20:]
+	}
+	key := logVariables.ReplaceAllString(msg, "*")
+
+	now := time.Now()
+	l.mu.Lock()
+	c := l.classes[key]
+	if c == nil {
+		c = &logClass{}
+		l.classes[key] = c
+	}
+	c.seen++
+	suppress := l.sample > 1 && (c.seen-1)%l.sample != 0
+	if !suppress && l.rate > 0 {
+		if now.Sub(c.window) >= time.Second {
+			c.window = now
+			c.inWindow = 0
+		}
+		c.inWindow++
+		suppress = c.inWindow > l.rate
+	}
+	if suppress {
+		c.suppressed++
+		c.example = strings.TrimSuffix(msg, "\n")
+	}
+	l.mu.Unlock()
+
+	if suppress {
+		return len(p), nil
+	}
+	return l.out.Write(p)
+}
+
+func (l *logLimiter) summarize(interval time.Duration) {
+	ticker := systemClock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.Chan() {
+		l.mu.Lock()
+		var lines []string
+		for key, c := range l.classes {
+			if c.suppressed > 0 {
+				lines = append(lines, fmt.Sprintf("Suppressed %d of %d log lines like: %s\n", c.suppressed, c.seen, c.example))
+			}
+			delete(l.classes, key)
+		}
+		l.mu.Unlock()
+		for _, line := range lines {
+			l.summary.Print(line)
+		}
+	}
+}
+
+// parseLogSample parses `1/N` sampling ratio into N
+func parseLogSample(ratio string) (uint64, error) {
+	parts := strings.SplitN(ratio, "/", 2)
+	if len(parts) != 2 || parts[0] != "1" {
+		return 0, fmt.Errorf("expected 1/N, got `%s`", ratio)
+	}
+	n, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("expected 1/N, got `%s`", ratio)
+	}
+	return n, nil
+}
+
+// logFile is a log writer which rotates the file by size and age, keeping a
+// number of numbered backups, and can be reopened after external rotation
+type logFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openLogFile(path string, maxSize int64, maxAge time.Duration, keep int) (*logFile, error) {
+	f := &logFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > 0) ||
+		(f.maxAge > 0 && time.Since(f.opened) > f.maxAge) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file `%s`: %v\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.N-1 to path.N, path to path.1 and opens a fresh file;
+// f.mu must be held
+func (f *logFile) rotate() error {
+	f.file.Close()
+	if f.keep > 0 {
+		for i := f.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			f.open()
+			return err
+		}
+	} else if err := os.Truncate(f.path, 0); err != nil {
+		f.open()
+		return err
+	}
+	return f.open()
+}
+
+// Reopen closes and opens the file by path, to be used after it was moved by
+// an external tool such as logrotate
+func (f *logFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.file.Close()
+	return f.open()
+}
+
+func (f *logFile) reopenOnSignal() {
+	c := make(chan os.Signal, 1)
+	notifyLogReopen(c)
+	for range c {
+		if err := f.Reopen(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to reopen log file `%s`: %v\n", f.path, err)
+		} else if verbose.Load() {
+			log.Printf("Reopened log file `%s`\n", f.path)
+		}
+	}
+}
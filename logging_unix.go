@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyLogReopen delivers SIGUSR2, the signal to reopen the log file
+func notifyLogReopen(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// notifyLogLevel delivers SIGUSR1, the signal to cycle the log level
+func notifyLogLevel(c chan os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
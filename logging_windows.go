@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// notifyLogReopen is a no-op, there is no SIGUSR2 on Windows
+func notifyLogReopen(c chan os.Signal) {}
+
+// notifyLogLevel is a no-op, there is no SIGUSR1 on Windows; use the admin
+// API to change the log level
+func notifyLogLevel(c chan os.Signal) {}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// logLevels in the order SIGUSR1 cycles through them: info logs errors and
+// summaries only, verbose adds -verbose lines and debug -debug lines
+var logLevels = []string{"info", "verbose", "debug"}
+
+// logLevelMu serializes changes of the log level; verbose and debug are read
+// atomically without it
+var logLevelMu sync.Mutex
+
+// logFlag is -verbose or -debug, read by all goroutines while setLogLevel
+// may change it
+type logFlag struct {
+	atomic.Bool
+}
+
+func (f *logFlag) String() string {
+	return strconv.FormatBool(f.Load())
+}
+
+func (f *logFlag) Set(value string) error {
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	f.Store(v)
+	return nil
+}
+
+func (f *logFlag) IsBoolFlag() bool {
+	return true
+}
+
+func logLevel() string {
+	logLevelMu.Lock()
+	defer logLevelMu.Unlock()
+	return currentLogLevel()
+}
+
+func currentLogLevel() string {
+	if debug.Load() {
+		return "debug"
+	}
+	if verbose.Load() {
+		return "verbose"
+	}
+	return "info"
+}
+
+// setLogLevel changes the log level at runtime, as if started with -verbose
+// or -debug
+func setLogLevel(level string) error {
+	logLevelMu.Lock()
+	defer logLevelMu.Unlock()
+	switch level {
+	case "info":
+		verbose.Store(false)
+		debug.Store(false)
+	case "verbose":
+		verbose.Store(true)
+		debug.Store(false)
+	case "debug":
+		verbose.Store(true)
+		debug.Store(true)
+	default:
+		return fmt.Errorf("unknown log level `%s`, expected info, verbose or debug", level)
+	}
+	log.Printf("Log level set to %s\n", level)
+	publishEvent("log.level", func() interface{} { return map[string]string{"level": level} })
+	return nil
+}
+
+// cycleLogLevelOnSignal switches to the next log level on SIGUSR1, from
+// debug back to info, or logs the top talkers with -sigusr1 top
+func cycleLogLevelOnSignal() {
+	c := make(chan os.Signal, 1)
+	notifyLogLevel(c)
+	for range c {
+		if sigusr1Action == "top" {
+			logTopTalkers()
+			continue
+		}
+		before := logLevel()
+		next := logLevels[0]
+		for i, level := range logLevels {
+			if level == before && i+1 < len(logLevels) {
+				next = logLevels[i+1]
+			}
+		}
+		setLogLevel(next)
+		audit("signal SIGUSR1", "set log level "+next, before, next)
+	}
+}
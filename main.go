@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,29 +24,260 @@ import (
 )
 
 var (
-	flags       = flag.NewFlagSet("goproxy", flag.ExitOnError)
-	udp         bool
-	srv         bool
-	dnsServer   string
-	dnsInterval time.Duration
-	timeout     time.Duration
-	verbose     bool
-	debug       bool
+	flags               = flag.NewFlagSet("goproxy", flag.ExitOnError)
+	udp                 bool
+	ipProto             int
+	srv                 bool
+	dnsServer           string
+	dnsInterval         time.Duration
+	dnsDenyList         string
+	minTargetsSpec      string
+	timeout             time.Duration
+	tlsTimeout          time.Duration
+	targetTimeouts      stringList
+	listenerTimeouts    stringList
+	maxConnLifetime     time.Duration
+	clientWriteTimeout  time.Duration
+	backendWriteTimeout time.Duration
+	firstByteTimeout    time.Duration
+	errorBudgetSpec     string
+	errorWindow         time.Duration
+	errorMin            int
+	alertWebhook        string
+	onOpen              string
+	banner              string
+	bannerDelay         time.Duration
+	rejectPayload       string
+	maintenanceTarget   string
+	onClose             string
+	dnsLb               bool
+	dnsLbTimeout        time.Duration
+	udpAffinity         string
+	udpSessionTimeout   time.Duration
+	udpRebindIdle       time.Duration
+	udpSessionLog       bool
+	udpUnreachableHold  time.Duration
+	logFilePath         string
+	logMaxSize          int64
+	logMaxAge           time.Duration
+	logKeep             int
+	logSample           string
+	logRate             int
+	logSummary          time.Duration
+	canary              string
+	split               uint
+	canaryCidrs         string
+	canaryPorts         string
+	stableName          string
+	canaryName          string
+	schedules           stringList
+	scheduleRules       []*scheduleRule
+	statsFile           string
+	statsInterval       time.Duration
+	topWindow           time.Duration
+	sigusr1Action       string
+	metricsPush         string
+	metricsPushFormat   string
+	metricsPushInterval time.Duration
+	clientQuotaSize     string
+	clientQuota         uint64
+	clientQuotaWindow   time.Duration
+	quotaThrottleRate   string
+	quotaThrottle       uint64
+	flowCollector       string
+	flowFormat          string
+	sflowCollector      string
+	sflowRate           int
+	sflowHeader         int
+	geoDb               string
+	geoAllow            string
+	geoDeny             string
+	geoRoutes           stringList
+	access              stringList
+	banChurn            int
+	banFailures         int
+	banWindow           time.Duration
+	banTime             time.Duration
+	banAllow            string
+	targetBlacklist     string
+	blacklistFile       string
+	admin               string
+	ruleName            string
+	adminSocketMode     string
+	adminSocketOwner    string
+	adminTokenFile      string
+	adminAllow          string
+	adminTlsCert        string
+	adminTlsKey         string
+	adminTlsClientCa    string
+	adminTlsCrl         string
+	adminTlsOcsp        bool
+	vaultAddr           string
+	vaultPki            string
+	vaultNames          string
+	vaultTtl            time.Duration
+	vaultTokenFile      string
+	vaultRoleId         string
+	vaultSecretIdFile   string
+	vaultCa             string
+	userName            string
+	groupName           string
+	chrootDir           string
+	sandboxed           bool
+	drainTimeout        time.Duration
+	pidFile             string
+	portFile            string
+	portRange           string
+	portLow             int
+	portHigh            int
+	portOffset          int
+	listenFamily        string
+	dscp                int
+	tos                 int
+	fwmark              uint
+	markDownstream      bool
+	mptcp               string
+	sctp                string
+	muxMode             string
+	muxConns            int
+	muxTrust            string
+	muxTransport        string
+	muxFec              string
+	nofile              uint64
+	fdReserve           int
+	maxDials            int
+	auditLogPath        string
+	agentCheck          string
+	agentCapacity       int
+	watchdogTimeout     time.Duration
+	healthFile          string
+	healthMin           int
+	healthInterval      time.Duration
+	leaderSpec          string
+	leaderTtl           time.Duration
+	warmTargets         int
+	warmTimeout         time.Duration
+	acceptRate          string
+	acceptBurst         int
+	acceptQueue         int
+	queueOverflow       string
+	clientRate          string
+	clientBurst         int
+	clientRateRedis     string
+	slowBytes           uint64
+	slowInterval        time.Duration
+	maxBufferedSize     string
+	maxBuffered         uint64
+	sourcePortList      string
+	viaProxy            string
+	viaKey              string
+	viaKnownHosts       string
+	nat64Spec           string
+	tlsFingerprint      bool
+	tlsDenyList         string
+	pgRouteSpecs        stringList
+	portRouteSpecs      stringList
+	listenOptsSpec      string
+	freebind            bool
+	bindRetry           time.Duration
+	shadowTarget        string
+	shadowCompare       bool
+	ownZone             string
+	targetZoneSpecs     stringList
+	zoneMaxConns        int
+	ruleLimitSpecs      stringList
+	httpForwarded       bool
+	sockmapSplice       bool
+	ioUring             bool
+	eventLoop           bool
+	ftp                 bool
+	ftpDataPorts        string
+	mysql               bool
+	mysqlHold           time.Duration
+	inetd               bool
+	daemon              bool
+	verbose             logFlag
+	debug               logFlag
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "conns":
+			runConns(os.Args[2:])
+			return
+		case "stats":
+			runStats(os.Args[2:])
+			return
+		case "service":
+			runService(os.Args[2:])
+			return
+		case "connect":
+			runConnect(os.Args[2:])
+			return
+		case "health":
+			runHealth(os.Args[2:])
+			return
+		case "top":
+			runTop(os.Args[2:])
+			return
+		case "status":
+			runStatus(os.Args[2:])
+			return
+		case "selftest":
+			runSelftest(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
 	parseFlags()
-	if len(flags.Args()) < 2 {
-		if debug {
+	if inetd && len(flags.Args()) > 0 {
+		serveInetd(serveCtx, flags.Args())
+		return
+	}
+	if inetd || len(flags.Args()) < 2 {
+		if debug.Load() {
 			log.Printf("Remaining arguments after parsing flags: %+v\n", flags.Args())
 		}
 		usage()
-		os.Exit(1)
+		os.Exit(errorKinds[errConfig].exit)
+	}
+
+	if daemon && !isDaemonChild() {
+		daemonize()
+	}
+	if isService() {
+		runAsService()
+		return
 	}
+	notifyShutdown()
+	serve(serveCtx)
+	// listeners are closed, wait for connections to drain
+	<-shutdown.done
+}
 
+// serve starts the proxy, returning only when listeners are closed on
+// shutdown
+func serve(ctx context.Context) {
 	if dnsServer != "" && !strings.Contains(dnsServer, ":") && !strings.Contains(dnsServer, "/") {
 		dnsServer = net.JoinHostPort(dnsServer, "53")
 	}
+	setupNat64()
+	if sockmapSplice {
+		initSockmap()
+	}
+	if ioUring {
+		initUring()
+	}
+	if eventLoop {
+		initEventLoop()
+	}
+
+	rand.Seed(time.Now().UnixNano())
+
+	go cycleLogLevelOnSignal()
 
 	// ignore HUP and PIPE signals
 	c := make(chan os.Signal, 1)
@@ -50,106 +287,1095 @@ func main() {
 		}
 	}()
 
+	if statsFile != "" {
+		if err := loadStats(statsFile); err != nil {
+			fatalf(errConfig, "Failed to load stats from `%s`: %v\n", statsFile, err)
+		}
+		go checkpointStats(ctx, statsFile, statsInterval)
+	}
+	go expireClientStats(ctx)
+	if topWindow > 0 {
+		go rollTopTalkers(ctx)
+	}
+	if metricsPush != "" {
+		if verbose.Load() {
+			log.Printf("Will push metrics to `%s` every %v\n", metricsPush, metricsPushInterval)
+		}
+		go pushMetrics(ctx)
+	}
+	if clientQuota > 0 {
+		go enforceQuotas(ctx)
+	}
+	if geoDb != "" {
+		if err := loadGeoDb(geoDb); err != nil {
+			fatalf(errConfig, "Failed to load GeoIP database `%s`: %v\n", geoDb, err)
+		}
+		go reloadGeoDb(ctx, geoDb)
+		for _, spec := range geoRoutes {
+			route, targets, err := parseGeoRoute(spec)
+			if err != nil {
+				fatalf(errConfig, "Error parsing -geoip-route: %v\n", err)
+			}
+			if verbose.Load() {
+				log.Printf("Will route clients from %s to %v\n", spec[:strings.IndexByte(spec, '=')], targets)
+			}
+			geoip.routes = append(geoip.routes, route)
+			go route.manage(ctx, targets)
+		}
+	}
+	if banEnabled() {
+		go expireBans(ctx)
+	}
+	if blacklistFile != "" {
+		go reloadBlacklistFile(ctx, blacklistFile)
+	}
+	if errorBudget.budget > 0 {
+		go expireErrorBudgets(ctx)
+	}
+	if slowBytes > 0 {
+		go closeSlowClients(ctx)
+	}
+	if clientRates.interval > 0 {
+		go expireClientRates(ctx)
+	}
+	if sflowCollector != "" {
+		if verbose.Load() {
+			log.Printf("Will export 1 in %d sampled packets to sFlow collector `%s`\n", sflowRate, sflowCollector)
+		}
+		go exportSflow(ctx, sflowCollector)
+	}
+	if flowCollector != "" {
+		if verbose.Load() {
+			log.Printf("Will export %s flows to `%s`\n", flowFormat, flowCollector)
+		}
+		shutdown.flushing.Add(1)
+		go func() {
+			defer shutdown.flushing.Done()
+			exportFlows(ctx, flowCollector)
+		}()
+	}
+	if vaultPki != "" {
+		go renewVaultCert(ctx)
+	}
+	if admin != "" {
+		serveAdmin(admin)
+		if adminTlsCrl != "" {
+			go reloadAdminCrl(ctx, adminTlsCrl)
+		}
+	}
+	if agentCheck != "" {
+		serveAgentCheck(agentCheck)
+	}
+	if healthFile != "" {
+		go writeHealthFile(ctx, healthFile)
+	}
+
 	// channels to pass DNS updates and new incoming connections
-	resolver := make(chan []string, 1)
-	manager := make(chan net.Conn, 10)
+	resolver := make(chan []Target, 1)
+	manager := make(chan net.Conn, acceptQueue)
 
 	connectTo := flags.Args()[1:]
-	if verbose {
+	if ipProto > 0 {
+		connectTo = rawTargets(connectTo)
+	}
+	if verbose.Load() {
 		log.Printf("Will connect to %v\n", connectTo)
 	}
 	if dnsServer != "" {
-		if verbose {
+		if verbose.Load() {
 			log.Printf("DNS server provided: `%s`, will refresh every %v\n", dnsServer, dnsInterval)
 		}
-		go refreshDns(connectTo, resolver)
+		if watchdogTimeout > 0 {
+			go supervise(ctx, "DNS refresher", &heartbeats.dns, dnsInterval+watchdogTimeout, func() bool { return true }, func(ctx context.Context) {
+				refreshDns(ctx, connectTo, resolver, &heartbeats.dns)
+			})
+		} else {
+			go refreshDns(ctx, connectTo, resolver, nil)
+		}
 	} else {
-		resolver <- connectTo
+		resolver <- staticTargets(connectTo)
 	}
 
-	listenOn := flags.Arg(0)
-	if verbose {
-		proto := "tcp"
-		if udp {
-			proto = "udp"
+	if canary != "" {
+		if verbose.Load() {
+			log.Printf("Will route %d%% of connections to `%s` group %v\n", split, canaryName, parseTargetList(canary))
 		}
-		log.Printf("Will listen on `%s://%s`\n", proto, listenOn)
+		go manageCanary(ctx, parseTargetList(canary))
 	}
 
-	if udp {
-		laddr, err := net.ResolveUDPAddr("udp", listenOn)
+	if len(scheduleRules) > 0 {
+		go runSchedule(ctx, scheduleRules)
+	}
+
+	for _, spec := range pgRouteSpecs {
+		route, targets, err := parsePgRoute(spec)
 		if err != nil {
-			log.Fatalf("Error resolving `%s`: %v\n", listenOn, err)
+			fatalf(errConfig, "Error parsing -pg-route: %v\n", err)
 		}
-		conn, err := net.ListenUDP("udp", laddr)
+		if verbose.Load() {
+			log.Printf("Will route PostgreSQL clients of %s to %v\n", spec[:strings.IndexByte(spec, '=')], targets)
+		}
+		pgRoutes = append(pgRoutes, route)
+		go route.manage(ctx, targets)
+	}
+
+	// comma-separated listen addresses all feed the same targets
+	listenOn := parseTargetList(flags.Arg(0))
+	hosts := listenOn
+	for _, spec := range portRouteSpecs {
+		route, targets, err := parsePortRoute(spec)
 		if err != nil {
-			log.Fatalf("Failed to setup UDP listener on `%s`: %v\n", listenOn, err)
+			fatalf(errConfig, "Error parsing -port-route: %v\n", err)
 		}
-		manager <- conn
-		manageUdp(resolver, manager)
-	} else {
-		listener, err := net.Listen("tcp", listenOn)
+		if portRoutes[route.port] != nil {
+			fatalf(errConfig, "Port %d is routed more than once\n", route.port)
+		}
+		for _, r := range portRoutes {
+			if r.name == route.name {
+				fatalf(errConfig, "Rule name `%s` is used more than once\n", route.name)
+			}
+		}
+		if route.name == mainRule() {
+			fatalf(errConfig, "Rule name `%s` is used by the main rule\n", route.name)
+		}
+		if verbose.Load() {
+			log.Printf("Will route connections to port %d to %v\n", route.port, targets)
+		}
+		portRoutes[route.port] = route
+		go route.manage(ctx, targets)
+		listenOn = append(listenOn, portRouteListeners(hosts, route.port)...)
+	}
+	for _, spec := range ruleLimitSpecs {
+		limit, err := parseRuleLimit(spec)
 		if err != nil {
-			log.Fatalf("Failed to setup TCP listener on `%s`: %v\n", listenOn, err)
+			fatalf(errConfig, "Error parsing -rule-limit: %v\n", err)
+		}
+		known := limit.name == mainRule()
+		for _, r := range portRoutes {
+			known = known || r.name == limit.name
+		}
+		if !known {
+			fatalf(errConfig, "-rule-limit names unknown rule `%s`\n", limit.name)
+		}
+		if ruleLimits[limit.name] != nil {
+			fatalf(errConfig, "Rule `%s` is limited more than once\n", limit.name)
+		}
+		ruleLimits[limit.name] = limit
+	}
+	if verbose.Load() {
+		proto := "tcp"
+		if udp || muxMode == "listen" && muxTransport == "kcp" {
+			proto = "udp"
+		} else if ipProto > 0 {
+			proto = "ip" + strconv.Itoa(ipProto)
+		}
+		for _, addr := range listenOn {
+			if isNpipe(addr) {
+				log.Printf("Will listen on `%s`\n", addr)
+				continue
+			}
+			if portRange != "" {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					host = addr
+				}
+				addr = host + ":" + portRange
+			}
+			log.Printf("Will listen on `%s://%s`\n", proto, addr)
 		}
-		go manageTcp(resolver, manager)
-		for {
-			conn, err := listener.Accept()
+	}
+	if portRange != "" {
+		listenOn = expandPortRange(listenOn)
+	}
+
+	if nofile > 0 {
+		if err := setNofile(nofile); err != nil {
+			fatalf(errConfig, "Failed to set file descriptor limit to %d: %v\n", nofile, err)
+		}
+	}
+
+	if leaderSpec != "" {
+		waitLeadership(ctx)
+	}
+	if warmTargets > 0 {
+		waitWarmTargets(ctx, resolver)
+	}
+
+	// bind all listeners before dropping privileges
+	var conns []*net.UDPConn
+	var rawConns []*net.IPConn
+	var listeners []net.Listener
+	var bound []net.Addr
+	for _, addr := range listenOn {
+		if ipProto > 0 {
+			var conn *net.IPConn
+			err := retryBind(ctx, fmt.Sprintf("IP protocol %d", ipProto), addr, func() (err error) {
+				conn, err = listenRawIp(addr)
+				return
+			})
 			if err != nil {
-				log.Printf("Failed to accept connection: %v\n", err)
-			} else {
+				fatalf(errBind, "Failed to setup IP protocol %d listener on `%s`: %v\n", ipProto, addr, err)
+			}
+			addListener(conn)
+			rawConns = append(rawConns, conn)
+			bound = append(bound, conn.LocalAddr())
+			continue
+		}
+		if !udp {
+			listener := listenTcp(ctx, addr)
+			listeners = append(listeners, listener)
+			bound = append(bound, listener.Addr())
+			continue
+		}
+		var conn *net.UDPConn
+		err := retryBind(ctx, "UDP", addr, func() (err error) {
+			conn, err = listenUdp(addr)
+			return
+		})
+		if err != nil {
+			fatalf(errBind, "Failed to setup UDP listener on `%s`: %v%s\n", addr, err, freebindHint(err))
+		}
+		addListener(conn)
+		conns = append(conns, conn)
+		bound = append(bound, conn.LocalAddr())
+		if dnsLb {
+			// TCP fallback for truncated responses is served on the same
+			// address, also when the UDP port was chosen by the system
+			tcpOn := conn.LocalAddr().String()
+			if verbose.Load() {
+				log.Printf("DNS load-balancer mode, will also listen on `tcp://%s`\n", tcpOn)
+			}
+			listeners = append(listeners, listenTcp(ctx, tcpOn))
+		}
+	}
+	// count descriptors in use before chroot hides them
+	initFdBudget()
+	if err := announce(listenOn, bound); err != nil {
+		fatalf(errConfig, "Failed to write port file `%s`: %v\n", portFile, err)
+	}
+	if pidFile != "" {
+		if err := writePidFile(pidFile); err != nil {
+			fatalf(errConfig, "Failed to write PID file `%s`: %v\n", pidFile, err)
+		}
+	}
+	if userName != "" || groupName != "" || chrootDir != "" {
+		if err := dropPrivileges(userName, groupName, chrootDir); err != nil {
+			fatalf(errConfig, "Failed to drop privileges: %v\n", err)
+		}
+		if verbose.Load() {
+			log.Printf("Dropped privileges, running as uid %d, gid %d\n", os.Getuid(), os.Getgid())
+		}
+	}
+	notifyReady()
+	if sandboxed {
+		if err := sandbox(); err != nil {
+			fatalf(errOther, "Failed to setup sandbox: %v\n", err)
+		}
+		if verbose.Load() {
+			log.Print("Sandbox enabled\n")
+		}
+	}
+
+	if ipProto > 0 {
+		manageRawIp(ctx, rawConns, resolver)
+		return
+	}
+	if udp {
+		if udpAffinity != "" {
+			manageUdpAffinity(ctx, conns, resolver, affinityExtractors[udpAffinity])
+			return
+		}
+		if !dnsLb {
+			for _, conn := range conns {
 				manager <- conn
 			}
+			manageUdp(ctx, resolver, manager)
+			return
 		}
+		lb := newDnsBalancer(conns)
+		tcpResolver := make(chan []Target, 1)
+		go lb.manage(ctx, resolver, tcpResolver)
+		acceptTcp(ctx, listeners, tcpResolver, manager, lb.pinned)
+	} else {
+		acceptTcp(ctx, listeners, resolver, manager, nil)
 	}
 }
 
+// announce writes the bound addresses, one per line, to -port-file, or
+// prints them to stdout when the system chose a port
+func announce(listenOn []string, bound []net.Addr) error {
+	var lines strings.Builder
+	ephemeral := false
+	for i, addr := range bound {
+		fmt.Fprintln(&lines, addr)
+		if _, port, err := net.SplitHostPort(listenOn[i]); err == nil && (port == "0" || port == "") {
+			ephemeral = true
+		}
+	}
+	if portFile != "" {
+		tmp := portFile + ".tmp"
+		if err := os.WriteFile(tmp, []byte(lines.String()), 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp, portFile)
+	}
+	if ephemeral {
+		fmt.Print(lines.String())
+	}
+	return nil
+}
+
+func listenTcp(ctx context.Context, listenOn string) net.Listener {
+	if muxMode == "listen" && muxTransport == "kcp" {
+		return listenKcp(ctx, listenOn)
+	}
+	var listener net.Listener
+	err := retryBind(ctx, "TCP", listenOn, func() (err error) {
+		listener, err = listen("tcp", listenOn)
+		return
+	})
+	if err != nil {
+		fatalf(errBind, "Failed to setup TCP listener on `%s`: %v%s\n", listenOn, err, freebindHint(err))
+	}
+	if muxMode == "listen" {
+		listener = newMuxListener(listener)
+	}
+	addListener(listener)
+	return listener
+}
+
+// acceptTcp passes connections accepted on all listeners to the manager,
+// returning when the listeners are closed
+func acceptTcp(ctx context.Context, listeners []net.Listener, resolver chan []Target, manager chan net.Conn, pinned func(net.Conn) string) {
+	if watchdogTimeout > 0 {
+		go supervise(ctx, "connection manager", &heartbeats.manager, watchdogTimeout, func() bool { return len(manager) > 0 }, func(ctx context.Context) {
+			manageTcp(ctx, resolver, manager, pinned)
+		})
+	} else {
+		go manageTcp(ctx, resolver, manager, pinned)
+	}
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			acceptLoop(listener, manager)
+		}(listener)
+	}
+	wg.Wait()
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr,
-		`Usage: %s [flags] [listen-ip]:port [connect-to-ip]:port
-Flags:
-`, os.Args[0])
+		`Usage: %s [flags] [listen-ip]:port[,...] [connect-to-ip]:port
+       %s -inetd [flags] [connect-to-ip]:port
+       %s connect [flags] _service._proto.name|host:port
+       %s conns [-admin host:port|unix:/path] [-kill id] [-kill-target host:port]
+       %s stats [-admin host:port|unix:/path] [-clients] [-rules]
+       %s top [-admin host:port|unix:/path] [-n 10] [-by bytes|conns]
+       %s status [-admin host:port|unix:/path] [-interval 1s]
+       %s selftest [-timeout 10s] [-verbose]
+       %s replay [flags] file.pcap host:port [-speed 1x|max]
+       %s service install|uninstall|start|stop [-name goproxy] [flags] [listen-ip]:port [connect-to-ip]:port
+Flags, also set by GOPROXY_<FLAG> environment variables, e.g. GOPROXY_DNS_INTERVAL=1m; flags take precedence:
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	flags.PrintDefaults()
 }
 
 func parseFlags() {
 	flags.BoolVar(&udp, "udp", false, "UDP mode")
-	flags.BoolVar(&srv, "srv", false, "Query DNS for SRV records, -dns must be specified")
+	flags.IntVar(&ipProto, "ip-proto", 0, "Expert mode: forward IP protocol number, e.g. 47 for GRE or 50 for ESP, between clients and a target with raw sockets; needs root or CAP_NET_RAW")
+	flags.BoolVar(&inetd, "inetd", false, "Forward a single connection on stdin/stdout to a target, for inetd, systemd socket units with Accept=yes or SSH ProxyCommand")
+	flags.BoolVar(&srv, "srv", false, "Query DNS for SRV records, -dns must be specified except with -inetd and connect")
 	flags.StringVar(&dnsServer, "dns", "", "DNS server address, supply host[:port]; will use system default if not set")
 	flags.DurationVar(&dnsInterval, "dns-interval", 20*time.Second, "Time interval between DNS queries")
+	flags.StringVar(&minTargetsSpec, "min-targets", "", "Keep the previous targets when DNS returns fewer than N, or N% of them, e.g. during a partial registry outage")
+	flags.StringVar(&dnsDenyList, "dns-deny", "", "Drop resolved target addresses in comma-separated CIDRs and classes: unspecified, loopback, link-local, multicast, private (RFC 1918, CGNAT, ULA), e.g. unspecified,loopback")
 	flags.DurationVar(&timeout, "timeout", 10*time.Second, "TCP connect timeout")
-	flags.BoolVar(&verbose, "verbose", false, "Print noticeable info")
-	flags.BoolVar(&debug, "debug", false, "Print debug level info")
+	flags.Var(&targetTimeouts, "target-timeout", "Connect timeout to targets, host:port or :port for any host, e.g. '10.0.1.5:5432,:6379=2s'; may be repeated")
+	flags.Var(&listenerTimeouts, "listener-timeout", "Connect timeout for connections accepted on listener ports, e.g. '8443=30s'; may be repeated")
+	flags.DurationVar(&tlsTimeout, "tls-timeout", 0, "Time to wait for a TLS ClientHello with -tls-fingerprint and for the TLS handshake with an https:// -via proxy, -timeout by default")
+	flags.StringVar(&viaProxy, "via", "", "Tunnel connections to targets through a forward proxy with CONNECT: http://[user:password@]host:port, or https:// for HTTP/2; or through an SSH jump host: ssh://[user@]host[:port]")
+	flags.StringVar(&nat64Spec, "nat64", "", "Map IPv4 targets into a NAT64 prefix on IPv6-only hosts, e.g. 64:ff9b::/96, or auto to discover it from DNS64 (RFC 7050)")
+	flags.StringVar(&viaKey, "via-key", "", "Private key file for an ssh:// -via jump host, in addition to ssh-agent keys")
+	flags.StringVar(&viaKnownHosts, "via-known-hosts", "", "Known hosts file to verify an ssh:// -via jump host (default ~/.ssh/known_hosts)")
+	flags.StringVar(&sourcePortList, "source-ports", "", "Connect to targets from comma-separated list of local ports and low-high ranges")
+	flags.BoolVar(&tlsFingerprint, "tls-fingerprint", false, "Compute JA3 and JA4 fingerprints of TLS clients, clients must send first")
+	flags.Var(&portRouteSpecs, "port-route", "Listen on an additional port routed to a dedicated target group, e.g. '19092=kafka-1:9092' for a Kafka broker, named port:19092 in metrics and admin output unless given as 'kafka-1:19092=kafka-1:9092'; may be repeated")
+	flags.Var(&ruleLimitSpecs, "rule-limit", "Limit a forwarding rule to live TCP connections, bandwidth per second in both directions and bytes buffered, e.g. 'kafka-1:conns=500,bandwidth=50M,buffered=16M'; may be repeated")
+	flags.StringVar(&ruleName, "rule-name", "", "Name of the main forwarding rule in metrics, logs and admin output, e.g. payments-db, default is "+defaultRule)
+	flags.Var(&pgRouteSpecs, "pg-route", "Route PostgreSQL clients of databases to a dedicated target group, e.g. 'orders,billing=10.0.1.5:5432'; may be repeated")
+	flags.StringVar(&listenOptsSpec, "listen-opts", "", "Comma-separated listener socket options: rcvbuf=size and sndbuf=size, inherited by accepted connections, backlog=N accept queue, defer-accept=duration to accept TCP connections once the client sends, freebind to bind addresses not assigned yet; e.g. 'rcvbuf=4M,backlog=4096'")
+	flags.DurationVar(&bindRetry, "bind-retry", 0, "Retry binding listeners with backoff for up to duration while the address is in use or not assigned to the host, e.g. during a rolling restart or until a VIP arrives, 0 to fail at once")
+	flags.BoolVar(&freebind, "freebind", false, "Bind listen addresses not assigned to the host yet, e.g. a keepalived VIP of a backup node, instead of failing; Linux only")
+	flags.StringVar(&ownZone, "zone", "", "Zone of this proxy, e.g. us-east-1a: prefer targets in the zone, spilling to other zones only when they fail or reach -zone-max-conns")
+	flags.Var(&targetZoneSpecs, "target-zone", "Put targets in a zone by address or DNS name suffix, e.g. 'us-east-1a=10.0.1.0/24,.use1a.example.com'; targets named with a zone label are in it anyway; may be repeated")
+	flags.IntVar(&zoneMaxConns, "zone-max-conns", 0, "Live TCP connections per target in -zone beyond which new ones spill to other zones, 0 for no limit")
+	flags.StringVar(&shadowTarget, "shadow", "", "Experimental: copy the client's data of TCP connections to shadow target host:port too, discarding its responses, e.g. to try a new backend with real traffic")
+	flags.BoolVar(&shadowCompare, "shadow-compare", false, "Experimental: compare the size and SHA-256 of the responses of the -shadow target with the primary target's per connection and report divergence")
+	flags.BoolVar(&sockmapSplice, "sockmap", false, "Splice TCP connections forwarded as they are in the kernel with eBPF sockmap; Linux only, needs CAP_BPF and CAP_NET_ADMIN, falls back to copying")
+	flags.BoolVar(&ioUring, "io-uring", false, "Experimental: forward TCP connections with io_uring, a ring per CPU with registered buffers; Linux 5.7 or later, falls back to copying")
+	flags.BoolVar(&eventLoop, "event-loop", false, "Experimental: forward TCP connections not left to -io-uring and -udp-affinity sessions with a worker per CPU waiting on epoll or kqueue, rather than goroutines per connection; Linux and macOS, falls back to goroutines")
+	flags.BoolVar(&httpForwarded, "http-forwarded", false, "Plaintext HTTP mode: add the client address to X-Forwarded-For and Forwarded request headers, set X-Forwarded-Port")
+	flags.BoolVar(&ftp, "ftp", false, "FTP mode: rewrite PORT, EPRT, PASV and EPSV and forward data connections")
+	flags.StringVar(&ftpDataPorts, "ftp-data-ports", "", "Range low-high of ports for FTP data listeners, ephemeral ports by default")
+	flags.BoolVar(&mysql, "mysql", false, "MySQL mode: hold clients while all targets are drained, send a server shutdown error to clients instead of closing")
+	flags.DurationVar(&mysqlHold, "mysql-hold", 5*time.Second, "Time to hold new MySQL clients while no target is available, e.g. during a primary switch")
+	flags.StringVar(&tlsDenyList, "tls-deny", "", "Reject TLS clients with comma-separated JA3 hashes or JA4 fingerprints, implies -tls-fingerprint")
+	flags.StringVar(&acceptRate, "accept-rate", "", "Max new TCP connections accepted on all listeners, e.g. 200/s; more are delayed in the listen backlog")
+	flags.IntVar(&acceptBurst, "accept-burst", 0, "Connections accepted at once beyond -accept-rate after a quiet period, default is one second's worth")
+	flags.IntVar(&acceptQueue, "accept-queue", 128, "Accepted TCP connections queued for the connection manager")
+	flags.StringVar(&queueOverflow, "queue-overflow", "wait", "When -accept-queue is full: wait holds listeners until the manager catches up, for up to twice -watchdog when set; reject closes new connections")
+	flags.StringVar(&clientRate, "client-rate", "", "Max new TCP connections per client IP, e.g. 10/s; more are closed")
+	flags.IntVar(&clientBurst, "client-burst", 0, "Connections a client may open at once beyond -client-rate after a quiet period, default is one second's worth")
+	flags.StringVar(&clientRateRedis, "client-rate-redis", "", "Share -client-rate buckets with other instances in Redis, redis://[:password@]host:port[/db]")
+	flags.IntVar(&warmTargets, "warm-targets", 0, "Bind listeners only once N targets accept a TCP connection, so the proxy isn't ready before it can forward; 0 to disable")
+	flags.DurationVar(&warmTimeout, "warm-timeout", 0, "Exit when -warm-targets are not reachable within duration, 0 to wait forever")
+	flags.StringVar(&leaderSpec, "leader", "", "Bind listeners only while holding a lease shared with standby instances: a file on shared storage or consul://host:port/key")
+	flags.DurationVar(&leaderTtl, "leader-ttl", 15*time.Second, "Time after which the -leader lease of a failed instance expires, renewed every third of it")
+	flags.DurationVar(&watchdogTimeout, "watchdog", 0, "Restart the connection manager or DNS refresher when stuck for longer than duration, e.g. 30s; 0 to disable")
+	flags.StringVar(&agentCheck, "agent-check", "", "Answer HAProxy agent checks on host:port with up, down when no target is available, or drain on shutdown")
+	flags.IntVar(&agentCapacity, "agent-capacity", 0, "Connections at which -agent-check reports full load, lowering the weight reported from 100% as connections approach it")
+	flags.StringVar(&healthFile, "health-file", "", "Keep file at 0 while -health-min targets accept a TCP connection and 1 otherwise, for keepalived track_file")
+	flags.IntVar(&healthMin, "health-min", 1, "Targets that must accept a TCP connection for the proxy to be healthy, in -health-file and GET /health")
+	flags.DurationVar(&healthInterval, "health-interval", 2*time.Second, "Interval between target probes for -health-file")
+	flags.IntVar(&maxDials, "max-dials", 0, "Max upstream TCP connections in progress, more wait up to -timeout in queue; 0 for unlimited")
+	flags.StringVar(&maxBufferedSize, "max-buffered", "", "Delay reads while connections hold more than size read and not yet written, e.g. 64M; unlimited by default")
+	flags.Uint64Var(&slowBytes, "slow-bytes", 0, "Close TCP connections transferring fewer bytes than N, both directions combined, per -slow-interval; 0 to disable")
+	flags.DurationVar(&slowInterval, "slow-interval", 30*time.Second, "Interval over which -slow-bytes must be transferred")
+	flags.DurationVar(&maxConnLifetime, "max-conn-lifetime", 0, "Close TCP connections open for longer than duration, 0 to disable")
+	flags.DurationVar(&firstByteTimeout, "first-byte-timeout", 0, "Retry with another target when a target doesn't answer within duration of the client's first data, 0 to disable")
+	flags.StringVar(&errorBudgetSpec, "error-budget", "", "Flag targets alerting when failed connects and, with -first-byte-timeout, unanswered connections exceed percentage of attempts over -error-window, e.g. 5%")
+	flags.DurationVar(&errorWindow, "error-window", 5*time.Minute, "Rolling window of the -error-budget")
+	flags.IntVar(&errorMin, "error-min", 20, "Connection attempts to a target within -error-window before -error-budget is evaluated")
+	flags.StringVar(&alertWebhook, "alert-webhook", "", "POST -error-budget alerts and recoveries to URL as JSON")
+	flags.StringVar(&banner, "banner", "", "Send text to clients on accept, before connecting the target; Go template with {{.Client}}, {{.ClientIP}}, {{.Listener}}, {{.Target}}, {{.Id}} and {{.Time}}, escapes such as \\r\\n are expanded")
+	flags.DurationVar(&bannerDelay, "banner-delay", 0, "Wait duration after accept before sending -banner, e.g. an SMTP greeting delay")
+	flags.StringVar(&rejectPayload, "reject-payload", "", "Send text to refused clients before closing, e.g. an HTTP 503 response; template like -banner with {{.Reason}} as well: banned, access, geo, quota, rate, rule-limit, maintenance, no-targets or unavailable")
+	flags.StringVar(&maintenanceTarget, "maintenance-target", "", "Forward new connections to listeners in maintenance mode to host:port instead of refusing them with -reject-payload")
+	flags.StringVar(&onOpen, "on-open", "", "Run command with the shell for every connection or UDP session opened, with details in GOPROXY_* environment variables")
+	flags.StringVar(&onClose, "on-close", "", "Run command with the shell for every connection or UDP session closed, with bytes transferred, duration and close reason in GOPROXY_* environment variables")
+	flags.DurationVar(&clientWriteTimeout, "client-write-timeout", 0, "Close TCP connection when a write to the client stalls for longer than duration, 0 to disable")
+	flags.DurationVar(&backendWriteTimeout, "backend-write-timeout", 0, "Close TCP connection when a write to the target stalls for longer than duration, 0 to disable")
+	flags.BoolVar(&dnsLb, "dns-lb", false, "DNS load-balancer mode for UDP: retransmit queries to an alternate target on timeout, serve TCP fallback from the same target")
+	flags.DurationVar(&dnsLbTimeout, "dns-lb-timeout", 2*time.Second, "Time to wait for a DNS response before retransmitting to an alternate target")
+	flags.StringVar(&udpAffinity, "udp-affinity", "", "Keep related UDP flows on one target by application key: sip (Call-ID), rtp (SSRC) or client (address only)")
+	flags.DurationVar(&udpSessionTimeout, "udp-session-timeout", 2*time.Minute, "Idle time after which a UDP affinity session is closed")
+	flags.BoolVar(&udpSessionLog, "udp-session-log", false, "Log a record per UDP session when it ends: client, target, datagrams and bytes in each direction, duration and reason")
+	flags.DurationVar(&udpUnreachableHold, "udp-unreachable-hold", 0, "Take a UDP target answering with ICMP port or host unreachable out of rotation for duration, 0 to only close the session")
+	flags.DurationVar(&udpRebindIdle, "udp-rebind-idle", 0, "When UDP targets change, keep forwarding to the current target until no datagram was forwarded for duration, 0 to switch right away")
+	flags.StringVar(&logFilePath, "log-file", "", "Write log to file instead of stderr; reopened on SIGUSR2")
+	flags.Int64Var(&logMaxSize, "log-max-size", 100, "Rotate log file when it grows beyond size in MB, 0 to disable")
+	flags.DurationVar(&logMaxAge, "log-max-age", 0, "Rotate log file when it gets older than duration, 0 to disable")
+	flags.IntVar(&logKeep, "log-keep", 5, "Number of rotated log files to keep")
+	flags.StringVar(&logSample, "log-sample", "", "Log only 1/N of similar lines, e.g. 1/100")
+	flags.IntVar(&logRate, "log-rate", 0, "Max similar log lines per second, 0 for unlimited")
+	flags.DurationVar(&logSummary, "log-summary", time.Minute, "Interval between summaries of suppressed log lines")
+	flags.StringVar(&canary, "canary", "", "Canary target group, comma-separated [connect-to-ip]:port list")
+	flags.UintVar(&split, "split", 0, "Percentage of new connections routed to the canary group")
+	flags.StringVar(&canaryCidrs, "canary-cidr", "", "Route clients from comma-separated CIDR list to the canary group")
+	flags.StringVar(&canaryPorts, "canary-ports", "", "Route connections to comma-separated listener ports to the canary group")
+	flags.StringVar(&stableName, "stable-name", "stable", "Name of the stable target group given as arguments")
+	flags.StringVar(&canaryName, "canary-name", "canary", "Name of the canary target group")
+	flags.Var(&schedules, "schedule", "Switch split or weights during a daily window, e.g. 'Sat 02:00-04:00 split=100'; may be repeated")
+	flags.StringVar(&statsFile, "stats-file", "", "Persist per-target and per-client counters to file, restored on start")
+	flags.DurationVar(&statsInterval, "stats-interval", time.Minute, "Interval between counter checkpoints to -stats-file")
+	flags.StringVar(&metricsPush, "metrics-push", "", "Push Prometheus metrics to a Pushgateway or remote write URL every -metrics-push-interval")
+	flags.StringVar(&metricsPushFormat, "metrics-push-format", "pushgateway", "Format of -metrics-push: pushgateway or remote-write")
+	flags.DurationVar(&metricsPushInterval, "metrics-push-interval", 15*time.Second, "Interval between -metrics-push pushes")
+	flags.DurationVar(&topWindow, "top-window", 5*time.Minute, "Rolling window of the top clients and targets by bytes and connections, 0 to disable")
+	flags.StringVar(&sigusr1Action, "sigusr1", "log-level", "Action on SIGUSR1: log-level to cycle the log level, top to log the top clients and targets over -top-window")
+	flags.StringVar(&clientQuotaSize, "client-quota", "", "Per-client IP transfer quota over -client-quota-window, e.g. 10G")
+	flags.DurationVar(&clientQuotaWindow, "client-quota-window", 24*time.Hour, "Rolling window of the per-client quota")
+	flags.StringVar(&quotaThrottleRate, "quota-throttle", "", "Throttle clients over quota to rate per second, e.g. 64K, instead of refusing connections")
+	flags.StringVar(&flowCollector, "flow-collector", "", "Export a flow record per connection or UDP session to NetFlow/IPFIX collector host:port")
+	flags.StringVar(&flowFormat, "flow-format", "v9", "Flow export format: v9 (NetFlow) or ipfix")
+	flags.StringVar(&sflowCollector, "sflow-collector", "", "Export sampled reads and UDP datagrams with a synthesized packet header to sFlow collector host:port")
+	flags.IntVar(&sflowRate, "sflow-rate", 1000, "Sample 1 in N reads and datagrams for -sflow-collector")
+	flags.IntVar(&sflowHeader, "sflow-header", 128, "Bytes of each sampled packet exported, headers and payload")
+	flags.StringVar(&geoDb, "geoip-db", "", "MaxMind GeoLite2/GeoIP2 country database file, reloaded when replaced")
+	flags.StringVar(&geoAllow, "geoip-allow", "", "Accept only clients from comma-separated ISO country codes, -- for unknown")
+	flags.StringVar(&geoDeny, "geoip-deny", "", "Reject clients from comma-separated ISO country codes, -- for unknown")
+	flags.Var(&geoRoutes, "geoip-route", "Route clients from countries to a dedicated target group, e.g. 'DE,FR=10.0.1.5:443,10.0.1.6:443'; may be repeated")
+	flags.Var(&access, "access", "Accept clients only during a daily window, optionally from CIDR list and only on listener ports, e.g. ':5432 Mon-Fri 08:00-18:00 10.0.0.0/8'; may be repeated")
+	flags.IntVar(&banChurn, "ban-churn", 0, "Ban clients opening more than N connections per -ban-window, 0 to disable")
+	flags.IntVar(&banFailures, "ban-failures", 0, "Ban clients with more than N failed, rejected or empty connections per -ban-window, 0 to disable")
+	flags.DurationVar(&banWindow, "ban-window", time.Minute, "Window over which client connections and failures are counted")
+	flags.DurationVar(&banTime, "ban-time", 10*time.Minute, "Duration of a client ban")
+	flags.StringVar(&banAllow, "ban-allow", "", "Never ban clients from comma-separated CIDR list")
+	flags.StringVar(&targetBlacklist, "target-blacklist", "", "Never connect to targets at comma-separated IP addresses and CIDRs, even when DNS returns them")
+	flags.StringVar(&blacklistFile, "target-blacklist-file", "", "Never connect to targets at IP addresses and CIDRs listed in file, one per line; reloaded when changed")
+	flags.StringVar(&auditLogPath, "audit-log", "", "Append a JSON line per admin API change, schedule switch, target set change, ban and reload to file; reopened on SIGUSR2")
+	flags.StringVar(&admin, "admin", "", "Admin API listen address host:port, e.g. "+defaultAdmin+", or Unix socket unix:/path")
+	flags.StringVar(&adminSocketMode, "admin-socket-mode", "0600", "Permissions of the -admin Unix socket")
+	flags.StringVar(&adminSocketOwner, "admin-socket-owner", "", "Owner of the -admin Unix socket as user[:group] or :group, e.g. to let a monitoring group in")
+	flags.StringVar(&adminTokenFile, "admin-token-file", "", "Require admin API requests, except GET /health, to carry the bearer token in file")
+	flags.StringVar(&adminAllow, "admin-allow", "", "Only serve admin API clients from comma-separated CIDR list")
+	flags.StringVar(&adminTlsCert, "admin-tls-cert", "", "Serve the admin API over HTTPS with certificate PEM file")
+	flags.StringVar(&adminTlsKey, "admin-tls-key", "", "Key PEM file of -admin-tls-cert")
+	flags.StringVar(&adminTlsClientCa, "admin-tls-client-ca", "", "Require admin API clients to present a certificate signed by CA certificates in PEM file")
+	flags.StringVar(&adminTlsCrl, "admin-tls-crl", "", "Refuse admin API client certificates revoked by CRLs in PEM or DER file, reloaded when it changes")
+	flags.BoolVar(&adminTlsOcsp, "admin-tls-ocsp", false, "Refuse admin API client certificates unless their OCSP responder reports them good")
+	flags.StringVar(&vaultAddr, "vault", "", "HashiCorp Vault address for -vault-pki, e.g. https://vault.example.com:8200")
+	flags.StringVar(&vaultPki, "vault-pki", "", "Obtain the admin API HTTPS and https:// -via client certificate from Vault PKI secrets engine mount/role, kept in memory and renewed at 2/3 of its lifetime")
+	flags.StringVar(&vaultNames, "vault-names", "", "Comma-separated names and IP addresses of the -vault-pki certificate, the first is the common name")
+	flags.DurationVar(&vaultTtl, "vault-ttl", 0, "Lifetime to request for the -vault-pki certificate, default is the role TTL")
+	flags.StringVar(&vaultTokenFile, "vault-token-file", "", "Authenticate to Vault with the token in file, default is the VAULT_TOKEN environment variable")
+	flags.StringVar(&vaultRoleId, "vault-role-id", "", "Authenticate to Vault with AppRole role ID and the -vault-secret-id-file secret ID")
+	flags.StringVar(&vaultSecretIdFile, "vault-secret-id-file", "", "AppRole secret ID file of -vault-role-id")
+	flags.StringVar(&vaultCa, "vault-ca", "", "Verify the Vault server certificate with CA certificates in PEM file instead of the system ones")
+	flags.StringVar(&userName, "user", "", "Switch to user after binding listeners, e.g. to bind ports below 1024 as root")
+	flags.StringVar(&groupName, "group", "", "Switch to group after binding listeners, default is the primary group of -user")
+	flags.StringVar(&chrootDir, "chroot", "", "Chroot to directory after binding listeners")
+	flags.BoolVar(&sandboxed, "sandbox", false, "Restrict file access with Landlock and deny unneeded syscalls with seccomp after initialization, Linux only")
+	flags.StringVar(&pidFile, "pidfile", "", "Write process ID to file, refuse to start if the process in it is alive")
+	flags.StringVar(&listenFamily, "listen-family", "auto", "Address family of wildcard listeners: ipv4, ipv6 (v6-only), dual (fail if not supported) or auto")
+	flags.IntVar(&tos, "tos", -1, "IP TOS / IPv6 traffic class byte of upstream connections, 0-255")
+	flags.IntVar(&dscp, "dscp", -1, "DSCP of upstream connections, 0-63, alternative to -tos")
+	flags.UintVar(&fwmark, "fwmark", 0, "SO_MARK of upstream connections for policy routing, Linux only")
+	flags.BoolVar(&markDownstream, "mark-downstream", false, "Apply -tos/-dscp and -fwmark to client connections as well")
+	flags.StringVar(&sctp, "sctp", "", "Use SCTP instead of TCP for listeners, upstream connections or both: listen, dial or both; Linux only")
+	flags.StringVar(&mptcp, "mptcp", "", "Use Multipath TCP for listeners, upstream connections or both: listen, dial or both; Linux only")
+	flags.StringVar(&muxMode, "mux", "", "Multiplex client connections over a few long-lived connections between paired goproxy instances: dial on the client side, listen on the target side")
+	flags.IntVar(&muxConns, "mux-conns", 4, "Multiplexing connections per target with -mux dial")
+	flags.StringVar(&muxTransport, "mux-transport", "tcp", "Transport of the -mux connections, tcp or kcp for reliable UDP on long-fat or lossy links; both sides must match")
+	flags.StringVar(&muxFec, "mux-fec", "10,3", "Forward error correction of -mux-transport kcp as data,parity packets per group, 0 parity to turn it off; both sides must match")
+	flags.StringVar(&muxTrust, "mux-trust", "", "Take the client addresses sent by -mux dial peers in comma-separated CIDR list, streams of other peers have the peer's address")
+	flags.StringVar(&portRange, "port-range", "", "Listen on every port of range low-high, connecting to the same port of the target plus -port-offset")
+	flags.IntVar(&portOffset, "port-offset", 0, "Offset added to the listener port to get the target port with -port-range")
+	flags.StringVar(&portFile, "port-file", "", "Write the bound listen address to file, useful with port 0; printed to stdout otherwise")
+	flags.Uint64Var(&nofile, "nofile", 0, "Set file descriptor limit (RLIMIT_NOFILE) at startup, raising the hard limit requires privileges; Linux and macOS only")
+	flags.IntVar(&fdReserve, "fd-reserve", 64, "Refuse new connections when fewer than N file descriptors are left, 0 to disable")
+	flags.BoolVar(&daemon, "daemon", false, "Detach from the terminal, exit once listening; use with -log-file")
+	flags.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "Time to wait for TCP connections to finish on SIGTERM, Ctrl+C or Windows service stop before closing them")
+	flags.Var(&verbose, "verbose", "Print noticeable info")
+	flags.Var(&debug, "debug", "Print debug level info")
 	flags.Usage = usage
 	flags.Parse(os.Args[1:])
-	if debug {
-		verbose = true
+	if err := applyEnv(flags); err != nil {
+		fatalf(errConfig, "Error parsing environment: %v\n", err)
+	}
+	if debug.Load() {
+		verbose.Store(true)
+	}
+	var logOut io.Writer = os.Stderr
+	if logFilePath != "" {
+		f, err := openLogFile(logFilePath, logMaxSize*1024*1024, logMaxAge, logKeep)
+		if err != nil {
+			fatalf(errConfig, "Failed to open log file `%s`: %v\n", logFilePath, err)
+		}
+		go f.reopenOnSignal()
+		logOut = f
+		log.SetOutput(logOut)
+		sessionLog.SetOutput(logOut)
+	}
+	if logSample != "" || logRate > 0 {
+		sample := uint64(1)
+		if logSample != "" {
+			var err error
+			sample, err = parseLogSample(logSample)
+			if err != nil {
+				fatalf(errConfig, "Error parsing -log-sample: %v\n", err)
+			}
+		}
+		log.SetOutput(newLogLimiter(logOut, sample, logRate, logSummary))
+	}
+	if auditLogPath != "" {
+		if err := openAuditLog(auditLogPath); err != nil {
+			fatalf(errConfig, "Failed to open audit log `%s`: %v\n", auditLogPath, err)
+		}
+		go reopenAuditLogOnSignal(auditLogPath)
+	}
+	if split > 100 {
+		fatalf(errConfig, "-split must be a percentage, got %d\n", split)
+	}
+	groups.split = split
+	if err := parseCanaryRules(canaryCidrs, canaryPorts); err != nil {
+		fatalf(errConfig, "Error parsing canary routing rules: %v\n", err)
+	}
+	if clientQuotaSize != "" {
+		var err error
+		if clientQuota, err = parseBytes(clientQuotaSize); err != nil {
+			fatalf(errConfig, "Error parsing -client-quota: %v\n", err)
+		}
+		if quotaThrottleRate != "" {
+			if quotaThrottle, err = parseBytes(quotaThrottleRate); err != nil {
+				fatalf(errConfig, "Error parsing -quota-throttle: %v\n", err)
+			}
+		}
+	}
+	if maxBufferedSize != "" {
+		var err error
+		if maxBuffered, err = parseBytes(maxBufferedSize); err != nil {
+			fatalf(errConfig, "Error parsing -max-buffered: %v\n", err)
+		}
+	}
+	if acceptRate != "" {
+		interval, err := parseAcceptRate(acceptRate)
+		if err != nil {
+			fatalf(errConfig, "Error parsing -accept-rate: %v\n", err)
+		}
+		burst := acceptBurst
+		if burst <= 0 {
+			burst = int(time.Second / interval)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		acceptLimit.interval, acceptLimit.burst = interval, burst
+	}
+	for _, spec := range targetTimeouts {
+		if err := parseTargetTimeout(spec); err != nil {
+			fatalf(errConfig, "Error parsing -target-timeout: %v\n", err)
+		}
+	}
+	for _, spec := range listenerTimeouts {
+		if err := parseListenerTimeout(spec); err != nil {
+			fatalf(errConfig, "Error parsing -listener-timeout: %v\n", err)
+		}
+	}
+	if firstByteTimeout > 0 && (httpForwarded || ftp || mysql) {
+		fatalf(errConfig, "-first-byte-timeout is not supported with -http-forwarded, -ftp or -mysql\n")
+	}
+	if errorBudgetSpec != "" {
+		if err := parseErrorBudget(errorBudgetSpec); err != nil {
+			fatalf(errConfig, "Error parsing -error-budget: %v\n", err)
+		}
+		if errorWindow <= 0 {
+			fatalf(errConfig, "-error-window must be positive\n")
+		}
+	} else if alertWebhook != "" {
+		fatalf(errConfig, "-alert-webhook requires -error-budget\n")
+	}
+	if acceptQueue < 1 {
+		fatalf(errConfig, "-accept-queue must be at least 1\n")
+	}
+	if queueOverflow != "reject" && queueOverflow != "wait" {
+		fatalf(errConfig, "-queue-overflow must be reject or wait\n")
+	}
+	if clientRate != "" {
+		interval, err := parseAcceptRate(clientRate)
+		if err != nil {
+			fatalf(errConfig, "Error parsing -client-rate: %v\n", err)
+		}
+		burst := clientBurst
+		if burst <= 0 {
+			burst = int(time.Second / interval)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		clientRates.interval, clientRates.burst = interval, burst
+		if clientRateRedis != "" {
+			if clientRates.redis, err = parseRedis(clientRateRedis); err != nil {
+				fatalf(errConfig, "Error parsing -client-rate-redis: %v\n", err)
+			}
+		}
+	} else if clientRateRedis != "" {
+		fatalf(errConfig, "-client-rate-redis requires -client-rate\n")
+	}
+	if warmTargets > 0 && udp {
+		fatalf(errConfig, "-warm-targets is not supported with -udp\n")
+	}
+	if n := len(flags.Args()) - 1; n > 0 && warmTargets > n && dnsServer == "" && !inetd {
+		fatalf(errConfig, "-warm-targets %d is more than the %d targets given\n", warmTargets, n)
+	}
+	if leaderSpec != "" {
+		if leaderTtl < 3*time.Second {
+			fatalf(errConfig, "-leader-ttl must be at least 3s\n")
+		}
+		lease, err := parseLeader(leaderSpec, leaderTtl)
+		if err != nil {
+			fatalf(errConfig, "Error parsing -leader: %v\n", err)
+		}
+		leader.lease = lease
+	}
+	if agentCapacity < 0 {
+		fatalf(errConfig, "-agent-capacity must not be negative\n")
+	}
+	if healthMin < 1 {
+		fatalf(errConfig, "-health-min must be at least 1\n")
+	}
+	if healthFile != "" && healthInterval <= 0 {
+		fatalf(errConfig, "-health-interval must be positive\n")
+	}
+	if slowBytes > 0 && slowInterval <= 0 {
+		fatalf(errConfig, "-slow-interval must be positive\n")
+	}
+	if flowFormat != "v9" && flowFormat != "ipfix" {
+		fatalf(errConfig, "Unknown flow export format `%s`\n", flowFormat)
+	}
+	if sflowRate < 1 {
+		fatalf(errConfig, "-sflow-rate must be at least 1\n")
+	}
+	if sflowHeader < 64 || sflowHeader > 1024 {
+		fatalf(errConfig, "-sflow-header must be 64-1024 bytes\n")
+	}
+	if geoDb == "" && (geoAllow != "" || geoDeny != "" || len(geoRoutes) > 0) {
+		fatalf(errConfig, "-geoip-allow, -geoip-deny and -geoip-route require -geoip-db\n")
+	}
+	geoip.allow = parseCountries(geoAllow)
+	geoip.deny = parseCountries(geoDeny)
+	for _, spec := range access {
+		rule, err := parseAccessRule(spec)
+		if err != nil {
+			fatalf(errConfig, "Error parsing -access: %v\n", err)
+		}
+		accessRules = append(accessRules, rule)
+	}
+	if err := parseBanAllow(banAllow); err != nil {
+		fatalf(errConfig, "Error parsing -ban-allow: %v\n", err)
+	}
+	if minTargetsSpec != "" {
+		if err := parseMinTargets(minTargetsSpec); err != nil {
+			fatalf(errConfig, "Error parsing -min-targets: %v\n", err)
+		}
+	}
+	if err := parseDnsDeny(dnsDenyList); err != nil {
+		fatalf(errConfig, "Error parsing -dns-deny: %v\n", err)
+	}
+	if err := parseBlacklist(targetBlacklist); err != nil {
+		fatalf(errConfig, "Error parsing -target-blacklist: %v\n", err)
+	}
+	if blacklistFile != "" {
+		if err := loadBlacklistFile(blacklistFile); err != nil {
+			fatalf(errConfig, "Failed to load target blacklist `%s`: %v\n", blacklistFile, err)
+		}
+	}
+	for _, spec := range schedules {
+		rule, err := parseScheduleRule(spec)
+		if err != nil {
+			fatalf(errConfig, "Error parsing -schedule: %v\n", err)
+		}
+		scheduleRules = append(scheduleRules, rule)
+	}
+	if dnsLb && !udp {
+		fatalf(errConfig, "-dns-lb requires -udp\n")
+	}
+	if dscp >= 0 {
+		if dscp > 63 || tos >= 0 {
+			fatalf(errConfig, "-dscp must be 0-63 and cannot be combined with -tos\n")
+		}
+		tos = dscp << 2
+	}
+	if tos > 255 {
+		fatalf(errConfig, "-tos must be 0-255, got %d\n", tos)
+	}
+	if sourcePortList != "" {
+		if err := parseSourcePorts(sourcePortList); err != nil {
+			fatalf(errConfig, "Error parsing -source-ports: %v\n", err)
+		}
+		if mptcp == "dial" || mptcp == "both" {
+			fatalf(errConfig, "-source-ports is not supported with -mptcp dial\n")
+		}
+	}
+	if udp {
+		for _, arg := range flags.Args() {
+			if strings.Contains(arg, npipePrefix) {
+				fatalf(errConfig, "Named pipes are not supported with -udp\n")
+			}
+		}
+	}
+	if tlsDenyList != "" {
+		tlsDeny = make(map[string]bool)
+		for _, fp := range parseTargetList(tlsDenyList) {
+			tlsDeny[strings.ToLower(fp)] = true
+		}
+		tlsFingerprint = true
+	}
+	if mysql && (udp || tlsFingerprint || len(pgRouteSpecs) > 0) {
+		fatalf(errConfig, "-mysql is not supported with -udp, -tls-fingerprint or -pg-route\n")
+	}
+	if ftp && (udp || mysql || tlsFingerprint || len(pgRouteSpecs) > 0) {
+		fatalf(errConfig, "-ftp is not supported with -udp, -mysql, -tls-fingerprint or -pg-route\n")
+	}
+	if httpForwarded && (udp || ftp || mysql || len(pgRouteSpecs) > 0) {
+		fatalf(errConfig, "-http-forwarded is not supported with -udp, -ftp, -mysql or -pg-route\n")
+	}
+	if ftpDataPorts != "" {
+		var err error
+		if ftpPortLow, ftpPortHigh, err = parsePortRange(ftpDataPorts); err != nil {
+			fatalf(errConfig, "Error parsing -ftp-data-ports: %v\n", err)
+		}
+	}
+	if len(portRouteSpecs) > 0 && (udp || portRange != "") {
+		fatalf(errConfig, "-port-route is not supported with -udp or -port-range\n")
+	}
+	if len(pgRouteSpecs) > 0 && udp {
+		fatalf(errConfig, "-pg-route is not supported with -udp\n")
+	}
+	if tlsFingerprint && udp {
+		fatalf(errConfig, "-tls-fingerprint and -tls-deny are not supported with -udp\n")
+	}
+	if viaProxy != "" {
+		var err error
+		if via, err = parseVia(viaProxy); err != nil {
+			fatalf(errConfig, "Error parsing -via: %v\n", err)
+		}
+		if udp || mptcp == "dial" || mptcp == "both" {
+			fatalf(errConfig, "-via is not supported with -udp or -mptcp dial\n")
+		}
+		if via.Scheme == "ssh" {
+			if err := initSshVia(); err != nil {
+				fatalf(errConfig, "Error setting up SSH -via: %v\n", err)
+			}
+		}
+	}
+	if sockmapSplice && udp {
+		fatalf(errConfig, "-sockmap is not supported with -udp\n")
+	}
+	if ioUring && udp {
+		fatalf(errConfig, "-io-uring is not supported with -udp\n")
+	}
+	if nat64Spec != "" && nat64Spec != "auto" {
+		var err error
+		if nat64, err = parseNat64(nat64Spec); err != nil {
+			fatalf(errConfig, "Error parsing -nat64: %v\n", err)
+		}
+	}
+	if ipProto != 0 {
+		if ipProto < 1 || ipProto > 255 || ipProto == syscall.IPPROTO_TCP || ipProto == syscall.IPPROTO_UDP {
+			fatalf(errConfig, "-ip-proto must be 1-255 and not TCP or UDP, use the TCP or -udp mode for those\n")
+		}
+		if udp || inetd || portRange != "" || len(portRouteSpecs) > 0 || srv {
+			fatalf(errConfig, "-ip-proto is not supported with -udp, -inetd, -port-range, -port-route or -srv\n")
+		}
+	}
+	if banner != "" {
+		var err error
+		if bannerTemplate, err = parsePayload(banner); err != nil {
+			fatalf(errConfig, "Error parsing -banner: %v\n", err)
+		}
+		if udp || ipProto != 0 {
+			fatalf(errConfig, "-banner is not supported with -udp or -ip-proto\n")
+		}
+	} else if bannerDelay > 0 {
+		fatalf(errConfig, "-banner-delay requires -banner\n")
+	}
+	if rejectPayload != "" {
+		var err error
+		if rejectTemplate, err = parsePayload(rejectPayload); err != nil {
+			fatalf(errConfig, "Error parsing -reject-payload: %v\n", err)
+		}
+		if udp || ipProto != 0 || mysql {
+			fatalf(errConfig, "-reject-payload is not supported with -udp, -ip-proto or -mysql\n")
+		}
+	}
+	if maintenanceTarget != "" {
+		if _, _, err := net.SplitHostPort(maintenanceTarget); err != nil {
+			fatalf(errConfig, "Error parsing -maintenance-target: %v\n", err)
+		}
+		if udp || ipProto != 0 {
+			fatalf(errConfig, "-maintenance-target is not supported with -udp or -ip-proto\n")
+		}
+	}
+	if metricsPush != "" {
+		if u, err := url.Parse(metricsPush); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fatalf(errConfig, "-metrics-push must be an http:// or https:// URL, got `%s`\n", metricsPush)
+		}
+		if metricsPushFormat != "pushgateway" && metricsPushFormat != "remote-write" {
+			fatalf(errConfig, "Unknown -metrics-push-format `%s`\n", metricsPushFormat)
+		}
+		if metricsPushInterval <= 0 {
+			fatalf(errConfig, "-metrics-push-interval must be positive\n")
+		}
+	}
+	if topWindow < 0 || (topWindow > 0 && topWindow < topSlots*time.Second) {
+		fatalf(errConfig, "-top-window must be at least %v, or 0 to disable\n", topSlots*time.Second)
+	}
+	switch sigusr1Action {
+	case "log-level":
+	case "top":
+		if topWindow == 0 {
+			fatalf(errConfig, "-sigusr1 top requires -top-window\n")
+		}
+	default:
+		fatalf(errConfig, "-sigusr1 must be log-level or top, got `%s`\n", sigusr1Action)
+	}
+	if err := parseListenOpts(listenOptsSpec); err != nil {
+		fatalf(errConfig, "Error parsing -listen-opts: %v\n", err)
+	}
+	for _, spec := range targetZoneSpecs {
+		if err := parseTargetZone(spec); err != nil {
+			fatalf(errConfig, "Error parsing -target-zone: %v\n", err)
+		}
+	}
+	if ownZone != "" {
+		zones.names[ownZone] = true
+	} else if len(targetZoneSpecs) > 0 || zoneMaxConns != 0 {
+		fatalf(errConfig, "-target-zone and -zone-max-conns require -zone\n")
+	}
+	if zoneMaxConns < 0 {
+		fatalf(errConfig, "-zone-max-conns must not be negative\n")
+	}
+	if shadowTarget != "" {
+		if !validShadowTarget(shadowTarget) {
+			fatalf(errConfig, "Expected -shadow host:port, got `%s`\n", shadowTarget)
+		}
+		if udp || ipProto > 0 || ftp || firstByteTimeout > 0 {
+			fatalf(errConfig, "-shadow is not supported with -udp, -ip-proto, -ftp or -first-byte-timeout\n")
+		}
+	} else if shadowCompare {
+		fatalf(errConfig, "-shadow-compare requires -shadow\n")
+	}
+	if bindRetry < 0 {
+		fatalf(errConfig, "-bind-retry must not be negative\n")
+	}
+	if freebind {
+		if runtime.GOOS != "linux" {
+			fatalf(errConfig, "-freebind is only supported on Linux\n")
+		}
+		listenOpts.freebind = true
+	}
+	if listenOptsSpec != "" && (mptcp == "listen" || mptcp == "both" || sctp == "listen" || sctp == "both") {
+		fatalf(errConfig, "-listen-opts is not supported with -mptcp or -sctp listening\n")
+	}
+	if ruleName != "" && !validRuleName(ruleName) {
+		fatalf(errConfig, "-rule-name may only contain letters, digits, `.`, `_` and `-`, got `%s`\n", ruleName)
+	}
+	if _, err := parseSocketMode(adminSocketMode); err != nil {
+		fatalf(errConfig, "Invalid -admin-socket-mode: %v\n", err)
+	}
+	if _, unix := adminSocketPath(admin); adminSocketOwner != "" && !unix {
+		fatalf(errConfig, "-admin-socket-owner requires -admin unix:/path\n")
+	} else if unix && (adminTlsCert != "" || adminTlsClientCa != "" || adminAllow != "") {
+		fatalf(errConfig, "-admin-tls-cert, -admin-tls-client-ca and -admin-allow are not supported with -admin unix:/path, use -admin-socket-mode\n")
+	}
+	if (adminTlsCert == "") != (adminTlsKey == "") {
+		fatalf(errConfig, "-admin-tls-cert and -admin-tls-key go together\n")
+	}
+	if adminTlsClientCa != "" && adminTlsCert == "" && vaultPki == "" {
+		fatalf(errConfig, "-admin-tls-client-ca requires -admin-tls-cert or -vault-pki\n")
+	}
+	if (adminTlsCrl != "" || adminTlsOcsp) && adminTlsClientCa == "" {
+		fatalf(errConfig, "-admin-tls-crl and -admin-tls-ocsp require -admin-tls-client-ca\n")
+	}
+	if err := setupAdminAuth(); err != nil {
+		fatalf(errConfig, "%v\n", err)
+	}
+	if vaultPki != "" {
+		if _, _, ok := strings.Cut(vaultPki, "/"); !ok || vaultAddr == "" || vaultNames == "" {
+			fatalf(errConfig, "-vault-pki requires mount/role, -vault and -vault-names\n")
+		}
+		if adminTlsCert != "" {
+			fatalf(errConfig, "-admin-tls-cert and -vault-pki both provide the admin API certificate\n")
+		}
+		if (vaultRoleId == "") != (vaultSecretIdFile == "") {
+			fatalf(errConfig, "-vault-role-id and -vault-secret-id-file go together\n")
+		}
+		if err := setupVault(); err != nil {
+			fatalf(errConfig, "%v\n", err)
+		}
+		if err := obtainVaultCert(); err != nil {
+			fatalf(errOther, "Failed to obtain certificate from Vault: %v\n", err)
+		}
+	} else if vaultAddr != "" || vaultNames != "" || vaultTtl != 0 || vaultTokenFile != "" || vaultRoleId != "" || vaultCa != "" {
+		fatalf(errConfig, "-vault, -vault-names, -vault-ttl, -vault-token-file, -vault-role-id and -vault-ca require -vault-pki\n")
+	}
+	if (onOpen != "" || onClose != "") && sandboxed {
+		fatalf(errConfig, "-on-open and -on-close are not supported with -sandbox, which denies running commands\n")
+	}
+	if sockmapSplice && sandboxed {
+		fatalf(errConfig, "-sockmap is not supported with -sandbox, which denies the bpf syscall\n")
+	}
+	if inetd && (udp || daemon) {
+		fatalf(errConfig, "-inetd is not supported with -udp or -daemon\n")
+	}
+	if maxDials > 0 {
+		dialSlots = make(chan struct{}, maxDials)
+	}
+	if mptcp != "" && mptcp != "listen" && mptcp != "dial" && mptcp != "both" {
+		fatalf(errConfig, "Unknown -mptcp mode `%s`\n", mptcp)
+	}
+	if sctp != "" {
+		if sctp != "listen" && sctp != "dial" && sctp != "both" {
+			fatalf(errConfig, "Unknown -sctp mode `%s`\n", sctp)
+		}
+		if udp || mptcp != "" || viaProxy != "" || sourcePortList != "" || sockmapSplice || ipProto != 0 {
+			fatalf(errConfig, "-sctp is not supported with -udp, -mptcp, -via, -source-ports, -sockmap or -ip-proto\n")
+		}
+	}
+	if muxMode != "" {
+		if muxMode != "dial" && muxMode != "listen" {
+			fatalf(errConfig, "Unknown -mux mode `%s`\n", muxMode)
+		}
+		if udp || viaProxy != "" || ftp {
+			fatalf(errConfig, "-mux is not supported with -udp, -via or -ftp\n")
+		}
+		if muxConns < 1 {
+			fatalf(errConfig, "-mux-conns must be at least 1\n")
+		}
+		if muxTransport != "tcp" && muxTransport != "kcp" {
+			fatalf(errConfig, "Unknown -mux-transport `%s`\n", muxTransport)
+		}
+		if muxTransport == "kcp" && muxMode == "listen" && (mptcp == "listen" || mptcp == "both" || sctp == "listen" || sctp == "both") {
+			fatalf(errConfig, "-mux-transport kcp is not supported with -mptcp or -sctp listening\n")
+		}
+		var err error
+		if muxFecData, muxFecParity, err = parseFec(muxFec); err != nil {
+			fatalf(errConfig, "Error parsing -mux-fec: %v\n", err)
+		}
+	} else if muxTransport != "tcp" {
+		fatalf(errConfig, "-mux-transport requires -mux\n")
+	}
+	if muxTrust != "" && muxMode != "listen" {
+		fatalf(errConfig, "-mux-trust requires -mux listen\n")
+	}
+	if err := parseMuxTrust(muxTrust); err != nil {
+		fatalf(errConfig, "Error parsing -mux-trust: %v\n", err)
+	}
+	if !listenFamilies[listenFamily] {
+		fatalf(errConfig, "Unknown listen address family `%s`\n", listenFamily)
+	}
+	if portRange != "" {
+		var err error
+		if portLow, portHigh, err = parsePortRange(portRange); err != nil {
+			fatalf(errConfig, "Error parsing -port-range: %v\n", err)
+		}
+		if portLow+portOffset < 1 || portHigh+portOffset > 65535 {
+			fatalf(errConfig, "-port-offset %d maps ports outside of 1-65535\n", portOffset)
+		}
+		if udp && udpAffinity == "" {
+			fatalf(errConfig, "-port-range with -udp requires -udp-affinity\n")
+		}
+		if dnsLb {
+			fatalf(errConfig, "-port-range is not supported with -dns-lb\n")
+		}
+	}
+	if udpAffinity != "" {
+		if !udp {
+			fatalf(errConfig, "-udp-affinity requires -udp\n")
+		}
+		if _, ok := affinityExtractors[udpAffinity]; !ok {
+			fatalf(errConfig, "Unknown UDP affinity extractor `%s`\n", udpAffinity)
+		}
 	}
 }
 
 type HostPort struct {
-	host, port string
-	resolve    bool
+	host, port       string
+	resolve          bool
+	priority, weight uint16 // of SRV records
 }
 
-func queryDns(dnsClient *dns.Client, name string, qType uint16) []HostPort {
-	if qType != dns.TypeA && qType != dns.TypeSRV {
-		log.Fatalf("Unsupported DNS query type `%s` resolving `%s`", dns.TypeToString[qType], name)
+func queryDns(dnsClient dnsExchanger, name string, qType uint16) []HostPort {
+	if qType != dns.TypeA && qType != dns.TypeAAAA && qType != dns.TypeSRV {
+		fatalf(errDns, "Unsupported DNS query type `%s` resolving `%s`\n", dns.TypeToString[qType], name)
 	}
 
 	req := &dns.Msg{}
 	req.SetQuestion(name, qType)
-	if debug {
+	if debug.Load() {
 		log.Printf("Querying DNS for `%s` type %s\n", name, dns.TypeToString[qType])
 	}
 
 	resp, _, err := dnsClient.Exchange(req, dnsServer)
 	if err != nil {
-		log.Printf("Error resolving `%s`: %v\n", name, err)
+		log.Printf("Error resolving `%s`: %v error=dns\n", name, err)
 		return nil
 	}
 	if req.Id != resp.Id {
-		log.Printf("DNS ID mismatch, request: %d, response: %d\n", req.Id, resp.Id)
+		log.Printf("DNS ID mismatch, request: %d, response: %d error=dns\n", req.Id, resp.Id)
 		return nil
 	}
 
@@ -158,7 +1384,15 @@ func queryDns(dnsClient *dns.Client, name string, qType uint16) []HostPort {
 		if qType == dns.TypeA {
 			if a, ok := r.(*dns.A); ok {
 				ip := a.A.String()
-				if debug {
+				if debug.Load() {
+					log.Printf("Resolved `%s` to `%s`\n", name, ip)
+				}
+				resolved = append(resolved, HostPort{host: ip})
+			}
+		} else if qType == dns.TypeAAAA {
+			if aaaa, ok := r.(*dns.AAAA); ok {
+				ip := aaaa.AAAA.String()
+				if debug.Load() {
 					log.Printf("Resolved `%s` to `%s`\n", name, ip)
 				}
 				resolved = append(resolved, HostPort{host: ip})
@@ -167,22 +1401,22 @@ func queryDns(dnsClient *dns.Client, name string, qType uint16) []HostPort {
 			if srv, ok := r.(*dns.SRV); ok {
 				target := srv.Target
 				port := strconv.Itoa(int(srv.Port))
-				if debug {
+				if debug.Load() {
 					log.Printf("Resolved `%s` to `%s`\n", name, net.JoinHostPort(target, port))
 				}
-				resolved = append(resolved, HostPort{host: target, port: port})
+				resolved = append(resolved, HostPort{host: target, port: port, priority: srv.Priority, weight: srv.Weight})
 			}
 		}
 	}
 
-	if verbose && len(resolved) == 0 {
+	if verbose.Load() && len(resolved) == 0 {
 		log.Printf("DNS response has no %s records for `%s`: %+v\n", dns.TypeToString[qType], name, resp)
 	}
 
 	return resolved
 }
 
-func refreshDns(connectTo []string, dnsUpdates chan []string) {
+func refreshDns(ctx context.Context, connectTo []string, dnsUpdates chan []Target, hb *heartbeat) {
 	var targets []HostPort
 
 	noDnsRequired := true
@@ -194,7 +1428,7 @@ func refreshDns(connectTo []string, dnsUpdates chan []string) {
 			var err error
 			host, port, err = net.SplitHostPort(target)
 			if err != nil {
-				log.Fatalf("Error parsing `%s`: %v\n", target, err)
+				fatalf(errConfig, "Error parsing `%s`: %v\n", target, err)
 			}
 		}
 		resolve := host != "" && net.ParseIP(host) == nil
@@ -204,175 +1438,612 @@ func refreshDns(connectTo []string, dnsUpdates chan []string) {
 		if host != "" {
 			host = dns.Fqdn(host)
 		}
-		targets = append(targets, HostPort{host, port, resolve})
+		targets = append(targets, HostPort{host: host, port: port, resolve: resolve})
 	}
 
 	if noDnsRequired {
-		if verbose && dnsServer != "" {
+		if verbose.Load() && dnsServer != "" {
 			log.Printf("Only port/IP provided in `%v`, DNS server address is unused\n", connectTo)
 		}
-		dnsUpdates <- connectTo
+		select {
+		case dnsUpdates <- staticTargets(connectTo):
+		case <-ctx.Done():
+		}
 		return
 	}
 
 	// https://pkg.go.dev/github.com/miekg/dns#Client
 	// https://github.com/benschw/dns-clb-go/blob/master/dns/lib.go
-	dnsClient := &dns.Client{Net: "tcp"}
-	var resolvedTargets []string
+	dnsClient := newDnsClient()
+	var resolvedTargets []Target
+
+	// with NAT64 the AAAA answers of a DNS64 server are preferred, IPv4
+	// addresses are mapped when dialing
+	queryIps := func(host string) []HostPort {
+		if nat64 != nil {
+			if ips := filterDnsDeny(host, queryDns(dnsClient, host, dns.TypeAAAA)); len(ips) > 0 {
+				return ips
+			}
+		}
+		return filterDnsDeny(host, queryDns(dnsClient, host, dns.TypeA))
+	}
 
 	queryDns := func() {
-		var newTargets []string
+		var newTargets []Target
 		for _, target := range targets {
 			if !target.resolve {
-				newTargets = append(newTargets, net.JoinHostPort(target.host, target.port))
+				newTargets = append(newTargets, Target{Addr: net.JoinHostPort(target.host, target.port), Source: sourceStatic})
 				continue
 			}
 
 			if srv {
 				srvTargets := queryDns(dnsClient, target.host, dns.TypeSRV)
 				for _, srvTarget := range srvTargets {
-					ips := queryDns(dnsClient, srvTarget.host, dns.TypeA)
+					ips := queryIps(srvTarget.host)
 					for _, ip := range ips {
-						newTargets = append(newTargets, net.JoinHostPort(ip.host, srvTarget.port))
+						newTargets = append(newTargets, Target{Addr: net.JoinHostPort(ip.host, srvTarget.port), Source: sourceSrv,
+							Name: strings.TrimSuffix(srvTarget.host, "."), Priority: srvTarget.priority, Weight: srvTarget.weight})
 					}
 				}
 			} else {
-				ips := queryDns(dnsClient, target.host, dns.TypeA)
+				ips := queryIps(target.host)
 				for _, ip := range ips {
-					newTargets = append(newTargets, net.JoinHostPort(ip.host, target.port))
+					newTargets = append(newTargets, Target{Addr: net.JoinHostPort(ip.host, target.port), Source: sourceDns,
+						Name: strings.TrimSuffix(target.host, ".")})
 				}
 			}
 		}
 
-		sort.Strings(newTargets)
+		sort.Slice(newTargets, func(i, j int) bool { return newTargets[i].Addr < newTargets[j].Addr })
+		withZones(newTargets)
+
+		update := !sameTargets(resolvedTargets, newTargets)
 
-		update := false
-		if len(resolvedTargets) != len(newTargets) {
-			update = true
+		if update && holdTargets(resolvedTargets, newTargets) {
+			update = false
 		}
-		if !update {
-			for i, newTarget := range newTargets {
-				if resolvedTargets[i] != newTarget {
-					update = true
-					break
-				}
-			}
+		// a refresher restarted by the watchdog doesn't send what it
+		// resolved before its replacement
+		if update && ctx.Err() != nil {
+			return
 		}
-
 		if update {
-			dnsUpdates <- newTargets
-			if verbose {
-				log.Printf("Connect target changed: %v\n", newTargets)
+			select {
+			case dnsUpdates <- newTargets:
+			case <-ctx.Done():
+				return
+			}
+			if verbose.Load() {
+				log.Printf("Connect target changed: %s\n", describeTargets(newTargets))
 			}
 			resolvedTargets = newTargets
 		}
+		if hb != nil {
+			hb.beat()
+		}
 	}
 
 	queryDns()
-	ticker := time.NewTicker(dnsInterval)
+	ticker := systemClock.NewTicker(dnsInterval)
 	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
 			queryDns()
 		}
 	}
 }
 
-func manageTcp(resolver chan []string, connections chan net.Conn) {
-	var connectTo []string
-	var i uint
+func manageTcp(ctx context.Context, resolver chan []Target, connections chan net.Conn, pinned func(net.Conn) string) {
+	// targets known before a restart by the watchdog
+	connectTo := currentTargets()
 
 	for {
+		// a manager restarted by the watchdog returns once it unblocks,
+		// rather than taking what its replacement is waiting for
+		if ctx.Err() != nil {
+			return
+		}
 		select {
-		case connectTo = <-resolver:
+		case <-ctx.Done():
+			return
+
+		case targets := <-resolver:
+			if ctx.Err() != nil {
+				// hand the update back, unless a newer one is waiting
+				select {
+				case resolver <- targets:
+				default:
+				}
+				return
+			}
+			heartbeats.manager.beat()
+			connectTo = targets
+			setTargets(connectTo)
 
 		case in := <-connections:
-			if len(connectTo) > 0 {
-				go forwardTcp(in, connectTo[i%uint(len(connectTo))])
-				i++
-			} else {
-				if debug {
-					log.Print("Don't know where to connect, closing incoming connection\n")
+			if ctx.Err() != nil {
+				select {
+				case connections <- in:
+				default:
+					in.Close()
 				}
+				return
+			}
+			heartbeats.manager.beat()
+			id := newConnId()
+			if debug.Load() {
+				log.Printf("[%d] Accepted connection from `%s`\n", id, in.RemoteAddr())
+			}
+			if fdsExhausted() {
+				log.Printf("[%d] Near file descriptor limit, %d of %d in use, closing incoming connection\n", id, fdsInUse(), fds.limit)
 				in.Close()
+				continue
+			}
+			if isBanned(in.RemoteAddr()) {
+				if debug.Load() {
+					log.Printf("[%d] Client is banned, closing incoming connection\n", id)
+				}
+				rejectConn(id, in, "", "banned")
+				continue
+			}
+			if !accessAllowed(in.RemoteAddr(), in.LocalAddr()) {
+				if debug.Load() {
+					log.Printf("[%d] Client is not allowed at this time, closing incoming connection\n", id)
+				}
+				rejectConn(id, in, "", "access")
+				continue
+			}
+			if !geoAllowed(in.RemoteAddr()) {
+				if debug.Load() {
+					log.Printf("[%d] Client country is not allowed, closing incoming connection\n", id)
+				}
+				recordClient(in.RemoteAddr(), 1, 1, "rejected connections")
+				rejectConn(id, in, "", "geo")
+				continue
+			}
+			if clientQuota > 0 && quotaThrottle == 0 {
+				if ip, _ := addrIpPort(in.RemoteAddr()); ip != nil && overQuota(ip.String()) {
+					if debug.Load() {
+						log.Printf("[%d] Client over transfer quota, closing incoming connection\n", id)
+					}
+					recordClient(in.RemoteAddr(), 1, 1, "rejected connections")
+					rejectConn(id, in, "", "quota")
+					continue
+				}
+			}
+			if !ruleAdmits(in.LocalAddr().String()) {
+				if debug.Load() {
+					log.Printf("[%d] Rule `%s` is at its connection limit, closing incoming connection\n", id, ruleOf(in.LocalAddr().String()))
+				}
+				rejectConn(id, in, "", "rule-limit")
+				continue
+			}
+			recordClient(in.RemoteAddr(), 1, 0, "")
+			if inMaintenance(in.LocalAddr()) {
+				if maintenanceTarget != "" {
+					go forwardTcp(ctx, id, in, maintenanceTarget)
+				} else {
+					if debug.Load() {
+						log.Printf("[%d] Listener is in maintenance, closing incoming connection\n", id)
+					}
+					rejectConn(id, in, "", "maintenance")
+				}
+				continue
+			}
+			if pinned != nil {
+				if target := pinned(in); target != "" && !isDraining(target) && !isBlacklisted(target) {
+					go forwardTcp(ctx, id, in, target)
+					continue
+				}
+			}
+			if target := pickTarget(groupTargets(connectTo, uint(rand.Uint32()), in.RemoteAddr(), in.LocalAddr())); target != "" {
+				if portRange != "" {
+					target = mapPort(target, in.LocalAddr())
+				}
+				go forwardTcp(ctx, id, in, target)
+			} else if mysql && mysqlHold > 0 {
+				go holdMysql(ctx, id, in)
+			} else {
+				if debug.Load() {
+					log.Printf("[%d] Don't know where to connect, closing incoming connection\n", id)
+				}
+				if mysql {
+					go rejectMysql(in)
+				} else {
+					rejectConn(id, in, "", "no-targets")
+				}
 			}
 		}
 	}
 }
 
-func forwardTcp(conn net.Conn, connectTo string) {
-	if debug {
-		log.Print("Accepted connection\n")
+func forwardTcp(ctx context.Context, id uint64, conn net.Conn, connectTo string) {
+	if clientRates.interval > 0 && !clientRateAllowed(conn.RemoteAddr()) {
+		if debug.Load() {
+			log.Printf("[%d] Client over rate limit, closing incoming connection\n", id)
+		}
+		accounting.Lock()
+		accounting.RateLimited++
+		accounting.Unlock()
+		recordClient(conn.RemoteAddr(), 0, 1, "rejected connections")
+		rejectConn(id, conn, connectTo, "rate")
+		return
+	}
+	if bannerTemplate != nil {
+		if err := sendBanner(ctx, id, conn, connectTo); err != nil {
+			if debug.Load() {
+				log.Printf("[%d] Failed to send banner: %v\n", id, err)
+			}
+			conn.Close()
+			return
+		}
+	}
+	var hello *helloConn
+	if tlsFingerprint {
+		var err error
+		if hello, err = peekHello(conn); err != nil {
+			if debug.Load() {
+				log.Printf("[%d] Failed to read TLS ClientHello: %v\n", id, err)
+			}
+			recordClient(conn.RemoteAddr(), 0, 1, "empty connections")
+			conn.Close()
+			return
+		}
+		if debug.Load() && hello.ja3 != "" {
+			log.Printf("[%d] TLS client fingerprint ja3=%s ja4=%s\n", id, hello.ja3, hello.ja4)
+		}
+		if hello.tlsDenied() {
+			if debug.Load() {
+				log.Printf("[%d] TLS client fingerprint is denied, closing incoming connection\n", id)
+			}
+			recordClient(conn.RemoteAddr(), 0, 1, "rejected connections")
+			conn.Close()
+			return
+		}
+		conn = hello
 	}
-	fwd, err := net.DialTimeout("tcp", connectTo, timeout)
+	if len(pgRoutes) > 0 {
+		peeked, database, err := peekStartup(conn)
+		if err != nil {
+			if debug.Load() {
+				log.Printf("[%d] Failed to read PostgreSQL startup message: %v\n", id, err)
+			}
+			recordClient(conn.RemoteAddr(), 0, 1, "empty connections")
+			conn.Close()
+			return
+		}
+		conn = peeked
+		if target := pickTarget(pgTargets(database)); target != "" {
+			if debug.Load() {
+				log.Printf("[%d] Routing database `%s` to `%s`\n", id, database, target)
+			}
+			connectTo = target
+		}
+	}
+	fwd, err := dialTcp(ctx, connectTo, conn)
 	if err != nil {
-		log.Printf("Conection to `%s` failed: %v\n", connectTo, err)
-		conn.Close()
+		log.Printf("[%d] Conection to `%s` failed: %v error=dial\n", id, connectTo, err)
+		recordClient(conn.RemoteAddr(), 0, 1, "failed connections")
+		rejectConn(id, conn, connectTo, "unavailable")
 		return
 	}
+	if debug.Load() {
+		log.Printf("[%d] Connected to `%s`\n", id, connectTo)
+	}
+	relayed := 0
+	if firstByteTimeout > 0 {
+		if fwd, connectTo, relayed, err = awaitFirstByte(ctx, id, conn, fwd, connectTo); err != nil {
+			log.Printf("[%d] No answer from targets: %v error=dial\n", id, err)
+			recordClient(conn.RemoteAddr(), 0, 1, "failed connections")
+			rejectConn(id, conn, connectTo, "unavailable")
+			return
+		}
+	}
+	var shadow *shadowConn
+	if shadowTarget != "" {
+		shadow = startShadow(ctx, id)
+	}
+	var cancel context.CancelFunc
+	if maxConnLifetime > 0 {
+		ctx, cancel = context.WithTimeout(ctx, maxConnLifetime)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	var closed int32
+	var c *trackedConn
+	var spliced *splicedPair
+	var ring *uringPair
+	var looped *loopPair
 	close := func() {
+		if atomic.SwapInt32(&closed, 1) == 0 && spliced != nil {
+			c.splicedBytes(spliced.unsplice())
+		}
+		if ring != nil {
+			ring.stop()
+		}
+		if looped != nil {
+			looped.stop()
+		}
+		cancel()
+		untrackConn(id)
+		if shadow != nil {
+			shadow.finish()
+		}
 		fwd.Close()
 		conn.Close()
 	}
+	var toClient, toTarget io.Writer = conn, fwd
+	if clientWriteTimeout > 0 {
+		toClient = deadlineWriter{conn, clientWriteTimeout}
+	}
+	if backendWriteTimeout > 0 {
+		toTarget = deadlineWriter{fwd, backendWriteTimeout}
+	}
+	// terminate closes the connection on behalf of the proxy rather than
+	// either peer
+	terminate := close
+	var mysqlConn *mysqlClient
+	if mysql {
+		mysqlConn = &mysqlClient{w: toClient, idle: true}
+		toClient = mysqlConn
+		terminate = func() {
+			if atomic.LoadInt32(&closed) == 0 {
+				mysqlConn.shutdown()
+			}
+			close()
+		}
+	}
+	c = trackConn(id, "tcp", conn.RemoteAddr().String(), conn.LocalAddr().String(), connectTo, terminate)
+	if hello != nil {
+		c.setFingerprint(hello.ja3, hello.ja4)
+	}
+	if relayed > 0 {
+		c.transferred(relayed, 0)
+	}
+	// close on shutdown or when the connection reaches -max-conn-lifetime
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			c.setCloseReason("lifetime")
+			if verbose.Load() {
+				log.Printf("[%d] Connection exceeded lifetime of %v, closing\n", id, maxConnLifetime)
+			}
+		}
+		terminate()
+	}()
+	var fromClient, fromTarget io.Reader = countingReader{conn, c, true}, countingReader{fwd, c, false}
+	if shadow != nil && shadowCompare {
+		fromTarget = shadow.responses(fromTarget)
+		toClient = shadow.toClient(toClient)
+	}
+	if mysqlConn != nil {
+		fromClient = mysqlConn.requests(fromClient)
+	}
+	if httpForwarded {
+		f := newForwardedReader(fromClient, id, conn.RemoteAddr(), conn.LocalAddr())
+		fromClient, fromTarget = f, f.responses(fromTarget)
+	}
+	if _, data := conn.(ftpDataConn); ftp && !data {
+		s := &ftpSession{ctx: ctx, id: id, client: conn, server: fwd}
+		fromClient, fromTarget = s.commands(fromClient), s.replies(fromTarget)
+	}
+	if clientQuota > 0 && quotaThrottle > 0 {
+		ip := clientIp(c.client)
+		fromClient, fromTarget = quotaReader{fromClient, ip}, quotaReader{fromTarget, ip}
+	}
+	if c.limit != nil && c.limit.bandwidth > 0 {
+		fromClient, fromTarget = ruleReader{fromClient, c.limit}, ruleReader{fromTarget, c.limit}
+	}
+	if shadow != nil {
+		// the shadow target gets the data as sent to the primary target
+		fromClient = shadow.requests(fromClient)
+	}
+	// only connections forwarded as they are, without inspecting or
+	// throttling data, are left to the kernel
+	_, plainIn := fromClient.(countingReader)
+	_, plainOut := fromTarget.(countingReader)
+	if sockmapSplice && plainIn && plainOut {
+		spliced = spliceTcp(conn, fwd)
+		if spliced != nil {
+			c.setSpliced()
+			if debug.Load() {
+				log.Printf("[%d] Forwarding in the kernel with eBPF sockmap\n", id)
+			}
+		}
+	}
+	if ioUring && plainIn && plainOut && spliced == nil && clientWriteTimeout == 0 && backendWriteTimeout == 0 {
+		if ring = uringForward(id, conn, fwd, c, close); ring != nil {
+			if atomic.LoadInt32(&closed) != 0 {
+				// closed while handed over
+				ring.stop()
+			}
+			if debug.Load() {
+				log.Printf("[%d] Forwarding with io_uring\n", id)
+			}
+			return
+		}
+	}
+	if eventLoop && plainIn && plainOut && spliced == nil && clientWriteTimeout == 0 && backendWriteTimeout == 0 {
+		if looped = loopForward(id, conn, fwd, c, close); looped != nil {
+			if atomic.LoadInt32(&closed) != 0 {
+				// closed while handed over
+				looped.stop()
+			}
+			if debug.Load() {
+				log.Printf("[%d] Forwarding with the event loop\n", id)
+			}
+			return
+		}
+	}
 	go func() {
 		defer close()
-		w, err := io.Copy(fwd, conn)
-		if debug {
-			log.Printf("Incoming TCP connection closed: %v; %v bytes forwarded\n", err, w)
+		w, err := copyBuffered(toTarget, fromClient, c)
+		c.setCloseReason("client")
+		if shadow != nil && shadowCompare && err == nil {
+			shadow.awaitPrimary(fwd)
+		}
+		if spliced != nil {
+			w += spliced.forwarded(true, err == nil)
+		}
+		if debug.Load() {
+			log.Printf("[%d] Incoming TCP connection closed: %v; %v bytes forwarded\n", id, err, w)
+		}
+		if w == 0 {
+			// connect-and-close without sending data is typical for port scans
+			recordClient(conn.RemoteAddr(), 0, 1, "empty connections")
 		}
 	}()
 	go func() {
 		defer close()
-		w, err := io.Copy(conn, fwd)
-		if debug {
-			log.Printf("Outgoing TCP connection closed: %v; %v bytes forwarded\n", err, w)
+		w, err := copyBuffered(toClient, fromTarget, c)
+		c.setCloseReason("target")
+		if spliced != nil {
+			w += spliced.forwarded(false, err == nil)
+		}
+		if debug.Load() {
+			log.Printf("[%d] Outgoing TCP connection closed: %v; %v bytes forwarded\n", id, err, w)
 		}
 	}()
 }
 
-func manageUdp(resolver chan []string, connections chan net.Conn) {
-	var in, out net.Conn
-	var i uint
+// deadlineWriter fails a write that does not complete within timeout, so a
+// peer that stops reading cannot hold the connection forever
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(p)
+}
+
+func manageUdp(ctx context.Context, resolver chan []Target, connections chan net.Conn) {
+	var ins []net.Conn
+	var out net.Conn
+	var session *trackedConn
+	// with -udp-rebind-idle, targets to switch to once the session idles
+	var pending []Target
+	// sessions the target answered with an ICMP error
+	failed := make(chan *trackedConn, 1)
+	var idleCheck <-chan time.Time
+	if udpRebindIdle > 0 {
+		ticker := systemClock.NewTicker(udpRebindIdle / 4)
+		defer ticker.Stop()
+		idleCheck = ticker.Chan()
+	}
+
+	rebind := func(connectTo []Target) {
+		if out != nil {
+			session.setCloseReason("rebind")
+			untrackConn(session.id)
+			out.Close()
+			out = nil
+		}
+		if target := pickTarget(groupTargets(connectTo, uint(rand.Uint32()), nil, nil)); target != "" {
+			id := newConnId()
+			_out, err := dialUpstream(ctx, "udp", target)
+			if err != nil {
+				log.Printf("[%d] Conection to `%s` failed: %v error=dial\n", id, target, err)
+			} else {
+				if debug.Load() {
+					log.Printf("[%d] New UDP session to `%s`\n", id, target)
+				}
+				var local string
+				if len(ins) > 0 {
+					local = ins[0].LocalAddr().String()
+				}
+				_out = countFd(_out)
+				session = trackConn(id, "udp", "", local, target, func() { untrackConn(id); _out.Close() })
+				out = _out
+				for _, in := range ins {
+					go forwardUdp(ctx, session, in, out, failed)
+				}
+			}
+		}
+	}
 
 	for {
 		select {
-		case connectTo := <-resolver:
+		case <-ctx.Done():
 			if out != nil {
+				session.setCloseReason("shutdown")
+				untrackConn(session.id)
 				out.Close()
-				out = nil
 			}
-			if len(connectTo) > 0 {
-				_out, err := net.Dial("udp", connectTo[i%uint(len(connectTo))])
-				i++
-				if err != nil {
-					log.Printf("Conection to `%s` failed: %v\n", connectTo, err)
-				} else {
-					out = _out
-					if in != nil {
-						go forwardUdp(in, out)
-					}
+			return
+
+		case connectTo := <-resolver:
+			setTargets(connectTo)
+			if out != nil && udpRebindIdle > 0 {
+				if debug.Load() && pending == nil {
+					log.Printf("[%d] Targets changed, keeping UDP session to `%s` until idle for %v\n", session.id, session.target, udpRebindIdle)
 				}
+				pending = connectTo
+				continue
 			}
+			rebind(connectTo)
 
-		case _in := <-connections:
-			in = _in
+		case c := <-failed:
+			if c == session && out != nil {
+				rebind(currentTargets())
+				pending = nil
+			}
+
+		case now := <-idleCheck:
+			if pending != nil && session.idle(now) >= udpRebindIdle {
+				if debug.Load() {
+					log.Printf("[%d] UDP session to `%s` idle, switching targets\n", session.id, session.target)
+				}
+				rebind(pending)
+				pending = nil
+			}
+
+		case in := <-connections:
+			ins = append(ins, in)
 			if out != nil {
-				go forwardUdp(in, out)
+				go forwardUdp(ctx, session, in, out, failed)
 			}
 		}
 	}
 }
 
-func forwardUdp(from net.Conn, to net.Conn) {
+func forwardUdp(ctx context.Context, session *trackedConn, from net.Conn, to net.Conn, failed chan<- *trackedConn) {
 	for {
-		w, err := io.Copy(to, from)
-		if debug {
-			log.Printf("UDP forwarding interrupted: %v; %v bytes forwarded\n", err, w)
+		w, err := io.Copy(to, countingReader{from, session, true})
+		if debug.Load() {
+			log.Printf("[%d] UDP forwarding interrupted: %v; %v bytes forwarded\n", session.id, err, w)
 		}
 		if strings.Contains(err.Error(), "closed network connection") {
 			break
 		}
-		time.Sleep(1 * time.Second)
+		// the manager switches targets, closing the session
+		if isIcmpError(err) {
+			if verbose.Load() {
+				log.Printf("[%d] Target `%s` unreachable, switching targets: %v\n", session.id, session.target, err)
+			}
+			markUnreachable(session.target)
+			session.setCloseReason("unreachable")
+			select {
+			case failed <- session:
+			default:
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
+
+var lastConnId uint64
+
+// newConnId returns a process-unique ID for a TCP connection or UDP session,
+// used to correlate log lines
+func newConnId() uint64 {
+	return atomic.AddUint64(&lastConnId, 1)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// maintenance holds the listeners switched into maintenance mode through the
+// admin API: new connections to them are refused with -reject-payload or
+// sent to -maintenance-target, connections already forwarded continue;
+// "*" stands for all listeners
+var maintenance = struct {
+	sync.RWMutex
+	listeners map[string]bool
+}{listeners: make(map[string]bool)}
+
+// parseMaintenanceListener normalizes a listener given as host:port or
+// :port, empty for all listeners
+func parseMaintenanceListener(listener string) (string, error) {
+	if listener == "" || listener == "*" {
+		return "*", nil
+	}
+	host, port, err := net.SplitHostPort(listener)
+	if err != nil {
+		return "", fmt.Errorf("expected listener host:port or :port, got `%s`", listener)
+	}
+	if host != "" {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "", fmt.Errorf("expected listener IP address, got `%s`", host)
+		}
+		if ip.IsUnspecified() {
+			host = ""
+		} else {
+			host = ip.String()
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// setMaintenance switches the listener into or out of maintenance mode
+func setMaintenance(listener string, on bool) error {
+	key, err := parseMaintenanceListener(listener)
+	if err != nil {
+		return err
+	}
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	if maintenance.listeners[key] == on {
+		return nil
+	}
+	typ := "maintenance.off"
+	if on {
+		maintenance.listeners[key] = true
+		typ = "maintenance.on"
+	} else {
+		delete(maintenance.listeners, key)
+	}
+	publishEvent(typ, func() interface{} { return map[string]string{"listener": key} })
+	return nil
+}
+
+// inMaintenance tells whether connections accepted on the local address are
+// refused for maintenance
+func inMaintenance(local net.Addr) bool {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	if len(maintenance.listeners) == 0 {
+		return false
+	}
+	if maintenance.listeners["*"] {
+		return true
+	}
+	ip, port := addrIpPort(local)
+	if ip == nil {
+		return false
+	}
+	p := strconv.Itoa(port)
+	return maintenance.listeners[net.JoinHostPort("", p)] || maintenance.listeners[net.JoinHostPort(ip.String(), p)]
+}
+
+func listMaintenance() []string {
+	maintenance.RLock()
+	list := make([]string, 0, len(maintenance.listeners))
+	for listener := range maintenance.listeners {
+		list = append(list, listener)
+	}
+	maintenance.RUnlock()
+	sort.Strings(list)
+	return list
+}
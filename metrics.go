@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metric is a sample of a Prometheus metric, labels sorted by name
+type metric struct {
+	name   string
+	labels [][2]string
+	value  float64
+}
+
+// metricFamily is the metrics of a name with its type, histograms are
+// expanded into _bucket, _sum and _count samples
+type metricFamily struct {
+	name, typ, help string
+	metrics         []metric
+}
+
+// collectMetrics converts the usage counters and histograms into metric
+// families; per-client counters are left out for their cardinality
+func collectMetrics() []metricFamily {
+	report := usageStats()
+	counter := func(name, help string, value uint64) metricFamily {
+		return metricFamily{name, "counter", help, []metric{{name, nil, float64(value)}}}
+	}
+	perTarget := func(name, help string, value func(u *usageCounters) uint64) metricFamily {
+		f := metricFamily{name, "counter", help, nil}
+		for target, u := range report.Targets {
+			f.metrics = append(f.metrics, metric{name, [][2]string{{"target", target}}, float64(value(u))})
+		}
+		sort.Slice(f.metrics, func(i, j int) bool { return f.metrics[i].labels[0][1] < f.metrics[j].labels[0][1] })
+		return f
+	}
+	perRule := func(name, help string, value func(u *usageCounters) uint64) metricFamily {
+		f := metricFamily{name, "counter", help, nil}
+		for rule, u := range report.Rules {
+			f.metrics = append(f.metrics, metric{name, [][2]string{{"rule", rule}}, float64(value(u))})
+		}
+		sort.Slice(f.metrics, func(i, j int) bool { return f.metrics[i].labels[0][1] < f.metrics[j].labels[0][1] })
+		return f
+	}
+	live := listConns()
+	active := metricFamily{"goproxy_rule_connections_active", "gauge", "Live TCP connections and UDP sessions per forwarding rule", nil}
+	perRuleActive := make(map[string]int)
+	for _, c := range live {
+		perRuleActive[c.Rule]++
+	}
+	for rule := range report.Rules {
+		active.metrics = append(active.metrics, metric{active.name, [][2]string{{"rule", rule}}, float64(perRuleActive[rule])})
+	}
+	sort.Slice(active.metrics, func(i, j int) bool { return active.metrics[i].labels[0][1] < active.metrics[j].labels[0][1] })
+	families := []metricFamily{
+		{"goproxy_connections_active", "gauge", "Live TCP connections and UDP sessions", []metric{{"goproxy_connections_active", nil, float64(len(live))}}},
+		counter("goproxy_connections_total", "TCP connections and UDP sessions opened", report.Total.Conns),
+		counter("goproxy_received_bytes_total", "Bytes received from clients", report.Total.BytesIn),
+		counter("goproxy_sent_bytes_total", "Bytes received from targets and sent to clients", report.Total.BytesOut),
+		perTarget("goproxy_target_connections_total", "TCP connections and UDP sessions opened per target", func(u *usageCounters) uint64 { return u.Conns }),
+		perTarget("goproxy_target_received_bytes_total", "Bytes received from clients per target", func(u *usageCounters) uint64 { return u.BytesIn }),
+		perTarget("goproxy_target_sent_bytes_total", "Bytes received from the target", func(u *usageCounters) uint64 { return u.BytesOut }),
+		active,
+		perRule("goproxy_rule_connections_total", "TCP connections and UDP sessions opened per forwarding rule", func(u *usageCounters) uint64 { return u.Conns }),
+		perRule("goproxy_rule_received_bytes_total", "Bytes received from clients per forwarding rule", func(u *usageCounters) uint64 { return u.BytesIn }),
+		perRule("goproxy_rule_sent_bytes_total", "Bytes received from targets per forwarding rule", func(u *usageCounters) uint64 { return u.BytesOut }),
+		counter("goproxy_accept_failures_total", "Failed accepts", report.AcceptFailures),
+		counter("goproxy_accept_delayed_total", "Accepts delayed by -accept-rate", report.AcceptDelayed),
+		counter("goproxy_rate_limited_total", "Connections closed by -client-rate", report.RateLimited),
+		counter("goproxy_overflow_total", "Connections closed on a full -accept-queue", report.Overflow),
+		counter("goproxy_shed_total", "Connections shed near the file descriptor limit", report.Shed),
+		counter("goproxy_slow_total", "Slow connections closed", report.Slow),
+		counter("goproxy_watchdog_restarts_total", "Subsystems restarted by the -watchdog", report.WatchdogRestarts),
+		counter("goproxy_stalled_total", "Connections closed while the manager stalled", report.Stalled),
+		counter("goproxy_targets_held_total", "DNS refreshes ignored by -min-targets", report.TargetsHeld),
+		counter("goproxy_zone_spills_total", "Targets picked outside of -zone as the ones in it failed or were saturated", report.ZoneSpills),
+		{"goproxy_buffered_bytes", "gauge", "Bytes read and not yet written", []metric{{"goproxy_buffered_bytes", nil, float64(report.Buffered)}}},
+		histogramFamily("goproxy_connection_duration_seconds", "Duration of closed connections and sessions", nil, report.Duration),
+		histogramFamily("goproxy_connection_size_bytes", "Bytes transferred by closed connections and sessions", nil, report.Size),
+	}
+	limits := make([]string, 0, len(report.RuleLimits))
+	for rule := range report.RuleLimits {
+		limits = append(limits, rule)
+	}
+	sort.Strings(limits)
+	perLimit := func(name, typ, help string, value func(l ruleLimitStats) float64) metricFamily {
+		f := metricFamily{name, typ, help, nil}
+		for _, rule := range limits {
+			f.metrics = append(f.metrics, metric{name, [][2]string{{"rule", rule}}, value(report.RuleLimits[rule])})
+		}
+		return f
+	}
+	families = append(families,
+		perLimit("goproxy_rule_connections_limit", "gauge", "Live TCP connections allowed by -rule-limit, 0 for unlimited", func(l ruleLimitStats) float64 { return float64(l.Conns) }),
+		perLimit("goproxy_rule_rejected_total", "counter", "Connections refused at the -rule-limit", func(l ruleLimitStats) float64 { return float64(l.Rejected) }),
+		perLimit("goproxy_rule_bandwidth_limit_bytes", "gauge", "Bytes per second allowed by -rule-limit, 0 for unlimited", func(l ruleLimitStats) float64 { return float64(l.Bandwidth) }),
+		perLimit("goproxy_rule_throttled_seconds_total", "counter", "Time reads waited for -rule-limit bandwidth", func(l ruleLimitStats) float64 { return l.ThrottledSeconds }),
+		perLimit("goproxy_rule_buffered_bytes", "gauge", "Bytes read and not yet written per limited rule", func(l ruleLimitStats) float64 { return float64(l.Buffered) }),
+		perLimit("goproxy_rule_buffered_limit_bytes", "gauge", "Bytes buffered allowed by -rule-limit, 0 for unlimited", func(l ruleLimitStats) float64 { return float64(l.MaxBuffered) }),
+		perLimit("goproxy_rule_buffer_pauses_total", "counter", "Reads delayed over the -rule-limit buffered", func(l ruleLimitStats) float64 { return float64(l.BufferPauses) }),
+	)
+	if sh := report.Shadow; sh != nil {
+		compared := metricFamily{"goproxy_shadow_compared_total", "counter", "Connections whose -shadow responses matched or differed in size or content from the primary target's, or were incomplete", nil}
+		for _, r := range []struct {
+			result string
+			value  uint64
+		}{{"match", sh.Matched}, {"size", sh.SizeDiffers}, {"content", sh.ContentDiffers}, {"incomplete", sh.Incomplete}} {
+			compared.metrics = append(compared.metrics, metric{compared.name, [][2]string{{"result", r.result}}, float64(r.value)})
+		}
+		families = append(families,
+			counter("goproxy_shadow_connections_total", "Connections copied to the -shadow target", sh.Connections),
+			counter("goproxy_shadow_failed_total", "Shadow connections failed or given up for lagging", sh.Failed),
+			compared,
+		)
+	}
+	dial := metricFamily{"goproxy_dial_duration_seconds", "histogram", "Latency of successful connects per target", nil}
+	targets := make([]string, 0, len(report.Dial))
+	for target := range report.Dial {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		f := histogramFamily(dial.name, dial.help, [][2]string{{"target", target}}, report.Dial[target])
+		dial.metrics = append(dial.metrics, f.metrics...)
+	}
+	return append(families, dial)
+}
+
+// histogramFamily expands a histogram into cumulative buckets
+func histogramFamily(name, help string, labels [][2]string, h *histogram) metricFamily {
+	f := metricFamily{name, "histogram", help, nil}
+	if h == nil {
+		return f
+	}
+	var cumulative uint64
+	for i, n := range h.Counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = strconv.FormatFloat(h.Bounds[i], 'g', -1, 64)
+		}
+		f.metrics = append(f.metrics, metric{name + "_bucket", sortLabels(append(append([][2]string(nil), labels...), [2]string{"le", le})), float64(cumulative)})
+	}
+	f.metrics = append(f.metrics, metric{name + "_sum", labels, h.Sum}, metric{name + "_count", labels, float64(h.Count)})
+	return f
+}
+
+func sortLabels(labels [][2]string) [][2]string {
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	return labels
+}
+
+// writeMetricsText formats metric families in the Prometheus text format
+func writeMetricsText(buf *bytes.Buffer, families []metricFamily) {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for _, f := range families {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, m := range f.metrics {
+			buf.WriteString(m.name)
+			if len(m.labels) > 0 {
+				buf.WriteByte('{')
+				for i, l := range m.labels {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(buf, `%s="%s"`, l[0], escape.Replace(l[1]))
+				}
+				buf.WriteByte('}')
+			}
+			fmt.Fprintf(buf, " %s\n", strconv.FormatFloat(m.value, 'g', -1, 64))
+		}
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	writeMetricsText(&buf, collectMetrics())
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// pushMetrics pushes metrics every -metrics-push-interval, to a Pushgateway
+// or a Prometheus remote write endpoint, and once more on shutdown
+func pushMetrics(ctx context.Context) {
+	instance, _ := os.Hostname()
+	target := metricsPush
+	if metricsPushFormat == "pushgateway" && !strings.Contains(target, "/metrics/job/") {
+		target = strings.TrimSuffix(target, "/") + "/metrics/job/goproxy/instance/" + url.PathEscape(instance)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	push := func() {
+		var req *http.Request
+		var err error
+		if metricsPushFormat == "pushgateway" {
+			var buf bytes.Buffer
+			writeMetricsText(&buf, collectMetrics())
+			req, err = http.NewRequest(http.MethodPut, target, &buf)
+			if err == nil {
+				req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+			}
+		} else {
+			body := snappyBlock(remoteWriteRequest(collectMetrics(), instance, time.Now()))
+			req, err = http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/x-protobuf")
+				req.Header.Set("Content-Encoding", "snappy")
+				req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to push metrics to `%s`: %v\n", target, err)
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Failed to push metrics to `%s`: %v\n", target, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Printf("Failed to push metrics to `%s`: %s\n", target, resp.Status)
+		} else if debug.Load() {
+			log.Printf("Pushed metrics to `%s`\n", target)
+		}
+	}
+	ticker := systemClock.NewTicker(metricsPushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			push()
+			return
+		case <-ticker.Chan():
+			push()
+		}
+	}
+}
+
+// remoteWriteRequest encodes the metrics as a Prometheus remote write
+// WriteRequest protobuf, every sample at now, with job and instance labels
+func remoteWriteRequest(families []metricFamily, instance string, now time.Time) []byte {
+	var req bytes.Buffer
+	for _, f := range families {
+		for _, m := range f.metrics {
+			labels := append([][2]string{{"__name__", m.name}, {"instance", instance}, {"job", "goproxy"}}, m.labels...)
+			sortLabels(labels)
+			var series bytes.Buffer
+			for _, l := range labels {
+				var label bytes.Buffer
+				protoBytes(&label, 1, []byte(l[0]))
+				protoBytes(&label, 2, []byte(l[1]))
+				protoBytes(&series, 1, label.Bytes())
+			}
+			var sample bytes.Buffer
+			sample.WriteByte(1<<3 | 1) // field 1, 64-bit
+			binary.Write(&sample, binary.LittleEndian, math.Float64bits(m.value))
+			sample.WriteByte(2 << 3) // field 2, varint
+			sample.Write(binary.AppendUvarint(nil, uint64(now.UnixMilli())))
+			protoBytes(&series, 2, sample.Bytes())
+			protoBytes(&req, 1, series.Bytes())
+		}
+	}
+	return req.Bytes()
+}
+
+// protoBytes appends a length-delimited protobuf field
+func protoBytes(buf *bytes.Buffer, field int, data []byte) {
+	buf.Write(binary.AppendUvarint(nil, uint64(field<<3|2)))
+	buf.Write(binary.AppendUvarint(nil, uint64(len(data))))
+	buf.Write(data)
+}
+
+// snappyBlock frames data as a snappy block of literals only, valid for any
+// decoder at the cost of no compression
+func snappyBlock(data []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > 65536 {
+			n = 65536
+		}
+		// literal with a 2 byte length-1 following the tag
+		out = append(out, 61<<2, byte(n-1), byte((n-1)>>8))
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// minTargets guards against a partial DNS or registry outage funneling all
+// traffic to the few targets still returned: a refresh shrinking the target
+// set below it is ignored and the previous set kept
+var minTargets struct {
+	n       int
+	percent bool // n is a percentage of the previous set
+}
+
+// parseMinTargets parses N or N%
+func parseMinTargets(spec string) error {
+	percent := strings.HasSuffix(spec, "%")
+	n, err := strconv.ParseUint(strings.TrimSuffix(spec, "%"), 10, 31)
+	if err != nil || percent && n > 100 {
+		return fmt.Errorf("expected number of targets or percentage, got `%s`", spec)
+	}
+	minTargets.n, minTargets.percent = int(n), percent
+	return nil
+}
+
+// holdTargets reports whether the previous target set is kept instead of the
+// new one, counting and logging it
+func holdTargets(before, after []Target) bool {
+	if minTargets.n == 0 || len(before) == 0 || len(after) >= len(before) {
+		return false
+	}
+	min := minTargets.n
+	if minTargets.percent {
+		min = (len(before)*minTargets.n + 99) / 100
+	}
+	if len(after) >= min {
+		return false
+	}
+	accounting.Lock()
+	accounting.TargetsHeld++
+	accounting.Unlock()
+	log.Printf("DNS returned %d of %d targets, fewer than -min-targets %d, keeping the previous set: %v error=dns\n", len(after), len(before), min, after)
+	publishEvent("targets.held", func() interface{} {
+		return map[string]interface{}{"targets": targetAddrs(before), "resolved": targetAddrs(after), "min": min}
+	})
+	return true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var mptcpFallback sync.Once
+
+// mptcpUnsupported reports errors of kernels without MPTCP or with it
+// disabled by net.mptcp.enabled, logged once as plain TCP is used instead
+func mptcpUnsupported(err error) bool {
+	if err == unix.EPROTONOSUPPORT || err == unix.EINVAL || err == unix.ENOPROTOOPT {
+		mptcpFallback.Do(func() {
+			log.Printf("MPTCP is not available, using TCP: %v\n", err)
+		})
+		return true
+	}
+	return false
+}
+
+func tcpSockaddr(addr *net.TCPAddr, family int) unix.Sockaddr {
+	if family == unix.AF_INET {
+		sa := &unix.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], addr.IP.To4())
+		return sa
+	}
+	sa := &unix.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16())
+	if addr.Zone != "" {
+		if iface, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(iface.Index)
+		}
+	}
+	return sa
+}
+
+func tcpFamily(ip net.IP) int {
+	if ip != nil && ip.To4() != nil {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// listenMptcp binds a Multipath TCP listener, MPTCP-unaware clients are
+// served as plain TCP by the kernel
+func listenMptcp(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveTCPAddr(listenNetwork("tcp"), addr)
+	if err != nil {
+		return nil, err
+	}
+	family := tcpFamily(laddr.IP)
+	if listenFamily == "ipv4" {
+		family = unix.AF_INET
+	}
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_MPTCP)
+	if mptcpUnsupported(err) {
+		return listenConfig().Listen(context.Background(), listenNetwork("tcp"), addr)
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	return listenSocket(fd, "mptcp", laddr, family)
+}
+
+// listenSocket binds and listens on a stream socket created for a protocol
+// other than TCP, returning it as a listener
+func listenSocket(fd int, name string, laddr *net.TCPAddr, family int) (net.Listener, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if family == unix.AF_INET6 {
+		if err := setV6Only(uintptr(fd), listenFamily == "ipv6"); err != nil {
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if markDownstream {
+		if err := markSocket(uintptr(fd)); err != nil {
+			return nil, err
+		}
+	}
+	if listenOpts.freebind {
+		if err := setFreebind(uintptr(fd)); err != nil {
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := unix.Bind(fd, tcpSockaddr(laddr, family)); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return net.FileListener(f)
+}
+
+// dialMptcp connects to the target with Multipath TCP, which falls back to
+// plain TCP when the target doesn't support it
+func dialMptcp(target string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	family := tcpFamily(raddr.IP)
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_MPTCP)
+	if mptcpUnsupported(err) {
+		d := dialer()
+		d.Timeout = timeout
+		return d.Dial("tcp", target)
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	return connectSocket(fd, "mptcp", raddr, family, timeout)
+}
+
+// connectSocket connects a stream socket created for a protocol other than
+// TCP within timeout, returning it as a connection
+func connectSocket(fd int, name string, raddr *net.TCPAddr, family int, timeout time.Duration) (net.Conn, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	if err := markSocket(uintptr(fd)); err != nil {
+		return nil, err
+	}
+	// a blocking connect is bounded by the send timeout
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &tv)
+	if err := unix.Connect(fd, tcpSockaddr(raddr, family)); err != nil {
+		if err == unix.EINPROGRESS {
+			err = unix.ETIMEDOUT
+		}
+		return nil, &net.OpError{Op: "dial", Net: name, Addr: raddr, Err: os.NewSyscallError("connect", err)}
+	}
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &unix.Timeval{})
+	return net.FileConn(f)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errMptcp = errors.New("MPTCP is only supported on Linux")
+
+func listenMptcp(addr string) (net.Listener, error) {
+	return nil, errMptcp
+}
+
+func dialMptcp(target string, timeout time.Duration) (net.Conn, error) {
+	return nil, errMptcp
+}
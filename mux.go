@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Multiplexing carries many client connections as streams over a few
+// long-lived connections between a goproxy with -mux dial and one with
+// -mux listen. After a preface, each frame is a 9-byte header: type, stream
+// ID and length, followed by length bytes of payload for open and data
+// frames; for window frames the length is the credit granted.
+const (
+	muxPreface = "goproxy-mux/1\n"
+
+	muxOpen   = 1 // payload is the client address
+	muxData   = 2
+	muxWindow = 3 // the receiver consumed length bytes
+	muxFin    = 4 // no more data from the sender
+	muxClose  = 5 // the sender closed the stream
+
+	muxMaxFrame = 16 * 1024
+	// bytes a stream may have in flight before the receiver reads them
+	muxWindowSize = 256 * 1024
+	// streams opened by peers and not accepted yet, more are reset so a
+	// slow accept loop doesn't hold up the frames of open streams
+	muxAcceptQueue = 128
+)
+
+var errMuxClosed = errors.New("multiplexed connection closed")
+
+// muxTrusted are the -mux-trust networks of peers whose client addresses
+// are taken, streams of other peers have the peer's address
+var muxTrusted []*net.IPNet
+
+func parseMuxTrust(list string) error {
+	for _, c := range parseTargetList(list) {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return err
+		}
+		muxTrusted = append(muxTrusted, cidr)
+	}
+	return nil
+}
+
+// muxPeerTrusted reports whether the client addresses sent by the peer are
+// to be believed
+func muxPeerTrusted(peer net.Addr) bool {
+	ip, _ := addrIpPort(peer)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range muxTrusted {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// muxSession is one multiplexing connection and its streams
+type muxSession struct {
+	conn    net.Conn
+	wmu     sync.Mutex // serializes frames
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextId  uint32
+	accept  chan<- net.Conn // streams opened by the peer, nil when dialing
+	stop    <-chan struct{} // closed when no more streams are accepted
+	trusted bool            // client addresses of opened streams are taken
+	done    chan struct{}
+}
+
+func newMuxSession(conn net.Conn, accept chan<- net.Conn, stop <-chan struct{}) *muxSession {
+	s := &muxSession{conn: conn, streams: make(map[uint32]*muxStream), accept: accept, stop: stop, done: make(chan struct{})}
+	s.trusted = accept != nil && muxPeerTrusted(conn.RemoteAddr())
+	go s.readFrames()
+	return s
+}
+
+func (s *muxSession) writeFrame(typ byte, id uint32, length int, payload []byte) error {
+	var header [9]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], uint32(length))
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, err := s.conn.Write(header[:]); err != nil {
+		s.close()
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := s.conn.Write(payload); err != nil {
+			s.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *muxSession) readFrames() {
+	defer s.close()
+	r := bufio.NewReaderSize(s.conn, 64*1024)
+	var header [9]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if debug.Load() && err != io.EOF {
+				log.Printf("Multiplexed connection with `%s` closed: %v\n", s.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		typ, id, length := header[0], binary.BigEndian.Uint32(header[1:5]), binary.BigEndian.Uint32(header[5:9])
+		var payload []byte
+		if typ == muxOpen || typ == muxData {
+			if length > muxMaxFrame {
+				log.Printf("Multiplexed connection with `%s` sent a frame of %d bytes, closing\n", s.conn.RemoteAddr(), length)
+				return
+			}
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return
+			}
+		}
+		s.mu.Lock()
+		st := s.streams[id]
+		s.mu.Unlock()
+		switch typ {
+		case muxOpen:
+			if s.accept == nil || st != nil {
+				return
+			}
+			st = s.newStream(id, string(payload))
+			select {
+			case <-s.stop:
+				// the listener is closed, refuse the stream but keep
+				// serving the others until the peer closes the session
+				s.remove(id)
+				s.writeFrame(muxClose, id, 0, nil)
+				continue
+			default:
+			}
+			select {
+			case s.accept <- st:
+			default:
+				log.Printf("Too many multiplexed streams from `%s` waiting to be accepted, resetting stream %d\n", s.conn.RemoteAddr(), id)
+				s.remove(id)
+				s.writeFrame(muxClose, id, 0, nil)
+			}
+		case muxData:
+			if st != nil && !st.received(payload) {
+				log.Printf("Multiplexed connection with `%s` overran the window of stream %d, closing\n", s.conn.RemoteAddr(), id)
+				return
+			}
+		case muxWindow:
+			if st != nil {
+				st.granted(int(length))
+			}
+		case muxFin:
+			if st != nil {
+				st.finished(false)
+			}
+		case muxClose:
+			if st != nil {
+				st.finished(true)
+			}
+		}
+	}
+}
+
+func (s *muxSession) newStream(id uint32, client string) *muxStream {
+	st := &muxStream{s: s, id: id, window: muxWindowSize, wake: make(chan struct{}, 1), written: make(chan struct{}, 1)}
+	if s.trusted {
+		st.remote, _ = net.ResolveTCPAddr("tcp", client)
+	}
+	if st.remote == nil {
+		st.remote = s.conn.RemoteAddr()
+	}
+	s.mu.Lock()
+	s.streams[id] = st
+	s.mu.Unlock()
+	return st
+}
+
+// open starts a stream on behalf of the client
+func (s *muxSession) open(client net.Addr) (*muxStream, error) {
+	s.mu.Lock()
+	s.nextId++
+	id := s.nextId
+	s.mu.Unlock()
+	st := s.newStream(id, client.String())
+	st.remote = client
+	if err := s.writeFrame(muxOpen, id, len(client.String()), []byte(client.String())); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *muxSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close ends the session and all of its streams
+func (s *muxSession) close() {
+	s.mu.Lock()
+	if s.closed() {
+		s.mu.Unlock()
+		return
+	}
+	close(s.done)
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+	s.conn.Close()
+	for _, st := range streams {
+		st.finished(true)
+	}
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// muxStream is a client connection carried over a session
+type muxStream struct {
+	s      *muxSession
+	id     uint32
+	remote net.Addr
+
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	consumed      int  // read since the last window frame
+	eof           bool // the peer finished or closed
+	peerClosed    bool
+	closed        bool // closed locally
+	finSent       bool
+	window        int // bytes we may send
+	readDeadline  time.Time
+	writeDeadline time.Time
+	wake          chan struct{} // data, EOF or a new read deadline
+	written       chan struct{} // window granted or a new write deadline
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (st *muxStream) received(p []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.buf.Len()+len(p) > muxWindowSize {
+		return false
+	}
+	if !st.closed {
+		st.buf.Write(p)
+	}
+	notify(st.wake)
+	return true
+}
+
+func (st *muxStream) granted(n int) {
+	st.mu.Lock()
+	st.window += n
+	st.mu.Unlock()
+	notify(st.written)
+}
+
+// finished marks the end of data from the peer; a closed stream can't be
+// written to either
+func (st *muxStream) finished(closed bool) {
+	st.mu.Lock()
+	st.eof = true
+	if closed {
+		st.peerClosed = true
+	}
+	done := st.peerClosed && st.closed
+	st.mu.Unlock()
+	notify(st.wake)
+	notify(st.written)
+	if done {
+		st.s.remove(st.id)
+	}
+}
+
+// wait blocks until c is notified, the deadline passes or the session ends
+func (st *muxStream) wait(c chan struct{}, deadline time.Time) error {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-c:
+		return nil
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-st.s.done:
+		return nil
+	}
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(p)
+			st.consumed += n
+			credit := 0
+			if st.consumed >= muxWindowSize/4 {
+				credit, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if credit > 0 {
+				st.s.writeFrame(muxWindow, st.id, credit, nil)
+			}
+			return n, nil
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if st.eof || st.s.closed() {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := st.wait(st.wake, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if st.peerClosed || st.finSent || st.s.closed() {
+			st.mu.Unlock()
+			return written, errMuxClosed
+		}
+		n := len(p) - written
+		if n > muxMaxFrame {
+			n = muxMaxFrame
+		}
+		if n > st.window {
+			n = st.window
+		}
+		if n == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.written, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		st.window -= n
+		st.mu.Unlock()
+		if err := st.s.writeFrame(muxData, st.id, n, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream, the peer reads EOF
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.finSent {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mu.Unlock()
+	return st.s.writeFrame(muxFin, st.id, 0, nil)
+}
+
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf.Reset()
+	st.mu.Unlock()
+	notify(st.wake)
+	notify(st.written)
+	// the peer forgets the stream on close, we do once the peer closed too
+	// or right away, as nothing more is read from the peer
+	st.s.remove(st.id)
+	if st.s.closed() {
+		return nil
+	}
+	return st.s.writeFrame(muxClose, st.id, 0, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.s.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.remote }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.wake)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.written)
+	return nil
+}
+
+// muxPool holds up to -mux-conns sessions per target, streams are spread
+// over them round-robin
+var muxPool = struct {
+	sync.Mutex
+	targets map[string]*muxTarget
+}{targets: make(map[string]*muxTarget)}
+
+type muxTarget struct {
+	sync.Mutex
+	sessions []*muxSession
+	next     int
+}
+
+// openMuxStream opens a stream for the client to the goproxy at target,
+// connecting a new session when the slot's session is missing or closed;
+// the session is dialed without holding the target, so streams over the
+// other sessions don't wait for the connect
+func openMuxStream(ctx context.Context, target string, client net.Conn) (net.Conn, error) {
+	muxPool.Lock()
+	t := muxPool.targets[target]
+	if t == nil {
+		t = &muxTarget{sessions: make([]*muxSession, muxConns)}
+		muxPool.targets[target] = t
+	}
+	muxPool.Unlock()
+
+	t.Lock()
+	i := t.next % len(t.sessions)
+	t.next++
+	s := t.sessions[i]
+	t.Unlock()
+	if s == nil || s.closed() {
+		var conn net.Conn
+		var err error
+		if muxTransport == "kcp" {
+			conn, err = dialKcp(ctx, target)
+		} else {
+			conn, err = dialTcp(ctx, target, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(conn, muxPreface); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		t.Lock()
+		// another client may have filled the slot meanwhile
+		if s = t.sessions[i]; s == nil || s.closed() {
+			if verbose.Load() {
+				log.Printf("Multiplexing connections to `%s` over `%s`\n", target, conn.LocalAddr())
+			}
+			s = newMuxSession(conn, nil, nil)
+			t.sessions[i] = s
+			conn = nil
+		}
+		t.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	return s.open(client.RemoteAddr())
+}
+
+// muxListener accepts multiplexing connections from goproxy instances with
+// -mux dial and returns their streams as connections
+type muxListener struct {
+	net.Listener
+	streams chan net.Conn
+	errs    chan error
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newMuxListener(l net.Listener) net.Listener {
+	m := &muxListener{Listener: l, streams: make(chan net.Conn, muxAcceptQueue), errs: make(chan error), done: make(chan struct{})}
+	go m.acceptSessions()
+	return m
+}
+
+func (m *muxListener) acceptSessions() {
+	for {
+		conn, err := m.Listener.Accept()
+		if err != nil {
+			// the accept loop backs off before taking the next error
+			select {
+			case m.errs <- err:
+			case <-m.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			preface := make([]byte, len(muxPreface))
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			if _, err := io.ReadFull(conn, preface); err != nil || string(preface) != muxPreface {
+				log.Printf("Connection from `%s` is not multiplexed by goproxy, closing\n", conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			if verbose.Load() {
+				log.Printf("Accepted multiplexed connection from `%s`\n", conn.RemoteAddr())
+			}
+			newMuxSession(conn, m.streams, m.done)
+		}()
+	}
+}
+
+func (m *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.streams:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and resets the streams waiting to be accepted, the
+// multiplexing connections stay open for the streams already accepted to
+// drain
+func (m *muxListener) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+		for {
+			select {
+			case conn := <-m.streams:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return m.Listener.Close()
+}
+
+func (m *muxListener) String() string {
+	return fmt.Sprintf("mux %s", m.Listener.Addr())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxFrame returns a frame as written by writeFrame
+func muxFrame(typ byte, id uint32, length int, payload string) []byte {
+	frame := make([]byte, 9, 9+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(length))
+	return append(frame, payload...)
+}
+
+func muxFrames(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+func TestMuxReadFrames(t *testing.T) {
+	const client = "10.0.0.5:51234"
+	open := muxFrame(muxOpen, 1, len(client), client)
+	full := string(bytes.Repeat([]byte{'x'}, muxMaxFrame))
+	var overrun [][]byte
+	overrun = append(overrun, open)
+	for i := 0; i <= muxWindowSize/muxMaxFrame; i++ {
+		overrun = append(overrun, muxFrame(muxData, 1, muxMaxFrame, full))
+	}
+	tests := []struct {
+		name   string
+		sent   []byte
+		hangUp bool   // the peer closes the connection after sending
+		data   string // read from the stream until the peer finishes it
+		closes bool   // the session is closed
+	}{
+		{"stream", muxFrames(open, muxFrame(muxData, 1, 5, "hello"), muxFrame(muxData, 1, 6, " world"), muxFrame(muxFin, 1, 0, "")), false, "hello world", false},
+		{"window and unknown frames", muxFrames(open, muxFrame(muxWindow, 1, 1024, ""), muxFrame(9, 1, 0, ""), muxFrame(muxData, 1, 2, "ok"), muxFrame(muxFin, 1, 0, "")), false, "ok", false},
+		{"frames of unknown streams", muxFrames(muxFrame(muxData, 7, 4, "lost"), muxFrame(muxFin, 7, 0, ""), open, muxFrame(muxData, 1, 2, "ok"), muxFrame(muxClose, 1, 0, "")), false, "ok", false},
+		{"empty data", muxFrames(open, muxFrame(muxData, 1, 0, ""), muxFrame(muxFin, 1, 0, "")), false, "", false},
+		{"full frame", muxFrames(open, muxFrame(muxData, 1, muxMaxFrame, full), muxFrame(muxFin, 1, 0, "")), false, full, false},
+		{"oversized data", muxFrames(open, muxFrame(muxData, 1, muxMaxFrame+1, "")), false, "", true},
+		{"oversized open", muxFrame(muxOpen, 1, muxMaxFrame+1, ""), false, "", true},
+		{"duplicate open", muxFrames(open, open), false, "", true},
+		{"window overrun", muxFrames(overrun...), false, "", true},
+		{"truncated header", open[:5], true, "", true},
+		{"truncated payload", muxFrames(open, muxFrame(muxData, 1, 10, "abc")), true, "", true},
+	}
+	for _, test := range tests {
+		peer, conn := net.Pipe()
+		// frames the session sends back
+		go io.Copy(io.Discard, peer)
+		accept := make(chan net.Conn, muxAcceptQueue)
+		s := newMuxSession(conn, accept, make(chan struct{}))
+		go func(sent []byte, hangUp bool) {
+			peer.Write(sent)
+			if hangUp {
+				peer.Close()
+			}
+		}(test.sent, test.hangUp)
+		if test.closes {
+			select {
+			case <-s.done:
+			case <-time.After(5 * time.Second):
+				t.Errorf("%s: session not closed", test.name)
+			}
+			peer.Close()
+			continue
+		}
+		var st net.Conn
+		select {
+		case st = <-accept:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: no stream accepted", test.name)
+			peer.Close()
+			continue
+		}
+		st.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := io.ReadAll(st)
+		if err != nil || string(data) != test.data {
+			t.Errorf("%s: read %d bytes, error %v, want %q", test.name, len(data), err, test.data)
+		}
+		if s.closed() {
+			t.Errorf("%s: session closed", test.name)
+		}
+		if st.RemoteAddr().String() == client {
+			t.Errorf("%s: took the client address of an untrusted peer", test.name)
+		}
+		peer.Close()
+	}
+}
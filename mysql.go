@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	mysqlServerShutdown = 1053
+	mysqlShutdownState  = "08S01"
+	mysqlShutdownText   = "Server shutdown in progress"
+)
+
+// mysqlError returns an ERR packet as sent by the server
+func mysqlError(seq byte, code uint16, state, text string) []byte {
+	packet := make([]byte, 4, 4+9+len(text))
+	packet = append(packet, 0xff, byte(code), byte(code>>8), '#')
+	packet = append(packet, state...)
+	packet = append(packet, text...)
+	binary.LittleEndian.PutUint32(packet, uint32(len(packet)-4))
+	packet[3] = seq
+	return packet
+}
+
+// rejectMysql tells a client that has not received the server greeting yet
+// that the server is shutting down, so it fails with a MySQL error rather
+// than a lost connection
+func rejectMysql(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	conn.Write(mysqlError(0, mysqlServerShutdown, mysqlShutdownState, mysqlShutdownText))
+	conn.Close()
+}
+
+// mysqlClient serializes writes to a MySQL client, so an ERR packet can be
+// injected between server responses when the proxy closes the connection
+type mysqlClient struct {
+	mu   sync.Mutex
+	w    io.Writer
+	idle bool // waiting for the server, nothing sent by the client since
+}
+
+func (c *mysqlClient) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idle = true
+	return c.w.Write(p)
+}
+
+// requests marks the client busy while a request is in flight to the server
+func (c *mysqlClient) requests(r io.Reader) io.Reader {
+	return mysqlRequests{r, c}
+}
+
+type mysqlRequests struct {
+	r io.Reader
+	c *mysqlClient
+}
+
+func (r mysqlRequests) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.c.mu.Lock()
+		r.c.idle = false
+		r.c.mu.Unlock()
+	}
+	return n, err
+}
+
+// shutdown sends ER_SERVER_SHUTDOWN when the client is not in the middle of
+// a request and discards further server responses; clients read it at
+// connect or with the response to their next command; a response being
+// written means the client is busy, the connection is closed without
+// waiting for a stalled client
+func (c *mysqlClient) shutdown() {
+	if !c.mu.TryLock() {
+		return
+	}
+	defer c.mu.Unlock()
+	if c.idle {
+		c.w.Write(mysqlError(0, mysqlServerShutdown, mysqlShutdownState, mysqlShutdownText))
+	}
+	c.w = io.Discard
+}
+
+// holdMysql waits up to -mysql-hold for a target to accept new connections,
+// e.g. while the old primary is drained and the new one not yet enabled;
+// the client is waiting for the server greeting meanwhile
+func holdMysql(ctx context.Context, id uint64, in net.Conn) {
+	if debug.Load() {
+		log.Printf("[%d] No target available, holding MySQL client for up to %v\n", id, mysqlHold)
+	}
+	deadline := time.NewTimer(mysqlHold)
+	defer deadline.Stop()
+	ticker := systemClock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			rejectMysql(in)
+			return
+		case <-deadline.C:
+			if debug.Load() {
+				log.Printf("[%d] No target available after %v, closing incoming connection\n", id, mysqlHold)
+			}
+			rejectMysql(in)
+			return
+		case <-ticker.Chan():
+		}
+		if target := pickTarget(groupTargets(currentTargets(), uint(rand.Uint32()), in.RemoteAddr(), in.LocalAddr())); target != "" {
+			if portRange != "" {
+				target = mapPort(target, in.LocalAddr())
+			}
+			forwardTcp(ctx, id, in, target)
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMysqlError(t *testing.T) {
+	// ER_SERVER_SHUTDOWN as sent by a MySQL 8.0 server stopping while the
+	// client waits for the response to a query
+	want := append([]byte{0x24, 0, 0, 1, 0xff, 0x1d, 0x04, '#', '0', '8', 'S', '0', '1'}, "Server shutdown in progress"...)
+	if got := mysqlError(1, mysqlServerShutdown, mysqlShutdownState, mysqlShutdownText); !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestMysqlShutdown(t *testing.T) {
+	// server greeting of a MySQL 8.0 server, cut after the auth plugin data
+	greeting := []byte{0x4a, 0, 0, 0, 0x0a, '8', '.', '0', '.', '3', '6', 0, 0x08, 0, 0, 0}
+	query := append([]byte{0x0f, 0, 0, 0, 0x03}, "SELECT SLEEP(5)"...)
+	tests := []struct {
+		name     string
+		server   [][]byte // server packets forwarded to the client
+		requests bool     // the client sent a request after them
+		err      bool     // the client gets the ERR packet
+	}{
+		{"before greeting", nil, false, true},
+		{"after greeting", [][]byte{greeting}, false, true},
+		{"query in flight", [][]byte{greeting}, true, false},
+		{"query answered", [][]byte{greeting, {0x07, 0, 0, 1, 0, 0, 0, 0x02, 0, 0, 0}}, false, true},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		c := &mysqlClient{w: &out, idle: true}
+		for _, p := range test.server {
+			c.Write(p)
+		}
+		if test.requests {
+			io.ReadAll(c.requests(bytes.NewReader(query)))
+		}
+		sent := out.Len()
+		c.shutdown()
+		got := out.Bytes()[sent:]
+		if test.err != (len(got) > 0) {
+			t.Errorf("%s: sent % x on shutdown", test.name, got)
+		} else if test.err && !strings.HasSuffix(string(got), mysqlShutdownText) {
+			t.Errorf("%s: sent %q, want the shutdown error", test.name, got)
+		}
+		// responses after the shutdown are discarded
+		c.Write([]byte{0x07, 0, 0, 2, 0, 0, 0, 0x02, 0, 0, 0})
+		if out.Len() != sent+len(got) {
+			t.Errorf("%s: forwarded a response after shutdown", test.name)
+		}
+	}
+}
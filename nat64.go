@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// nat64 is the NAT64 prefix IPv4 targets are mapped into on IPv6-only hosts
+var nat64 *net.IPNet
+
+// wellKnownIpv4only are the addresses of ipv4only.arpa, which DNS64 embeds in
+// synthesized answers (RFC 7050)
+var wellKnownIpv4only = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+// parseNat64 parses a prefix of one of the lengths of RFC 6052
+func parseNat64(spec string) (*net.IPNet, error) {
+	_, prefix, err := net.ParseCIDR(spec)
+	if err != nil {
+		return nil, err
+	}
+	bits, size := prefix.Mask.Size()
+	if size != 128 || !validNat64Length(bits) {
+		return nil, fmt.Errorf("`%s` is not an IPv6 prefix of length 32, 40, 48, 56, 64 or 96", spec)
+	}
+	return prefix, nil
+}
+
+func validNat64Length(bits int) bool {
+	switch bits {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+// discoverNat64 finds the prefix used by DNS64 from the AAAA records of
+// ipv4only.arpa, queried from -dns or the system resolver
+func discoverNat64() (*net.IPNet, error) {
+	var ips []net.IP
+	if dnsServer != "" {
+		for _, aaaa := range queryDns(newDnsClient(), "ipv4only.arpa.", dns.TypeAAAA) {
+			ips = append(ips, net.ParseIP(aaaa.host))
+		}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIP(context.Background(), "ip6", "ipv4only.arpa")
+		if err != nil {
+			return nil, err
+		}
+		ips = addrs
+	}
+	for _, ip := range ips {
+		for _, bits := range []int{96, 64, 56, 48, 40, 32} {
+			embedded := extractNat64(ip, bits)
+			for _, known := range wellKnownIpv4only {
+				if embedded.Equal(known) {
+					mask := net.CIDRMask(bits, 128)
+					return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no DNS64 answer for `ipv4only.arpa`")
+}
+
+// setupNat64 discovers the prefix with `-nat64 auto`
+func setupNat64() {
+	if nat64Spec != "auto" {
+		return
+	}
+	var err error
+	if nat64, err = discoverNat64(); err != nil {
+		fatalf(errDns, "Failed to discover NAT64 prefix: %v\n", err)
+	}
+	if verbose.Load() {
+		log.Printf("Discovered NAT64 prefix `%s`\n", nat64)
+	}
+}
+
+// extractNat64 returns the IPv4 address embedded after bits of prefix, the
+// bits 64 to 71 are skipped (RFC 6052 section 2.2)
+func extractNat64(ip net.IP, bits int) net.IP {
+	ip4 := make(net.IP, 0, 4)
+	for i := bits / 8; len(ip4) < 4; i++ {
+		if i != 8 {
+			ip4 = append(ip4, ip[i])
+		}
+	}
+	return ip4
+}
+
+func synthesizeNat64(ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, nat64.IP)
+	bits, _ := nat64.Mask.Size()
+	i := bits / 8
+	for _, b := range ip4 {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// nat64Addr maps an IPv4 target to its NAT64 address; a name is resolved
+// and mapped only when it has no IPv6 address, as DNS64 would answer
+func nat64Addr(ctx context.Context, target string) string {
+	if nat64 == nil {
+		return target
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return target
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			// let the dial report the error
+			return target
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() == nil {
+				return target
+			}
+		}
+		ip = addrs[0].IP
+	}
+	ip4 := ip.To4()
+	if ip4 == nil || ip4.IsLoopback() || ip4.IsUnspecified() {
+		return target
+	}
+	return net.JoinHostPort(synthesizeNat64(ip4).String(), port)
+}
@@ -0,0 +1,15 @@
+package main
+
+import "strings"
+
+// npipePrefix marks Windows named pipe addresses in the notation of Docker,
+// `npipe:////./pipe/docker_engine` is the pipe `\\.\pipe\docker_engine`
+const npipePrefix = "npipe://"
+
+func isNpipe(addr string) bool {
+	return strings.HasPrefix(addr, npipePrefix)
+}
+
+func npipePath(addr string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(addr, npipePrefix), "/", `\`)
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errNpipe = errors.New("named pipes are only supported on Windows")
+
+func listenNpipe(path string) (net.Listener, error) {
+	return nil, errNpipe
+}
+
+func dialNpipe(ctx context.Context, path string) (net.Conn, error) {
+	return nil, errNpipe
+}
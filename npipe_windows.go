@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+const npipeBuffer = 65536
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// pipeIo runs an overlapped operation on the handle and waits for it to
+// complete, cancelling it at the deadline; o must not move while the
+// operation is pending, so it is kept in the heap-allocated owner
+func pipeIo(h windows.Handle, o *windows.Overlapped, deadline time.Time, op func() error) (int, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(event)
+	*o = windows.Overlapped{HEvent: event}
+	err = op()
+	if err != nil && err != windows.ERROR_IO_PENDING {
+		return 0, err
+	}
+	expired := false
+	if err != nil && !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait < 0 {
+			wait = 0
+		}
+		if r, _ := windows.WaitForSingleObject(event, uint32(wait/time.Millisecond)); r == uint32(windows.WAIT_TIMEOUT) {
+			windows.CancelIoEx(h, o)
+			expired = true
+		}
+	}
+	var n uint32
+	err = windows.GetOverlappedResult(h, o, &n, true)
+	if expired && err == windows.ERROR_OPERATION_ABORTED {
+		err = os.ErrDeadlineExceeded
+	}
+	return int(n), err
+}
+
+// pipeConn is a connected named pipe instance; reads and writes are
+// overlapped, so both directions are forwarded at the same time
+type pipeConn struct {
+	h             windows.Handle
+	path          pipeAddr
+	closed        int32
+	rop, wop      windows.Overlapped
+	readDeadline  atomic.Value
+	writeDeadline atomic.Value
+}
+
+func newPipeConn(h windows.Handle, path string) *pipeConn {
+	c := &pipeConn{h: h, path: pipeAddr(path)}
+	c.readDeadline.Store(time.Time{})
+	c.writeDeadline.Store(time.Time{})
+	return c
+}
+
+func (c *pipeConn) err(err error) error {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	n, err := pipeIo(c.h, &c.rop, c.readDeadline.Load().(time.Time), func() error {
+		var done uint32
+		return windows.ReadFile(c.h, p, &done, &c.rop)
+	})
+	if err == windows.ERROR_BROKEN_PIPE || err == windows.ERROR_PIPE_NOT_CONNECTED {
+		return n, io.EOF
+	}
+	if err != nil {
+		return n, c.err(err)
+	}
+	return n, nil
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	n, err := pipeIo(c.h, &c.wop, c.writeDeadline.Load().(time.Time), func() error {
+		var done uint32
+		return windows.WriteFile(c.h, p, &done, &c.wop)
+	})
+	if err != nil {
+		return n, c.err(err)
+	}
+	return n, nil
+}
+
+// Close cancels pending reads and writes, then closes the handle
+func (c *pipeConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return net.ErrClosed
+	}
+	windows.CancelIoEx(c.h, nil)
+	return windows.CloseHandle(c.h)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.path
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.path
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	c.writeDeadline.Store(t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(t)
+	return nil
+}
+
+// npipeListener waits for a client on a pipe instance created in advance,
+// so clients connecting while the previous one is being handed over find
+// the pipe
+type npipeListener struct {
+	path   string
+	mu     sync.Mutex
+	next   windows.Handle
+	closed bool
+	op     windows.Overlapped
+}
+
+func createPipe(path string, first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		// fail rather than share the pipe with another server
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	return windows.CreateNamedPipe(name, flags, windows.PIPE_TYPE_BYTE|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, npipeBuffer, npipeBuffer, 0, nil)
+}
+
+func listenNpipe(path string) (net.Listener, error) {
+	h, err := createPipe(path, true)
+	if err != nil {
+		return nil, err
+	}
+	return &npipeListener{path: path, next: h}, nil
+}
+
+func (l *npipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	h := l.next
+	if h == windows.InvalidHandle {
+		var err error
+		if h, err = createPipe(l.path, false); err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		l.next = h
+	}
+	l.mu.Unlock()
+
+	_, err := pipeIo(h, &l.op, time.Time{}, func() error {
+		return windows.ConnectNamedPipe(h, &l.op)
+	})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, net.ErrClosed
+	}
+	next, nextErr := createPipe(l.path, false)
+	if nextErr != nil {
+		next = windows.InvalidHandle
+	}
+	l.next = next
+	// a client may connect between creating the instance and waiting on it
+	if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	return newPipeConn(h, l.path), nil
+}
+
+// Close cancels a pending Accept and removes the waiting pipe instance
+func (l *npipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	l.closed = true
+	if l.next == windows.InvalidHandle {
+		return nil
+	}
+	windows.CancelIoEx(l.next, nil)
+	return windows.CloseHandle(l.next)
+}
+
+func (l *npipeListener) Addr() net.Addr {
+	return pipeAddr(l.path)
+}
+
+var errPipeBusy = errors.New("all pipe instances are busy")
+
+// dialNpipe opens the pipe, waiting up to -timeout while the server has no
+// free instance
+func dialNpipe(ctx context.Context, path string) (net.Conn, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil,
+			windows.OPEN_EXISTING, windows.FILE_FLAG_OVERLAPPED, 0)
+		if err == nil {
+			return newPipeConn(h, path), nil
+		}
+		if err != windows.ERROR_PIPE_BUSY {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline.C:
+			return nil, errPipeBusy
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
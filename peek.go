@@ -0,0 +1,21 @@
+package main
+
+import (
+	"bufio"
+	"net"
+)
+
+// peekedConn is an incoming connection with the start of the stream
+// buffered, so it can be inspected before choosing where to forward it
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newPeekedConn(conn net.Conn, size int) *peekedConn {
+	return &peekedConn{conn, bufio.NewReaderSize(conn, size)}
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
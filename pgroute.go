@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PostgreSQL limit on the length of the startup message
+const maxPgStartup = 10000
+
+var pgRoutes []*pgRoute
+
+// pgRoute sends clients of the listed databases to a dedicated target group
+type pgRoute struct {
+	name      string
+	databases map[string]bool
+	mu        sync.Mutex
+	targets   []Target
+}
+
+// parsePgRoute parses `db[,db]=host:port[,host:port]`
+func parsePgRoute(spec string) (*pgRoute, []string, error) {
+	eq := strings.IndexByte(spec, '=')
+	if eq < 0 {
+		return nil, nil, fmt.Errorf("expected db[,db]=host:port[,host:port], got `%s`", spec)
+	}
+	databases := make(map[string]bool)
+	for _, db := range parseTargetList(spec[:eq]) {
+		databases[db] = true
+	}
+	targets := parseTargetList(spec[eq+1:])
+	if len(databases) == 0 || len(targets) == 0 {
+		return nil, nil, fmt.Errorf("expected db[,db]=host:port[,host:port], got `%s`", spec)
+	}
+	return &pgRoute{name: "pg:" + spec[:eq], databases: databases}, targets, nil
+}
+
+func (r *pgRoute) manage(ctx context.Context, connectTo []string) {
+	resolveGroup(ctx, connectTo, func(targets []Target) {
+		r.mu.Lock()
+		r.targets = targets
+		r.mu.Unlock()
+	})
+}
+
+// pgTargets returns the target group for the database, if any
+func pgTargets(database string) []Target {
+	for _, r := range pgRoutes {
+		if r.databases[database] {
+			r.mu.Lock()
+			targets := r.targets
+			r.mu.Unlock()
+			if len(targets) > 0 {
+				return targets
+			}
+		}
+	}
+	return nil
+}
+
+// peekStartup waits up to -timeout for the first message of a PostgreSQL
+// client and returns the database requested, which defaults to the user
+// name; SSL and GSSAPI encryption requests and cancel requests carry no
+// database and leave it empty
+func peekStartup(conn net.Conn) (*peekedConn, string, error) {
+	c := newPeekedConn(conn, maxPgStartup)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	header, err := c.r.Peek(8)
+	if err != nil {
+		return nil, "", err
+	}
+	n := int(binary.BigEndian.Uint32(header[:4]))
+	// protocol version 3.x, other codes are requests
+	if binary.BigEndian.Uint32(header[4:8])>>16 != 3 || n <= 8 || n > maxPgStartup {
+		return c, "", nil
+	}
+	msg, err := c.r.Peek(n)
+	if err != nil {
+		return nil, "", err
+	}
+	var user, database string
+	params := strings.Split(string(msg[8:]), "\x00")
+	for i := 0; i+1 < len(params); i += 2 {
+		switch params[i] {
+		case "user":
+			user = params[i+1]
+		case "database":
+			database = params[i+1]
+		}
+	}
+	if database == "" {
+		database = user
+	}
+	return c, database, nil
+}
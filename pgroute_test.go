@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pgStartup returns a StartupMessage of protocol 3.0 with the parameters as
+// name, value pairs
+func pgStartup(params ...string) []byte {
+	body := strings.Join(params, "\x00") + "\x00\x00"
+	msg := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(msg, uint32(8+len(body)))
+	binary.BigEndian.PutUint32(msg[4:], 3<<16)
+	return append(msg, body...)
+}
+
+func TestPeekStartup(t *testing.T) {
+	defer func(to time.Duration) { timeout = to }(timeout)
+	timeout = time.Second
+	// as sent by psql 15
+	psql := pgStartup("user", "alice", "database", "shop", "application_name", "psql", "client_encoding", "UTF8")
+	tests := []struct {
+		name     string
+		sent     []byte
+		database string
+		fails    bool
+	}{
+		{"psql", psql, "shop", false},
+		{"user only", pgStartup("user", "bob"), "bob", false},
+		{"database first", pgStartup("database", "orders", "user", "bob"), "orders", false},
+		{"ssl request", []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}, "", false},
+		{"gssenc request", []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x30}, "", false},
+		{"cancel request", []byte{0, 0, 0, 16, 0x04, 0xd2, 0x16, 0x2e, 0, 0, 0x30, 0x39, 0x12, 0x34, 0x56, 0x78}, "", false},
+		{"protocol 2", []byte{0, 0, 0, 8, 0, 2, 0, 0}, "", false},
+		{"user without value", []byte{0, 0, 0, 13, 0, 3, 0, 0, 'u', 's', 'e', 'r', 0}, "", false},
+		{"oversized length", []byte{0, 0, 0x27, 0x11, 0, 3, 0, 0}, "", false},
+		{"truncated message", psql[:20], "", true},
+		{"truncated header", psql[:6], "", true},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func(sent []byte) {
+			client.Write(sent)
+			client.Close()
+		}(test.sent)
+		c, database, err := peekStartup(server)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: peeked, want error", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else {
+			if database != test.database {
+				t.Errorf("%s: database %q, want %q", test.name, database, test.database)
+			}
+			// the peeked bytes are forwarded
+			if got, _ := io.ReadAll(c); string(got) != string(test.sent) {
+				t.Errorf("%s: forwarded %q, want %q", test.name, got, test.sent)
+			}
+		}
+		server.Close()
+	}
+}
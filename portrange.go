@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parsePortRange parses `low-high`
+func parsePortRange(spec string) (int, int, error) {
+	bounds := strings.SplitN(spec, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("expected low-high, got `%s`", spec)
+	}
+	low, err1 := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	high, err2 := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err1 != nil || err2 != nil || low < 1 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range `%s`", spec)
+	}
+	return low, high, nil
+}
+
+// expandPortRange replaces the port of each listen address, which may be
+// omitted, with every port of the range
+func expandPortRange(listenOn []string) []string {
+	var expanded []string
+	for _, addr := range listenOn {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = strings.Trim(addr, "[]")
+		}
+		for port := portLow; port <= portHigh; port++ {
+			expanded = append(expanded, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return expanded
+}
+
+// mapPort returns the target with its port replaced by the port of the
+// listener plus -port-offset
+func mapPort(target string, local net.Addr) string {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	_, port := addrIpPort(local)
+	return net.JoinHostPort(host, strconv.Itoa(port+portOffset))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// portRoutes maps additional listener ports to dedicated target groups,
+// e.g. a port per Kafka broker; filled before listeners are bound
+var portRoutes = make(map[int]*portRoute)
+
+type portRoute struct {
+	name    string
+	port    int
+	mu      sync.Mutex
+	targets []Target
+}
+
+// parsePortRoute parses `[name:]port=host:port[,host:port]`, the name
+// defaults to port:N
+func parsePortRoute(spec string) (*portRoute, []string, error) {
+	eq := strings.IndexByte(spec, '=')
+	if eq < 0 {
+		return nil, nil, fmt.Errorf("expected [name:]port=host:port[,host:port], got `%s`", spec)
+	}
+	name, portSpec, named := strings.Cut(strings.TrimSpace(spec[:eq]), ":")
+	if !named {
+		portSpec = name
+	}
+	port, err := strconv.Atoi(portSpec)
+	targets := parseTargetList(spec[eq+1:])
+	if err != nil || port < 1 || port > 65535 || len(targets) == 0 || (named && !validRuleName(name)) {
+		return nil, nil, fmt.Errorf("expected [name:]port=host:port[,host:port], got `%s`", spec)
+	}
+	if !named {
+		name = "port:" + strconv.Itoa(port)
+	}
+	return &portRoute{name: name, port: port}, targets, nil
+}
+
+func (r *portRoute) manage(ctx context.Context, connectTo []string) {
+	resolveGroup(ctx, connectTo, func(targets []Target) {
+		r.mu.Lock()
+		r.targets = targets
+		r.mu.Unlock()
+	})
+}
+
+// portTargets returns the target group of the listener port, if it has one;
+// the group may be empty until resolved
+func portTargets(local net.Addr) ([]Target, bool) {
+	if len(portRoutes) == 0 {
+		return nil, false
+	}
+	_, port := addrIpPort(local)
+	r := portRoutes[port]
+	if r == nil {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.targets, true
+}
+
+// portRouteListeners returns listen addresses for the routed port on every
+// host of the listen addresses
+func portRouteListeners(listenOn []string, port int) []string {
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range listenOn {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = strings.Trim(addr, "[]")
+		}
+		if !seen[host] {
+			seen[host] = true
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges optionally chroots and switches to an unprivileged user and
+// group, called once listeners are bound; the group defaults to the user's
+// primary group
+func dropPrivileges(userName, groupName, chrootDir string) error {
+	uid, gid, err := lookupIds(userName, groupName)
+	if err != nil {
+		return err
+	}
+	if chrootDir != "" {
+		if err := syscall.Chroot(chrootDir); err != nil {
+			return fmt.Errorf("chroot to `%s`: %v", chrootDir, err)
+		}
+		if err := syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid %d: %v", gid, err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid %d: %v", uid, err)
+		}
+	}
+	return nil
+}
+
+// lookupIds returns the uid and gid of the user and group, -1 when not
+// given; the group defaults to the user's primary group
+func lookupIds(userName, groupName string) (int, int, error) {
+	uid, gid := -1, -1
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return -1, -1, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return -1, -1, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
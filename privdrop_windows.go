@@ -0,0 +1,14 @@
+package main
+
+import "errors"
+
+// dropPrivileges is not supported, run the service under a dedicated account
+// instead
+func dropPrivileges(userName, groupName, chrootDir string) error {
+	return errors.New("-user, -group and -chroot are not supported on Windows")
+}
+
+// lookupIds is not supported, Windows accounts have no numeric IDs
+func lookupIds(userName, groupName string) (int, int, error) {
+	return -1, -1, errors.New("numeric user and group IDs are not supported on Windows")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quotaBucket records the bytes each client transferred from a point in
+// time until the next bucket; usage over the rolling window is the sum of
+// the buckets in it
+type quotaBucket struct {
+	At    time.Time         `json:"at"`
+	Bytes map[string]uint64 `json:"bytes"`
+}
+
+var quotas = struct {
+	sync.RWMutex
+	buckets []quotaBucket
+	usage   map[string]uint64     // sum of the buckets per client
+	last    map[string]uint64     // client counters at the last tick
+	over    map[string]*ruleLimit // clients over quota, throttled together
+}{usage: make(map[string]uint64), over: make(map[string]*ruleLimit)}
+
+// quota buckets per window, usage is accurate to window/quotaBuckets
+const quotaBuckets = 24
+
+func clientBytes() map[string]uint64 {
+	report := usageStats()
+	bytes := make(map[string]uint64, len(report.Clients))
+	for client, u := range report.Clients {
+		bytes[client] = u.BytesIn + u.BytesOut
+	}
+	return bytes
+}
+
+// setQuotaBuckets restores buckets saved with the stats
+func setQuotaBuckets(buckets []quotaBucket) {
+	quotas.Lock()
+	defer quotas.Unlock()
+	quotas.buckets = buckets
+	quotas.usage = make(map[string]uint64)
+	for _, b := range buckets {
+		for ip, bytes := range b.Bytes {
+			quotas.usage[ip] += bytes
+		}
+	}
+}
+
+// overQuota reports whether client IP exceeded its quota over the window
+func overQuota(ip string) bool {
+	quotas.RLock()
+	defer quotas.RUnlock()
+	return quotas.over[ip] != nil
+}
+
+// enforceQuotas periodically adds what clients transferred since the last
+// tick to the current bucket, expires buckets that left the window and
+// recomputes the set of clients over quota; in refuse mode their live
+// connections are closed
+func enforceQuotas(ctx context.Context) {
+	bucket := clientQuotaWindow / quotaBuckets
+	quotas.Lock()
+	// counters restored from -stats-file are already in the restored buckets
+	quotas.last = clientBytes()
+	quotas.Unlock()
+
+	ticker := systemClock.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.Chan():
+		}
+		current := clientBytes()
+
+		quotas.Lock()
+		if len(quotas.buckets) == 0 || now.Sub(quotas.buckets[len(quotas.buckets)-1].At) >= bucket {
+			quotas.buckets = append(quotas.buckets, quotaBucket{now, make(map[string]uint64)})
+		}
+		deltas := quotas.buckets[len(quotas.buckets)-1].Bytes
+		for ip, bytes := range current {
+			// counters of a client whose stats expired start over from 0
+			if last := quotas.last[ip]; bytes > last {
+				deltas[ip] += bytes - last
+				quotas.usage[ip] += bytes - last
+			} else if bytes < last {
+				deltas[ip] += bytes
+				quotas.usage[ip] += bytes
+			}
+		}
+		quotas.last = current
+		for len(quotas.buckets) > 1 && now.Sub(quotas.buckets[0].At) >= clientQuotaWindow {
+			for ip, bytes := range quotas.buckets[0].Bytes {
+				if quotas.usage[ip] <= bytes {
+					delete(quotas.usage, ip)
+				} else {
+					quotas.usage[ip] -= bytes
+				}
+			}
+			quotas.buckets = quotas.buckets[1:]
+		}
+		over := make(map[string]*ruleLimit)
+		var exceeded []string
+		for ip, bytes := range quotas.usage {
+			if bytes > clientQuota {
+				if over[ip] = quotas.over[ip]; over[ip] == nil {
+					over[ip] = &ruleLimit{name: ip, bandwidth: quotaThrottle, last: now}
+					exceeded = append(exceeded, ip)
+				}
+			}
+		}
+		quotas.over = over
+		quotas.Unlock()
+
+		for _, ip := range exceeded {
+			log.Printf("Client `%s` exceeded transfer quota of %d bytes per %v, connections will be %s\n",
+				ip, clientQuota, clientQuotaWindow, map[bool]string{true: "throttled", false: "refused"}[quotaThrottle > 0])
+			if quotaThrottle == 0 {
+				killClientConns(ip)
+			}
+		}
+	}
+}
+
+func killClientConns(ip string) {
+	for _, c := range listConns() {
+		if clientIp(c.Client) == ip {
+			killConns(c.Id, "")
+		}
+	}
+}
+
+// quotaReader limits the transfer rate of a client over quota, all of its
+// connections together, to quotaThrottle bytes per second
+type quotaReader struct {
+	r  io.Reader
+	ip string
+}
+
+func (r quotaReader) Read(p []byte) (int, error) {
+	quotas.RLock()
+	l := quotas.over[r.ip]
+	quotas.RUnlock()
+	if l != nil && len(p) > int(quotaThrottle) {
+		p = p[:quotaThrottle]
+	}
+	n, err := r.r.Read(p)
+	if l != nil && n > 0 {
+		l.take(n)
+	}
+	return n, err
+}
+
+// parseBytes parses a size with optional K, M, G or T binary suffix
+func parseBytes(size string) (uint64, error) {
+	multiplier := uint64(1)
+	suffixes := map[string]uint64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	if len(s) > 0 {
+		if m, ok := suffixes[s[len(s)-1:]]; ok {
+			multiplier = m
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("invalid size `%s`", size)
+	}
+	return n * multiplier, nil
+}
+
+// formatBytes prints a size with the K, M, G or T binary suffix of
+// parseBytes
+func formatBytes(size float64) string {
+	for _, suffix := range []string{"", "K", "M", "G"} {
+		if size < 1024 {
+			return strconv.FormatFloat(size, 'f', 1, 64) + suffix
+		}
+		size /= 1024
+	}
+	return strconv.FormatFloat(size, 'f', 1, 64) + "T"
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTimeout bounds a shared rate limit check, the local bucket decides
+// when Redis doesn't answer in time
+const redisTimeout = 500 * time.Millisecond
+
+// clientRates holds the per-client token buckets of -client-rate as the
+// time each bucket runs empty at the current pace, as for -accept-rate
+var clientRates = struct {
+	sync.Mutex
+	interval time.Duration
+	burst    int
+	next     map[string]time.Time
+	redis    *redisPool
+	failing  bool
+}{next: make(map[string]time.Time)}
+
+// clientRateScript is the same bucket in Redis, shared by all instances
+// pointed at it; the time is taken from Redis so that the instances'
+// clocks don't matter
+const clientRateScript = `
+local t = redis.call('TIME')
+local now = t[1] * 1000000 + t[2]
+local interval, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local next = math.max(tonumber(redis.call('GET', KEYS[1]) or 0), now - burst * interval) + interval
+if next > now then
+	return 0
+end
+redis.call('SET', KEYS[1], string.format('%.0f', next), 'PX', string.format('%.0f', math.ceil((next - now + burst * interval) / 1000) + 1))
+return 1
+`
+
+// clientRateAllowed takes a token from the client's bucket, in Redis with
+// -client-rate-redis, reporting false when the bucket is empty
+func clientRateAllowed(client net.Addr) bool {
+	ip, _ := addrIpPort(client)
+	if ip == nil {
+		return true
+	}
+	if clientRates.redis != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		allowed, err := clientRates.redis.eval(ctx, clientRateScript, []string{"goproxy:rate:" + ip.String()},
+			strconv.FormatInt(clientRates.interval.Microseconds(), 10), strconv.Itoa(clientRates.burst))
+		clientRates.Lock()
+		failing := clientRates.failing
+		clientRates.failing = err != nil
+		clientRates.Unlock()
+		if err == nil {
+			if failing {
+				log.Printf("Shared client rate limit in Redis recovered\n")
+			}
+			return allowed == 1
+		}
+		if !failing {
+			log.Printf("Failed to check shared client rate limit, limiting per instance until Redis recovers: %v\n", err)
+		}
+	}
+	clientRates.Lock()
+	defer clientRates.Unlock()
+	now := time.Now()
+	next := clientRates.next[ip.String()]
+	if full := now.Add(-time.Duration(clientRates.burst) * clientRates.interval); next.Before(full) {
+		next = full
+	}
+	next = next.Add(clientRates.interval)
+	if next.After(now) {
+		return false
+	}
+	clientRates.next[ip.String()] = next
+	return true
+}
+
+// expireClientRates forgets buckets that refilled, so the table doesn't
+// grow with every client ever seen
+func expireClientRates(ctx context.Context) {
+	ticker := systemClock.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.Chan():
+			clientRates.Lock()
+			full := now.Add(-time.Duration(clientRates.burst) * clientRates.interval)
+			for client, next := range clientRates.next {
+				if next.Before(full) {
+					delete(clientRates.next, client)
+				}
+			}
+			clientRates.Unlock()
+		}
+	}
+}
+
+// redisPool is a minimal Redis client for the shared rate limit: idle
+// connections are reused, a connection that failed is dropped
+type redisPool struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// parseRedis parses redis://[:password@]host:port[/db]
+func parseRedis(spec string) (*redisPool, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("redis://[:password@]host:port[/db] expected")
+	}
+	pool := &redisPool{addr: u.Host, idle: make(chan *redisConn, 16)}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		pool.addr = net.JoinHostPort(u.Host, "6379")
+	}
+	if u.User != nil {
+		pool.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if pool.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database `%s`", db)
+		}
+	}
+	return pool, nil
+}
+
+func (p *redisPool) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn, bufio.NewReader(conn)}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if p.password != "" {
+		if _, err := c.do("AUTH", p.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if p.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(p.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (p *redisPool) put(c *redisConn) {
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// eval runs a Lua script returning an integer
+func (p *redisPool) eval(ctx context.Context, script string, keys []string, args ...string) (int64, error) {
+	c, err := p.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	cmd := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	reply, err := c.do(append(cmd, args...)...)
+	if err != nil {
+		c.Close()
+		return 0, err
+	}
+	p.put(c)
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply %v", reply)
+	}
+	return n, nil
+}
+
+// do sends a command and reads a simple string, error or integer reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("Redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	}
+	return nil, fmt.Errorf("unsupported reply `%s`", line)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// rawBridge relays packets of -ip-proto received on one raw socket: packets
+// from the target go to the client that sent last, packets from any other
+// address come from a client and go to the target
+type rawBridge struct {
+	conn    *net.IPConn
+	mu      sync.Mutex
+	client  *net.IPAddr
+	target  *net.IPAddr
+	session *trackedConn
+}
+
+// listenRawIp binds a raw socket for -ip-proto on the host of addr, the port
+// is ignored
+func listenRawIp(addr string) (*net.IPConn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	network := "ip4"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		network = "ip6"
+	}
+	var laddr *net.IPAddr
+	if host != "" {
+		if laddr, err = net.ResolveIPAddr(network, host); err != nil {
+			return nil, err
+		}
+	}
+	return net.ListenIP(network+":"+strconv.Itoa(ipProto), laddr)
+}
+
+// rawTargets adds a port to targets given as bare addresses, so they can be
+// resolved like other targets; the port is ignored
+func rawTargets(connectTo []string) []string {
+	var targets []string
+	for _, target := range connectTo {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(strings.Trim(target, "[]"), "0")
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// manageRawIp forwards packets between clients and the target picked among
+// the resolved targets, switching when the targets change
+func manageRawIp(ctx context.Context, conns []*net.IPConn, resolver chan []Target) {
+	var bridges []*rawBridge
+	for _, conn := range conns {
+		b := &rawBridge{conn: conn}
+		bridges = append(bridges, b)
+		go b.relay()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for _, b := range bridges {
+				b.setTarget(nil)
+			}
+			return
+		case connectTo := <-resolver:
+			setTargets(connectTo)
+			var addr *net.IPAddr
+			if target := pickTarget(connectTo); target != "" {
+				host, _, _ := net.SplitHostPort(target)
+				var err error
+				if addr, err = net.ResolveIPAddr("ip", host); err != nil {
+					log.Printf("Failed to resolve `%s`: %v error=dns\n", host, err)
+				} else if verbose.Load() {
+					log.Printf("Forwarding IP protocol %d to `%s`\n", ipProto, addr)
+				}
+			}
+			for _, b := range bridges {
+				b.setTarget(addr)
+			}
+		}
+	}
+}
+
+// setTarget switches the target, ending the session with the previous one
+func (b *rawBridge) setTarget(target *net.IPAddr) {
+	b.mu.Lock()
+	session := b.session
+	b.target, b.session = target, nil
+	b.mu.Unlock()
+	if session != nil {
+		session.setCloseReason("rebind")
+		untrackConn(session.id)
+	}
+}
+
+func (b *rawBridge) relay() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "closed network connection") {
+				return
+			}
+			log.Printf("Failed to read IP protocol %d packet: %v\n", ipProto, err)
+			continue
+		}
+		src := from.(*net.IPAddr)
+		b.mu.Lock()
+		target, client := b.target, b.client
+		var ended *trackedConn
+		if target == nil {
+			b.mu.Unlock()
+			if debug.Load() {
+				log.Printf("Don't know where to forward, dropping packet from `%s`\n", src)
+			}
+			continue
+		}
+		toClient := src.IP.Equal(target.IP)
+		if !toClient && (client == nil || !src.IP.Equal(client.IP) || b.session == nil) {
+			if isBanned(src) || !accessAllowed(src, nil) || !geoAllowed(src) {
+				b.mu.Unlock()
+				if debug.Load() {
+					log.Printf("Client `%s` is not allowed, dropping packet\n", src)
+				}
+				continue
+			}
+			ended = b.session
+			id := newConnId()
+			if debug.Load() {
+				log.Printf("[%d] New IP protocol %d session from `%s` to `%s`\n", id, ipProto, src, target)
+			}
+			b.client = src
+			var session *trackedConn
+			session = trackConn(id, "ip", src.String(), b.conn.LocalAddr().String(), target.String(), func() {
+				b.mu.Lock()
+				if b.session == session {
+					b.session = nil
+				}
+				b.mu.Unlock()
+				untrackConn(id)
+			})
+			b.session = session
+		}
+		session := b.session
+		b.mu.Unlock()
+		if ended != nil {
+			ended.setCloseReason("rebind")
+			untrackConn(ended.id)
+		}
+
+		dst := target
+		if toClient {
+			if client == nil || session == nil {
+				continue
+			}
+			dst = client
+			session.transferred(0, n)
+		} else {
+			session.transferred(n, 0)
+		}
+		session.sample(!toClient, buf[:n])
+		if _, err := b.conn.WriteTo(buf[:n], dst); err != nil && debug.Load() {
+			log.Printf("[%d] Failed to forward IP protocol %d packet to `%s`: %v\n", session.id, ipProto, dst, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"text/template"
+	"time"
+)
+
+// rejectTemplate is -reject-payload, executed for every client refused
+var rejectTemplate *template.Template
+
+// rejectLinger is how long a refused client's data is read and discarded
+// after the payload, so closing doesn't reset the connection before the
+// client has read it
+const rejectLinger = time.Second
+
+// rejectConn closes a refused client connection, sending -reject-payload
+// first when set; reason tells why, for the payload's {{.Reason}}
+func rejectConn(id uint64, conn net.Conn, target, reason string) {
+	if rejectTemplate == nil {
+		conn.Close()
+		return
+	}
+	go func() {
+		defer conn.Close()
+		var buf bytes.Buffer
+		err := rejectTemplate.Execute(&buf, bannerData{
+			Id:       id,
+			Client:   conn.RemoteAddr().String(),
+			ClientIP: clientIp(conn.RemoteAddr().String()),
+			Listener: conn.LocalAddr().String(),
+			Target:   target,
+			Reason:   reason,
+			Time:     time.Now(),
+		})
+		if err != nil {
+			log.Printf("[%d] Failed to render reject payload: %v\n", id, err)
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			if debug.Load() {
+				log.Printf("[%d] Failed to send reject payload: %v\n", id, err)
+			}
+			return
+		}
+		if cw, ok := unwrapFd(conn).(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+			conn.SetReadDeadline(time.Now().Add(rejectLinger))
+			io.Copy(io.Discard, conn)
+		}
+	}()
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pcap link types replay understands
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkRawBsd   = 12
+	linkLoop     = 108
+	linkSll      = 113
+	linkSll2     = 276
+)
+
+// replayPending is how many out-of-order segments of a connection are kept
+// waiting for a missing one, a capture missing packets drops the rest
+const replayPending = 1024
+
+// replayStream is a TCP connection in a capture with the data its client
+// sent, at offsets from the start of the capture
+type replayStream struct {
+	client, server string
+	start          time.Duration
+	end            time.Duration // FIN or RST, 0 when the capture ends first
+	segs           []replaySeg
+	next           uint32 // next sequence number from the client
+	synced         bool   // next is known
+	pending        map[uint32][]byte
+}
+
+type replaySeg struct {
+	at   time.Duration
+	data []byte
+}
+
+// tcpSegment is the part of a captured TCP packet replay uses
+type tcpSegment struct {
+	src, dst         net.IP
+	srcPort, dstPort uint16
+	seq              uint32
+	syn, ack         bool
+	fin, rst         bool
+	payload          []byte
+}
+
+// runReplay implements `goproxy replay` which opens a connection to the
+// target for each TCP connection in a capture and sends the data its client
+// sent, with the original timing, through the dial path of the proxy
+func runReplay(args []string) {
+	speed, args, err := replaySpeed(args)
+	if err != nil {
+		fatalf(errConfig, "Error parsing -speed: %v\n", err)
+	}
+	os.Args = append(os.Args[:1], args...)
+	parseFlags()
+	if len(flags.Args()) != 2 {
+		usage()
+		os.Exit(errorKinds[errConfig].exit)
+	}
+	file, target := flags.Arg(0), flags.Arg(1)
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		fatalf(errConfig, "Expected target host:port, got `%s`\n", target)
+	}
+	streams, err := readCapture(file)
+	if err != nil {
+		log.Fatalf("Failed to read capture `%s`: %v\n", file, err)
+	}
+	if len(streams) == 0 {
+		log.Fatalf("No TCP connections in `%s`\n", file)
+	}
+
+	var failed, sent, received uint64
+	var wg sync.WaitGroup
+	start := time.Now()
+	at := func(offset time.Duration) time.Time {
+		if speed == 0 {
+			return start
+		}
+		return start.Add(time.Duration(float64(offset) / speed))
+	}
+	for i, s := range streams {
+		wg.Add(1)
+		go func(id int, s *replayStream) {
+			defer wg.Done()
+			in, out, err := replayConn(serveCtx, id, s, target, at)
+			atomic.AddUint64(&sent, uint64(in))
+			atomic.AddUint64(&received, uint64(out))
+			if err != nil {
+				atomic.AddUint64(&failed, 1)
+				log.Printf("[%d] Replay of `%s` failed: %v\n", id, s.client, err)
+			}
+		}(i+1, s)
+	}
+	wg.Wait()
+	fmt.Printf("Replayed %d connections in %v, %d failed, sent %sB, received %sB\n", len(streams),
+		time.Since(start).Round(time.Millisecond), failed, formatBytes(float64(sent)), formatBytes(float64(received)))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// replaySpeed takes -speed out of args, wherever it is, as in
+// `goproxy replay file.pcap host:port -speed 2x`; returns 0 for max
+func replaySpeed(args []string) (float64, []string, error) {
+	spec := "1x"
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-speed" || arg == "--speed" {
+			if i+1 == len(args) {
+				return 0, nil, errors.New("missing value")
+			}
+			spec = args[i+1]
+			i++
+		} else if v, ok := cutPrefixes(arg, "-speed=", "--speed="); ok {
+			spec = v
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	if spec == "max" {
+		return 0, rest, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(spec, "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, nil, fmt.Errorf("expected factor such as 2x, 0.5x or max, got `%s`", spec)
+	}
+	return speed, rest, nil
+}
+
+func cutPrefixes(s string, prefixes ...string) (string, bool) {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return s[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// replayConn connects the target when the captured connection started and
+// sends its client data on time, discarding the responses; returns bytes
+// sent and received
+func replayConn(ctx context.Context, id int, s *replayStream, target string, at func(time.Duration) time.Time) (int, int64, error) {
+	if !sleepUntil(ctx, at(s.start)) {
+		return 0, 0, ctx.Err()
+	}
+	conn, err := dialTcp(ctx, target, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	if verbose.Load() {
+		log.Printf("[%d] Replaying `%s` to `%s`, %d segments\n", id, s.client, target, len(s.segs))
+	}
+	var received int64
+	done := make(chan error, 1)
+	go func() {
+		n, err := io.Copy(io.Discard, conn)
+		atomic.StoreInt64(&received, n)
+		done <- err
+	}()
+	sent := 0
+	for _, seg := range s.segs {
+		if !sleepUntil(ctx, at(seg.at)) {
+			return sent, atomic.LoadInt64(&received), ctx.Err()
+		}
+		n, err := conn.Write(seg.data)
+		sent += n
+		if err != nil {
+			return sent, atomic.LoadInt64(&received), err
+		}
+	}
+	if s.end > 0 && !sleepUntil(ctx, at(s.end)) {
+		return sent, atomic.LoadInt64(&received), ctx.Err()
+	}
+	// let the target finish its responses, as it would for the client
+	if cw, ok := unwrapFd(conn).(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		conn.Close()
+		err = <-done
+	}
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	if verbose.Load() {
+		log.Printf("[%d] Replayed `%s`, sent %d bytes, received %d bytes\n", id, s.client, sent, received)
+	}
+	return sent, received, err
+}
+
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// readCapture reads the TCP connections of a pcap file, ordered by start;
+// the client is the side sending the SYN or, for connections already open
+// when the capture started, the side with the higher port
+func readCapture(path string) ([]*replayStream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading file header: %v", err)
+	}
+	var order binary.ByteOrder
+	nanos := false
+	switch magic := binary.LittleEndian.Uint32(header); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order, nanos = binary.LittleEndian, magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, magic == 0x4d3cb2a1
+	case 0x0a0d0d0a:
+		return nil, errors.New("pcapng is not supported, convert it with `editcap -F pcap`")
+	default:
+		return nil, fmt.Errorf("not a pcap file, magic %#x", magic)
+	}
+	link := order.Uint32(header[20:]) & 0xffff
+
+	var streams []*replayStream
+	open := make(map[string]*replayStream)
+	var first time.Time
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("reading packet header: %v", err)
+		}
+		sec, frac := order.Uint32(record), order.Uint32(record[4:])
+		length := order.Uint32(record[8:])
+		if length > 256*1024 {
+			return nil, fmt.Errorf("packet of %d bytes is too long", length)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return nil, fmt.Errorf("reading packet: %v", err)
+		}
+		ts := time.Unix(int64(sec), int64(frac)*1000)
+		if nanos {
+			ts = time.Unix(int64(sec), int64(frac))
+		}
+		if first.IsZero() {
+			first = ts
+		}
+		seg, ok := parsePacket(link, packet)
+		if !ok {
+			continue
+		}
+		at := ts.Sub(first)
+		src := net.JoinHostPort(seg.src.String(), strconv.Itoa(int(seg.srcPort)))
+		dst := net.JoinHostPort(seg.dst.String(), strconv.Itoa(int(seg.dstPort)))
+		key := src + " " + dst
+		if dst < src {
+			key = dst + " " + src
+		}
+		s := open[key]
+		if s == nil || (seg.syn && !seg.ack && s.end > 0) {
+			// the rest of a connection open before the capture started
+			if seg.rst || !seg.syn && len(seg.payload) == 0 {
+				continue
+			}
+			s = &replayStream{start: at, pending: make(map[uint32][]byte)}
+			s.client, s.server = src, dst
+			if (seg.syn && seg.ack) || (!seg.syn && seg.srcPort < seg.dstPort) {
+				s.client, s.server = dst, src
+			}
+			open[key] = s
+			streams = append(streams, s)
+		}
+		if seg.rst {
+			if s.end == 0 {
+				s.end = at
+			}
+			continue
+		}
+		if src != s.client {
+			continue
+		}
+		if seg.syn {
+			s.next, s.synced = seg.seq+1, true
+			continue
+		}
+		s.add(at, seg.seq, seg.payload)
+		if seg.fin && s.end == 0 {
+			s.end = at
+		}
+	}
+	sort.SliceStable(streams, func(i, j int) bool { return streams[i].start < streams[j].start })
+	return streams, nil
+}
+
+// add appends the client data in sequence, dropping retransmitted bytes and
+// holding segments received ahead of a missing one
+func (s *replayStream) add(at time.Duration, seq uint32, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if !s.synced {
+		s.next, s.synced = seq, true
+	}
+	if ahead := int32(seq - s.next); ahead > 0 {
+		if len(s.pending) < replayPending {
+			s.pending[seq] = data
+		}
+		return
+	}
+	overlap := int(int32(s.next - seq))
+	if overlap >= len(data) {
+		return
+	}
+	s.segs = append(s.segs, replaySeg{at, data[overlap:]})
+	s.next += uint32(len(data) - overlap)
+	for seq, data := range s.pending {
+		if int32(seq-s.next) <= 0 {
+			delete(s.pending, seq)
+			s.add(at, seq, data)
+			return
+		}
+	}
+}
+
+// parsePacket decodes a TCP segment over IPv4 or IPv6 from a captured frame
+func parsePacket(link uint32, frame []byte) (tcpSegment, bool) {
+	var ip []byte
+	switch link {
+	case linkEthernet:
+		if len(frame) < 14 {
+			return tcpSegment{}, false
+		}
+		etherType, rest := binary.BigEndian.Uint16(frame[12:]), frame[14:]
+		// VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(rest) >= 4 {
+			etherType, rest = binary.BigEndian.Uint16(rest[2:]), rest[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return tcpSegment{}, false
+		}
+		ip = rest
+	case linkNull, linkLoop:
+		if len(frame) < 4 {
+			return tcpSegment{}, false
+		}
+		ip = frame[4:]
+	case linkRaw, linkRawBsd:
+		ip = frame
+	case linkSll:
+		if len(frame) < 16 {
+			return tcpSegment{}, false
+		}
+		ip = frame[16:]
+	case linkSll2:
+		if len(frame) < 20 {
+			return tcpSegment{}, false
+		}
+		ip = frame[20:]
+	default:
+		return tcpSegment{}, false
+	}
+	if len(ip) == 0 {
+		return tcpSegment{}, false
+	}
+	var seg tcpSegment
+	var tcp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		if len(ip) < 20 {
+			return seg, false
+		}
+		ihl, total := int(ip[0]&0x0f)*4, int(binary.BigEndian.Uint16(ip[2:]))
+		// fragments are not reassembled
+		if ip[9] != 6 || binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 || ihl < 20 || total < ihl || total > len(ip) {
+			return seg, false
+		}
+		seg.src, seg.dst = net.IP(ip[12:16]), net.IP(ip[16:20])
+		tcp = ip[ihl:total]
+	case 6:
+		if len(ip) < 40 {
+			return seg, false
+		}
+		total := 40 + int(binary.BigEndian.Uint16(ip[4:]))
+		if total > len(ip) {
+			return seg, false
+		}
+		seg.src, seg.dst = net.IP(ip[8:24]), net.IP(ip[24:40])
+		next, rest := ip[6], ip[40:total]
+		// hop-by-hop, routing and destination options headers
+		for (next == 0 || next == 43 || next == 60) && len(rest) >= 8 {
+			n := 8 + int(rest[1])*8
+			if n > len(rest) {
+				return seg, false
+			}
+			next, rest = rest[0], rest[n:]
+		}
+		if next != 6 {
+			return seg, false
+		}
+		tcp = rest
+	default:
+		return seg, false
+	}
+	if len(tcp) < 20 {
+		return seg, false
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || offset > len(tcp) {
+		return seg, false
+	}
+	seg.srcPort, seg.dstPort = binary.BigEndian.Uint16(tcp), binary.BigEndian.Uint16(tcp[2:])
+	seg.seq = binary.BigEndian.Uint32(tcp[4:])
+	bits := tcp[13]
+	seg.fin, seg.syn, seg.rst, seg.ack = bits&0x01 != 0, bits&0x02 != 0, bits&0x04 != 0, bits&0x10 != 0
+	seg.payload = tcp[offset:]
+	return seg, true
+}
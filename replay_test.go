@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loopback.pcap holds two HTTP/1.0 requests captured on lo, the first over
+// IPv6, each sent in two segments and answered before the close
+const loopbackPcap = "testdata/loopback.pcap"
+
+// captureFrames returns the frames of a little-endian pcap file
+func captureFrames(t *testing.T, path string) [][]byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames [][]byte
+	for data = data[24:]; len(data) >= 16; {
+		n := int(binary.LittleEndian.Uint32(data[8:]))
+		frames = append(frames, data[16:16+n])
+		data = data[16+n:]
+	}
+	return frames
+}
+
+func TestReadCapture(t *testing.T) {
+	streams, err := readCapture(loopbackPcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		client, server string
+	}{
+		{"[::1]:48466", "[::1]:19141"},
+		{"127.0.0.1:49578", "127.0.0.1:19142"},
+	}
+	if len(streams) != len(want) {
+		t.Fatalf("%d streams, want %d", len(streams), len(want))
+	}
+	for i, s := range streams {
+		if s.client != want[i].client || s.server != want[i].server {
+			t.Errorf("stream %d from %s to %s, want %s to %s", i, s.client, s.server, want[i].client, want[i].server)
+		}
+		var data []byte
+		for _, seg := range s.segs {
+			data = append(data, seg.data...)
+		}
+		if string(data) != "GET / HTTP/1.0\r\nHost: x\r\n\r\n" || len(s.segs) != 2 {
+			t.Errorf("stream %d sent %q in %d segments", i, data, len(s.segs))
+		}
+		if s.end <= s.start {
+			t.Errorf("stream %d ends at %v, started at %v", i, s.end, s.start)
+		}
+	}
+}
+
+func TestReadCaptureMalformed(t *testing.T) {
+	data, err := os.ReadFile(loopbackPcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oversized := append([]byte(nil), data[:40]...)
+	binary.LittleEndian.PutUint32(oversized[32:], 1<<20)
+	tests := []struct {
+		name    string
+		data    []byte
+		streams int
+		fails   bool
+	}{
+		{"header only", data[:24], 0, false},
+		{"truncated header", data[:10], 0, true},
+		{"truncated record header", data[:30], 0, true},
+		{"truncated packet", data[:60], 0, true},
+		{"oversized packet", oversized, 0, true},
+		{"pcapng", append([]byte{0x0a, 0x0d, 0x0d, 0x0a}, data[4:]...), 0, true},
+		{"not pcap", []byte("GET / HTTP/1.0\r\nHost: x\r\n\r\n"), 0, true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "capture.pcap")
+		if err := os.WriteFile(path, test.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		streams, err := readCapture(path)
+		if test.fails != (err != nil) || len(streams) != test.streams {
+			t.Errorf("%s: %d streams, error %v", test.name, len(streams), err)
+		}
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	var syn6, data4 []byte
+	for _, frame := range captureFrames(t, loopbackPcap) {
+		if syn6 == nil && binary.BigEndian.Uint16(frame[12:]) == 0x86dd {
+			syn6 = frame
+		}
+		if data4 == nil && binary.BigEndian.Uint16(frame[12:]) == 0x0800 && bytes.HasSuffix(frame, []byte("HTTP/1.0\r\n")) {
+			data4 = frame
+		}
+	}
+	if syn6 == nil || data4 == nil {
+		t.Fatal("capture lacks the IPv6 SYN or the IPv4 request")
+	}
+	ip4 := data4[14:]
+	modified := func(frame []byte, offset int, b byte) []byte {
+		frame = append([]byte(nil), frame...)
+		frame[offset] = b
+		return frame
+	}
+	vlan := append(append(append([]byte(nil), data4[:12]...), 0x81, 0x00, 0x00, 0x64), data4[12:]...)
+	sll := append(append(make([]byte, 14), 0x08, 0x00), ip4...)
+	null := append([]byte{2, 0, 0, 0}, ip4...)
+	tests := []struct {
+		name    string
+		link    uint32
+		frame   []byte
+		ok      bool
+		syn     bool
+		payload string
+	}{
+		{"ipv4", linkEthernet, data4, true, false, "GET / HTTP/1.0\r\n"},
+		{"ipv6 syn", linkEthernet, syn6, true, true, ""},
+		{"vlan", linkEthernet, vlan, true, false, "GET / HTTP/1.0\r\n"},
+		{"linux cooked", linkSll, sll, true, false, "GET / HTTP/1.0\r\n"},
+		{"raw", linkRaw, ip4, true, false, "GET / HTTP/1.0\r\n"},
+		{"bsd loopback", linkNull, null, true, false, "GET / HTTP/1.0\r\n"},
+		{"unknown link", 147, data4, false, false, ""},
+		{"arp", linkEthernet, modified(data4, 13, 0x06), false, false, ""},
+		{"udp", linkEthernet, modified(data4, 23, 17), false, false, ""},
+		{"fragment", linkEthernet, modified(data4, 20, 0x20), false, false, ""},
+		{"bad tcp offset", linkEthernet, modified(data4, 46, 0xf0), false, false, ""},
+		{"truncated ethernet", linkEthernet, data4[:10], false, false, ""},
+		{"truncated ipv4", linkEthernet, data4[:30], false, false, ""},
+		{"truncated tcp", linkEthernet, data4[:len(data4)-20], false, false, ""},
+		{"truncated ipv6", linkEthernet, syn6[:60], false, false, ""},
+		{"empty", linkRaw, nil, false, false, ""},
+	}
+	for _, test := range tests {
+		seg, ok := parsePacket(test.link, test.frame)
+		if ok != test.ok {
+			t.Errorf("%s: parsed %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if ok && (seg.syn != test.syn || string(seg.payload) != test.payload) {
+			t.Errorf("%s: SYN %v and payload %q, want %v and %q", test.name, seg.syn, seg.payload, test.syn, test.payload)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ruleLimit caps the resources of a forwarding rule so a noisy rule can't
+// starve the others in the process: live TCP connections, bandwidth shared
+// by its connections and bytes its connections hold read and not yet
+// written
+type ruleLimit struct {
+	name        string
+	conns       int64
+	bandwidth   uint64 // bytes per second in both directions, 0 for unlimited
+	maxBuffered uint64
+
+	live      int64  // live TCP connections, updated atomically
+	rejected  uint64 // connections refused at the limit, updated atomically
+	throttled int64  // nanoseconds reads waited for bandwidth, updated atomically
+	held      uint64 // bytes buffered, updated atomically
+	pauses    uint64 // reads delayed over maxBuffered, updated atomically
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	tokens float64
+	last   time.Time
+}
+
+type ruleLimitStats struct {
+	Conns            int64   `json:"conns,omitempty"`
+	Bandwidth        uint64  `json:"bandwidth,omitempty"`
+	MaxBuffered      uint64  `json:"max_buffered,omitempty"`
+	Live             int64   `json:"live"`
+	Rejected         uint64  `json:"rejected"`
+	ThrottledSeconds float64 `json:"throttled_seconds"`
+	Buffered         uint64  `json:"buffered"`
+	BufferPauses     uint64  `json:"buffer_pauses"`
+}
+
+// ruleLimits maps rule names to their -rule-limit; filled at startup
+var ruleLimits = make(map[string]*ruleLimit)
+
+// parseRuleLimit parses `name:conns=N,bandwidth=size,buffered=size`
+func parseRuleLimit(spec string) (*ruleLimit, error) {
+	name, limits, ok := strings.Cut(spec, ":")
+	if !ok || name == "" || strings.TrimSpace(limits) == "" {
+		return nil, fmt.Errorf("expected name:conns=N,bandwidth=size,buffered=size, got `%s`", spec)
+	}
+	l := &ruleLimit{name: name, last: time.Now()}
+	l.cond = sync.NewCond(&l.mu)
+	for _, limit := range parseTargetList(limits) {
+		key, value, _ := strings.Cut(limit, "=")
+		var err error
+		switch key {
+		case "conns":
+			l.conns, err = strconv.ParseInt(value, 10, 64)
+			if err == nil && l.conns < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "bandwidth":
+			l.bandwidth, err = parseBytes(value)
+			if err == nil && l.bandwidth == 0 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "buffered":
+			l.maxBuffered, err = parseBytes(value)
+			if err == nil && l.maxBuffered < copyBufferSize {
+				err = fmt.Errorf("must be at least %d", copyBufferSize)
+			}
+		default:
+			err = fmt.Errorf("unknown limit, expected conns, bandwidth or buffered")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("`%s` of rule `%s`: %v", limit, name, err)
+		}
+	}
+	return l, nil
+}
+
+// ruleAdmits reports whether the rule of the listener address is under its
+// connection limit, counting a refusal when it isn't; connections being
+// connected are not counted yet, so a burst may exceed it briefly
+func ruleAdmits(local string) bool {
+	l := ruleLimits[ruleOf(local)]
+	if l == nil || l.conns == 0 || atomic.LoadInt64(&l.live) < l.conns {
+		return true
+	}
+	atomic.AddUint64(&l.rejected, 1)
+	return false
+}
+
+// take waits until n bytes fit within the rule's bandwidth; the bucket holds
+// up to a second's worth
+func (l *ruleLimit) take(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	rate := float64(l.bandwidth)
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait > 0 {
+		atomic.AddInt64(&l.throttled, int64(wait))
+		time.Sleep(wait)
+	}
+}
+
+// ruleReader limits the transfer rate of a connection to its rule's share
+// of bandwidth
+type ruleReader struct {
+	r io.Reader
+	l *ruleLimit
+}
+
+func (r ruleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.l.take(n)
+	}
+	return n, err
+}
+
+// waitBuffered delays a read while the rule's connections hold its budget
+func (l *ruleLimit) waitBuffered() {
+	if atomic.LoadUint64(&l.held) < l.maxBuffered {
+		return
+	}
+	atomic.AddUint64(&l.pauses, 1)
+	l.mu.Lock()
+	for atomic.LoadUint64(&l.held) >= l.maxBuffered {
+		l.cond.Wait()
+	}
+	l.mu.Unlock()
+}
+
+func (l *ruleLimit) release(n int) {
+	atomic.AddUint64(&l.held, ^uint64(n-1))
+	if l.maxBuffered > 0 {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	}
+}
+
+// ruleLimitReport returns the limits and saturation counters per rule
+func ruleLimitReport() map[string]ruleLimitStats {
+	if len(ruleLimits) == 0 {
+		return nil
+	}
+	report := make(map[string]ruleLimitStats, len(ruleLimits))
+	for name, l := range ruleLimits {
+		report[name] = ruleLimitStats{
+			Conns:            l.conns,
+			Bandwidth:        l.bandwidth,
+			MaxBuffered:      l.maxBuffered,
+			Live:             atomic.LoadInt64(&l.live),
+			Rejected:         atomic.LoadUint64(&l.rejected),
+			ThrottledSeconds: time.Duration(atomic.LoadInt64(&l.throttled)).Seconds(),
+			Buffered:         atomic.LoadUint64(&l.held),
+			BufferPauses:     atomic.LoadUint64(&l.pauses),
+		}
+	}
+	return report
+}
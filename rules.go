@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"strconv"
+)
+
+// defaultRule names the main forwarding rule, from the listen addresses to
+// the targets given as arguments, unless -rule-name is set
+const defaultRule = "default"
+
+// validRuleName reports whether the name is usable as a rule name: letters,
+// digits, `.`, `_` and `-`
+func validRuleName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleOf returns the name of the forwarding rule serving connections to
+// the listener address: its -port-route, or the main rule
+func ruleOf(local string) string {
+	if len(portRoutes) > 0 {
+		if _, port, err := net.SplitHostPort(local); err == nil {
+			if p, err := strconv.Atoi(port); err == nil && portRoutes[p] != nil {
+				return portRoutes[p].name
+			}
+		}
+	}
+	return mainRule()
+}
+
+func mainRule() string {
+	if ruleName != "" {
+		return ruleName
+	}
+	return defaultRule
+}
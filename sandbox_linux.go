@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+)
+
+// syscalls a network proxy never needs, denied with EPERM by the seccomp
+// filter; a denylist keeps working across Go runtime versions which an
+// allowlist would not
+var deniedSyscalls = []uintptr{
+	unix.SYS_EXECVE, unix.SYS_EXECVEAT, unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT, unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE, unix.SYS_KEXEC_LOAD, unix.SYS_REBOOT,
+	unix.SYS_SWAPON, unix.SYS_SWAPOFF, unix.SYS_ACCT, unix.SYS_SETTIMEOFDAY, unix.SYS_CLOCK_SETTIME,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD, unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+}
+
+var auditArch = map[string]uint32{
+	"amd64": unix.AUDIT_ARCH_X86_64,
+	"arm64": unix.AUDIT_ARCH_AARCH64,
+	"386":   unix.AUDIT_ARCH_I386,
+	"arm":   unix.AUDIT_ARCH_ARM,
+}
+
+// sandbox restricts the process with Landlock to the directories it needs
+// after initialization, and installs a seccomp filter; applied to all
+// threads, which requires a build without cgo
+func sandbox() error {
+	readDirs, writeDirs := sandboxDirs()
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %v", errno)
+	}
+	if err := landlock(readDirs, writeDirs); err == unix.ENOSYS || err == unix.EOPNOTSUPP {
+		log.Printf("Landlock is not available, file access is not restricted: %v\n", err)
+	} else if err != nil {
+		return fmt.Errorf("landlock: %v", err)
+	}
+	return seccomp()
+}
+
+func landlock(readDirs, writeDirs []string) error {
+	const read = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	const write = read | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE
+	// all access rights of Landlock ABI v1
+	attr := unix.LandlockRulesetAttr{Access_fs: 1<<13 - 1}
+	fd, _, errno := syscall.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(int(fd))
+
+	allow := func(dir string, access uint64) error {
+		dirFd, err := unix.Open(dir, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("open `%s`: %v", dir, err)
+		}
+		defer unix.Close(dirFd)
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(dirFd)}
+		if _, _, errno := syscall.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH,
+			uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("add rule for `%s`: %v", dir, errno)
+		}
+		return nil
+	}
+	for _, dir := range readDirs {
+		if err := allow(dir, read); err != nil {
+			return err
+		}
+	}
+	for _, dir := range writeDirs {
+		if err := allow(dir, write); err != nil {
+			return err
+		}
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func seccomp() error {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp filter is not supported on %s", runtime.GOARCH)
+	}
+	stmt := func(code uint16, k uint32) unix.SockFilter { return unix.SockFilter{Code: code, K: k} }
+	jeq := func(k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: jt, Jf: jf, K: k}
+	}
+	deny := stmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM))
+	// struct seccomp_data: nr at offset 0, arch at offset 4; foreign
+	// architectures and x32 syscall numbers are denied
+	filter := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 4),
+		jeq(arch, 1, 0),
+		deny,
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 0),
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: 0, Jf: 1, K: 0x40000000},
+		deny,
+	}
+	for _, nr := range deniedSyscalls {
+		filter = append(filter, jeq(uint32(nr), 0, 1), deny)
+	}
+	filter = append(filter, stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow))
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("seccomp: %v", errno)
+	}
+	return nil
+}
+
+// sandboxDirs returns directories to read and write: /etc and the
+// systemd-resolved stub for the resolver configuration, the GeoIP database,
+// target blacklist and admin CRL directories as they are reloaded, the log, stats, audit log, health and lease
+// file directories as files there are rotated and replaced, and the PID
+// file, port file and admin API socket directories as they are written or
+// removed later
+func sandboxDirs() (readDirs, writeDirs []string) {
+	lease, _ := leader.lease.(*fileLease)
+	if lease != nil {
+		writeDirs = append(writeDirs, filepath.Dir(lease.path))
+	}
+	socket, _ := adminSocketPath(admin)
+	for _, path := range []string{logFilePath, statsFile, auditLogPath, healthFile, pidFile, portFile, socket} {
+		if path != "" {
+			writeDirs = append(writeDirs, filepath.Dir(path))
+		}
+	}
+	readDirs = append(readDirs, "/etc", "/run/systemd/resolve")
+	for _, path := range []string{geoDb, blacklistFile, adminTlsCrl} {
+		if path != "" {
+			readDirs = append(readDirs, filepath.Dir(path))
+		}
+	}
+	return
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// sandbox is only implemented with Landlock and seccomp on Linux
+func sandbox() error {
+	return errors.New("-sandbox is only supported on Linux")
+}
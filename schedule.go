@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stringList is a flag which may be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// timeWindow is a daily window on selected days of week
+type timeWindow struct {
+	days  [7]bool
+	start int // minutes since midnight
+	end   int
+}
+
+// scheduleRule switches the canary split and/or target weights during a
+// daily time window and restores previous values when the window ends
+type scheduleRule struct {
+	timeWindow
+	spec    string
+	split   *uint
+	weights map[string]uint
+
+	active       bool
+	savedSplit   uint
+	savedWeights map[string]*uint
+}
+
+// parseScheduleRule parses `[days] HH:MM-HH:MM action[,action]` where days is
+// `*`, a range `Mon-Fri` or a list `Sat,Sun`, and action is `split=N` or
+// `host:port=weight`
+func parseScheduleRule(spec string) (*scheduleRule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 2 {
+		fields = append([]string{"*"}, fields...)
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("expected `[days] HH:MM-HH:MM action[,action]`, got `%s`", spec)
+	}
+	r := &scheduleRule{spec: spec, weights: make(map[string]uint)}
+	if err := r.parse(fields[0], fields[1]); err != nil {
+		return nil, err
+	}
+
+	for _, action := range strings.Split(fields[2], ",") {
+		eq := strings.LastIndexByte(action, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid action `%s`", action)
+		}
+		n, err := strconv.ParseUint(action[eq+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid action `%s`", action)
+		}
+		if key := action[:eq]; key == "split" {
+			if n > 100 {
+				return nil, fmt.Errorf("split must be a percentage, got %d", n)
+			}
+			split := uint(n)
+			r.split = &split
+		} else {
+			r.weights[key] = uint(n)
+		}
+	}
+	return r, nil
+}
+
+// parse parses days and `HH:MM-HH:MM` window, the end may be 24:00 for a
+// window until midnight
+func (r *timeWindow) parse(days, window string) error {
+	if err := r.parseDays(days); err != nil {
+		return err
+	}
+	bounds := strings.SplitN(window, "-", 2)
+	if len(bounds) != 2 {
+		return fmt.Errorf("invalid time window `%s`", window)
+	}
+	var err error
+	if r.start, err = parseClock(bounds[0]); err != nil {
+		return err
+	}
+	if bounds[1] == "24:00" {
+		r.end = 24 * 60
+		return nil
+	}
+	r.end, err = parseClock(bounds[1])
+	return err
+}
+
+func (r *timeWindow) parseDays(days string) error {
+	if days == "*" {
+		for i := range r.days {
+			r.days[i] = true
+		}
+		return nil
+	}
+	for _, d := range strings.Split(strings.ToLower(days), ",") {
+		bounds := strings.SplitN(d, "-", 2)
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("invalid day `%s`", bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("invalid day `%s`", bounds[1])
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			r.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time `%s`", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// matches reports whether the window is open at t; a window spanning
+// midnight belongs to the day it starts on
+func (r *timeWindow) matches(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if r.start <= r.end {
+		return r.days[t.Weekday()] && minute >= r.start && minute < r.end
+	}
+	if minute >= r.start {
+		return r.days[t.Weekday()]
+	}
+	return minute < r.end && r.days[(t.Weekday()+6)%7]
+}
+
+func (r *scheduleRule) apply() {
+	if r.split != nil {
+		r.savedSplit = getSplit().Percent
+		setSplit(*r.split)
+	}
+	r.savedWeights = make(map[string]*uint)
+	targetState.Lock()
+	for target, w := range r.weights {
+		if saved, ok := targetState.weights[target]; ok {
+			r.savedWeights[target] = &saved
+		} else {
+			r.savedWeights[target] = nil
+		}
+		targetState.weights[target] = w
+	}
+	targetState.Unlock()
+}
+
+// restore switches back to the values saved by apply, except those changed
+// since, e.g. through the admin API, which are left as they are
+func (r *scheduleRule) restore() {
+	if r.split != nil && getSplit().Percent == *r.split {
+		setSplit(r.savedSplit)
+	}
+	targetState.Lock()
+	for target, saved := range r.savedWeights {
+		if w, ok := targetState.weights[target]; !ok || w != r.weights[target] {
+			continue
+		}
+		if saved != nil {
+			targetState.weights[target] = *saved
+		} else {
+			delete(targetState.weights, target)
+		}
+	}
+	targetState.Unlock()
+}
+
+// runSchedule checks the rules every few seconds, applying a rule when its
+// window opens and switching back when it closes
+func runSchedule(ctx context.Context, rules []*scheduleRule) {
+	check := func(now time.Time) {
+		for _, r := range rules {
+			if match := r.matches(now); match && !r.active {
+				if verbose.Load() {
+					log.Printf("Schedule `%s` started\n", r.spec)
+				}
+				r.active = true
+				before := currentControlState()
+				r.apply()
+				audit("schedule `"+r.spec+"`", "start", before, currentControlState())
+			} else if !match && r.active {
+				if verbose.Load() {
+					log.Printf("Schedule `%s` ended\n", r.spec)
+				}
+				r.active = false
+				before := currentControlState()
+				r.restore()
+				audit("schedule `"+r.spec+"`", "end", before, currentControlState())
+			}
+		}
+	}
+	check(time.Now())
+	ticker := systemClock.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.Chan():
+		}
+		check(now)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sctpSocket opens a one-to-one style SCTP socket, which reads and writes
+// like a TCP stream
+func sctpSocket(family int) (int, error) {
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err == unix.EPROTONOSUPPORT || err == unix.ESOCKTNOSUPPORT {
+		return -1, errors.New("SCTP is not available, is the sctp kernel module loaded?")
+	}
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	return fd, nil
+}
+
+// listenSctp binds an SCTP listener, its associations are accepted as
+// connections
+func listenSctp(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveTCPAddr(listenNetwork("tcp"), addr)
+	if err != nil {
+		return nil, err
+	}
+	family := tcpFamily(laddr.IP)
+	if listenFamily == "ipv4" {
+		family = unix.AF_INET
+	}
+	fd, err := sctpSocket(family)
+	if err != nil {
+		return nil, err
+	}
+	return listenSocket(fd, "sctp", laddr, family)
+}
+
+// dialSctp sets up an SCTP association with the target
+func dialSctp(target string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	family := tcpFamily(raddr.IP)
+	fd, err := sctpSocket(family)
+	if err != nil {
+		return nil, err
+	}
+	return connectSocket(fd, "sctp", raddr, family, timeout)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errSctp = errors.New("SCTP is only supported on Linux")
+
+func listenSctp(addr string) (net.Listener, error) {
+	return nil, errSctp
+}
+
+func dialSctp(target string, timeout time.Duration) (net.Conn, error) {
+	return nil, errSctp
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsExchanger sends a query to the -dns server; *dns.Client implements it,
+// a fake one can simulate DNS churn and failures
+type dnsExchanger interface {
+	Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error)
+}
+
+// ticker is the part of *time.Ticker used to schedule DNS refreshes
+type ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// clock creates the tickers of periodic work such as DNS refreshes, UDP
+// rebinding and counter rollover; a fake clock fires them on demand instead
+// of after -dns-interval and the like
+type clock interface {
+	NewTicker(d time.Duration) ticker
+}
+
+// The injection points default to the real DNS client, clock and dialer;
+// set them before serving, they are not synchronized
+var (
+	newDnsClient = func() dnsExchanger { return &dns.Client{Net: "tcp"} }
+	systemClock  = clock(realClock{})
+	// upstreamDial opens connections and UDP sockets to targets, see
+	// dialTransport; set in init as the transports dial through it again
+	upstreamDial func(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error)
+)
+
+func init() {
+	upstreamDial = dialTransport
+}
+
+// dialTransport dials network tcp or udp with the -timeout, -source-ports
+// and socket options configured on the dialer, or a transport of dialTcp:
+// npipe or via without a dialer, mptcp or sctp with only its timeout
+func dialTransport(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+	switch network {
+	case "npipe":
+		return dialNpipe(ctx, npipePath(address))
+	case "via":
+		return dialVia(ctx, address)
+	case "mptcp":
+		return dialMptcp(address, d.Timeout)
+	case "sctp":
+		return dialSctp(address, d.Timeout)
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+type realClock struct{}
+
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) Chan() <-chan time.Time {
+	return t.C
+}
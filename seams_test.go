@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeDns answers A queries from a table the test changes
+type fakeDns struct {
+	mu  sync.Mutex
+	ips map[string][]string
+}
+
+func (f *fakeDns) set(name string, ips ...string) {
+	f.mu.Lock()
+	f.ips[dns.Fqdn(name)] = ips
+	f.mu.Unlock()
+}
+
+func (f *fakeDns) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	q := m.Question[0]
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ip := range f.ips[q.Name] {
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP(ip)})
+		}
+	}
+	return resp, 0, nil
+}
+
+// fakeClock fires its tickers when the test ticks
+type fakeClock struct {
+	ticks chan time.Time
+}
+
+func (c fakeClock) NewTicker(d time.Duration) ticker {
+	return fakeTicker{c.ticks}
+}
+
+type fakeTicker struct {
+	c chan time.Time
+}
+
+func (t fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t fakeTicker) Stop() {}
+
+func nextTargets(t *testing.T, updates chan []Target) []Target {
+	t.Helper()
+	select {
+	case targets := <-updates:
+		return targets
+	case <-time.After(5 * time.Second):
+		t.Fatal("no target update")
+		return nil
+	}
+}
+
+func TestDnsRefreshChangesTargets(t *testing.T) {
+	resolver := &fakeDns{ips: make(map[string][]string)}
+	fake := fakeClock{make(chan time.Time)}
+	var dialed []string
+	defer func(d func() dnsExchanger, c clock, dial func(context.Context, *net.Dialer, string, string) (net.Conn, error), s string, to time.Duration) {
+		newDnsClient, systemClock, upstreamDial, dnsServer, timeout = d, c, dial, s, to
+	}(newDnsClient, systemClock, upstreamDial, dnsServer, timeout)
+	newDnsClient = func() dnsExchanger { return resolver }
+	systemClock = fake
+	upstreamDial = func(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	dnsServer, timeout = "192.0.2.53:53", time.Second
+
+	resolver.set("db.example.com", "10.0.0.1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan []Target)
+	go refreshDns(ctx, []string{"db.example.com:5432"}, updates, nil)
+
+	targets := nextTargets(t, updates)
+	if got := targetAddrs(targets); len(got) != 1 || got[0] != "10.0.0.1:5432" {
+		t.Fatalf("targets %v, want [10.0.0.1:5432]", got)
+	}
+	if targets[0].Source != sourceDns || targets[0].Name != "db.example.com" {
+		t.Errorf("target %+v, want source dns and name db.example.com", targets[0])
+	}
+
+	resolver.set("db.example.com", "10.0.0.3", "10.0.0.2")
+	fake.ticks <- time.Now()
+	targets = nextTargets(t, updates)
+	if got := targetAddrs(targets); len(got) != 2 || got[0] != "10.0.0.2:5432" || got[1] != "10.0.0.3:5432" {
+		t.Fatalf("targets %v, want [10.0.0.2:5432 10.0.0.3:5432]", got)
+	}
+
+	conn, err := dialTcp(ctx, targets[0].Addr, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+	if len(dialed) != 1 || dialed[0] != "tcp 10.0.0.2:5432" {
+		t.Errorf("dialed %v, want [tcp 10.0.0.2:5432]", dialed)
+	}
+}
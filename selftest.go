@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// runSelftest implements `goproxy selftest` which starts echo backends and
+// goproxy itself on ephemeral loopback ports, and passes TCP and UDP traffic
+// through them
+func runSelftest(args []string) {
+	cmd := flag.NewFlagSet("goproxy selftest", flag.ExitOnError)
+	timeout := cmd.Duration("timeout", 10*time.Second, "Time allowed for each check")
+	verbose := cmd.Bool("verbose", false, "Print the log of goproxy under test")
+	cmd.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find executable: %v\n", err)
+		os.Exit(1)
+	}
+	checks := []struct {
+		name  string
+		check func(exe string, timeout time.Duration, logs io.Writer) error
+	}{
+		{"TCP", selftestTcp},
+		{"UDP", selftestUdp},
+		{"UDP affinity", selftestUdpAffinity},
+	}
+	failed := false
+	for _, c := range checks {
+		// the log is read once the proxy has exited
+		var logs bytes.Buffer
+		err := c.check(exe, *timeout, &logs)
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL %s: %v\n", c.name, err)
+		} else {
+			fmt.Printf("PASS %s\n", c.name)
+		}
+		if err != nil || *verbose {
+			fmt.Print(logs.String())
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// selftestProxy starts goproxy with args and a listener on an ephemeral
+// port, returning the bound address and a function stopping it; GOPROXY_*
+// variables configuring the proxy being tested are not passed on
+func selftestProxy(ctx context.Context, exe string, logs io.Writer, args ...string) (string, func(), error) {
+	proxy := exec.Command(exe, append([]string{"-verbose"}, args...)...)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, envPrefix) {
+			proxy.Env = append(proxy.Env, env)
+		}
+	}
+	proxy.Stderr = logs
+	stdout, err := proxy.StdoutPipe()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := proxy.Start(); err != nil {
+		return "", nil, err
+	}
+	bound := make(chan string, 1)
+	exited := make(chan struct{})
+	go func() {
+		line, _ := bufio.NewReader(stdout).ReadString('\n')
+		bound <- strings.TrimSpace(line)
+		io.Copy(io.Discard, stdout)
+		proxy.Wait()
+		close(exited)
+	}()
+	stop := func() {
+		proxy.Process.Kill()
+		<-exited
+	}
+	select {
+	case addr := <-bound:
+		if addr == "" {
+			stop()
+			return "", nil, fmt.Errorf("goproxy exited without listening")
+		}
+		return addr, stop, nil
+	case <-ctx.Done():
+		stop()
+		return "", nil, fmt.Errorf("goproxy didn't start listening")
+	}
+}
+
+func selftestTcp(exe string, timeout time.Duration, logs io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	addr, stop, err := selftestProxy(ctx, exe, logs, "127.0.0.1:0", backend.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer stop()
+	sent := make([]byte, 1<<20)
+	rand.Read(sent)
+	for {
+		n, err := selftestEcho(ctx, addr, sent)
+		if err == nil {
+			return nil
+		}
+		// connections are refused until the targets are resolved
+		if n > 0 || err != io.EOF {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// selftestEcho sends data through the proxy at addr and reads the echo,
+// returning the number of bytes echoed
+func selftestEcho(ctx context.Context, addr string, sent []byte) (int, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	// the proxy closes both ends once either is closed, so the echo is read
+	// in full before closing
+	go conn.Write(sent)
+	received := make([]byte, len(sent))
+	if n, err := io.ReadFull(conn, received); err != nil {
+		if n > 0 {
+			return n, fmt.Errorf("echoed %d of %d bytes: %v", n, len(sent), err)
+		}
+		return 0, err
+	}
+	if !bytes.Equal(sent, received) {
+		return len(sent), fmt.Errorf("echoed data differs from data sent")
+	}
+	return len(sent), nil
+}
+
+// selftestUdp checks plain UDP forwarding, which is one way
+func selftestUdp(exe string, timeout time.Duration, logs io.Writer) error {
+	return selftestDatagram(exe, timeout, logs, false, "-udp")
+}
+
+// selftestUdpAffinity checks UDP sessions with replies
+func selftestUdpAffinity(exe string, timeout time.Duration, logs io.Writer) error {
+	return selftestDatagram(exe, timeout, logs, true, "-udp", "-udp-affinity", "client")
+}
+
+func selftestDatagram(exe string, timeout time.Duration, logs io.Writer, reply bool, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	received := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received <- append([]byte(nil), buf[:n]...)
+			if reply {
+				backend.WriteTo(buf[:n], from)
+			}
+		}
+	}()
+	addr, stop, err := selftestProxy(ctx, exe, logs, append(args, "127.0.0.1:0", backend.LocalAddr().String())...)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	sent := make([]byte, 1200)
+	rand.Read(sent)
+	// datagrams may be lost, send until one makes it
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	conn.Write(sent)
+	for got := false; !got; {
+		select {
+		case data := <-received:
+			if !bytes.Equal(data, sent) {
+				return fmt.Errorf("backend received a different datagram")
+			}
+			got = true
+		case <-ticker.C:
+			conn.Write(sent)
+		case <-ctx.Done():
+			return fmt.Errorf("backend received no datagram")
+		}
+	}
+	if !reply {
+		return nil
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return fmt.Errorf("no reply: %v", err)
+	}
+	if !bytes.Equal(buf[:n], sent) {
+		return fmt.Errorf("reply differs from the datagram sent")
+	}
+	return nil
+}
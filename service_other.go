@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "log"
+
+func isService() bool {
+	return false
+}
+
+func runAsService() {}
+
+func runService(args []string) {
+	log.Fatal("goproxy service is only supported on Windows\n")
+}
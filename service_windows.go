@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func isService() bool {
+	service, err := svc.IsWindowsService()
+	if err != nil {
+		log.Fatalf("Failed to determine if running as a service: %v\n", err)
+	}
+	return service
+}
+
+// proxyService runs the proxy under the service control manager, draining
+// connections on stop and system shutdown
+type proxyService struct{}
+
+func (proxyService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	go serve(serveCtx)
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for r := range requests {
+		switch r.Cmd {
+		case svc.Interrogate:
+			status <- r.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32((drainTimeout + 5*time.Second) / time.Millisecond)}
+			drain(drainTimeout)
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+func runAsService() {
+	// the name is ignored for services running in own process
+	if err := svc.Run("goproxy", proxyService{}); err != nil {
+		log.Fatalf("Failed to run service: %v\n", err)
+	}
+}
+
+func isDaemonChild() bool {
+	return false
+}
+
+func daemonize() {
+	log.Fatal("-daemon is not supported on Windows, use goproxy service install\n")
+}
+
+// notifyReady is a no-op, there is no daemon mode on Windows
+func notifyReady() {}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// notifyShutdown drains connections on Ctrl+C or Ctrl+Break in console, a
+// second one exits immediately
+func notifyShutdown() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		go func() {
+			<-c
+			os.Exit(1)
+		}()
+		drain(drainTimeout)
+	}()
+}
+
+// runService manages the Windows service, flags and arguments given to
+// install are passed to the service on start; -name, to install multiple
+// instances, must come first
+func runService(args []string) {
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+	action, args := args[0], args[1:]
+	name := "goproxy"
+	if len(args) > 1 && (args[0] == "-name" || args[0] == "--name") {
+		name, args = args[1], args[2:]
+	} else if len(args) > 0 && (strings.HasPrefix(args[0], "-name=") || strings.HasPrefix(args[0], "--name=")) {
+		name, args = args[0][strings.IndexByte(args[0], '=')+1:], args[1:]
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to service manager: %v\n", err)
+	}
+	defer m.Disconnect()
+
+	if action == "install" {
+		if len(args) < 2 {
+			usage()
+			os.Exit(1)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatalf("Failed to locate executable: %v\n", err)
+		}
+		s, err := m.CreateService(name, exe, mgr.Config{
+			DisplayName: fmt.Sprintf("goproxy %s", strings.Join(args, " ")),
+			Description: "TCP and UDP proxy",
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			log.Fatalf("Failed to install service `%s`: %v\n", name, err)
+		}
+		s.Close()
+		log.Printf("Installed service `%s`\n", name)
+		return
+	}
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		log.Fatalf("Failed to open service `%s`: %v\n", name, err)
+	}
+	defer s.Close()
+	switch action {
+	case "uninstall":
+		err = s.Delete()
+	case "start":
+		err = s.Start()
+	case "stop":
+		_, err = s.Control(svc.Stop)
+	default:
+		usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("Failed to %s service `%s`: %v\n", action, name, err)
+	}
+	log.Printf("Service `%s`: %s requested\n", name, action)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// sessionLog writes -udp-session-log records past -log-sample and -log-rate,
+// so none of them is lost to sampling
+var sessionLog = log.New(os.Stderr, "", log.LstdFlags)
+
+// setCloseReason records why the connection or session is closed, the first
+// reason given wins
+func (c *trackedConn) setCloseReason(reason string) {
+	connTable.Lock()
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+	connTable.Unlock()
+}
+
+// connCloseReason returns why the connection or session was closed; those
+// closed through the connection table without a reason are killed through
+// the admin API or on shutdown
+func connCloseReason(c *trackedConn) string {
+	connTable.Lock()
+	reason := c.closeReason
+	connTable.Unlock()
+	if reason == "" {
+		reason = "killed"
+		shutdown.Lock()
+		if shutdown.draining {
+			reason = "shutdown"
+		}
+		shutdown.Unlock()
+	}
+	return reason
+}
+
+// logUdpSession writes a record of the session ending, with the datagrams
+// and bytes from the client (in) and the target (out)
+func logUdpSession(c *trackedConn) {
+	reason := connCloseReason(c)
+	client := c.client
+	if client == "" {
+		client = "-"
+	}
+	sessionLog.Printf("[%d] UDP session ended rule=%s client=%s listener=%s target=%s datagrams_in=%d bytes_in=%d datagrams_out=%d bytes_out=%d duration=%v reason=%s\n",
+		c.id, c.rule, client, c.local, c.target, atomic.LoadUint64(&c.pktsIn), atomic.LoadUint64(&c.bytesIn),
+		atomic.LoadUint64(&c.pktsOut), atomic.LoadUint64(&c.bytesOut), time.Since(c.started).Round(time.Millisecond), reason)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sflowBatch      = 8 // samples per datagram
+	sflowFlowSample = 1
+	sflowRawHeader  = 1
+	sflowProtoIpv4  = 11
+	sflowProtoIpv6  = 12
+)
+
+// sflowSample is a sampled read or datagram, with the header of a packet
+// synthesized around it on the client side: from the client to the
+// listener, or from the listener back to the client
+type sflowSample struct {
+	header []byte
+	frame  int
+	pool   uint64
+	v6     bool
+}
+
+var sflow = struct {
+	countdown int64  // reads and datagrams to the next sample, atomically
+	pool      uint64 // reads and datagrams seen, atomically
+	drops     uint64 // samples dropped on a full queue, atomically
+	samples   chan sflowSample
+}{samples: make(chan sflowSample, 1024)}
+
+// sflowSkip returns the count to the next sample, random around -sflow-rate
+// so periodic traffic isn't sampled in step
+func sflowSkip() int64 {
+	return 1 + rand.Int63n(2*int64(sflowRate)-1)
+}
+
+// sample offers data read from the client (in) or the target (!in) for
+// sFlow sampling
+func (c *trackedConn) sample(in bool, p []byte) {
+	if sflowCollector == "" {
+		return
+	}
+	atomic.AddUint64(&sflow.pool, 1)
+	if atomic.AddInt64(&sflow.countdown, -1) != 0 {
+		return
+	}
+	atomic.StoreInt64(&sflow.countdown, sflowSkip())
+	src, srcPort := splitIpPort(c.client)
+	dst, dstPort := splitIpPort(c.local)
+	if src == nil || dst == nil {
+		return
+	}
+	if !in {
+		src, srcPort, dst, dstPort = dst, dstPort, src, srcPort
+	}
+	s := sflowPacket(c.proto, src, dst, srcPort, dstPort, p)
+	s.pool = atomic.LoadUint64(&sflow.pool)
+	select {
+	case sflow.samples <- s:
+	default:
+		atomic.AddUint64(&sflow.drops, 1)
+	}
+}
+
+// sflowPacket builds the IP and TCP or UDP header of a packet carrying
+// payload, truncated to -sflow-header bytes
+func sflowPacket(proto string, src, dst net.IP, srcPort, dstPort uint16, payload []byte) sflowSample {
+	var l4 bytes.Buffer
+	ipProtocol := byte(ipProto)
+	switch proto {
+	case "tcp":
+		ipProtocol = 6
+		// data offset 5 words, PSH and ACK
+		binary.Write(&l4, binary.BigEndian, struct {
+			SrcPort, DstPort uint16
+			Seq, Ack         uint32
+			Flags, Window    uint16
+			Checksum, Urgent uint16
+		}{srcPort, dstPort, 0, 0, 5<<12 | 0x18, 65535, 0, 0})
+	case "udp":
+		ipProtocol = 17
+		binary.Write(&l4, binary.BigEndian, [4]uint16{srcPort, dstPort, uint16(8 + len(payload)), 0})
+	}
+	var pkt bytes.Buffer
+	v6 := src.To4() == nil || dst.To4() == nil
+	length := l4.Len() + len(payload)
+	if v6 {
+		pkt.Write([]byte{0x60, 0, 0, 0})
+		binary.Write(&pkt, binary.BigEndian, uint16(length))
+		pkt.Write([]byte{ipProtocol, 64})
+		pkt.Write(src.To16())
+		pkt.Write(dst.To16())
+	} else {
+		length += 20
+		pkt.Write([]byte{0x45, 0})
+		binary.Write(&pkt, binary.BigEndian, [3]uint16{uint16(length), 0, 0x4000})
+		pkt.Write([]byte{64, ipProtocol, 0, 0})
+		pkt.Write(src.To4())
+		pkt.Write(dst.To4())
+	}
+	frame := pkt.Len() + l4.Len() + len(payload)
+	pkt.Write(l4.Bytes())
+	if len(payload) > sflowHeader {
+		payload = payload[:sflowHeader]
+	}
+	pkt.Write(payload)
+	header := pkt.Bytes()
+	if len(header) > sflowHeader {
+		header = header[:sflowHeader]
+	}
+	return sflowSample{header: header, frame: frame, v6: v6}
+}
+
+// exportSflow sends samples to the collector as sFlow v5 datagrams, a batch
+// at a time or every second
+func exportSflow(ctx context.Context, collector string) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		fatalf(errDial, "Failed to setup sFlow export to `%s`: %v\n", collector, err)
+	}
+	agent := conn.LocalAddr().(*net.UDPAddr).IP
+	atomic.StoreInt64(&sflow.countdown, sflowSkip())
+	var sequence, sampleSequence uint32
+	var batch []sflowSample
+	ticker := systemClock.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-sflow.samples:
+			batch = append(batch, s)
+			if len(batch) < sflowBatch {
+				continue
+			}
+		case <-ticker.Chan():
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		var msg bytes.Buffer
+		if a := agent.To4(); a != nil {
+			binary.Write(&msg, binary.BigEndian, [2]uint32{5, 1})
+			msg.Write(a)
+		} else {
+			binary.Write(&msg, binary.BigEndian, [2]uint32{5, 2})
+			msg.Write(agent.To16())
+		}
+		sequence++
+		binary.Write(&msg, binary.BigEndian, [4]uint32{0, sequence, uint32(time.Since(processStart).Milliseconds()), uint32(len(batch))})
+		drops := uint32(atomic.LoadUint64(&sflow.drops))
+		for _, s := range batch {
+			sampleSequence++
+			proto := uint32(sflowProtoIpv4)
+			if s.v6 {
+				proto = sflowProtoIpv6
+			}
+			pad := (4 - len(s.header)%4) % 4
+			record := 16 + len(s.header) + pad
+			// flow sample: sequence, source ID, sampling rate, sample pool,
+			// drops, input and output interfaces, one raw header record
+			binary.Write(&msg, binary.BigEndian, [2]uint32{sflowFlowSample, uint32(32 + 8 + record)})
+			binary.Write(&msg, binary.BigEndian, [8]uint32{sampleSequence, 1, uint32(sflowRate), uint32(s.pool), drops, 0, 0, 1})
+			binary.Write(&msg, binary.BigEndian, [2]uint32{sflowRawHeader, uint32(record)})
+			binary.Write(&msg, binary.BigEndian, [4]uint32{proto, uint32(s.frame), 0, uint32(len(s.header))})
+			msg.Write(s.header)
+			msg.Write(make([]byte, pad))
+		}
+		if _, err := conn.Write(msg.Bytes()); err != nil {
+			log.Printf("Failed to export sFlow samples to `%s`: %v\n", collector, err)
+		} else if debug.Load() {
+			log.Printf("Exported %d sFlow sample(s) to `%s`\n", len(batch), collector)
+		}
+		batch = batch[:0]
+	}
+}
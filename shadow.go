@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// shadowQueue is the number of client reads waiting for a slow shadow
+	// target before its connection is given up, so it never holds back
+	// the client
+	shadowQueue = 64
+	// shadowLinger is how long the shadow target may take to finish its
+	// responses once the primary connection closed, and with -shadow-compare
+	// the primary target once the client ended its requests
+	shadowLinger = 5 * time.Second
+)
+
+// shadowStats counts connections copied to the -shadow target and, with
+// -shadow-compare, how the responses of both targets compared; responses
+// either target didn't finish are incomplete and not compared
+type shadowStats struct {
+	Connections    uint64 `json:"connections"`
+	Failed         uint64 `json:"failed"`
+	Matched        uint64 `json:"matched"`
+	SizeDiffers    uint64 `json:"size_differs"`
+	ContentDiffers uint64 `json:"content_differs"`
+	Incomplete     uint64 `json:"incomplete"`
+}
+
+var shadowCounters struct {
+	sync.Mutex
+	shadowStats
+}
+
+// responseDigest is the size and hash of all the responses of a target on a
+// connection
+type responseDigest struct {
+	size int64
+	hash hash.Hash
+}
+
+func (d *responseDigest) Write(p []byte) (int, error) {
+	d.size += int64(len(p))
+	if d.hash != nil {
+		d.hash.Write(p)
+	}
+	return len(p), nil
+}
+
+// shadowConn copies the client's data of a connection to the -shadow
+// target; its responses are discarded, or digested to compare with the
+// primary target's
+type shadowConn struct {
+	id         uint64
+	mu         sync.Mutex
+	queue      chan []byte
+	closed     bool           // queue closed, under mu
+	failed     bool           // under mu
+	primary    responseDigest // under mu
+	primaryEOF bool           // the primary target ended its responses, under mu
+	shadow     responseDigest // written by the reader until done
+	shadowEOF  bool           // written by the reader until done
+	done       chan struct{}
+	once       sync.Once
+	// primaryDone is closed once reading the primary target's responses ends
+	primaryDone chan struct{}
+	primaryEnd  sync.Once
+}
+
+// startShadow connects the shadow target in the background, the client
+// isn't held back waiting for it
+func startShadow(ctx context.Context, id uint64) *shadowConn {
+	s := &shadowConn{id: id, queue: make(chan []byte, shadowQueue), done: make(chan struct{}), primaryDone: make(chan struct{})}
+	if shadowCompare {
+		s.primary.hash, s.shadow.hash = sha256.New(), sha256.New()
+	}
+	shadowCounters.Lock()
+	shadowCounters.Connections++
+	shadowCounters.Unlock()
+	go s.run(ctx)
+	return s
+}
+
+func (s *shadowConn) run(ctx context.Context) {
+	defer close(s.done)
+	conn, err := dialTcp(ctx, shadowTarget, nil)
+	if err != nil {
+		s.fail("connection failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	read := make(chan struct{})
+	go func() {
+		_, err := io.Copy(&s.shadow, conn)
+		s.shadowEOF = err == nil
+		close(read)
+	}()
+	for p := range s.queue {
+		conn.SetWriteDeadline(time.Now().Add(shadowLinger))
+		if _, err := conn.Write(p); err != nil {
+			s.fail("write failed: %v", err)
+			return
+		}
+	}
+	// let the shadow target see the end of the requests and finish
+	if cw, ok := unwrapFd(conn).(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	select {
+	case <-read:
+	case <-time.After(shadowLinger):
+		conn.Close()
+		<-read
+	}
+}
+
+func (s *shadowConn) fail(format string, args ...interface{}) {
+	s.mu.Lock()
+	failed := s.failed
+	s.failed = true
+	s.mu.Unlock()
+	if failed {
+		return
+	}
+	shadowCounters.Lock()
+	shadowCounters.Failed++
+	shadowCounters.Unlock()
+	if debug.Load() {
+		log.Printf("[%d] Shadow `%s` "+format+"\n", append([]interface{}{s.id, shadowTarget}, args...)...)
+	}
+}
+
+// send queues a copy of client data, giving up the shadow when it lags
+func (s *shadowConn) send(p []byte) {
+	s.mu.Lock()
+	if s.closed || s.failed {
+		s.mu.Unlock()
+		return
+	}
+	select {
+	case s.queue <- append([]byte(nil), p...):
+		s.mu.Unlock()
+	default:
+		s.mu.Unlock()
+		s.fail("is too slow, giving up")
+	}
+}
+
+// finish ends the requests to the shadow target once the primary connection
+// closed and, with -shadow-compare, compares the responses when the shadow
+// target is done
+func (s *shadowConn) finish() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		close(s.queue)
+		s.mu.Unlock()
+		if shadowCompare {
+			go s.compare()
+		}
+	})
+}
+
+func (s *shadowConn) compare() {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed {
+		return
+	}
+	primary, shadow := s.primary, s.shadow
+	result := "match"
+	if !s.primaryEOF || !s.shadowEOF {
+		// cut short by a timeout, an error or the proxy, comparing would
+		// report divergence that isn't there
+		result = "incomplete"
+	} else if primary.size != shadow.size {
+		result = "size"
+	} else if !bytes.Equal(primary.hash.Sum(nil), shadow.hash.Sum(nil)) {
+		result = "content"
+	}
+	shadowCounters.Lock()
+	switch result {
+	case "match":
+		shadowCounters.Matched++
+	case "incomplete":
+		shadowCounters.Incomplete++
+	case "size":
+		shadowCounters.SizeDiffers++
+	default:
+		shadowCounters.ContentDiffers++
+	}
+	shadowCounters.Unlock()
+	if result == "incomplete" && debug.Load() {
+		log.Printf("[%d] Shadow `%s` responses incomplete, not compared: %d bytes, primary %d bytes\n", s.id, shadowTarget, shadow.size, primary.size)
+	}
+	if result == "match" || result == "incomplete" {
+		return
+	}
+	if verbose.Load() {
+		log.Printf("[%d] Shadow `%s` responses differ in %s: %d bytes, primary %d bytes\n", s.id, shadowTarget, result, shadow.size, primary.size)
+	}
+	publishEvent("shadow.diverge", func() interface{} {
+		return map[string]interface{}{"id": s.id, "shadow": shadowTarget, "differs": result, "bytes": shadow.size, "primary_bytes": primary.size}
+	})
+}
+
+// requests copies the client's data read to the shadow target
+func (s *shadowConn) requests(r io.Reader) io.Reader {
+	return shadowReader{r: r, copy: func(p []byte) { s.send(p) }}
+}
+
+// responses digests the primary target's data read, until it ends
+func (s *shadowConn) responses(r io.Reader) io.Reader {
+	return shadowReader{r, func(p []byte) {
+		s.mu.Lock()
+		s.primary.Write(p)
+		s.mu.Unlock()
+	}, func(err error) {
+		s.mu.Lock()
+		s.primaryEOF = err == io.EOF
+		s.mu.Unlock()
+		s.primaryEnd.Do(func() { close(s.primaryDone) })
+	}}
+}
+
+// awaitPrimary lets the primary target finish its responses once the
+// client ended its requests, as the shadow target may, so responses cut
+// short by closing the connection aren't compared
+func (s *shadowConn) awaitPrimary(fwd net.Conn) {
+	if cw, ok := unwrapFd(fwd).(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	fwd.SetReadDeadline(time.Now().Add(shadowLinger))
+	select {
+	case <-s.primaryDone:
+	case <-time.After(shadowLinger):
+	}
+}
+
+// toClient keeps the primary target's responses flowing into the digest
+// when the client can no longer take them
+func (s *shadowConn) toClient(w io.Writer) io.Writer {
+	return &discardingWriter{w: w}
+}
+
+type discardingWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (d *discardingWriter) Write(p []byte) (int, error) {
+	if !d.failed {
+		if _, err := d.w.Write(p); err != nil {
+			d.failed = true
+		}
+	}
+	return len(p), nil
+}
+
+type shadowReader struct {
+	r    io.Reader
+	copy func([]byte)
+	end  func(error) // optional
+}
+
+func (r shadowReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.copy(p[:n])
+	}
+	if err != nil && r.end != nil {
+		r.end(err)
+	}
+	return n, err
+}
+
+// shadowReport returns the shadow counters, nil without -shadow
+func shadowReport() *shadowStats {
+	if shadowTarget == "" {
+		return nil
+	}
+	shadowCounters.Lock()
+	defer shadowCounters.Unlock()
+	stats := shadowCounters.shadowStats
+	return &stats
+}
+
+// validShadowTarget checks -shadow is host:port
+func validShadowTarget(target string) bool {
+	_, port, err := net.SplitHostPort(target)
+	return err == nil && port != ""
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// shutdown tracks listeners to close when the proxy is stopped gracefully
+var shutdown = struct {
+	sync.Mutex
+	listeners []io.Closer
+	draining  bool
+	done      chan struct{}
+	// goroutines writing out what they hold once serveCtx is cancelled,
+	// waited for before exiting
+	flushing sync.WaitGroup
+}{done: make(chan struct{})}
+
+// serveCtx is the root context of goroutines serving the proxy: managers,
+// resolvers, forwarders and periodic tasks; cancelled on shutdown once
+// connections are closed
+var serveCtx, cancelServe = context.WithCancel(context.Background())
+
+func addListener(l io.Closer) {
+	shutdown.Lock()
+	shutdown.listeners = append(shutdown.listeners, l)
+	shutdown.Unlock()
+}
+
+// drain stops accepting new connections and waits up to timeout for TCP
+// connections to finish, then closes the remaining connections and UDP
+// sessions
+func drain(timeout time.Duration) {
+	shutdown.Lock()
+	if shutdown.draining {
+		shutdown.Unlock()
+		return
+	}
+	shutdown.draining = true
+	for _, l := range shutdown.listeners {
+		l.Close()
+	}
+	shutdown.Unlock()
+	stopHealthFile()
+	releaseLeadership()
+
+	tcpConns := func() (n int) {
+		for _, c := range listConns() {
+			if c.Proto == "tcp" {
+				n++
+			}
+		}
+		return
+	}
+	log.Printf("Shutting down, waiting up to %v for %d connection(s) to finish\n", timeout, tcpConns())
+	deadline := time.Now().Add(timeout)
+	for tcpConns() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	killed := 0
+	for _, c := range listConns() {
+		killed += killConns(c.Id, "")
+	}
+	if verbose.Load() && killed > 0 {
+		log.Printf("Closed %d connection(s) and session(s) still open\n", killed)
+	}
+	cancelServe()
+	shutdown.flushing.Wait()
+	if statsFile != "" {
+		if err := saveStats(statsFile); err != nil {
+			log.Printf("Failed to save stats to `%s`: %v\n", statsFile, err)
+		}
+	}
+	removePidFile()
+	removeAdminSocket()
+	close(shutdown.done)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// closeSlowClients closes TCP connections that transferred fewer than
+// -slow-bytes, both directions combined, over the last -slow-interval, so
+// near-idle sockets held open by slow-loris clients don't pile up; a
+// connection is checked once it was open for a whole interval
+func closeSlowClients(ctx context.Context) {
+	ticker := systemClock.NewTicker(slowInterval)
+	defer ticker.Stop()
+	last := make(map[uint64]uint64)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+		var slow []*trackedConn
+		seen := make(map[uint64]uint64)
+		connTable.Lock()
+		for id, c := range connTable.conns {
+			// bytes the kernel forwards are counted on close
+			if c.proto != "tcp" || c.spliced {
+				continue
+			}
+			bytes := atomic.LoadUint64(&c.bytesIn) + atomic.LoadUint64(&c.bytesOut)
+			if prev, ok := last[id]; ok && bytes-prev < slowBytes {
+				slow = append(slow, c)
+			}
+			seen[id] = bytes
+		}
+		connTable.Unlock()
+		last = seen
+
+		for _, c := range slow {
+			if verbose.Load() {
+				log.Printf("[%d] Connection from `%s` transferred less than %d bytes in %v, closing\n", c.id, c.client, slowBytes, slowInterval)
+			}
+			accounting.Lock()
+			accounting.Slow++
+			accounting.Unlock()
+			if addr, err := net.ResolveTCPAddr("tcp", c.client); err == nil {
+				recordClient(addr, 0, 1, "slow connections")
+			}
+			c.close()
+		}
+	}
+}
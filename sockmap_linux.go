@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sockmap holds the eBPF maps and programs of -sockmap: peers maps the
+// address tuple of a socket to the tuple of the other socket of its pair,
+// redirect holds the sockets data is redirected to, and sockets added to
+// attached have their data passed to the programs
+var sockmap struct {
+	ready                     bool
+	peers, redirect, attached int
+}
+
+const (
+	sockKeySize  = 40
+	sockMapSize  = 65536
+	bpfFuncRedir = 72 // bpf_sk_redirect_hash
+	skPass       = 1
+)
+
+// TCP states after a FIN was received
+const (
+	tcpTimeWait  = 6
+	tcpCloseWait = 8
+	tcpLastAck   = 9
+	tcpClosing   = 11
+)
+
+// sockKey is the tuple of a socket as the verdict program builds it from
+// __sk_buff: remote and local address, IPv4 in the first word, then the
+// remote port in network byte order shifted by 16 bits and the local port
+// in host byte order
+type sockKey [sockKeySize]byte
+
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+var bigEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 0
+}()
+
+func insn(code uint8, dst, src uint8, off int16, imm int32) bpfInsn {
+	if bigEndian {
+		return bpfInsn{code, dst<<4 | src, off, imm}
+	}
+	return bpfInsn{code, src<<4 | dst, off, imm}
+}
+
+func ldxw(dst, src uint8, off int16) bpfInsn {
+	return insn(unix.BPF_LDX|unix.BPF_MEM|unix.BPF_W, dst, src, off, 0)
+}
+
+func stxw(dst, src uint8, off int16) bpfInsn {
+	return insn(unix.BPF_STX|unix.BPF_MEM|unix.BPF_W, dst, src, off, 0)
+}
+
+func movImm(dst uint8, imm int32) bpfInsn {
+	return insn(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_K, dst, 0, 0, imm)
+}
+
+func movReg(dst, src uint8) bpfInsn {
+	return insn(unix.BPF_ALU64|unix.BPF_MOV|unix.BPF_X, dst, src, 0, 0)
+}
+
+func ldMap(dst uint8, fd int) []bpfInsn {
+	return []bpfInsn{insn(unix.BPF_LD|unix.BPF_IMM|unix.BPF_DW, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd)), {}}
+}
+
+func call(fn int32) bpfInsn {
+	return insn(unix.BPF_JMP|unix.BPF_CALL, 0, 0, 0, fn)
+}
+
+func exit() bpfInsn {
+	return insn(unix.BPF_JMP|unix.BPF_EXIT, 0, 0, 0, 0)
+}
+
+// __sk_buff offsets
+const (
+	skbLen        = 0
+	skbFamily     = 88
+	skbRemoteIp4  = 92
+	skbLocalIp4   = 96
+	skbRemoteIp6  = 100
+	skbLocalIp6   = 116
+	skbRemotePort = 132
+	skbLocalPort  = 136
+)
+
+// verdictProgram redirects data to the egress of the peer socket, or
+// passes it to the socket itself when the socket has no peer
+func verdictProgram(peers, redirect int) []bpfInsn {
+	const key = -sockKeySize
+	prog := []bpfInsn{movReg(6, 1)}
+	for off := int16(key); off < 0; off += 8 {
+		prog = append(prog, insn(unix.BPF_ST|unix.BPF_MEM|unix.BPF_DW, 10, 0, off, 0))
+	}
+	ip4 := []bpfInsn{
+		ldxw(3, 6, skbRemoteIp4), stxw(10, 3, key),
+		ldxw(3, 6, skbLocalIp4), stxw(10, 3, key+16),
+	}
+	var ip6 []bpfInsn
+	for i := int16(0); i < 16; i += 4 {
+		ip6 = append(ip6, ldxw(3, 6, skbRemoteIp6+i), stxw(10, 3, key+i))
+		ip6 = append(ip6, ldxw(3, 6, skbLocalIp6+i), stxw(10, 3, key+16+i))
+	}
+	prog = append(prog, ldxw(2, 6, skbFamily),
+		insn(unix.BPF_JMP|unix.BPF_JNE|unix.BPF_K, 2, 0, int16(len(ip4)+1), unix.AF_INET))
+	prog = append(prog, ip4...)
+	prog = append(prog, insn(unix.BPF_JMP|unix.BPF_JA, 0, 0, int16(len(ip6)), 0))
+	prog = append(prog, ip6...)
+	prog = append(prog,
+		ldxw(3, 6, skbRemotePort), stxw(10, 3, key+32),
+		ldxw(3, 6, skbLocalPort), stxw(10, 3, key+36))
+	prog = append(prog, ldMap(1, peers)...)
+	prog = append(prog,
+		movReg(2, 10),
+		insn(unix.BPF_ALU64|unix.BPF_ADD|unix.BPF_K, 2, 0, 0, key),
+		call(1), // bpf_map_lookup_elem
+		insn(unix.BPF_JMP|unix.BPF_JNE|unix.BPF_K, 0, 0, 2, 0),
+		movImm(0, skPass),
+		exit(),
+		movReg(1, 6))
+	prog = append(prog, ldMap(2, redirect)...)
+	return append(prog, movReg(3, 0), movImm(4, 0), call(bpfFuncRedir), exit())
+}
+
+// parserProgram makes every received chunk a message of its own
+func parserProgram() []bpfInsn {
+	return []bpfInsn{ldxw(0, 1, skbLen), exit()}
+}
+
+// bpfPtr is a pointer field of bpf_attr, 64-bit on all platforms; it's kept
+// as a pointer for the runtime to adjust it if the stack moves
+type bpfPtr [8 / unsafe.Sizeof(uintptr(0))]unsafe.Pointer
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func bpfMap(mapType, keySize, valueSize uint32) (int, error) {
+	attr := struct{ mapType, keySize, valueSize, maxEntries, flags uint32 }{mapType, keySize, valueSize, sockMapSize, 0}
+	return bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfProg(prog []bpfInsn) (int, error) {
+	license := []byte("Apache-2.0\x00")
+	logBuf := make([]byte, 4096)
+	attr := struct {
+		progType, insnCnt   uint32
+		insns, license      bpfPtr
+		logLevel, logSize   uint32
+		logBuf              bpfPtr
+		kernVersion, flags  uint32
+		name                [16]byte
+		ifindex, attachType uint32
+	}{
+		progType: unix.BPF_PROG_TYPE_SK_SKB,
+		insnCnt:  uint32(len(prog)),
+		insns:    bpfPtr{unsafe.Pointer(&prog[0])},
+		license:  bpfPtr{unsafe.Pointer(&license[0])},
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   bpfPtr{unsafe.Pointer(&logBuf[0])},
+	}
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil && debug.Load() {
+		log.Printf("eBPF verifier log: %s\n", logBuf[:clen(logBuf)])
+	}
+	return fd, err
+}
+
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+func bpfAttach(mapFd, progFd int, attachType uint32) error {
+	attr := struct{ target, prog, attachType, flags uint32 }{uint32(mapFd), uint32(progFd), attachType, 0}
+	_, err := bpf(unix.BPF_PROG_ATTACH, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfUpdate(mapFd int, key *sockKey, value unsafe.Pointer) error {
+	attr := struct {
+		mapFd, _   uint32
+		key, value bpfPtr
+		flags      uint64
+	}{mapFd: uint32(mapFd), key: bpfPtr{unsafe.Pointer(key)}, value: bpfPtr{value}}
+	_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfDelete(mapFd int, key *sockKey) {
+	attr := struct {
+		mapFd, _ uint32
+		key      bpfPtr
+	}{mapFd: uint32(mapFd), key: bpfPtr{unsafe.Pointer(key)}}
+	bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// initSockmap creates the maps and loads the programs, when it fails
+// connections are copied in userspace as without -sockmap
+func initSockmap() {
+	err := func() (err error) {
+		if sockmap.peers, err = bpfMap(unix.BPF_MAP_TYPE_HASH, sockKeySize, sockKeySize); err != nil {
+			return fmt.Errorf("peers map: %v", err)
+		}
+		if sockmap.redirect, err = bpfMap(unix.BPF_MAP_TYPE_SOCKHASH, sockKeySize, 4); err != nil {
+			return fmt.Errorf("redirect map: %v", err)
+		}
+		if sockmap.attached, err = bpfMap(unix.BPF_MAP_TYPE_SOCKHASH, sockKeySize, 4); err != nil {
+			return fmt.Errorf("attached map: %v", err)
+		}
+		parser, err := bpfProg(parserProgram())
+		if err != nil {
+			return fmt.Errorf("parser program: %v", err)
+		}
+		verdict, err := bpfProg(verdictProgram(sockmap.peers, sockmap.redirect))
+		if err != nil {
+			return fmt.Errorf("verdict program: %v", err)
+		}
+		if err = bpfAttach(sockmap.attached, parser, unix.BPF_SK_SKB_STREAM_PARSER); err != nil {
+			return fmt.Errorf("attaching parser: %v", err)
+		}
+		if err = bpfAttach(sockmap.attached, verdict, unix.BPF_SK_SKB_STREAM_VERDICT); err != nil {
+			return fmt.Errorf("attaching verdict: %v", err)
+		}
+		return nil
+	}()
+	if err != nil {
+		log.Printf("eBPF sockmap is not available, copying in userspace: %v\n", err)
+		return
+	}
+	sockmap.ready = true
+	if verbose.Load() {
+		log.Printf("Splicing TCP connections with eBPF sockmap\n")
+	}
+}
+
+// splicedSocket is one side of a spliced pair
+type splicedSocket struct {
+	conn    *net.TCPConn
+	key     sockKey
+	written uint64 // bytes sent and queued when spliced
+}
+
+// splicedPair is a client and target connection pair the kernel forwards
+// between
+type splicedPair struct {
+	client, target splicedSocket
+}
+
+func sockFd(conn *net.TCPConn, f func(fd int)) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return raw.Control(func(fd uintptr) { f(int(fd)) })
+}
+
+func newSplicedSocket(conn *net.TCPConn) (s splicedSocket, err error) {
+	s.conn = conn
+	local, remote := conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr)
+	ctlErr := sockFd(conn, func(fd int) {
+		var family int
+		if family, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN); err != nil {
+			return
+		}
+		if family == unix.AF_INET {
+			copy(s.key[0:4], remote.IP.To4())
+			copy(s.key[16:20], local.IP.To4())
+		} else {
+			copy(s.key[0:16], remote.IP.To16())
+			copy(s.key[16:32], local.IP.To16())
+		}
+		binary.BigEndian.PutUint16(s.key[34:36], uint16(remote.Port))
+		*(*uint32)(unsafe.Pointer(&s.key[36])) = uint32(local.Port)
+		s.written, _ = socketWritten(fd)
+	})
+	if ctlErr != nil {
+		err = ctlErr
+	}
+	return
+}
+
+// socketWritten returns bytes acknowledged by the peer plus those in the
+// send queue
+func socketWritten(fd int) (uint64, error) {
+	info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return 0, err
+	}
+	queued, err := unix.IoctlGetInt(fd, unix.SIOCOUTQ)
+	if err != nil {
+		return 0, err
+	}
+	return info.Bytes_acked + uint64(queued), nil
+}
+
+// socketReceived returns bytes received, without the FIN which is counted
+// as a byte once the peer closed its side
+func socketReceived(conn *net.TCPConn) (received uint64) {
+	sockFd(conn, func(fd int) {
+		if info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO); err == nil {
+			received = info.Bytes_received
+			switch info.State {
+			case tcpTimeWait, tcpCloseWait, tcpLastAck, tcpClosing:
+				if received > 0 {
+					received--
+				}
+			}
+		}
+	})
+	return
+}
+
+// spliceTcp hands forwarding between the connections to the kernel; the
+// sockets are added to the redirect map before either gets the programs
+// attached, so no data is passed before its peer can take it; nil when
+// either can't be spliced and the pair is to be copied
+func spliceTcp(client, target net.Conn) *splicedPair {
+	if !sockmap.ready {
+		return nil
+	}
+	c, ok1 := unwrapFd(client).(*net.TCPConn)
+	t, ok2 := unwrapFd(target).(*net.TCPConn)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	var p splicedPair
+	var err error
+	if p.client, err = newSplicedSocket(c); err != nil {
+		return nil
+	}
+	if p.target, err = newSplicedSocket(t); err != nil {
+		return nil
+	}
+	if err = bpfUpdate(sockmap.peers, &p.client.key, unsafe.Pointer(&p.target.key)); err != nil {
+		return nil
+	}
+	if err = bpfUpdate(sockmap.peers, &p.target.key, unsafe.Pointer(&p.client.key)); err != nil {
+		bpfDelete(sockmap.peers, &p.client.key)
+		return nil
+	}
+	type entry struct {
+		m   int
+		key *sockKey
+	}
+	var added []entry
+	for _, m := range []int{sockmap.redirect, sockmap.attached} {
+		for _, s := range []*splicedSocket{&p.client, &p.target} {
+			if ctlErr := sockFd(s.conn, func(fd int) {
+				value := uint32(fd)
+				err = bpfUpdate(m, &s.key, unsafe.Pointer(&value))
+			}); ctlErr != nil {
+				err = ctlErr
+			}
+			if err != nil {
+				// with one side spliced and the other not, data would be
+				// passed to a socket nobody forwards from; take the pair
+				// out of the maps and leave it to be copied
+				if debug.Load() {
+					log.Printf("Failed to splice `%s`: %v\n", s.conn.RemoteAddr(), err)
+				}
+				for i := len(added) - 1; i >= 0; i-- {
+					bpfDelete(added[i].m, added[i].key)
+				}
+				bpfDelete(sockmap.peers, &p.client.key)
+				bpfDelete(sockmap.peers, &p.target.key)
+				return nil
+			}
+			added = append(added, entry{m, &s.key})
+		}
+	}
+	return &p
+}
+
+// forwarded returns bytes received from one side, on EOF it waits up to
+// -timeout for the kernel to pass them all to the other side before the
+// pair is closed
+func (p *splicedPair) forwarded(fromClient, eof bool) int64 {
+	from, to := p.target, p.client
+	if fromClient {
+		from, to = p.client, p.target
+	}
+	received := socketReceived(from.conn)
+	for deadline := time.Now().Add(timeout); eof && time.Now().Before(deadline); {
+		var written uint64
+		if sockFd(to.conn, func(fd int) { written, _ = socketWritten(fd) }) != nil || written-to.written >= received {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return int64(received)
+}
+
+// unsplice removes the pair from the peers map and returns bytes received
+// from the client and the target; the sockets leave the other maps when
+// closed
+func (p *splicedPair) unsplice() (in, out uint64) {
+	bpfDelete(sockmap.peers, &p.client.key)
+	bpfDelete(sockmap.peers, &p.target.key)
+	return socketReceived(p.client.conn), socketReceived(p.target.conn)
+}
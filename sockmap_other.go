@@ -0,0 +1,26 @@
+//go:build !linux
+
+package main
+
+import (
+	"log"
+	"net"
+)
+
+type splicedPair struct{}
+
+func initSockmap() {
+	log.Printf("eBPF sockmap is only supported on Linux, copying in userspace\n")
+}
+
+func spliceTcp(client, target net.Conn) *splicedPair {
+	return nil
+}
+
+func (p *splicedPair) forwarded(fromClient, eof bool) int64 {
+	return 0
+}
+
+func (p *splicedPair) unsplice() (in, out uint64) {
+	return 0, 0
+}
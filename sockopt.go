@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var listenFamilies = map[string]bool{"auto": true, "ipv4": true, "ipv6": true, "dual": true}
+
+// listenNetwork returns the network to listen on for -listen-family: ipv4
+// and ipv6 restrict wildcard binds to one family, the latter setting
+// IPV6_V6ONLY, while auto leaves the choice to Go, which binds dual-stack
+// where IPv4-mapped addresses are supported
+func listenNetwork(proto string) string {
+	switch listenFamily {
+	case "ipv4":
+		return proto + "4"
+	case "ipv6", "dual":
+		return proto + "6"
+	}
+	return proto
+}
+
+// listenConfig clears IPV6_V6ONLY for dual, so a wildcard bind fails rather
+// than silently falling back to a single family; with -mark-downstream
+// listeners are marked, accepted connections inherit the marks and the
+// buffer sizes of -listen-opts
+func listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			if listenFamily == "dual" {
+				err = setV6Only(fd, false)
+			}
+			if err == nil && markDownstream {
+				err = markSocket(fd)
+			}
+			if err == nil {
+				err = setListenOpts(network, fd)
+			}
+		})
+		return err
+	}}
+}
+
+// markSocket sets -tos and -fwmark on a socket
+func markSocket(fd uintptr) error {
+	if tos >= 0 {
+		if err := setTos(fd, tos); err != nil {
+			return fmt.Errorf("failed to set TOS: %v", err)
+		}
+	}
+	if fwmark > 0 {
+		if err := setMark(fd, fwmark); err != nil {
+			return fmt.Errorf("failed to set SO_MARK: %v", err)
+		}
+	}
+	return nil
+}
+
+// upstreamControl marks sockets to targets; with -source-ports it allows
+// reusing ports of TCP connections in TIME_WAIT, a connect with an identical
+// address pair fails and the next port is tried; UDP sockets would share the
+// port
+func upstreamControl(network, address string, c syscall.RawConn) error {
+	var err error
+	c.Control(func(fd uintptr) {
+		if err = markSocket(fd); err == nil && len(sourcePorts) > 0 && strings.HasPrefix(network, "tcp") {
+			err = setReuseAddr(fd)
+		}
+	})
+	return err
+}
+
+// dialSlots limits upstream TCP dials in flight to -max-dials, so a flood of
+// clients during a backend brownout waits in queue instead of sending
+// thousands of SYNs and exhausting ephemeral ports
+var dialSlots chan struct{}
+
+var errDialQueue = errors.New("too many connections in progress, timed out waiting in queue")
+
+// dialTcp connects to the target within the dial timeout of the target or
+// of the listener the client connection was accepted on; client is nil for
+// connections of goproxy's own, which are never multiplexed
+func dialTcp(ctx context.Context, target string, client net.Conn) (conn net.Conn, err error) {
+	var local net.Addr
+	if client != nil {
+		local = client.LocalAddr()
+		if muxMode == "dial" {
+			conn, err = openMuxStream(ctx, target, client)
+			if ctx.Err() == nil {
+				recordAttempt(target, err != nil)
+			}
+			return conn, err
+		}
+	}
+	if dialSlots != nil {
+		select {
+		case dialSlots <- struct{}{}:
+		default:
+			wait := time.NewTimer(timeout)
+			select {
+			case dialSlots <- struct{}{}:
+				wait.Stop()
+			case <-wait.C:
+				return nil, errDialQueue
+			case <-ctx.Done():
+				wait.Stop()
+				return nil, ctx.Err()
+			}
+		}
+		defer func() { <-dialSlots }()
+	}
+	start := time.Now()
+	if isNpipe(target) {
+		conn, err = upstreamDial(ctx, nil, "npipe", target)
+	} else if via != nil {
+		conn, err = upstreamDial(ctx, nil, "via", target)
+	} else if mptcp == "dial" || mptcp == "both" {
+		conn, err = upstreamDial(ctx, &net.Dialer{Timeout: dialTimeout(target, local)}, "mptcp", nat64Addr(ctx, target))
+	} else if sctp == "dial" || sctp == "both" {
+		conn, err = upstreamDial(ctx, &net.Dialer{Timeout: dialTimeout(target, local)}, "sctp", nat64Addr(ctx, target))
+	} else {
+		dialCtx, cancel := context.WithTimeout(ctx, dialTimeout(target, local))
+		conn, err = dialUpstream(dialCtx, "tcp", target)
+		cancel()
+	}
+	// only connections of clients count against the error budget
+	if client != nil && ctx.Err() == nil {
+		recordAttempt(target, err != nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if client != nil {
+		recordDial(target, time.Since(start))
+	}
+	return countFd(conn), nil
+}
+
+// dialer returns a dialer for upstream connections with -timeout, marked with
+// -tos and -fwmark
+func dialer() *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Control: upstreamControl}
+}
+
+func listen(proto, addr string) (net.Listener, error) {
+	if isNpipe(addr) {
+		return listenNpipe(npipePath(addr))
+	}
+	if proto == "tcp" && (mptcp == "listen" || mptcp == "both") {
+		return listenMptcp(addr)
+	}
+	if proto == "tcp" && (sctp == "listen" || sctp == "both") {
+		return listenSctp(addr)
+	}
+	l, err := listenConfig().Listen(context.Background(), listenNetwork(proto), addr)
+	if err == nil {
+		if err = setListenBacklog(l); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, err
+}
+
+func listenUdp(addr string) (*net.UDPConn, error) {
+	conn, err := listenConfig().ListenPacket(context.Background(), listenNetwork("udp"), addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
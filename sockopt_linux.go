@@ -0,0 +1,28 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setMark(fd uintptr, mark uint) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+}
+
+// setFreebind allows binding to an address not assigned to the host yet,
+// one of them fails depending on the socket family
+func setFreebind(fd uintptr) error {
+	err4 := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+	err6 := syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, unix.IPV6_FREEBIND, 1)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// setDeferAccept wakes up accept only once the client sent data, or after
+// seconds
+func setDeferAccept(fd uintptr, seconds int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, seconds)
+}
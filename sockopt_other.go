@@ -0,0 +1,17 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+func setMark(fd uintptr, mark uint) error {
+	return errors.New("only supported on Linux")
+}
+
+func setFreebind(fd uintptr) error {
+	return errors.New("only supported on Linux")
+}
+
+func setDeferAccept(fd uintptr, seconds int) error {
+	return errors.New("only supported on Linux")
+}
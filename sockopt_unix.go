@@ -0,0 +1,41 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// setTos sets the IPv6 traffic class and the IPv4 TOS, one of them fails
+// depending on the socket family
+func setTos(fd uintptr, tos int) error {
+	err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+func setReuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+func setV6Only(fd uintptr, v6only bool) error {
+	value := 0
+	if v6only {
+		value = 1
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, value)
+}
+
+func setRcvbuf(fd uintptr, size int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+}
+
+func setSndbuf(fd uintptr, size int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, size)
+}
+
+// setBacklog listens again on a listening socket, which updates the backlog
+func setBacklog(fd uintptr, backlog int) error {
+	return syscall.Listen(int(fd), backlog)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setTos is not supported, Windows ignores IP_TOS; use QoS policies instead
+func setTos(fd uintptr, tos int) error {
+	return errors.New("not supported on Windows")
+}
+
+func setMark(fd uintptr, mark uint) error {
+	return errors.New("not supported on Windows")
+}
+
+// setReuseAddr does nothing, on Windows SO_REUSEADDR allows to steal ports
+// actively in use
+func setReuseAddr(fd uintptr) error {
+	return nil
+}
+
+func setV6Only(fd uintptr, v6only bool) error {
+	value := 0
+	if v6only {
+		value = 1
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, value)
+}
+
+func setRcvbuf(fd uintptr, size int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+}
+
+func setSndbuf(fd uintptr, size int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, size)
+}
+
+func setFreebind(fd uintptr) error {
+	return errors.New("not supported on Windows")
+}
+
+func setDeferAccept(fd uintptr, seconds int) error {
+	return errors.New("not supported on Windows")
+}
+
+// setBacklog is not supported, Windows doesn't allow listening again
+func setBacklog(fd uintptr, backlog int) error {
+	return errors.New("not supported on Windows")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ports tried per connection before giving up, binding a port in use fails
+// immediately
+const sourcePortTries = 64
+
+// sourcePorts are local ports for connections to targets from -source-ports,
+// for firewalls permitting only specific source ports
+var sourcePorts []int
+
+// parseSourcePorts parses a comma-separated list of ports and `low-high`
+// ranges
+func parseSourcePorts(spec string) error {
+	for _, p := range parseTargetList(spec) {
+		if strings.Contains(p, "-") {
+			low, high, err := parsePortRange(p)
+			if err != nil {
+				return err
+			}
+			for port := low; port <= high; port++ {
+				sourcePorts = append(sourcePorts, port)
+			}
+			continue
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port `%s`", p)
+		}
+		sourcePorts = append(sourcePorts, port)
+	}
+	return nil
+}
+
+// trySourcePorts calls bind with source ports starting at a random one until
+// it succeeds or fails for a reason other than the port being in use
+func trySourcePorts(bind func(port int) error) error {
+	start := rand.Intn(len(sourcePorts))
+	var err error
+	for i := 0; i < len(sourcePorts) && i < sourcePortTries; i++ {
+		err = bind(sourcePorts[(start+i)%len(sourcePorts)])
+		if !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+			return err
+		}
+	}
+	return fmt.Errorf("no free source port: %v", err)
+}
+
+// dialUpstream connects to a target, from a port of -source-ports if set
+func dialUpstream(ctx context.Context, network, target string) (conn net.Conn, err error) {
+	d := dialer()
+	if _, ok := ctx.Deadline(); ok {
+		// the caller's deadline may be longer than -timeout
+		d.Timeout = 0
+	}
+	target = nat64Addr(ctx, target)
+	if len(sourcePorts) == 0 {
+		return upstreamDial(ctx, d, network, target)
+	}
+	err = trySourcePorts(func(port int) error {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{Port: port}
+		} else {
+			d.LocalAddr = &net.TCPAddr{Port: port}
+		}
+		var err error
+		conn, err = upstreamDial(ctx, d, network, target)
+		return err
+	})
+	return
+}
+
+// listenUpstream opens an unconnected UDP socket to send to targets, bound to
+// a port of -source-ports if set
+func listenUpstream() (conn *net.UDPConn, err error) {
+	lc := net.ListenConfig{Control: upstreamControl}
+	bind := func(port int) error {
+		c, err := lc.ListenPacket(context.Background(), "udp", ":"+strconv.Itoa(port))
+		if err == nil {
+			conn = c.(*net.UDPConn)
+		}
+		return err
+	}
+	if len(sourcePorts) == 0 {
+		err = bind(0)
+	} else {
+		err = trySourcePorts(bind)
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshVia is the connection to an ssh:// -via jump host shared by tunnels,
+// each is a direct-tcpip channel; it's reopened after the host drops it
+var sshVia struct {
+	sync.Mutex
+	client   *ssh.Client
+	user     string
+	auth     []ssh.AuthMethod
+	hostKeys ssh.HostKeyCallback
+}
+
+// initSshVia loads the -via-key private key and the known hosts file before
+// privileges are dropped
+func initSshVia() error {
+	sshVia.user = via.User.Username()
+	if sshVia.user == "" {
+		current, err := user.Current()
+		if err != nil {
+			return err
+		}
+		sshVia.user = current.Username
+	}
+	if viaKey != "" {
+		pem, err := os.ReadFile(viaKey)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return fmt.Errorf("%s: %v", viaKey, err)
+		}
+		sshVia.auth = append(sshVia.auth, ssh.PublicKeys(signer))
+	}
+	if password, ok := via.User.Password(); ok {
+		sshVia.auth = append(sshVia.auth, ssh.Password(password))
+	}
+	path := viaKnownHosts
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	var err error
+	sshVia.hostKeys, err = knownhosts.New(path)
+	return err
+}
+
+// dialSsh opens a channel to the target through the jump host, connecting
+// again once when the shared connection turns out to be gone
+func dialSsh(ctx context.Context, target string) (net.Conn, error) {
+	for retry := true; ; retry = false {
+		sshVia.Lock()
+		client := sshVia.client
+		var err error
+		if client == nil {
+			if client, err = connectSsh(ctx); err == nil {
+				sshVia.client = client
+				go func() {
+					err := client.Wait()
+					sshVia.Lock()
+					if sshVia.client == client {
+						sshVia.client = nil
+					}
+					sshVia.Unlock()
+					if verbose.Load() {
+						log.Printf("SSH connection to `%s` closed: %v\n", via.Host, err)
+					}
+				}()
+			}
+			retry = false
+		}
+		sshVia.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		conn, err := client.DialContext(dialCtx, "tcp", target)
+		cancel()
+		if err == nil || !retry {
+			return conn, err
+		}
+		if _, refused := err.(*ssh.OpenChannelError); refused {
+			return nil, err
+		}
+		// the connection is likely dead, close it to reconnect
+		client.Close()
+		sshVia.Lock()
+		if sshVia.client == client {
+			sshVia.client = nil
+		}
+		sshVia.Unlock()
+	}
+}
+
+// connectSsh connects and authenticates to the jump host, with the keys of
+// ssh-agent when SSH_AUTH_SOCK is set
+func connectSsh(ctx context.Context) (*ssh.Client, error) {
+	auth := sshVia.auth
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		// the agent signs during the handshake, keep it connected until then
+		if agentConn, err := net.Dial("unix", sock); err == nil {
+			defer agentConn.Close()
+			auth = append([]ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers)}, auth...)
+		} else if verbose.Load() {
+			log.Printf("Failed to connect to ssh-agent: %v\n", err)
+		}
+	}
+	conn, err := dialUpstream(ctx, "tcp", via.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, via.Host, &ssh.ClientConfig{
+		User:            sshVia.user,
+		Auth:            auth,
+		HostKeyCallback: sshVia.hostKeys,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if verbose.Load() {
+		log.Printf("SSH connection to `%s` as `%s` established\n", via.Host, sshVia.user)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// where a target came from
+const (
+	sourceStatic = "static" // given as host:port with an IP address
+	sourceDns    = "dns"    // an A or AAAA record of -dns
+	sourceSrv    = "srv"    // an SRV record
+)
+
+// Target is a resolved target as passed from the resolver to the managers,
+// with what is known about it; runtime state such as weights set through
+// the admin API, draining, blacklisting and health, which would be stale by
+// the time a target set reaches the managers, is kept by address, see
+// targetState
+type Target struct {
+	Addr     string `json:"addr"` // host:port dialed
+	Source   string `json:"source"`
+	Name     string `json:"name,omitempty"` // resolved name, empty for static targets
+	Priority uint16 `json:"priority,omitempty"`
+	Weight   uint16 `json:"weight,omitempty"` // SRV weight, see weight for the one used
+	Zone     string `json:"zone,omitempty"`
+}
+
+func (t Target) String() string {
+	return t.Addr
+}
+
+// staticTargets makes targets of host:port addresses not resolved by goproxy
+func staticTargets(addrs []string) []Target {
+	targets := make([]Target, 0, len(addrs))
+	for _, addr := range addrs {
+		targets = append(targets, Target{Addr: addr, Source: sourceStatic})
+	}
+	return withZones(targets)
+}
+
+// targetAddrs returns the addresses of the targets
+func targetAddrs(targets []Target) []string {
+	addrs := make([]string, 0, len(targets))
+	for _, t := range targets {
+		addrs = append(addrs, t.Addr)
+	}
+	return addrs
+}
+
+// sameTargets tells whether two target sets are the same, metadata included
+func sameTargets(a, b []Target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// describeTargets formats targets for logs, with the metadata that is set
+func describeTargets(targets []Target) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, t := range targets {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(t.Addr)
+		var meta []string
+		if t.Source == sourceSrv {
+			meta = append(meta, "priority="+strconv.Itoa(int(t.Priority)), "weight="+strconv.Itoa(int(t.Weight)))
+		}
+		if t.Zone != "" {
+			meta = append(meta, "zone="+t.Zone)
+		}
+		if len(meta) > 0 {
+			b.WriteString("(" + strings.Join(meta, ",") + ")")
+		}
+	}
+	b.WriteByte(']')
+	return b.String()
+}
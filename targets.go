@@ -0,0 +1,248 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// targetState holds runtime adjustments of targets made through the admin
+// API; targets are identified by their host:port as passed to the managers
+var targetState = struct {
+	sync.Mutex
+	current  []Target
+	weights  map[string]uint
+	draining map[string]bool
+	rr       map[string]int // current weights of smooth weighted round-robin
+}{weights: make(map[string]uint), draining: make(map[string]bool), rr: make(map[string]int)}
+
+type targetInfo struct {
+	Group       string  `json:"group"`
+	Target      string  `json:"target"`
+	Source      string  `json:"source,omitempty"`
+	Name        string  `json:"name,omitempty"`
+	Priority    uint16  `json:"priority,omitempty"`
+	SrvWeight   uint16  `json:"srv_weight,omitempty"`
+	Zone        string  `json:"zone,omitempty"`
+	Weight      uint    `json:"weight"`
+	Draining    bool    `json:"draining"`
+	Blacklisted bool    `json:"blacklisted,omitempty"`
+	Unreachable bool    `json:"unreachable,omitempty"`
+	Conns       int     `json:"conns"`
+	ErrorRate   float64 `json:"error_rate,omitempty"`
+	Alerting    bool    `json:"alerting,omitempty"`
+}
+
+// setTargets records the current target set for the admin API
+func setTargets(connectTo []Target) {
+	targetState.Lock()
+	before := targetState.current
+	changed := !sameTargets(before, connectTo)
+	targetState.current = connectTo
+	if changed {
+		// start over so removed targets don't linger and added ones don't
+		// trail behind
+		targetState.rr = make(map[string]int)
+	}
+	targetState.Unlock()
+	if changed {
+		publishEvent("targets", func() interface{} { return map[string][]string{"targets": targetAddrs(connectTo)} })
+		actor := "startup"
+		if dnsServer != "" {
+			actor = "dns"
+		}
+		audit(actor, "set targets", targetAddrs(before), targetAddrs(connectTo))
+	}
+}
+
+// currentTargets returns the current target set, for connections picking a
+// target outside of the manager
+func currentTargets() []Target {
+	targetState.Lock()
+	defer targetState.Unlock()
+	return targetState.current
+}
+
+// weight returns the weight of the target set through the admin API, else
+// its SRV weight, where 0 counts as 1 so such records still get a share,
+// and 1 for other targets; targetState must be locked
+func weight(t Target) uint {
+	if w, ok := targetState.weights[t.Addr]; ok {
+		return w
+	}
+	if t.Source == sourceSrv && t.Weight > 0 {
+		return uint(t.Weight)
+	}
+	return 1
+}
+
+// effectiveWeight is the weight for new connections, 0 when draining,
+// blacklisted or unreachable; targetState must be locked
+func effectiveWeight(t Target) uint {
+	if targetState.draining[t.Addr] || isBlacklisted(t.Addr) || isUnreachable(t.Addr) {
+		return 0
+	}
+	return weight(t)
+}
+
+// usableTargets returns the targets among those in -zone when set and usable
+// that get new connections, those of the lowest SRV priority with any left,
+// and their total effective weight; targetState must be locked
+func usableTargets(connectTo []Target) ([]Target, uint) {
+	if ownZone != "" {
+		connectTo = localTargets(connectTo)
+	}
+	var usable []Target
+	var total uint
+	for _, target := range connectTo {
+		w := effectiveWeight(target)
+		if w == 0 {
+			continue
+		}
+		if len(usable) > 0 && target.Priority < usable[0].Priority {
+			usable, total = usable[:0], 0
+		} else if len(usable) > 0 && target.Priority > usable[0].Priority {
+			continue
+		}
+		usable = append(usable, target)
+		total += w
+	}
+	return usable, total
+}
+
+// pickTarget selects the next target in smooth weighted round-robin order,
+// skipping draining, blacklisted and unreachable targets and falling back
+// to higher SRV priorities only when none of a lower one is left; returns
+// the address of the target, empty string if there is no usable target
+func pickTarget(connectTo []Target) string {
+	targetState.Lock()
+	defer targetState.Unlock()
+	usable, total := usableTargets(connectTo)
+	var best string
+	var max int
+	for _, target := range usable {
+		current := targetState.rr[target.Addr] + int(effectiveWeight(target))
+		targetState.rr[target.Addr] = current
+		if best == "" || current > max {
+			best, max = target.Addr, current
+		}
+	}
+	if best != "" {
+		targetState.rr[best] -= int(total)
+	}
+	return best
+}
+
+// hashTarget selects the target the hash n falls on in proportion to the
+// weights, so the same n keeps picking the same target while the set is
+// unchanged; otherwise as pickTarget
+func hashTarget(connectTo []Target, n uint) string {
+	targetState.Lock()
+	defer targetState.Unlock()
+	usable, total := usableTargets(connectTo)
+	if total == 0 {
+		return ""
+	}
+	n %= total
+	for _, target := range usable {
+		w := effectiveWeight(target)
+		if n < w {
+			return target.Addr
+		}
+		n -= w
+	}
+	return ""
+}
+
+func isDraining(target string) bool {
+	targetState.Lock()
+	defer targetState.Unlock()
+	return targetState.draining[target]
+}
+
+func setDraining(target string, draining bool) {
+	targetState.Lock()
+	defer targetState.Unlock()
+	if draining {
+		targetState.draining[target] = true
+		publishEvent("target.drain", func() interface{} { return map[string]string{"target": target} })
+	} else {
+		delete(targetState.draining, target)
+		publishEvent("target.enable", func() interface{} { return map[string]string{"target": target} })
+	}
+}
+
+func setWeight(target string, w uint) {
+	targetState.Lock()
+	defer targetState.Unlock()
+	targetState.weights[target] = w
+	publishEvent("target.weight", func() interface{} { return map[string]interface{}{"target": target, "weight": w} })
+}
+
+func listTargets() []targetInfo {
+	conns := make(map[string]int)
+	for _, c := range listConns() {
+		conns[c.Target]++
+	}
+
+	canary := canaryTargets()
+
+	targetState.Lock()
+	defer targetState.Unlock()
+	seen := make(map[string]bool)
+	var list []targetInfo
+	add := func(group string, t Target) {
+		target := t.Addr
+		if seen[target] {
+			return
+		}
+		seen[target] = true
+		rate, alerting := targetErrorRate(target)
+		list = append(list, targetInfo{group, target, t.Source, t.Name, t.Priority, t.Weight, t.Zone, weight(t), targetState.draining[target],
+			isBlacklisted(target), isUnreachable(target), conns[target], rate, alerting})
+	}
+	for _, target := range targetState.current {
+		add(stableName, target)
+	}
+	for _, target := range canary {
+		add(canaryName, target)
+	}
+	for _, r := range geoip.routes {
+		r.mu.Lock()
+		for _, target := range r.targets {
+			add(r.name, target)
+		}
+		r.mu.Unlock()
+	}
+	for _, r := range portRoutes {
+		r.mu.Lock()
+		for _, target := range r.targets {
+			add(r.name, target)
+		}
+		r.mu.Unlock()
+	}
+	for _, r := range pgRoutes {
+		r.mu.Lock()
+		for _, target := range r.targets {
+			add(r.name, target)
+		}
+		r.mu.Unlock()
+	}
+	// draining targets that already left the set may still have connections
+	for target := range targetState.draining {
+		add("", Target{Addr: target})
+	}
+	// stable and canary first, then port, GeoIP and PostgreSQL route groups,
+	// then leftovers
+	rank := map[string]int{stableName: -3, canaryName: -2, "": 1}
+	sort.Slice(list, func(i, j int) bool {
+		gi, gj := list[i].Group, list[j].Group
+		if gi != gj {
+			if rank[gi] != rank[gj] {
+				return rank[gi] < rank[gj]
+			}
+			return gi < gj
+		}
+		return list[i].Target < list[j].Target
+	})
+	return list
+}
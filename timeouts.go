@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dialTimeouts overrides -timeout for connections to targets and from
+// listener ports; the target override takes precedence
+var dialTimeouts = struct {
+	targets   map[string]time.Duration // host:port, or :port for any host
+	listeners map[int]time.Duration
+}{targets: make(map[string]time.Duration), listeners: make(map[int]time.Duration)}
+
+// parseTimeoutSpec parses comma-separated keys and a duration, key[,key]=duration
+func parseTimeoutSpec(spec string) ([]string, time.Duration, error) {
+	i := strings.LastIndexByte(spec, '=')
+	if i < 0 {
+		return nil, 0, fmt.Errorf("`%s` is not key=duration", spec)
+	}
+	d, err := time.ParseDuration(spec[i+1:])
+	if err != nil || d <= 0 {
+		return nil, 0, fmt.Errorf("invalid duration in `%s`", spec)
+	}
+	keys := parseTargetList(spec[:i])
+	if len(keys) == 0 {
+		return nil, 0, fmt.Errorf("no key in `%s`", spec)
+	}
+	return keys, d, nil
+}
+
+// parseTargetTimeout parses a -target-timeout, e.g. '10.0.1.5:5432,:6379=2s'
+func parseTargetTimeout(spec string) error {
+	targets, d, err := parseTimeoutSpec(spec)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return fmt.Errorf("`%s` is not host:port or :port", target)
+		}
+		dialTimeouts.targets[target] = d
+	}
+	return nil
+}
+
+// parseListenerTimeout parses a -listener-timeout, e.g. '8443,9443=30s'
+func parseListenerTimeout(spec string) error {
+	ports, d, err := parseTimeoutSpec(spec)
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port `%s`", p)
+		}
+		dialTimeouts.listeners[port] = d
+	}
+	return nil
+}
+
+// dialTimeout returns the connect timeout to the target for a connection
+// accepted on local, which is nil when there's no listener
+func dialTimeout(target string, local net.Addr) time.Duration {
+	if d, ok := dialTimeouts.targets[target]; ok {
+		return d
+	}
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		if d, ok := dialTimeouts.targets[":"+port]; ok {
+			return d
+		}
+	}
+	if local != nil {
+		if _, port := addrIpPort(local); port != 0 {
+			if d, ok := dialTimeouts.listeners[port]; ok {
+				return d
+			}
+		}
+	}
+	return timeout
+}
+
+// handshakeTimeout bounds waiting for a TLS ClientHello and the TLS
+// handshake with an https:// -via proxy, -tls-timeout or else -timeout
+func handshakeTimeout() time.Duration {
+	if tlsTimeout > 0 {
+		return tlsTimeout
+	}
+	return timeout
+}
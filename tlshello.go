@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tlsDeny holds JA3 hashes and JA4 fingerprints of client stacks to reject
+var tlsDeny map[string]bool
+
+const maxTlsRecord = 1 << 14
+
+// helloConn is an incoming connection with the TLS ClientHello peeked, it is
+// forwarded unchanged
+type helloConn struct {
+	*peekedConn
+	ja3, ja4 string
+}
+
+// peekHello waits up to -tls-timeout for the ClientHello and fingerprints it;
+// connections not starting with a TLS handshake record, or with a
+// ClientHello fragmented across records, get no fingerprint
+func peekHello(conn net.Conn) (*helloConn, error) {
+	c := &helloConn{peekedConn: newPeekedConn(conn, 5+maxTlsRecord)}
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout()))
+	defer conn.SetReadDeadline(time.Time{})
+	header, err := c.r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(header[3:5]))
+	if header[0] != 22 || n > maxTlsRecord {
+		return c, nil
+	}
+	record, err := c.r.Peek(5 + n)
+	if err != nil {
+		return nil, err
+	}
+	if hello, err := parseClientHello(record[5:]); err == nil {
+		c.ja3, c.ja4 = hello.ja3(), hello.ja4()
+	}
+	return c, nil
+}
+
+// tlsDenied reports whether the fingerprint of the client is in -tls-deny
+func (c *helloConn) tlsDenied() bool {
+	return c.ja3 != "" && (tlsDeny[c.ja3] || tlsDeny[c.ja4])
+}
+
+type clientHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16
+	groups     []uint16
+	points     []uint8
+	sigAlgs    []uint16
+	versions   []uint16
+	sni        bool
+	alpn       string
+}
+
+var errHello = errors.New("malformed ClientHello")
+
+// helloReader consumes big-endian fields of a handshake message
+type helloReader []byte
+
+func (r *helloReader) next(n int) ([]byte, error) {
+	if len(*r) < n {
+		return nil, errHello
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b, nil
+}
+
+func (r *helloReader) uint(n int) (uint32, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint32
+	for _, x := range b {
+		v = v<<8 | uint32(x)
+	}
+	return v, nil
+}
+
+// vector returns the content of a vector with n bytes of length prefix
+func (r *helloReader) vector(n int) (helloReader, error) {
+	size, err := r.uint(n)
+	if err != nil {
+		return nil, err
+	}
+	return r.next(int(size))
+}
+
+func (r helloReader) uint16s() []uint16 {
+	list := make([]uint16, 0, len(r)/2)
+	for ; len(r) >= 2; r = r[2:] {
+		list = append(list, binary.BigEndian.Uint16(r))
+	}
+	return list
+}
+
+func parseClientHello(msg helloReader) (*clientHello, error) {
+	if t, err := msg.uint(1); err != nil || t != 1 {
+		return nil, errHello
+	}
+	body, err := msg.vector(3)
+	if err != nil {
+		return nil, err
+	}
+	h := &clientHello{}
+	version, err := body.uint(2)
+	if err != nil {
+		return nil, err
+	}
+	h.version = uint16(version)
+	if _, err := body.next(32); err != nil {
+		return nil, err
+	}
+	if _, err := body.vector(1); err != nil {
+		return nil, err
+	}
+	ciphers, err := body.vector(2)
+	if err != nil {
+		return nil, err
+	}
+	h.ciphers = ciphers.uint16s()
+	if _, err := body.vector(1); err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return h, nil
+	}
+	extensions, err := body.vector(2)
+	if err != nil {
+		return nil, err
+	}
+	for len(extensions) > 0 {
+		t, err := extensions.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		data, err := extensions.vector(2)
+		if err != nil {
+			return nil, err
+		}
+		h.extensions = append(h.extensions, uint16(t))
+		switch t {
+		case 0:
+			h.sni = true
+		case 10:
+			groups, _ := data.vector(2)
+			h.groups = groups.uint16s()
+		case 11:
+			points, _ := data.vector(1)
+			h.points = points
+		case 13:
+			sigAlgs, _ := data.vector(2)
+			h.sigAlgs = sigAlgs.uint16s()
+		case 16:
+			protocols, _ := data.vector(2)
+			if alpn, err := protocols.vector(1); err == nil {
+				h.alpn = string(alpn)
+			}
+		case 43:
+			versions, _ := data.vector(1)
+			h.versions = versions.uint16s()
+		}
+	}
+	return h, nil
+}
+
+// isGrease reports the reserved values of RFC 8701 clients send to keep
+// servers tolerant, they are left out of fingerprints
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGrease(list []uint16) []uint16 {
+	var values []uint16
+	for _, v := range list {
+		if !isGrease(v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func joinUint16s(list []uint16, format func(uint16) string, sep string) string {
+	s := make([]string, len(list))
+	for i, v := range list {
+		s[i] = format(v)
+	}
+	return strings.Join(s, sep)
+}
+
+func decimal(v uint16) string {
+	return strconv.Itoa(int(v))
+}
+
+func hex4(v uint16) string {
+	return fmt.Sprintf("%04x", v)
+}
+
+// ja3 returns the MD5 of version, ciphers, extensions, groups and point
+// formats as listed by the client
+func (h *clientHello) ja3() string {
+	points := make([]uint16, len(h.points))
+	for i, p := range h.points {
+		points[i] = uint16(p)
+	}
+	s := strings.Join([]string{
+		decimal(h.version),
+		joinUint16s(withoutGrease(h.ciphers), decimal, "-"),
+		joinUint16s(withoutGrease(h.extensions), decimal, "-"),
+		joinUint16s(withoutGrease(h.groups), decimal, "-"),
+		joinUint16s(points, decimal, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+var ja4Versions = map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3"}
+
+// ja4 returns the JA4 fingerprint of a ClientHello received over TCP,
+// which does not depend on the order of ciphers and extensions
+func (h *clientHello) ja4() string {
+	version := h.version
+	if versions := withoutGrease(h.versions); len(versions) > 0 {
+		version = 0
+		for _, v := range versions {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	v, ok := ja4Versions[version]
+	if !ok {
+		v = "00"
+	}
+	sni := "i"
+	if h.sni {
+		sni = "d"
+	}
+	ciphers := withoutGrease(h.ciphers)
+	extensions := withoutGrease(h.extensions)
+	alpn := "00"
+	if h.alpn != "" {
+		alpn = h.alpn[:1] + h.alpn[len(h.alpn)-1:]
+		if !isAlnum(alpn[0]) || !isAlnum(alpn[1]) {
+			x := hex.EncodeToString([]byte(h.alpn))
+			alpn = x[:1] + x[len(x)-1:]
+		}
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", v, sni, capCount(len(ciphers)), capCount(len(extensions)), alpn)
+
+	sorted := append([]uint16(nil), ciphers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	b := truncatedHash(joinUint16s(sorted, hex4, ","), len(sorted) == 0)
+
+	sorted = sorted[:0]
+	for _, e := range extensions {
+		// server name and ALPN are already in the first part
+		if e != 0 && e != 16 {
+			sorted = append(sorted, e)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	s := joinUint16s(sorted, hex4, ",")
+	if len(h.sigAlgs) > 0 {
+		s += "_" + joinUint16s(h.sigAlgs, hex4, ",")
+	}
+	c := truncatedHash(s, len(sorted) == 0)
+	return a + "_" + b + "_" + c
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+func capCount(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+func truncatedHash(s string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
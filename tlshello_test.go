@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// readHello returns a TLS record holding a ClientHello captured off the wire
+func readHello(t *testing.T, name string) []byte {
+	t.Helper()
+	record, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestParseClientHello(t *testing.T) {
+	tests := []struct {
+		file     string
+		ja3, ja4 string
+	}{
+		// curl 7.88.1 with OpenSSL 3.0, TLS 1.3, SNI and h2 ALPN; JA3 string
+		// 771,4866-4867-4865-...-47-255,0-11-10-16-22-23-49-13-43-45-51-21,29-23-30-25-24-256-257-258-259-260,0-1-2
+		{"curl-hello.bin", "0149f47eabf9a20d0893e2a44e5a6323", "t13d3112h2_e8f1e7e78f70_b26ce05bbdd6"},
+		// openssl s_client -tls1_2 -noservername, no SNI nor ALPN
+		{"openssl-tls12-hello.bin", "fbe7e189e37a07ee33706f86bc746344", "t12i280600_d943125447b4_e7e480e5a997"},
+	}
+	for _, test := range tests {
+		record := readHello(t, test.file)
+		hello, err := parseClientHello(record[5:])
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		if ja3 := hello.ja3(); ja3 != test.ja3 {
+			t.Errorf("%s: JA3 %s, want %s", test.file, ja3, test.ja3)
+		}
+		if ja4 := hello.ja4(); ja4 != test.ja4 {
+			t.Errorf("%s: JA4 %s, want %s", test.file, ja4, test.ja4)
+		}
+	}
+}
+
+func TestParseClientHelloMalformed(t *testing.T) {
+	msg := readHello(t, "curl-hello.bin")[5:]
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"empty", nil},
+		{"server hello", append([]byte{2}, msg[1:]...)},
+		{"truncated length", msg[:3]},
+		{"truncated random", msg[:20]},
+		{"truncated ciphers", msg[:50]},
+		{"truncated extensions", msg[:len(msg)-10]},
+		{"length past the end", append([]byte{1, 0xff, 0xff, 0xff}, msg[4:]...)},
+	}
+	for _, test := range tests {
+		if _, err := parseClientHello(test.msg); err == nil {
+			t.Errorf("%s: parsed, want error", test.name)
+		}
+	}
+}
+
+func TestFingerprintsIgnoreGrease(t *testing.T) {
+	plain := &clientHello{version: 0x0303, ciphers: []uint16{0x1301, 0xc02f}, extensions: []uint16{0, 10, 43},
+		groups: []uint16{29}, versions: []uint16{0x0304}, sni: true}
+	greased := &clientHello{version: 0x0303, ciphers: []uint16{0x2a2a, 0x1301, 0xc02f}, extensions: []uint16{0xdada, 0, 10, 43, 0x8a8a},
+		groups: []uint16{0x4a4a, 29}, versions: []uint16{0xfafa, 0x0304}, sni: true}
+	if plain.ja3() != greased.ja3() {
+		t.Errorf("JA3 %s with GREASE, want %s", greased.ja3(), plain.ja3())
+	}
+	if plain.ja4() != greased.ja4() {
+		t.Errorf("JA4 %s with GREASE, want %s", greased.ja4(), plain.ja4())
+	}
+}
+
+func TestPeekHello(t *testing.T) {
+	defer func(to time.Duration) { timeout = to }(timeout)
+	timeout = time.Second
+	hello := readHello(t, "curl-hello.bin")
+	tests := []struct {
+		name  string
+		sent  []byte
+		ja3   string
+		fails bool
+	}{
+		{"hello", hello, "0149f47eabf9a20d0893e2a44e5a6323", false},
+		{"not tls", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "", false},
+		// the record header announces more than was sent before the close
+		{"truncated record", hello[:200], "", true},
+		{"truncated header", hello[:3], "", true},
+		// a record too long for a hello is forwarded without a fingerprint
+		{"oversized record", []byte{22, 3, 1, 0x40, 0x01, 1}, "", false},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func(sent []byte) {
+			client.Write(sent)
+			client.Close()
+		}(test.sent)
+		c, err := peekHello(server)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: peeked, want error", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if c.ja3 != test.ja3 {
+			t.Errorf("%s: JA3 %q, want %q", test.name, c.ja3, test.ja3)
+		}
+		server.Close()
+	}
+}
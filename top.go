@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// topSlots is the number of slots the -top-window is divided into, the
+// window rolls forward a slot at a time
+const topSlots = 10
+
+// topTalkers counts connections and bytes per client IP and per target over
+// the rolling -top-window; bytes of live connections are added every slot,
+// so long-lived connections show up before they close
+var topTalkers = struct {
+	sync.Mutex
+	slots [topSlots]topSlot
+	cur   int
+}{}
+
+type topSlot struct {
+	clients map[string]*usageCounters
+	targets map[string]*usageCounters
+}
+
+type topEntry struct {
+	Address string `json:"address"`
+	usageCounters
+}
+
+type topReport struct {
+	Window  float64    `json:"window"`
+	Clients []topEntry `json:"clients"`
+	Targets []topEntry `json:"targets"`
+}
+
+// topCount adds to the current slot; topTalkers must be locked
+func topCount(c *trackedConn, conns uint64) {
+	in := atomic.LoadUint64(&c.bytesIn)
+	out := atomic.LoadUint64(&c.bytesOut)
+	slot := &topTalkers.slots[topTalkers.cur]
+	if slot.clients == nil {
+		slot.clients = make(map[string]*usageCounters)
+		slot.targets = make(map[string]*usageCounters)
+	}
+	add := func(m map[string]*usageCounters, key string) {
+		if key == "" {
+			return
+		}
+		if m[key] == nil {
+			m[key] = &usageCounters{}
+		}
+		m[key].add(conns, in-c.topIn, out-c.topOut)
+	}
+	add(slot.clients, clientIp(c.client))
+	add(slot.targets, c.target)
+	c.topIn, c.topOut = in, out
+}
+
+func topOpen(c *trackedConn) {
+	if topWindow == 0 {
+		return
+	}
+	topTalkers.Lock()
+	topCount(c, 1)
+	topTalkers.Unlock()
+}
+
+func topClose(c *trackedConn) {
+	if topWindow == 0 {
+		return
+	}
+	topTalkers.Lock()
+	topCount(c, 0)
+	topTalkers.Unlock()
+}
+
+// rollTopTalkers adds bytes of live connections and moves on to the next
+// slot every -top-window / topSlots
+func rollTopTalkers(ctx context.Context) {
+	ticker := systemClock.NewTicker(topWindow / topSlots)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+		connTable.Lock()
+		live := make([]*trackedConn, 0, len(connTable.conns))
+		for _, c := range connTable.conns {
+			live = append(live, c)
+		}
+		connTable.Unlock()
+		topTalkers.Lock()
+		for _, c := range live {
+			topCount(c, 0)
+		}
+		topTalkers.cur = (topTalkers.cur + 1) % topSlots
+		topTalkers.slots[topTalkers.cur] = topSlot{}
+		topTalkers.Unlock()
+	}
+}
+
+// topList returns the n heaviest clients and targets over the window, by
+// bytes in both directions or by connections
+func topList(n int, byConns bool) topReport {
+	clients := make(map[string]*usageCounters)
+	targets := make(map[string]*usageCounters)
+	sum := func(into, from map[string]*usageCounters) {
+		for key, u := range from {
+			if into[key] == nil {
+				into[key] = &usageCounters{}
+			}
+			into[key].add(u.Conns, u.BytesIn, u.BytesOut)
+		}
+	}
+	topTalkers.Lock()
+	for _, slot := range topTalkers.slots {
+		sum(clients, slot.clients)
+		sum(targets, slot.targets)
+	}
+	topTalkers.Unlock()
+	rank := func(m map[string]*usageCounters) []topEntry {
+		list := make([]topEntry, 0, len(m))
+		for key, u := range m {
+			list = append(list, topEntry{key, *u})
+		}
+		sort.Slice(list, func(i, j int) bool {
+			a, b := list[i], list[j]
+			if byConns && a.Conns != b.Conns {
+				return a.Conns > b.Conns
+			}
+			if ab, bb := a.BytesIn+a.BytesOut, b.BytesIn+b.BytesOut; ab != bb {
+				return ab > bb
+			}
+			return a.Address < b.Address
+		})
+		if len(list) > n {
+			list = list[:n]
+		}
+		return list
+	}
+	return topReport{Window: topWindow.Seconds(), Clients: rank(clients), Targets: rank(targets)}
+}
+
+// logTopTalkers logs the 10 heaviest clients and targets by bytes, on
+// SIGUSR1 with -sigusr1 top
+func logTopTalkers() {
+	var b strings.Builder
+	printTop(&b, topList(10, false))
+	log.Printf("Top talkers, %s\n", strings.TrimRight(b.String(), "\n"))
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// uringRings are the io_uring instances of -io-uring, one per CPU, pairs
+// are spread over them by connection id
+var uringRings []*uring
+
+const (
+	uringEntries = 4096
+	uringBufSize = 16 << 10
+	uringBufs    = 256 // per ring, taken only while data is in flight
+
+	uringOpWriteFixed     = 5
+	uringOpRecv           = 27
+	uringOpProvideBuffers = 31
+
+	uringOffSqRing = 0
+	uringOffCqRing = 0x8000000
+	uringOffSqes   = 0x10000000
+
+	uringFeatSingleMmap  = 1
+	uringEnterGetevents  = 1
+	uringRegisterBuffers = 0
+	uringSqeBufferSelect = 1 << 5
+	uringCqeBuffer       = 1
+)
+
+// operations in the low bits of user data, the rest is the direction key
+const (
+	uringRecv = iota
+	uringWrite
+	uringProvide
+)
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCpu, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		userAddr                                                        uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		userAddr                                                        uint64
+	}
+}
+
+type uringSqe struct {
+	opcode, flags         uint8
+	ioprio                uint16
+	fd                    int32
+	off, addr             uint64
+	len, opFlags          uint32
+	userData              uint64
+	bufIndex, personality uint16 // bufIndex is also the buffer group
+	spliceFdIn            int32
+	addr3, pad            uint64
+}
+
+type uringCqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is a submission and completion queue pair with a slab of registered
+// buffers provided to receives, a goroutine reaps completions and submits
+// what follows from them
+type uring struct {
+	sync.Mutex
+	fd                     int
+	sqHead, sqTail, sqMask *uint32
+	sqArray                []uint32
+	sqes                   []uringSqe
+	cqHead, cqTail, cqMask *uint32
+	cqes                   []uringCqe
+	slab                   []byte
+	queued                 uint32
+	dirs                   map[uint64]*uringDir
+	next                   uint64
+	starved                []*uringDir // receives that found no buffer
+}
+
+// uringDir is one direction of a pair: data received from one socket into
+// a provided buffer is written to the other before the next receive
+type uringDir struct {
+	pair     *uringPair
+	key      uint64
+	from, to int
+	in       bool
+	buf      uint16
+	n, off   int
+	total    int64
+	done     bool
+	err      error
+}
+
+// uringPair is a client and target connection pair forwarded by a ring on
+// descriptors of its own, so the sockets outlive the connections closed by
+// the proxy until no operation refers to them
+type uringPair struct {
+	r       *uring
+	id      uint64
+	c       *trackedConn
+	client  net.Addr
+	dirs    [2]*uringDir
+	stopped bool
+	close   func()
+}
+
+func uringSetup(entries uint32, p *uringParams) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(p)), 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+func newUring() (r *uring, err error) {
+	var p uringParams
+	r = &uring{dirs: make(map[uint64]*uringDir)}
+	if r.fd, err = uringSetup(uringEntries, &p); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			unix.Close(r.fd)
+		}
+	}()
+	sqSize := int(p.sqOff.array + p.sqEntries*4)
+	cqSize := int(p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(uringCqe{})))
+	if p.features&uringFeatSingleMmap != 0 && cqSize > sqSize {
+		sqSize = cqSize
+	}
+	sq, err := unix.Mmap(r.fd, uringOffSqRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, err
+	}
+	cq := sq
+	if p.features&uringFeatSingleMmap == 0 {
+		if cq, err = unix.Mmap(r.fd, uringOffCqRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+			return nil, err
+		}
+	}
+	sqes, err := unix.Mmap(r.fd, uringOffSqes, int(p.sqEntries)*int(unsafe.Sizeof(uringSqe{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, err
+	}
+	r.sqHead = (*uint32)(unsafe.Pointer(&sq[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&sq[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&sq[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&sq[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*uringSqe)(unsafe.Pointer(&sqes[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&cq[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&cq[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&cq[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCqe)(unsafe.Pointer(&cq[p.cqOff.cqes])), p.cqEntries)
+
+	// the slab is outside the Go heap and registered once, so writes from it
+	// need no page pinning per operation
+	if r.slab, err = unix.Mmap(-1, 0, uringBufs*uringBufSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS); err != nil {
+		return nil, err
+	}
+	iov := unix.Iovec{Base: &r.slab[0]}
+	iov.SetLen(len(r.slab))
+	if _, _, errno := unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), uringRegisterBuffers, uintptr(unsafe.Pointer(&iov)), 1, 0, 0); errno != 0 {
+		return nil, fmt.Errorf("registering buffers: %v", errno)
+	}
+	r.push(uringSqe{opcode: uringOpProvideBuffers, fd: uringBufs, addr: r.bufAddr(0), len: uringBufSize, userData: uringProvide})
+	if err = r.enter(r.queued, 1, uringEnterGetevents); err != nil {
+		return nil, err
+	}
+	r.queued = 0
+	head := *r.cqHead
+	cqe := r.cqes[head&*r.cqMask]
+	atomic.StoreUint32(r.cqHead, head+1)
+	if cqe.res < 0 {
+		return nil, fmt.Errorf("providing buffers: %v", syscall.Errno(-cqe.res))
+	}
+	return r, nil
+}
+
+// initUring sets up the rings, when it fails connections are copied in
+// userspace as without -io-uring
+func initUring() {
+	for i := 0; i < runtime.NumCPU(); i++ {
+		r, err := newUring()
+		if err != nil {
+			log.Printf("io_uring is not available, copying in userspace: %v\n", err)
+			for _, r := range uringRings {
+				unix.Close(r.fd)
+			}
+			uringRings = nil
+			return
+		}
+		uringRings = append(uringRings, r)
+	}
+	for _, r := range uringRings {
+		go r.run()
+	}
+	if verbose.Load() {
+		log.Printf("Forwarding TCP connections with %d io_uring rings\n", len(uringRings))
+	}
+}
+
+func (r *uring) bufAddr(buf uint16) uint64 {
+	return uint64(uintptr(unsafe.Pointer(&r.slab[0]))) + uint64(buf)*uringBufSize
+}
+
+// push queues an entry to be submitted by the next enter, r is locked; a
+// full queue is submitted right away
+func (r *uring) push(sqe uringSqe) {
+	tail := *r.sqTail
+	if tail-atomic.LoadUint32(r.sqHead) == uint32(len(r.sqes)) {
+		if err := r.enter(r.queued, 0, 0); err != nil {
+			log.Printf("io_uring submission failed: %v\n", err)
+		}
+		r.queued = 0
+	}
+	i := tail & *r.sqMask
+	r.sqes[i] = sqe
+	r.sqArray[i] = i
+	atomic.StoreUint32(r.sqTail, tail+1)
+	r.queued++
+}
+
+func (r *uring) enter(submit, wait uint32, flags uintptr) error {
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(submit), uintptr(wait), flags, 0, 0)
+		if errno != unix.EINTR {
+			if errno != 0 {
+				return errno
+			}
+			return nil
+		}
+	}
+}
+
+// submit enters queued entries from outside the reaping goroutine, which
+// waits in the kernel meanwhile
+func (r *uring) submit() {
+	r.Lock()
+	queued := r.queued
+	r.queued = 0
+	r.Unlock()
+	if err := r.enter(queued, 0, 0); err != nil {
+		log.Printf("io_uring submission failed: %v\n", err)
+	}
+}
+
+// run submits what completions queued and waits for more
+func (r *uring) run() {
+	for {
+		r.Lock()
+		queued := r.queued
+		r.queued = 0
+		r.Unlock()
+		if err := r.enter(queued, 1, uringEnterGetevents); err != nil && err != unix.EBUSY && err != unix.EAGAIN {
+			log.Printf("io_uring failed: %v\n", err)
+			return
+		}
+		r.Lock()
+		head, tail := *r.cqHead, atomic.LoadUint32(r.cqTail)
+		for ; head != tail; head++ {
+			cqe := r.cqes[head&*r.cqMask]
+			r.complete(cqe.userData, cqe.res, cqe.flags)
+		}
+		atomic.StoreUint32(r.cqHead, head)
+		r.Unlock()
+	}
+}
+
+func (r *uring) recv(d *uringDir) {
+	r.push(uringSqe{
+		opcode:   uringOpRecv,
+		flags:    uringSqeBufferSelect,
+		fd:       int32(d.from),
+		len:      uringBufSize,
+		userData: d.key<<2 | uringRecv,
+	})
+}
+
+func (r *uring) write(d *uringDir) {
+	r.push(uringSqe{
+		opcode:   uringOpWriteFixed,
+		fd:       int32(d.to),
+		addr:     r.bufAddr(d.buf) + uint64(d.off),
+		len:      uint32(d.n - d.off),
+		userData: d.key<<2 | uringWrite,
+	})
+}
+
+// release provides a buffer back and retries a receive that found none
+func (r *uring) release(buf uint16) {
+	r.push(uringSqe{opcode: uringOpProvideBuffers, fd: 1, addr: r.bufAddr(buf), len: uringBufSize, off: uint64(buf), userData: uringProvide})
+	if len(r.starved) > 0 {
+		d := r.starved[0]
+		r.starved = r.starved[1:]
+		r.recv(d)
+	}
+}
+
+// complete advances the direction of a completed operation, r is locked
+func (r *uring) complete(userData uint64, res int32, flags uint32) {
+	d := r.dirs[userData>>2]
+	if d == nil {
+		return
+	}
+	switch userData & 3 {
+	case uringRecv:
+		received := flags&uringCqeBuffer != 0
+		if received {
+			d.buf = uint16(flags >> 16)
+		}
+		switch {
+		case res == -int32(unix.ENOBUFS) && !d.pair.stopped:
+			r.starved = append(r.starved, d)
+		case res <= 0 || d.pair.stopped:
+			if received {
+				r.release(d.buf)
+			}
+			r.finish(d, res)
+		default:
+			if d.in {
+				d.pair.c.transferred(int(res), 0)
+			} else {
+				d.pair.c.transferred(0, int(res))
+			}
+			d.n, d.off = int(res), 0
+			r.write(d)
+		}
+	case uringWrite:
+		if res <= 0 || d.pair.stopped {
+			r.release(d.buf)
+			r.finish(d, res)
+			return
+		}
+		d.off += int(res)
+		d.total += int64(res)
+		if d.off < d.n {
+			r.write(d)
+			return
+		}
+		r.release(d.buf)
+		r.recv(d)
+	}
+}
+
+// finish ends a direction and stops the pair so the other one ends too, on
+// a read error or EOF everything received was already written
+func (r *uring) finish(d *uringDir, res int32) {
+	d.done = true
+	if res < 0 {
+		d.err = syscall.Errno(-res)
+	}
+	p := d.pair
+	if !p.stopped {
+		// the first direction to end tells which side closed
+		if d.in {
+			p.c.setCloseReason("client")
+		} else {
+			p.c.setCloseReason("target")
+		}
+	}
+	r.stopPair(p)
+	if !p.dirs[0].done || !p.dirs[1].done {
+		return
+	}
+	for _, d := range p.dirs {
+		delete(r.dirs, d.key)
+		unix.Close(d.from)
+	}
+	go p.closed()
+}
+
+// stopPair shuts the sockets down to wake operations waiting on them, a
+// starved receive has none and ends right away; r is locked
+func (r *uring) stopPair(p *uringPair) {
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	for _, d := range p.dirs {
+		unix.Shutdown(d.from, unix.SHUT_RDWR)
+	}
+	var ended []*uringDir
+	starved := r.starved[:0]
+	for _, d := range r.starved {
+		if d.pair == p {
+			ended = append(ended, d)
+		} else {
+			starved = append(starved, d)
+		}
+	}
+	r.starved = starved
+	for _, d := range ended {
+		r.finish(d, 0)
+	}
+}
+
+// stop ends forwarding of a pair closed by the proxy
+func (p *uringPair) stop() {
+	p.r.Lock()
+	p.r.stopPair(p)
+	p.r.Unlock()
+}
+
+func (p *uringPair) closed() {
+	in, out := p.dirs[0], p.dirs[1]
+	if debug.Load() {
+		log.Printf("[%d] Incoming TCP connection closed: %v; %v bytes forwarded\n", p.id, in.err, in.total)
+		log.Printf("[%d] Outgoing TCP connection closed: %v; %v bytes forwarded\n", p.id, out.err, out.total)
+	}
+	if in.total == 0 {
+		recordClient(p.client, 0, 1, "empty connections")
+	}
+	p.close()
+}
+
+// uringDup duplicates the descriptor of a connection; it shares O_NONBLOCK
+// with the runtime's, which is left as is, as the ring polls nonblocking
+// sockets internally instead of failing with EAGAIN
+func uringDup(conn *net.TCPConn) (dup int, err error) {
+	dup = -1
+	if ctlErr := sockFd(conn, func(fd int) {
+		dup, err = unix.Dup(fd)
+	}); ctlErr != nil {
+		err = ctlErr
+	}
+	if err != nil && dup >= 0 {
+		unix.Close(dup)
+	}
+	return
+}
+
+// uringForward hands a pair over to a ring, close is called once both
+// directions end; nil when the pair is to be copied in userspace
+func uringForward(id uint64, client, target net.Conn, c *trackedConn, close func()) *uringPair {
+	if len(uringRings) == 0 {
+		return nil
+	}
+	cl, ok1 := unwrapFd(client).(*net.TCPConn)
+	t, ok2 := unwrapFd(target).(*net.TCPConn)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	cfd, err := uringDup(cl)
+	if err != nil {
+		return nil
+	}
+	tfd, err := uringDup(t)
+	if err != nil {
+		unix.Close(cfd)
+		return nil
+	}
+	r := uringRings[id%uint64(len(uringRings))]
+	p := &uringPair{r: r, id: id, c: c, client: client.RemoteAddr(), close: close}
+	r.Lock()
+	for i, fds := range [][2]int{{cfd, tfd}, {tfd, cfd}} {
+		r.next++
+		d := &uringDir{pair: p, key: r.next, from: fds[0], to: fds[1], in: i == 0}
+		p.dirs[i] = d
+		r.dirs[d.key] = d
+		r.recv(d)
+	}
+	r.Unlock()
+	r.submit()
+	return p
+}
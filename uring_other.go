@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"log"
+	"net"
+)
+
+type uringPair struct{}
+
+func initUring() {
+	log.Printf("io_uring is only supported on Linux, copying in userspace\n")
+}
+
+func uringForward(id uint64, client, target net.Conn, c *trackedConn, close func()) *uringPair {
+	return nil
+}
+
+func (p *uringPair) stop() {}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultCert is the certificate issued by the Vault PKI secrets engine with
+// -vault-pki, kept in memory only and renewed before it expires
+var vaultCert struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+// vaultAuth holds the token, or the AppRole credentials to log in with, and
+// the HTTP client, set up at startup
+var vaultAuth struct {
+	token    string
+	roleId   string
+	secretId string
+	client   *http.Client
+}
+
+// vaultRetry is the wait after a failed renewal
+const vaultRetry = time.Minute
+
+// setupVault reads the Vault credentials
+func setupVault() error {
+	vaultAuth.client = &http.Client{Timeout: timeout}
+	if vaultCa != "" {
+		pool, err := loadCertPool(vaultCa)
+		if err != nil {
+			return fmt.Errorf("-vault-ca: %v", err)
+		}
+		vaultAuth.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	switch {
+	case vaultRoleId != "":
+		secretId, err := readToken(vaultSecretIdFile)
+		if err != nil {
+			return fmt.Errorf("-vault-secret-id-file: %v", err)
+		}
+		vaultAuth.roleId, vaultAuth.secretId = vaultRoleId, secretId
+	case vaultTokenFile != "":
+		token, err := readToken(vaultTokenFile)
+		if err != nil {
+			return fmt.Errorf("-vault-token-file: %v", err)
+		}
+		vaultAuth.token = token
+	default:
+		if vaultAuth.token = os.Getenv("VAULT_TOKEN"); vaultAuth.token == "" {
+			return errors.New("-vault-pki requires -vault-token-file, VAULT_TOKEN or -vault-role-id")
+		}
+	}
+	return nil
+}
+
+// obtainVaultCert issues the first certificate
+func obtainVaultCert() error {
+	cert, err := issueVaultCert()
+	if err != nil {
+		return err
+	}
+	vaultCert.Lock()
+	vaultCert.cert = cert
+	vaultCert.Unlock()
+	if verbose.Load() {
+		log.Printf("Obtained certificate from Vault, serial %x, expires %v\n", cert.Leaf.SerialNumber, cert.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// renewVaultCert issues a new certificate once two thirds of the lifetime
+// of the current one passed
+func renewVaultCert(ctx context.Context) {
+	for {
+		vaultCert.RLock()
+		leaf := vaultCert.cert.Leaf
+		vaultCert.RUnlock()
+		wait := time.Until(leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3))
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			cert, err := issueVaultCert()
+			if err == nil {
+				vaultCert.Lock()
+				vaultCert.cert = cert
+				vaultCert.Unlock()
+				if verbose.Load() {
+					log.Printf("Renewed certificate from Vault, serial %x, expires %v\n", cert.Leaf.SerialNumber, cert.Leaf.NotAfter)
+				}
+				publishEvent("reload", func() interface{} {
+					return map[string]string{"config": "vault certificate", "expires": cert.Leaf.NotAfter.Format(time.RFC3339)}
+				})
+				break
+			}
+			log.Printf("Failed to renew certificate from Vault, current one expires %v: %v\n", leaf.NotAfter, err)
+			wait = vaultRetry
+		}
+	}
+}
+
+// vaultCertificate returns the current certificate to the admin API
+// clients
+func vaultCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	vaultCert.RLock()
+	defer vaultCert.RUnlock()
+	return vaultCert.cert, nil
+}
+
+// vaultClientCertificate returns the current certificate to the -via proxy
+func vaultClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return vaultCertificate(nil)
+}
+
+// vaultRequest sends a request to the Vault API and decodes the JSON
+// response into v
+func vaultRequest(path, token string, body, v interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(vaultAddr, "/")+"/v1/"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := vaultAuth.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("%s: %s", resp.Status, strings.Join(failure.Errors, "; "))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// issueVaultCert logs in with AppRole when configured and issues a
+// certificate for -vault-names from the -vault-pki role
+func issueVaultCert() (*tls.Certificate, error) {
+	token := vaultAuth.token
+	if vaultAuth.roleId != "" {
+		var login struct {
+			Auth struct {
+				ClientToken string `json:"client_token"`
+			} `json:"auth"`
+		}
+		if err := vaultRequest("auth/approle/login", "", map[string]string{"role_id": vaultAuth.roleId, "secret_id": vaultAuth.secretId}, &login); err != nil {
+			return nil, fmt.Errorf("AppRole login: %v", err)
+		}
+		token = login.Auth.ClientToken
+	}
+	names := parseTargetList(vaultNames)
+	request := map[string]string{"common_name": names[0]}
+	var alt, ips []string
+	for _, name := range names[1:] {
+		if net.ParseIP(name) != nil {
+			ips = append(ips, name)
+		} else {
+			alt = append(alt, name)
+		}
+	}
+	if len(alt) > 0 {
+		request["alt_names"] = strings.Join(alt, ",")
+	}
+	if len(ips) > 0 {
+		request["ip_sans"] = strings.Join(ips, ",")
+	}
+	if vaultTtl > 0 {
+		request["ttl"] = vaultTtl.String()
+	}
+	mount, role, _ := strings.Cut(vaultPki, "/")
+	var issued struct {
+		Data struct {
+			Certificate string   `json:"certificate"`
+			CaChain     []string `json:"ca_chain"`
+			PrivateKey  string   `json:"private_key"`
+		} `json:"data"`
+	}
+	if err := vaultRequest(mount+"/issue/"+role, token, request, &issued); err != nil {
+		return nil, err
+	}
+	chain := issued.Data.Certificate
+	for _, ca := range issued.Data.CaChain {
+		chain += "\n" + ca
+	}
+	cert, err := tls.X509KeyPair([]byte(chain), []byte(issued.Data.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
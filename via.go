@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// via is the forward proxy or SSH jump host from -via that connections to
+// targets are tunneled through
+var via *url.URL
+
+func parseVia(spec string) (*url.URL, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ssh" {
+		return nil, fmt.Errorf("unsupported proxy scheme `%s`", u.Scheme)
+	}
+	if u.Port() == "" {
+		port := map[string]string{"http": "80", "https": "443", "ssh": "22"}[u.Scheme]
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// h2Proxy is the HTTP/2 connection to an https:// proxy shared by tunnels,
+// each is a stream; a new one is opened when it can take no more streams
+var h2Proxy struct {
+	sync.Mutex
+	cc *http2.ClientConn
+}
+
+// dialVia connects to the target through the -via proxy with CONNECT, as
+// a stream of a shared HTTP/2 connection when the proxy negotiates it
+func dialVia(ctx context.Context, target string) (net.Conn, error) {
+	if via.Scheme == "ssh" {
+		return dialSsh(ctx, target)
+	}
+	h2Proxy.Lock()
+	cc := h2Proxy.cc
+	h2Proxy.Unlock()
+	if cc != nil && cc.CanTakeNewRequest() {
+		return connectH2(ctx, cc, target)
+	}
+	conn, err := dialUpstream(ctx, "tcp", via.Host)
+	if err != nil {
+		return nil, err
+	}
+	if via.Scheme == "http" {
+		return connectH1(conn, target)
+	}
+	config := &tls.Config{ServerName: via.Hostname(), NextProtos: []string{http2.NextProtoTLS, "http/1.1"}}
+	if vaultPki != "" {
+		config.GetClientCertificate = vaultClientCertificate
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout()))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		return connectH1(tlsConn, target)
+	}
+	cc, err = (&http2.Transport{}).NewClientConn(tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	h2Proxy.Lock()
+	h2Proxy.cc = cc
+	h2Proxy.Unlock()
+	return connectH2(ctx, cc, target)
+}
+
+func proxyAuthorization(header http.Header) {
+	if via.User != nil {
+		password, _ := via.User.Password()
+		header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(via.User.Username()+":"+password)))
+	}
+}
+
+// connectH1 sends an HTTP/1.1 CONNECT on the proxy connection
+func connectH1(conn net.Conn, target string) (net.Conn, error) {
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: target}, Host: target, Header: make(http.Header)}
+	proxyAuthorization(req.Header)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &peekedConn{conn, r}, nil
+}
+
+// h2Tunnel is a CONNECT stream, deadlines are not supported
+type h2Tunnel struct {
+	io.ReadCloser
+	w      *io.PipeWriter
+	cancel context.CancelFunc
+	local  net.Addr
+	remote string
+}
+
+func connectH2(ctx context.Context, cc *http2.ClientConn, target string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	expired := time.AfterFunc(timeout, cancel)
+	r, w := io.Pipe()
+	req := (&http.Request{Method: http.MethodConnect, URL: &url.URL{Scheme: "https", Host: via.Host}, Host: target, Header: make(http.Header), Body: r}).WithContext(ctx)
+	proxyAuthorization(req.Header)
+	resp, err := cc.RoundTrip(req)
+	if !expired.Stop() && err == nil {
+		resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+	return &h2Tunnel{ReadCloser: resp.Body, w: w, cancel: cancel, local: &net.TCPAddr{}, remote: target}, nil
+}
+
+func (t *h2Tunnel) Write(p []byte) (int, error) {
+	return t.w.Write(p)
+}
+
+func (t *h2Tunnel) Close() error {
+	t.w.Close()
+	t.cancel()
+	return t.ReadCloser.Close()
+}
+
+// CloseWrite ends the request body, half-closing the stream
+func (t *h2Tunnel) CloseWrite() error {
+	return t.w.Close()
+}
+
+func (t *h2Tunnel) LocalAddr() net.Addr {
+	return t.local
+}
+
+func (t *h2Tunnel) RemoteAddr() net.Addr {
+	return tunnelAddr(t.remote)
+}
+
+func (t *h2Tunnel) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (t *h2Tunnel) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (t *h2Tunnel) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "tcp"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// waitWarmTargets holds startup, before listeners are bound, until
+// -warm-targets of the resolved targets accept a TCP connection, probing
+// every second; the targets are passed on to the manager once they do
+func waitWarmTargets(ctx context.Context, resolver chan []Target) {
+	var targets []Target
+	select {
+	case targets = <-resolver:
+	case <-ctx.Done():
+		return
+	}
+	started := time.Now()
+	for {
+		reachable := probeTargets(ctx, targetAddrs(targets))
+		if reachable >= warmTargets {
+			if verbose.Load() {
+				log.Printf("%d of %d targets reachable after %v\n", reachable, len(targets), time.Since(started).Round(time.Millisecond))
+			}
+			break
+		}
+		if warmTimeout > 0 && time.Since(started) >= warmTimeout {
+			fatalf(errDial, "Only %d of %d targets reachable after %v, -warm-targets is %d\n", reachable, len(targets), warmTimeout, warmTargets)
+		}
+		if verbose.Load() {
+			log.Printf("Waiting for targets, %d of %d reachable, -warm-targets is %d\n", reachable, len(targets), warmTargets)
+		}
+		select {
+		case targets = <-resolver:
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+	// unless DNS already has a newer answer queued
+	select {
+	case resolver <- targets:
+	default:
+	}
+}
+
+// probeTargets connects to all targets at once and returns how many
+// accepted
+func probeTargets(ctx context.Context, targets []string) int {
+	var reachable int32
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			conn, err := dialTcp(ctx, target, nil)
+			if err != nil {
+				if debug.Load() {
+					log.Printf("Target `%s` is not reachable yet: %v\n", target, err)
+				}
+				return
+			}
+			conn.Close()
+			atomic.AddInt32(&reachable, 1)
+		}(target)
+	}
+	wg.Wait()
+	return int(reachable)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat is the time a supervised goroutine last made progress
+type heartbeat struct {
+	last int64 // unix nanoseconds, updated atomically
+}
+
+func (h *heartbeat) beat() {
+	atomic.StoreInt64(&h.last, time.Now().UnixNano())
+}
+
+func (h *heartbeat) at() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&h.last))
+}
+
+// heartbeats of the TCP connection manager, beating on each connection and
+// target update it takes, and of the DNS refresher, beating on each refresh
+var heartbeats struct {
+	manager heartbeat
+	dns     heartbeat
+}
+
+// supervise runs a goroutine under the -watchdog: when it is busy without a
+// heartbeat for longer than limit it's reported and started again with a
+// fresh context; the stuck goroutine can't be stopped, it's abandoned and
+// must check its context before taking more work, so it returns once it
+// unblocks without competing with its replacement
+func supervise(ctx context.Context, name string, hb *heartbeat, limit time.Duration, busy func() bool, run func(ctx context.Context)) {
+	hb.beat()
+	child, cancel := context.WithCancel(ctx)
+	go run(child)
+	ticker := systemClock.NewTicker(watchdogTimeout / 4)
+	defer ticker.Stop()
+	// since when the goroutine is found busy without progress
+	var since time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			cancel()
+			return
+		case <-ticker.Chan():
+		}
+		now := time.Now()
+		if !busy() {
+			since = time.Time{}
+			continue
+		}
+		if since.IsZero() || hb.at().After(since) {
+			since = now
+			continue
+		}
+		if now.Sub(since) < limit {
+			continue
+		}
+		log.Printf("Watchdog: %s made no progress for %v, restarting\n", name, now.Sub(hb.at()).Round(time.Second))
+		accounting.Lock()
+		accounting.WatchdogRestarts++
+		accounting.Unlock()
+		publishEvent("watchdog", func() interface{} {
+			return map[string]interface{}{"subsystem": name, "stalled": now.Sub(hb.at()).Seconds()}
+		})
+		cancel()
+		since = time.Time{}
+		hb.beat()
+		child, cancel = context.WithCancel(ctx)
+		go run(child)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// zones maps targets to zones, from -target-zone rules or a label of their
+// DNS or SRV target name equal to a known zone, and counts live TCP
+// connections per target to tell when the targets in -zone are saturated
+var zones = struct {
+	rules []zoneRule
+	names map[string]bool // zones of -zone and -target-zone
+
+	mu   sync.Mutex
+	live map[string]int // by target address
+}{names: make(map[string]bool), live: make(map[string]int)}
+
+// zoneRule puts targets with an address in one of the CIDRs or a name
+// ending in one of the suffixes in the zone
+type zoneRule struct {
+	zone     string
+	cidrs    []*net.IPNet
+	suffixes []string
+}
+
+// parseTargetZone parses `zone=cidr|.suffix[,cidr|.suffix]`
+func parseTargetZone(spec string) error {
+	eq := strings.IndexByte(spec, '=')
+	if eq < 1 {
+		return fmt.Errorf("expected zone=cidr|.suffix[,cidr|.suffix], got `%s`", spec)
+	}
+	r := zoneRule{zone: strings.TrimSpace(spec[:eq])}
+	for _, m := range parseTargetList(spec[eq+1:]) {
+		if strings.HasPrefix(m, ".") {
+			r.suffixes = append(r.suffixes, strings.ToLower(strings.TrimSuffix(m, ".")))
+			continue
+		}
+		if !strings.Contains(m, "/") {
+			if ip := net.ParseIP(m); ip != nil && ip.To4() != nil {
+				m += "/32"
+			} else {
+				m += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(m)
+		if err != nil {
+			return fmt.Errorf("expected CIDR, IP address or .suffix, got `%s`", m)
+		}
+		r.cidrs = append(r.cidrs, cidr)
+	}
+	if len(r.cidrs) == 0 && len(r.suffixes) == 0 {
+		return fmt.Errorf("expected zone=cidr|.suffix[,cidr|.suffix], got `%s`", spec)
+	}
+	zones.rules = append(zones.rules, r)
+	zones.names[r.zone] = true
+	return nil
+}
+
+// zoneOf returns the zone of a target, empty when unknown: by -target-zone
+// rules first, then by a label of the name, such as us-east-1a in
+// node-3.us-east-1a.example.com
+func zoneOf(t Target) string {
+	host, _, err := net.SplitHostPort(t.Addr)
+	if err != nil {
+		host = t.Addr
+	}
+	ip := net.ParseIP(host)
+	name := strings.ToLower(t.Name)
+	for _, r := range zones.rules {
+		for _, cidr := range r.cidrs {
+			if ip != nil && cidr.Contains(ip) {
+				return r.zone
+			}
+		}
+		for _, suffix := range r.suffixes {
+			if name != "" && (name == suffix[1:] || strings.HasSuffix(name, suffix)) {
+				return r.zone
+			}
+		}
+	}
+	for _, label := range strings.Split(name, ".") {
+		if zones.names[label] {
+			return label
+		}
+	}
+	return ""
+}
+
+// withZones sets the zone of targets when zone-aware routing is enabled
+func withZones(targets []Target) []Target {
+	if len(zones.names) == 0 {
+		return targets
+	}
+	for i := range targets {
+		targets[i].Zone = zoneOf(targets[i])
+	}
+	return targets
+}
+
+// localTargets narrows targets to those in -zone that are usable and not
+// saturated; when there are none, the targets in other zones are spilled
+// to, and all targets are returned when no target is in the zone;
+// targetState must be locked
+func localTargets(connectTo []Target) []Target {
+	var local, others []Target
+	inZone := false
+	zones.mu.Lock()
+	for _, t := range connectTo {
+		if t.Zone != ownZone {
+			others = append(others, t)
+			continue
+		}
+		inZone = true
+		if effectiveWeight(t) > 0 && (zoneMaxConns == 0 || zones.live[t.Addr] < zoneMaxConns) {
+			local = append(local, t)
+		}
+	}
+	zones.mu.Unlock()
+	if len(local) > 0 {
+		return local
+	}
+	if !inZone {
+		return connectTo
+	}
+	// the targets in the zone failed or are saturated
+	accounting.Lock()
+	accounting.ZoneSpills++
+	accounting.Unlock()
+	if len(others) > 0 {
+		return others
+	}
+	return connectTo
+}
+
+// zoneConnOpened and zoneConnClosed count live TCP connections per target
+// for -zone-max-conns
+func zoneConnOpened(target string) {
+	zones.mu.Lock()
+	zones.live[target]++
+	zones.mu.Unlock()
+}
+
+func zoneConnClosed(target string) {
+	zones.mu.Lock()
+	if zones.live[target]--; zones.live[target] <= 0 {
+		delete(zones.live, target)
+	}
+	zones.mu.Unlock()
+}